@@ -0,0 +1,185 @@
+package accounts
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"shorty/internal/app/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("invalid login or password")
+var ErrInvalidLogin = errors.New("login must be 3 to 255 characters")
+var ErrWeakPassword = errors.New("password must be 8 to 72 bytes")
+
+const APIKeyPrefix = "shorty_"
+
+const minLoginLength = 3
+const maxLoginLength = 255
+const minPasswordLength = 8
+const maxPasswordLength = 72
+const apiKeyBytes = 32
+
+// dummyHash is compared against when the login doesn't exist so that both
+// failure paths take the same time.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+type Store interface {
+	CreateAccount(ctx context.Context, account models.Account) error
+	AccountByLogin(ctx context.Context, login string) (models.Account, error)
+	AccountByID(ctx context.Context, id string) (models.Account, error)
+	ClaimUserURLs(ctx context.Context, fromUserID, toUserID string) error
+}
+
+// Register creates an account. When the caller is an anonymous user the
+// account takes over that identity, so the links created so far stay theirs.
+func Register(ctx context.Context, str Store, currentUserID string, req models.AuthRequest) (models.Account, error) {
+	login := normalizeLogin(req.Login)
+	if n := utf8.RuneCountInString(login); n < minLoginLength || n > maxLoginLength {
+		return models.Account{}, ErrInvalidLogin
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		return models.Account{}, ErrWeakPassword
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.Account{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	id := currentUserID
+	isAccount, err := isAccount(ctx, str, currentUserID)
+	if err != nil {
+		return models.Account{}, err
+	}
+	if id == "" || isAccount {
+		id = uuid.NewString()
+	}
+
+	account := models.Account{
+		ID:           id,
+		Login:        login,
+		PasswordHash: string(passwordHash),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := str.CreateAccount(ctx, account); err != nil {
+		return models.Account{}, fmt.Errorf("failed to create account: %w", err)
+	}
+
+	return account, nil
+}
+
+// Login checks the credentials and moves links of the anonymous caller into
+// the account.
+func Login(ctx context.Context, str Store, currentUserID string, req models.AuthRequest) (models.Account, error) {
+	account, err := str.AccountByLogin(ctx, normalizeLogin(req.Login))
+	if errors.Is(err, models.ErrNotFound) {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		return models.Account{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return models.Account{}, fmt.Errorf("failed to get account: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(req.Password)); err != nil {
+		return models.Account{}, ErrInvalidCredentials
+	}
+
+	if err := claimAnonymousLinks(ctx, str, currentUserID, account.ID); err != nil {
+		return models.Account{}, err
+	}
+
+	return account, nil
+}
+
+// LoginExternal signs in a user authenticated by an identity provider. The
+// account is created on first sign-in and has no password.
+func LoginExternal(ctx context.Context, str Store, currentUserID, userID, login string) (models.Account, error) {
+	account, err := str.AccountByID(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		account = models.Account{ID: userID, Login: normalizeLogin(login), CreatedAt: time.Now().UTC()}
+		if err := str.CreateAccount(ctx, account); err != nil {
+			return models.Account{}, fmt.Errorf("failed to create account: %w", err)
+		}
+	} else if err != nil {
+		return models.Account{}, fmt.Errorf("failed to get account: %w", err)
+	}
+
+	if err := claimAnonymousLinks(ctx, str, currentUserID, account.ID); err != nil {
+		return models.Account{}, err
+	}
+
+	return account, nil
+}
+
+func claimAnonymousLinks(ctx context.Context, str Store, currentUserID, accountID string) error {
+	if currentUserID == "" || currentUserID == accountID {
+		return nil
+	}
+	isAccount, err := isAccount(ctx, str, currentUserID)
+	if err != nil {
+		return err
+	}
+	if isAccount {
+		return nil
+	}
+	if err := str.ClaimUserURLs(ctx, currentUserID, accountID); err != nil {
+		return fmt.Errorf("failed to claim anonymous links: %w", err)
+	}
+	return nil
+}
+
+func isAccount(ctx context.Context, str Store, userID string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+	_, err := str.AccountByID(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get account by id: %w", err)
+	}
+	return true, nil
+}
+
+func normalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// NewAPIKey returns the stored representation of a key together with the
+// plain key, which is shown to the user once and never persisted.
+func NewAPIKey(userID, name string) (models.APIKey, string, error) {
+	buf := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return models.APIKey{}, "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	return models.APIKey{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Name:      strings.TrimSpace(name),
+		KeyHash:   HashAPIKey(key),
+		CreatedAt: time.Now().UTC(),
+	}, key, nil
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -0,0 +1,77 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage/mapstorage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	ctx := context.Background()
+	str, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+
+	links := []models.UserURLs{
+		{ShortURL: "http://localhost:8080/aaa", OriginalURL: "https://a.example.com/"},
+		{ShortURL: "http://localhost:8080/bbb", OriginalURL: "https://b.example.com/"},
+	}
+	require.NoError(t, str.Put(ctx, links[0], "anon-1"))
+	require.NoError(t, str.Put(ctx, links[1], "anon-2"))
+
+	creds := models.AuthRequest{Login: " Alice ", Password: "correct horse"}
+	account, err := Register(ctx, str, "anon-1", creds)
+	require.NoError(t, err)
+	assert.Equal(t, "anon-1", account.ID, "anonymous identity should become the account")
+	assert.Equal(t, "alice", account.Login)
+
+	_, err = Register(ctx, str, "anon-3", models.AuthRequest{Login: "alice", Password: "another password"})
+	assert.ErrorIs(t, err, models.ErrAccountExists)
+
+	_, err = Register(ctx, str, "anon-3", models.AuthRequest{Login: "bob", Password: "short"})
+	assert.ErrorIs(t, err, ErrWeakPassword)
+
+	_, err = Login(ctx, str, "anon-2", models.AuthRequest{Login: "alice", Password: "wrong password"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = Login(ctx, str, "anon-2", models.AuthRequest{Login: "nobody", Password: "correct horse"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	loggedIn, err := Login(ctx, str, "anon-2", models.AuthRequest{Login: "ALICE", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.Equal(t, account.ID, loggedIn.ID)
+
+	urls, err := str.UserURLs(ctx, account.ID, models.URLFilter{})
+	require.NoError(t, err)
+	assert.Len(t, urls, 2, "links of the anonymous session should be claimed on login")
+
+	second, err := Register(ctx, str, account.ID, models.AuthRequest{Login: "carol", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.NotEqual(t, account.ID, second.ID, "registering from an account must not reuse its identity")
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	str, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+
+	key, plain, err := NewAPIKey("user-1", "ci")
+	require.NoError(t, err)
+	assert.True(t, IsAPIKey(plain))
+	assert.NotContains(t, key.KeyHash, plain)
+	require.NoError(t, str.CreateAPIKey(ctx, key))
+
+	userID, err := str.UserIDByAPIKey(ctx, HashAPIKey(plain))
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", userID)
+
+	assert.ErrorIs(t, str.RevokeAPIKey(ctx, key.ID, "user-2"), models.ErrNotFound)
+	require.NoError(t, str.RevokeAPIKey(ctx, key.ID, "user-1"))
+
+	_, err = str.UserIDByAPIKey(ctx, HashAPIKey(plain))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
@@ -5,14 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"shorty/internal/app/accounts"
 	"shorty/internal/app/config"
+	"shorty/internal/app/models"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+var ErrDefaultSecret = errors.New("refusing to sign tokens with the default jwt secret outside dev mode")
+var ErrInvalidCredentials = errors.New("invalid or expired credentials")
+
+// ErrLegacyToken reports a validly signed token without an expiry, issued
+// before tokens expired. Parse returns its claims along with the error.
+var ErrLegacyToken = errors.New("token has no expiry")
+
 type Claims struct {
 	jwt.RegisteredClaims
 	UserID string
@@ -20,81 +31,279 @@ type Claims struct {
 
 type contextKey int
 
-const UserIDContextKey contextKey = iota
+const (
+	UserIDContextKey contextKey = iota
+	newIdentityContextKey
+)
 
-func WithAuthorization(h http.Handler, cfg config.Config, logger *zap.SugaredLogger) http.Handler {
-	authorizationMiddleware := func(w http.ResponseWriter, r *http.Request) {
-		authToken, err := r.Cookie("AuthToken")
+const authCookieName = "AuthToken"
+
+// AuthTokenHeader carries issued tokens for clients that don't keep cookies.
+const AuthTokenHeader = "X-Auth-Token"
+const bearerPrefix = "Bearer "
+
+type APIKeyStore interface {
+	UserIDByAPIKey(ctx context.Context, keyHash string) (string, error)
+}
+
+type Tokens struct {
+	keys   *KeySet
+	ttl    time.Duration
+	cookie http.Cookie
+	now    func() time.Time
+}
+
+func NewTokens(cfg config.Config) (*Tokens, error) {
+	var keys *KeySet
+	if cfg.JWTKeyFile != "" {
+		ks, err := LoadKeySet(cfg.JWTKeyFile)
 		if err != nil {
-			if errors.Is(err, http.ErrNoCookie) {
-				id := uuid.NewString()
-				token, err := generateJWTToken(id, cfg)
-				if err != nil {
-					logger.Errorf("Failed to get token string: %v", err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+			return nil, err
+		}
+		keys = ks
+	} else {
+		if cfg.JWTSecret == config.DefaultJWTSecret && !cfg.DevMode {
+			return nil, ErrDefaultSecret
+		}
+		keys = NewSecretKeySet(cfg.JWTSecret)
+	}
+
+	sameSite, err := parseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		keys: keys,
+		ttl:  cfg.JWTTTL,
+		cookie: http.Cookie{
+			Name:     authCookieName,
+			Path:     cfg.CookiePath,
+			Domain:   cfg.CookieDomain,
+			Secure:   cfg.CookieSecure,
+			HttpOnly: cfg.CookieHTTPOnly,
+			SameSite: sameSite,
+		},
+		now: time.Now,
+	}, nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("unknown cookie SameSite mode %q", value)
+	}
+}
+
+func WithAuthorization(h http.Handler, tokens *Tokens, keys APIKeyStore, logger *zap.SugaredLogger) http.Handler {
+	authorizationMiddleware := func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := bearerToken(r); ok {
+			userID, status := bearerUserID(r.Context(), w, bearer, tokens, keys, logger)
+			if status != http.StatusOK {
+				if status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
 				}
-				ctx := context.WithValue(r.Context(), UserIDContextKey, id)
-				setAuthCookie(w, token)
-				h.ServeHTTP(w, r.WithContext(ctx))
+				w.WriteHeader(status)
 				return
 			}
+			ctx := context.WithValue(r.Context(), UserIDContextKey, userID)
+			h.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
 
+		authToken, err := r.Cookie(authCookieName)
+		if err != nil && !errors.Is(err, http.ErrNoCookie) {
 			logger.Errorf("Failed to get AuthToken: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		userID := GetUserIDFromJWTToken(authToken.Value, cfg)
-		if userID == "" {
-			logger.Errorw("Failed to parse userID from jwt token")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+		var claims *Claims
+		if authToken != nil {
+			// A legacy cookie keeps its user and is replaced below by a
+			// token with an expiry.
+			claims, err = tokens.Parse(authToken.Value)
+			if err != nil && !errors.Is(err, jwt.ErrTokenExpired) && !errors.Is(err, ErrLegacyToken) {
+				logger.Errorf("Failed to parse userID from jwt token: %v", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 		}
 
-		ctx := context.WithValue(r.Context(), UserIDContextKey, userID)
-		setAuthCookie(w, authToken.Value)
+		ctx := r.Context()
+		if claims == nil {
+			claims = &Claims{UserID: uuid.NewString()}
+			ctx = context.WithValue(ctx, newIdentityContextKey, true)
+		}
+
+		if authToken == nil || err != nil || tokens.needsRefresh(claims) {
+			if err := tokens.SetUserToken(w, claims.UserID); err != nil {
+				logger.Errorf("Failed to get token string: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		ctx = context.WithValue(ctx, UserIDContextKey, claims.UserID)
 		h.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	return http.HandlerFunc(authorizationMiddleware)
 }
 
-func generateJWTToken(id string, cfg config.Config) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		UserID: id,
-	})
+// bearerUserID answers bearer requests the way the cookie flow does: a
+// refreshed token is returned in the AuthTokenHeader.
+func bearerUserID(
+	ctx context.Context,
+	w http.ResponseWriter,
+	bearer string,
+	tokens *Tokens,
+	keys APIKeyStore,
+	logger *zap.SugaredLogger,
+) (string, int) {
+	userID, refreshed, err := tokens.BearerIdentity(ctx, bearer, keys)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return "", http.StatusUnauthorized
+	}
+	if err != nil {
+		logger.Errorf("Failed to check bearer token: %v", err)
+		return "", http.StatusInternalServerError
+	}
+	if refreshed != "" {
+		w.Header().Set(AuthTokenHeader, refreshed)
+	}
+	return userID, http.StatusOK
+}
+
+// BearerIdentity resolves an API key or a JWT passed as a bearer token.
+// Unlike the cookie, an invalid or expired bearer token never falls back to
+// a new anonymous identity. refreshed is the reissued JWT once half of its
+// lifetime has passed, empty otherwise.
+func (t *Tokens) BearerIdentity(ctx context.Context, bearer string, keys APIKeyStore) (string, string, error) {
+	if accounts.IsAPIKey(bearer) {
+		userID, err := keys.UserIDByAPIKey(ctx, accounts.HashAPIKey(bearer))
+		if errors.Is(err, models.ErrNotFound) {
+			return "", "", ErrInvalidCredentials
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to check api key: %w", err)
+		}
+		return userID, "", nil
+	}
 
-	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
+	claims, err := t.Parse(bearer)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate token string: %w", err)
+		return "", "", ErrInvalidCredentials
+	}
+	if !t.needsRefresh(claims) {
+		return claims.UserID, "", nil
 	}
+	refreshed, err := t.Issue(claims.UserID)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get token string: %w", err)
+	}
+	return claims.UserID, refreshed, nil
+}
+
+// RequireIdentity rejects requests that arrived without valid credentials
+// instead of serving them as a freshly created anonymous user.
+func RequireIdentity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isNew, _ := r.Context().Value(newIdentityContextKey).(bool); isNew {
+			removeAuthCookie(w)
+			w.Header().Del(AuthTokenHeader)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-	return tokenString, nil
+func (t *Tokens) Issue(userID string) (string, error) {
+	now := t.now()
+	return t.keys.sign(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.ttl)),
+		},
+		UserID: userID,
+	})
 }
 
-func GetUserIDFromJWTToken(tokenString string, cfg config.Config) string {
+// Parse validates the signature and expiry. Tokens without an expiry were
+// issued before expiring tokens existed and are reported with
+// ErrLegacyToken, so only the cookie flow accepts them to reissue them.
+func (t *Tokens) Parse(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(cfg.JWTSecret), nil
-		})
-
+	token, err := jwt.ParseWithClaims(tokenString, claims, t.keys.keyFunc)
 	if err != nil {
-		return ""
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+	if !token.Valid || claims.UserID == "" {
+		return nil, errors.New("invalid token")
+	}
+	if claims.ExpiresAt == nil {
+		return claims, ErrLegacyToken
+	}
+	return claims, nil
+}
+
+// needsRefresh implements the sliding session: once half of the lifetime
+// has passed the token is reissued on the next request.
+func (t *Tokens) needsRefresh(claims *Claims) bool {
+	if claims.ExpiresAt == nil {
+		return true
 	}
+	return claims.ExpiresAt.Sub(t.now()) < t.ttl/2
+}
 
-	if !token.Valid {
-		return ""
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
 	}
+	return strings.TrimSpace(header[len(bearerPrefix):]), true
+}
 
-	return claims.UserID
+// SetUserToken switches the response to a new identity, replacing the cookie
+// queued earlier in the same response if there is one. The token is also
+// returned in the AuthTokenHeader for non-browser clients.
+func (t *Tokens) SetUserToken(w http.ResponseWriter, userID string) error {
+	token, err := t.Issue(userID)
+	if err != nil {
+		return err
+	}
+	cookie := t.cookie
+	cookie.Value = token
+	cookie.MaxAge = int(t.ttl.Seconds())
+	removeAuthCookie(w)
+	http.SetCookie(w, &cookie)
+	w.Header().Set(AuthTokenHeader, token)
+	return nil
 }
 
-func setAuthCookie(w http.ResponseWriter, token string) {
-	cookie := &http.Cookie{Name: "AuthToken", Value: token}
-	http.SetCookie(w, cookie)
+func (t *Tokens) ClearAuthCookie(w http.ResponseWriter) {
+	cookie := t.cookie
+	cookie.MaxAge = -1
+	removeAuthCookie(w)
+	http.SetCookie(w, &cookie)
+}
+
+func removeAuthCookie(w http.ResponseWriter) {
+	cookies := w.Header().Values("Set-Cookie")
+	w.Header().Del("Set-Cookie")
+	for _, c := range cookies {
+		if !strings.HasPrefix(c, authCookieName+"=") {
+			w.Header().Add("Set-Cookie", c)
+		}
+	}
 }
@@ -0,0 +1,441 @@
+package authorization
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shorty/internal/app/accounts"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type noAPIKeys struct{}
+
+func (noAPIKeys) UserIDByAPIKey(context.Context, string) (string, error) {
+	return "", models.ErrNotFound
+}
+
+func testConfig() config.Config {
+	return config.Config{
+		JWTSecret:      "test-secret",
+		JWTTTL:         time.Hour,
+		CookieHTTPOnly: true,
+		CookieSecure:   true,
+		CookieSameSite: "strict",
+		CookiePath:     "/",
+	}
+}
+
+func writeKeyFile(t *testing.T, dir string, file keyFile) string {
+	t.Helper()
+	data, err := json.Marshal(file)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+}
+
+func TestNewTokens(t *testing.T) {
+	cfg := testConfig()
+	cfg.JWTSecret = config.DefaultJWTSecret
+	_, err := NewTokens(cfg)
+	assert.ErrorIs(t, err, ErrDefaultSecret)
+
+	cfg.DevMode = true
+	_, err = NewTokens(cfg)
+	assert.NoError(t, err)
+
+	cfg = testConfig()
+	cfg.CookieSameSite = "sometimes"
+	_, err = NewTokens(cfg)
+	assert.Error(t, err)
+}
+
+// legacyToken is signed like tokens were before they expired.
+func legacyToken(t *testing.T) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "user-1"}).SignedString([]byte("test-secret"))
+	require.NoError(t, err)
+	return token
+}
+
+func TestIssueAndParse(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+
+	token, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+
+	claims, err := tokens.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserID)
+	assert.NotNil(t, claims.IssuedAt)
+	require.NotNil(t, claims.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), claims.ExpiresAt.Time, time.Minute)
+
+	other := testConfig()
+	other.JWTSecret = "other-secret"
+	otherTokens, err := NewTokens(other)
+	require.NoError(t, err)
+	_, err = otherTokens.Parse(token)
+	assert.Error(t, err)
+
+	claims, err = tokens.Parse(legacyToken(t))
+	assert.ErrorIs(t, err, ErrLegacyToken)
+	require.NotNil(t, claims)
+	assert.Equal(t, "user-1", claims.UserID)
+	_, _, err = tokens.BearerIdentity(context.Background(), legacyToken(t), noAPIKeys{})
+	assert.ErrorIs(t, err, ErrInvalidCredentials, "tokens without exp must not be accepted forever")
+
+	tokens.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expired, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+	tokens.now = time.Now
+	_, err = tokens.Parse(expired)
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	writePEM(t, dir, "ed.pem", "PRIVATE KEY", edDER)
+	edPubDER, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	require.NoError(t, err)
+	writePEM(t, dir, "ed.pub.pem", "PUBLIC KEY", edPubDER)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	cfg := testConfig()
+	cfg.JWTKeyFile = writeKeyFile(t, dir, keyFile{
+		Active: "ed-1",
+		Keys: []keyFileEntry{
+			{ID: "hs-1", Algorithm: "HS256", Secret: "old-secret"},
+			{ID: "ed-1", Algorithm: "EdDSA", PrivateKeyFile: "ed.pem"},
+			{ID: "rsa-1", Algorithm: "RS256", PrivateKeyFile: "rsa.pem"},
+		},
+	})
+	oldTokens, err := NewTokens(cfg)
+	require.NoError(t, err)
+	oldToken, err := oldTokens.Issue("user-1")
+	require.NoError(t, err)
+
+	header, _, err := jwt.NewParser().ParseUnverified(oldToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "ed-1", header.Header["kid"])
+	assert.Equal(t, "EdDSA", header.Header["alg"])
+
+	cfg.JWTKeyFile = writeKeyFile(t, dir, keyFile{
+		Active: "rsa-1",
+		Keys: []keyFileEntry{
+			{ID: "ed-1", Algorithm: "EdDSA", PublicKeyFile: "ed.pub.pem"},
+			{ID: "rsa-1", Algorithm: "RS256", PrivateKeyFile: "rsa.pem"},
+		},
+	})
+	newTokens, err := NewTokens(cfg)
+	require.NoError(t, err)
+
+	claims, err := newTokens.Parse(oldToken)
+	require.NoError(t, err, "tokens signed with a retired key must still verify")
+	assert.Equal(t, "user-1", claims.UserID)
+
+	newToken, err := newTokens.Issue("user-2")
+	require.NoError(t, err)
+	claims, err = oldTokens.Parse(newToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user-2", claims.UserID)
+
+	hsToken, err := NewSecretKeySet("old-secret").sign(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		UserID:           "user-3",
+	})
+	require.NoError(t, err)
+	_, err = newTokens.Parse(hsToken)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	cfg.JWTKeyFile = writeKeyFile(t, dir, keyFile{
+		Active: "ed-1",
+		Keys:   []keyFileEntry{{ID: "ed-1", Algorithm: "EdDSA", PublicKeyFile: "ed.pub.pem"}},
+	})
+	_, err = NewTokens(cfg)
+	assert.Error(t, err, "a verify-only key can't be active")
+}
+
+func TestWithAuthorization(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+
+	var seenUserID string
+	handler := WithAuthorization(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenUserID, _ = r.Context().Value(UserIDContextKey).(string)
+	}), tokens, noAPIKeys{}, zap.NewNop().Sugar())
+
+	issueAt := func(offset time.Duration) string {
+		tokens.now = func() time.Time { return time.Now().Add(offset) }
+		defer func() { tokens.now = time.Now }()
+		token, err := tokens.Issue("user-1")
+		require.NoError(t, err)
+		return token
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		wantCode    int
+		wantUser    string
+		wantNewUser bool
+		wantCookie  bool
+	}{
+		{name: "no cookie", wantCode: http.StatusOK, wantNewUser: true, wantCookie: true},
+		{name: "fresh token", token: issueAt(0), wantCode: http.StatusOK, wantUser: "user-1"},
+		{name: "token past half of its lifetime", token: issueAt(-40 * time.Minute), wantCode: http.StatusOK, wantUser: "user-1", wantCookie: true},
+		{name: "expired token", token: issueAt(-2 * time.Hour), wantCode: http.StatusOK, wantNewUser: true, wantCookie: true},
+		{name: "legacy token", token: legacyToken(t), wantCode: http.StatusOK, wantUser: "user-1", wantCookie: true},
+		{name: "forged token", token: "not-a-jwt", wantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			seenUserID = ""
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.token != "" {
+				request.AddCookie(&http.Cookie{Name: authCookieName, Value: tc.token})
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			result := recorder.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			if tc.wantNewUser {
+				assert.NotEmpty(t, seenUserID)
+				assert.NotEqual(t, "user-1", seenUserID)
+			} else {
+				assert.Equal(t, tc.wantUser, seenUserID)
+			}
+
+			cookies := result.Cookies()
+			if !tc.wantCookie {
+				assert.Empty(t, cookies)
+				return
+			}
+			require.Len(t, cookies, 1)
+			cookie := cookies[0]
+			assert.True(t, cookie.HttpOnly)
+			assert.True(t, cookie.Secure)
+			assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+			assert.Equal(t, "/", cookie.Path)
+			assert.Equal(t, 3600, cookie.MaxAge)
+
+			assert.Equal(t, cookie.Value, result.Header.Get(AuthTokenHeader))
+
+			claims, err := tokens.Parse(cookie.Value)
+			require.NoError(t, err)
+			assert.Equal(t, seenUserID, claims.UserID)
+			assert.NotNil(t, claims.ExpiresAt)
+		})
+	}
+}
+
+type apiKeys map[string]string
+
+func (k apiKeys) UserIDByAPIKey(_ context.Context, keyHash string) (string, error) {
+	if userID, ok := k[keyHash]; ok {
+		return userID, nil
+	}
+	return "", models.ErrNotFound
+}
+
+func TestBearerAndStrictMode(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+
+	keys := apiKeys{accounts.HashAPIKey("shorty_valid"): "user-2"}
+	var seenUserID string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenUserID, _ = r.Context().Value(UserIDContextKey).(string)
+	})
+	lenient := WithAuthorization(next, tokens, keys, zap.NewNop().Sugar())
+	strict := WithAuthorization(RequireIdentity(next), tokens, keys, zap.NewNop().Sugar())
+
+	token, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+	tokens.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expired, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+	tokens.now = time.Now
+
+	tests := []struct {
+		name          string
+		handler       http.Handler
+		authorization string
+		cookie        string
+		wantCode      int
+		wantUser      string
+		wantNewUser   bool
+	}{
+		{name: "bearer jwt", handler: lenient, authorization: "Bearer " + token, wantCode: http.StatusOK, wantUser: "user-1"},
+		{name: "lowercase scheme", handler: lenient, authorization: "bearer " + token, wantCode: http.StatusOK, wantUser: "user-1"},
+		{name: "bearer api key", handler: lenient, authorization: "Bearer shorty_valid", wantCode: http.StatusOK, wantUser: "user-2"},
+		{name: "unknown api key", handler: lenient, authorization: "Bearer shorty_unknown", wantCode: http.StatusUnauthorized},
+		{name: "expired bearer jwt", handler: lenient, authorization: "Bearer " + expired, wantCode: http.StatusUnauthorized},
+		{name: "garbage bearer", handler: lenient, authorization: "Bearer nope", wantCode: http.StatusUnauthorized},
+		{name: "no credentials", handler: lenient, wantCode: http.StatusOK, wantNewUser: true},
+		{name: "strict without credentials", handler: strict, wantCode: http.StatusUnauthorized},
+		{name: "strict with expired cookie", handler: strict, cookie: expired, wantCode: http.StatusUnauthorized},
+		{name: "strict with cookie", handler: strict, cookie: token, wantCode: http.StatusOK, wantUser: "user-1"},
+		{name: "strict with bearer", handler: strict, authorization: "Bearer " + token, wantCode: http.StatusOK, wantUser: "user-1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			seenUserID = ""
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+			if tc.authorization != "" {
+				request.Header.Set("Authorization", tc.authorization)
+			}
+			if tc.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: authCookieName, Value: tc.cookie})
+			}
+			recorder := httptest.NewRecorder()
+			tc.handler.ServeHTTP(recorder, request)
+			result := recorder.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tc.wantCode, result.StatusCode)
+			if tc.wantCode == http.StatusUnauthorized {
+				assert.Empty(t, seenUserID)
+				assert.Empty(t, result.Cookies(), "a rejected request must not get an identity")
+				assert.Empty(t, result.Header.Get(AuthTokenHeader))
+				assert.NotEmpty(t, result.Header.Get("WWW-Authenticate"))
+				return
+			}
+			if tc.wantNewUser {
+				assert.NotEmpty(t, seenUserID)
+				assert.NotEmpty(t, result.Header.Get(AuthTokenHeader))
+				return
+			}
+			assert.Equal(t, tc.wantUser, seenUserID)
+			if tc.authorization != "" {
+				assert.Empty(t, result.Cookies(), "bearer clients don't get cookies")
+			}
+		})
+	}
+}
+
+func TestBearerRefresh(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+	handler := WithAuthorization(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		tokens, apiKeys{}, zap.NewNop().Sugar())
+
+	tokens.now = func() time.Time { return time.Now().Add(-40 * time.Minute) }
+	old, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+	tokens.now = time.Now
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+old)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	refreshed := recorder.Header().Get(AuthTokenHeader)
+	require.NotEmpty(t, refreshed)
+	claims, err := tokens.Parse(refreshed)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserID)
+}
+
+func TestUnlockCookie(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+
+	unlockedRequest := func(shortURL string, ttl time.Duration) *http.Request {
+		writer := httptest.NewRecorder()
+		require.NoError(t, tokens.SetUnlockCookie(writer, shortURL, ttl))
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, cookie := range writer.Result().Cookies() {
+			assert.True(t, cookie.HttpOnly)
+			request.AddCookie(cookie)
+		}
+		return request
+	}
+
+	request := unlockedRequest("http://localhost/a", time.Minute)
+	assert.True(t, tokens.Unlocked(request, "http://localhost/a"))
+	assert.False(t, tokens.Unlocked(request, "http://localhost/b"), "cookies unlock a single link")
+
+	tokens.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expired := unlockedRequest("http://localhost/a", time.Minute)
+	tokens.now = time.Now
+	assert.False(t, tokens.Unlocked(expired, "http://localhost/a"))
+
+	authToken, err := tokens.Issue("user-1")
+	require.NoError(t, err)
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.AddCookie(&http.Cookie{Name: unlockCookieName("http://localhost/a"), Value: authToken})
+	assert.False(t, tokens.Unlocked(forged, "http://localhost/a"), "auth tokens must not unlock links")
+
+	unlockWriter := httptest.NewRecorder()
+	require.NoError(t, tokens.SetUnlockCookie(unlockWriter, "http://localhost/a", time.Minute))
+	_, err = tokens.Parse(unlockWriter.Result().Cookies()[0].Value)
+	assert.Error(t, err, "unlock tokens must not authenticate users")
+}
+
+func TestVariantCookie(t *testing.T) {
+	tokens, err := NewTokens(testConfig())
+	require.NoError(t, err)
+
+	writer := httptest.NewRecorder()
+	require.NoError(t, tokens.SetVariantCookie(writer, "http://localhost/a", "variant-1", time.Minute))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range writer.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	assert.Equal(t, "variant-1", tokens.Variant(request, "http://localhost/a"))
+	assert.Equal(t, "", tokens.Variant(request, "http://localhost/b"))
+
+	unlockWriter := httptest.NewRecorder()
+	require.NoError(t, tokens.SetUnlockCookie(unlockWriter, "http://localhost/a", time.Minute))
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.AddCookie(&http.Cookie{
+		Name:  variantCookieName("http://localhost/a"),
+		Value: unlockWriter.Result().Cookies()[0].Value,
+	})
+	assert.Equal(t, "", tokens.Variant(forged, "http://localhost/a"), "unlock tokens must not pick variants")
+
+	plain := httptest.NewRequest(http.MethodGet, "/", nil)
+	plain.AddCookie(&http.Cookie{Name: variantCookieName("http://localhost/a"), Value: "variant-2"})
+	assert.Equal(t, "", tokens.Variant(plain, "http://localhost/a"))
+
+	_, err = tokens.Parse(writer.Result().Cookies()[0].Value)
+	assert.Error(t, err, "variant tokens must not authenticate users")
+}
@@ -0,0 +1,208 @@
+package authorization
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+const defaultKeyID = "default"
+
+type signingKey struct {
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+type KeySet struct {
+	activeID string
+	keys     map[string]signingKey
+}
+
+type keyFile struct {
+	Active string         `json:"active"`
+	Keys   []keyFileEntry `json:"keys"`
+}
+
+// keyFileEntry describes one key. Retired asymmetric keys may carry only the
+// public part: they keep verifying old tokens but can't become active.
+type keyFileEntry struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret"`
+	PrivateKey     string `json:"private_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKey      string `json:"public_key"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+func NewSecretKeySet(secret string) *KeySet {
+	return &KeySet{
+		activeID: defaultKeyID,
+		keys: map[string]signingKey{
+			defaultKeyID: {method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)},
+		},
+	}
+}
+
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key file: %w", err)
+	}
+
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode jwt key file: %w", err)
+	}
+
+	ks := &KeySet{activeID: file.Active, keys: map[string]signingKey{}}
+	dir := filepath.Dir(path)
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return nil, errors.New("jwt key without kid")
+		}
+		if _, ok := ks.keys[entry.ID]; ok {
+			return nil, fmt.Errorf("duplicate jwt kid %q", entry.ID)
+		}
+		key, err := entry.load(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jwt key %q: %w", entry.ID, err)
+		}
+		ks.keys[entry.ID] = key
+	}
+
+	active, ok := ks.keys[ks.activeID]
+	if !ok {
+		return nil, fmt.Errorf("active jwt key %q is not defined", ks.activeID)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active jwt key %q has no private part", ks.activeID)
+	}
+
+	return ks, nil
+}
+
+func (e keyFileEntry) load(dir string) (signingKey, error) {
+	switch e.Algorithm {
+	case "HS256", "HS384", "HS512":
+		if len(e.Secret) == 0 {
+			return signingKey{}, errors.New("secret is required")
+		}
+		secret := []byte(e.Secret)
+		return signingKey{method: jwt.GetSigningMethod(e.Algorithm), signKey: secret, verifyKey: secret}, nil
+	case "EdDSA":
+		return e.loadAsymmetric(dir, jwt.SigningMethodEdDSA,
+			func(pem []byte) (any, any, error) {
+				key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+				if err != nil {
+					return nil, nil, err
+				}
+				signer, ok := key.(crypto.Signer)
+				if !ok {
+					return nil, nil, errors.New("unexpected ed25519 key type")
+				}
+				return key, signer.Public(), nil
+			},
+			func(pem []byte) (any, error) { return jwt.ParseEdPublicKeyFromPEM(pem) },
+		)
+	case "RS256", "RS384", "RS512":
+		return e.loadAsymmetric(dir, jwt.GetSigningMethod(e.Algorithm),
+			func(pem []byte) (any, any, error) {
+				key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+				if err != nil {
+					return nil, nil, err
+				}
+				return key, &key.PublicKey, nil
+			},
+			func(pem []byte) (any, error) { return jwt.ParseRSAPublicKeyFromPEM(pem) },
+		)
+	default:
+		return signingKey{}, fmt.Errorf("unsupported algorithm %q", e.Algorithm)
+	}
+}
+
+func (e keyFileEntry) loadAsymmetric(
+	dir string,
+	method jwt.SigningMethod,
+	parsePrivate func([]byte) (any, any, error),
+	parsePublic func([]byte) (any, error),
+) (signingKey, error) {
+	key := signingKey{method: method}
+
+	privatePEM, err := pemValue(dir, e.PrivateKey, e.PrivateKeyFile)
+	if err != nil {
+		return key, err
+	}
+	if privatePEM != nil {
+		key.signKey, key.verifyKey, err = parsePrivate(privatePEM)
+		if err != nil {
+			return key, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		return key, nil
+	}
+
+	publicPEM, err := pemValue(dir, e.PublicKey, e.PublicKeyFile)
+	if err != nil {
+		return key, err
+	}
+	if publicPEM == nil {
+		return key, errors.New("private or public key is required")
+	}
+	key.verifyKey, err = parsePublic(publicPEM)
+	if err != nil {
+		return key, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return key, nil
+}
+
+func pemValue(dir, inline, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	return data, nil
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	key := ks.keys[ks.activeID]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = ks.activeID
+
+	tokenString, err := token.SignedString(key.signKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token string: %w", err)
+	}
+	return tokenString, nil
+}
+
+func (ks *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyID
+	}
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
@@ -0,0 +1,63 @@
+package authorization
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const unlockCookiePrefix = "Unlock-"
+
+// unlockAudience keeps unlock tokens and auth tokens from being accepted in
+// place of each other.
+const unlockAudience = "link-unlock"
+
+type unlockClaims struct {
+	jwt.RegisteredClaims
+	ShortURL string
+}
+
+// SetUnlockCookie lets the browser past the password prompt of shortURL
+// until ttl passes. Every protected link gets its own cookie.
+func (t *Tokens) SetUnlockCookie(w http.ResponseWriter, shortURL string, ttl time.Duration) error {
+	now := t.now()
+	token, err := t.keys.sign(unlockClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{unlockAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		ShortURL: shortURL,
+	})
+	if err != nil {
+		return err
+	}
+	cookie := t.cookie
+	cookie.Name = unlockCookieName(shortURL)
+	cookie.Value = token
+	cookie.MaxAge = int(ttl.Seconds())
+	cookie.HttpOnly = true
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+func (t *Tokens) Unlocked(r *http.Request, shortURL string) bool {
+	cookie, err := r.Cookie(unlockCookieName(shortURL))
+	if err != nil {
+		return false
+	}
+	claims := &unlockClaims{}
+	token, err := jwt.ParseWithClaims(cookie.Value, claims, t.keys.keyFunc)
+	if err != nil || !token.Valid {
+		return false
+	}
+	return claims.ExpiresAt != nil && claims.VerifyAudience(unlockAudience, true) && claims.ShortURL == shortURL
+}
+
+func unlockCookieName(shortURL string) string {
+	sum := sha256.Sum256([]byte(shortURL))
+	return unlockCookiePrefix + hex.EncodeToString(sum[:8])
+}
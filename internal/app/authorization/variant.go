@@ -0,0 +1,68 @@
+package authorization
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const variantCookiePrefix = "Variant-"
+
+const variantAudience = "link-variant"
+
+type variantClaims struct {
+	jwt.RegisteredClaims
+	ShortURL string
+	Variant  string
+}
+
+// SetVariantCookie pins the browser to a variant of a split link. It is
+// signed so the stats can't be skewed by handing out made-up assignments.
+func (t *Tokens) SetVariantCookie(w http.ResponseWriter, shortURL, variantID string, ttl time.Duration) error {
+	now := t.now()
+	token, err := t.keys.sign(variantClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{variantAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		ShortURL: shortURL,
+		Variant:  variantID,
+	})
+	if err != nil {
+		return err
+	}
+	cookie := t.cookie
+	cookie.Name = variantCookieName(shortURL)
+	cookie.Value = token
+	cookie.MaxAge = int(ttl.Seconds())
+	cookie.HttpOnly = true
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// Variant returns the variant the browser is pinned to for shortURL, "" when
+// there is none.
+func (t *Tokens) Variant(r *http.Request, shortURL string) string {
+	cookie, err := r.Cookie(variantCookieName(shortURL))
+	if err != nil {
+		return ""
+	}
+	claims := &variantClaims{}
+	token, err := jwt.ParseWithClaims(cookie.Value, claims, t.keys.keyFunc)
+	if err != nil || !token.Valid {
+		return ""
+	}
+	if claims.ExpiresAt == nil || !claims.VerifyAudience(variantAudience, true) || claims.ShortURL != shortURL {
+		return ""
+	}
+	return claims.Variant
+}
+
+func variantCookieName(shortURL string) string {
+	sum := sha256.Sum256([]byte(shortURL))
+	return variantCookiePrefix + hex.EncodeToString(sum[:8])
+}
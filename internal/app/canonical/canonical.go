@@ -0,0 +1,150 @@
+package canonical
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"shorty/internal/app/config"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	TrailingSlashKeep  = "keep"
+	TrailingSlashStrip = "strip"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+type Options struct {
+	SortQuery      bool
+	StripTracking  bool
+	TrackingParams []string
+	TrailingSlash  string
+}
+
+func OptionsFromConfig(cfg config.Config) Options {
+	opts := Options{
+		SortQuery:     cfg.CanonicalSortQuery,
+		StripTracking: cfg.CanonicalStripTracking,
+		TrailingSlash: cfg.CanonicalTrailingSlash,
+	}
+	for _, param := range strings.Split(cfg.CanonicalTrackingParams, ",") {
+		if param = strings.ToLower(strings.TrimSpace(param)); param != "" {
+			opts.TrackingParams = append(opts.TrackingParams, param)
+		}
+	}
+	return opts
+}
+
+// Canonicalize rewrites u in place so that equivalent urls produce the same
+// string, which is what gets hashed and deduplicated. The result is also
+// what redirects go to, so the path and the query keep their escaping, empty
+// and dot segments and parameters without a value: servers may tell them
+// apart.
+func Canonicalize(u *url.URL, opts Options) (*url.URL, error) {
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	escaped := canonicalPath(u.EscapedPath(), opts.TrailingSlash)
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return nil, fmt.Errorf("failed to unescape path %q: %w", escaped, err)
+	}
+	u.RawPath = escaped
+
+	u.RawQuery = canonicalQuery(u.RawQuery, opts)
+	u.ForceQuery = false
+
+	return u, nil
+}
+
+func canonicalHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert host %q to punycode: %w", host, err)
+	}
+	return ascii, nil
+}
+
+func canonicalPath(p string, trailingSlash string) string {
+	if p == "" || p == "/" {
+		return "/"
+	}
+	if trailingSlash == TrailingSlashStrip {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// canonicalQuery works on the raw "&" separated parameters, as parsing the
+// query would reject ";" and encode "?ref" as "?ref=".
+func canonicalQuery(raw string, opts Options) string {
+	if raw == "" || !opts.SortQuery && !opts.StripTracking {
+		return raw
+	}
+	var params []string
+	for _, param := range strings.Split(raw, "&") {
+		if param == "" {
+			continue
+		}
+		if opts.StripTracking && isTrackingParam(strings.ToLower(queryKey(param)), opts.TrackingParams) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if opts.SortQuery {
+		// Repeated parameters keep their order.
+		sort.SliceStable(params, func(i, j int) bool {
+			return queryKey(params[i]) < queryKey(params[j])
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func queryKey(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
+
+func isTrackingParam(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+			continue
+		}
+		if key == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package canonical
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalize(t *testing.T) {
+	defaults := Options{SortQuery: true, TrailingSlash: TrailingSlashKeep}
+	stripping := Options{
+		SortQuery:      true,
+		StripTracking:  true,
+		TrackingParams: []string{"utm_*", "fbclid"},
+		TrailingSlash:  TrailingSlashStrip,
+	}
+
+	tests := []struct {
+		name     string
+		raw      string
+		opts     Options
+		expected string
+	}{
+		{name: "Should lowercase scheme and host", raw: "HTTP://Example.COM/Path", opts: defaults, expected: "http://example.com/Path"},
+		{name: "Should add root slash", raw: "http://example.com", opts: defaults, expected: "http://example.com/"},
+		{name: "Should drop default http port", raw: "http://example.com:80/", opts: defaults, expected: "http://example.com/"},
+		{name: "Should drop default https port", raw: "https://example.com:443/a", opts: defaults, expected: "https://example.com/a"},
+		{name: "Should keep custom port", raw: "https://example.com:8443/a", opts: defaults, expected: "https://example.com:8443/a"},
+		{name: "Should drop trailing dot in host", raw: "http://example.com./", opts: defaults, expected: "http://example.com/"},
+		{name: "Should convert IDN to punycode", raw: "http://пример.рф/", opts: defaults, expected: "http://xn--e1afmkfd.xn--p1ai/"},
+		{name: "Should keep dot segments", raw: "http://example.com/a/./b/../c/", opts: defaults, expected: "http://example.com/a/./b/../c/"},
+		{name: "Should keep empty segments", raw: "http://example.com/a//b", opts: defaults, expected: "http://example.com/a//b"},
+		{name: "Should keep escaped slash", raw: "http://example.com/a%2Fb/c", opts: stripping, expected: "http://example.com/a%2Fb/c"},
+		{name: "Should keep params without value", raw: "http://example.com/?ref", opts: defaults, expected: "http://example.com/?ref"},
+		{name: "Should keep semicolons", raw: "http://example.com/?b=2;c=3&a=1", opts: stripping, expected: "http://example.com/?a=1&b=2;c=3"},
+		{name: "Should keep query escaping", raw: "http://example.com/?q=a+b%26c", opts: stripping, expected: "http://example.com/?q=a+b%26c"},
+		{name: "Should keep trailing slash", raw: "http://example.com/a/", opts: defaults, expected: "http://example.com/a/"},
+		{name: "Should strip trailing slash", raw: "http://example.com/a/", opts: stripping, expected: "http://example.com/a"},
+		{name: "Should sort query", raw: "http://example.com/?b=2&a=1&a=0", opts: defaults, expected: "http://example.com/?a=1&a=0&b=2"},
+		{name: "Should keep query order when disabled", raw: "http://example.com/?b=2&a=1", opts: Options{}, expected: "http://example.com/?b=2&a=1"},
+		{
+			name:     "Should strip tracking params",
+			raw:      "http://example.com/?utm_source=x&UTM_medium=y&fbclid=z&id=1",
+			opts:     stripping,
+			expected: "http://example.com/?id=1",
+		},
+		{name: "Should drop empty query", raw: "http://example.com/?utm_source=x", opts: stripping, expected: "http://example.com/"},
+		{name: "Should keep IPv6 hosts", raw: "http://[2001:DB8::1]:80/", opts: defaults, expected: "http://[2001:db8::1]/"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.raw)
+			require.NoError(t, err)
+
+			canonical, err := Canonicalize(u, tc.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, canonical.String())
+		})
+	}
+}
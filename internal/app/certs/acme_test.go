@@ -0,0 +1,70 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"shorty/internal/app/certs/acmetest"
+	"shorty/internal/app/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestACME(t *testing.T) {
+	ca := acmetest.NewServer()
+	defer ca.Close()
+
+	manager, err := NewManager(config.Config{
+		BaseAddress:      "https://short.test",
+		Domains:          "https://go.test:8443",
+		ACME:             true,
+		ACMEDirectoryURL: ca.DirectoryURL(),
+		ACMECacheDir:     t.TempDir(),
+	}, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	defer manager.Close()
+
+	redirect := manager.HTTPHandler(RedirectHandler(":443"))
+	ca.Challenges = redirect
+
+	tlsConfig := manager.TLSConfig()
+	handshake := func(serverName string) (*x509.Certificate, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_ = tls.Server(serverConn, tlsConfig).Handshake()
+			serverConn.Close()
+		}()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName, RootCAs: ca.Roots()})
+		defer client.Close()
+		if err := client.Handshake(); err != nil {
+			return nil, err
+		}
+		return client.ConnectionState().PeerCertificates[0], nil
+	}
+
+	for _, host := range []string{"short.test", "go.test"} {
+		leaf, err := handshake(host)
+		require.NoError(t, err, host)
+		assert.Equal(t, []string{host}, leaf.DNSNames)
+	}
+	assert.Equal(t, 2, ca.Orders())
+
+	// Issued certificates are reused, hosts outside the short link domains
+	// get none.
+	_, err = handshake("short.test")
+	require.NoError(t, err)
+	_, err = handshake("other.test")
+	assert.Error(t, err)
+	assert.Equal(t, 2, ca.Orders())
+
+	// Requests that aren't challenges are redirected.
+	writer := httptest.NewRecorder()
+	redirect.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "http://short.test/abc?x=1", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, writer.Code)
+	assert.Equal(t, "https://short.test/abc?x=1", writer.Header().Get("Location"))
+}
@@ -0,0 +1,309 @@
+// Package acmetest provides a stand-in ACME CA for tests.
+package acmetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type order struct {
+	domain string
+	valid  bool
+	leaf   []byte
+}
+
+// Server implements just enough of RFC 8555 for autocert: any account is
+// accepted, orders are for a single domain and are authorized by an HTTP-01
+// challenge, which is fetched from Challenges instead of over the network.
+// Certificates are signed by a root of its own.
+type Server struct {
+	*httptest.Server
+	// Challenges is the plain HTTP handler of the domains being validated.
+	Challenges http.Handler
+
+	rootKey *ecdsa.PrivateKey
+	root    *x509.Certificate
+
+	mu     sync.Mutex
+	orders []*order
+}
+
+func NewServer() *Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{rootKey: key, root: root}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) DirectoryURL() string {
+	return s.URL + "/"
+}
+
+// Roots trusts the certificates the server issued.
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.root)
+	return pool
+}
+
+// Orders is the number of orders placed so far.
+func (s *Server) Orders() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.orders)
+}
+
+func (s *Server) url(format string, args ...any) string {
+	return s.URL + fmt.Sprintf(format, args...)
+}
+
+func token(id int) string {
+	return "token-" + strconv.Itoa(id)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.url("/nonce"),
+			"newAccount": s.url("/account"),
+			"newOrder":   s.url("/order"),
+		})
+		return
+	}
+
+	switch {
+	case parts[0] == "nonce":
+	case parts[0] == "account":
+		w.Header().Set("Location", s.url("/account/1"))
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case parts[0] == "order" && len(parts) == 1:
+		s.newOrder(w, r)
+	case len(parts) != 2:
+		http.NotFound(w, r)
+	default:
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 0 || id >= s.Orders() {
+			http.NotFound(w, r)
+			return
+		}
+		s.handleOrder(w, r, parts[0], id)
+	}
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Value string }
+	}
+	if err := decodePayload(r, &req); err != nil || len(req.Identifiers) != 1 {
+		http.Error(w, "orders must be for a single domain", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.orders = append(s.orders, &order{domain: req.Identifiers[0].Value})
+	id := len(s.orders) - 1
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.url("/order/%d", id))
+	writeJSON(w, http.StatusCreated, s.orderJSON(id))
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request, resource string, id int) {
+	switch resource {
+	case "order":
+		w.Header().Set("Location", s.url("/order/%d", id))
+		writeJSON(w, http.StatusOK, s.orderJSON(id))
+	case "authz":
+		writeJSON(w, http.StatusOK, s.authzJSON(id))
+	case "challenge":
+		s.validate(id)
+		writeJSON(w, http.StatusOK, s.challengeJSON(id))
+	case "finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := decodePayload(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.issue(id, req.CSR); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Location", s.url("/order/%d", id))
+		writeJSON(w, http.StatusOK, s.orderJSON(id))
+	case "cert":
+		s.mu.Lock()
+		leaf := s.orders[id].leaf
+		s.mu.Unlock()
+		if leaf == nil {
+			http.Error(w, "certificate not issued", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.root.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) orderJSON(id int) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[id]
+	status := "pending"
+	switch {
+	case o.leaf != nil:
+		status = "valid"
+	case o.valid:
+		status = "ready"
+	}
+	return map[string]any{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{s.url("/authz/%d", id)},
+		"finalize":       s.url("/finalize/%d", id),
+		"certificate":    s.url("/cert/%d", id),
+	}
+}
+
+func (s *Server) challengeJSON(id int) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := "pending"
+	if s.orders[id].valid {
+		status = "valid"
+	}
+	return map[string]any{
+		"type":   "http-01",
+		"url":    s.url("/challenge/%d", id),
+		"token":  token(id),
+		"status": status,
+	}
+}
+
+func (s *Server) authzJSON(id int) map[string]any {
+	challenge := s.challengeJSON(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"status":     challenge["status"],
+		"identifier": map[string]string{"type": "dns", "value": s.orders[id].domain},
+		"challenges": []map[string]any{challenge},
+	}
+}
+
+// validate fetches the key authorization of the challenge the way a CA
+// would, with the domain as the host.
+func (s *Server) validate(id int) {
+	s.mu.Lock()
+	domain := s.orders[id].domain
+	s.mu.Unlock()
+	if s.Challenges == nil {
+		return
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/"+token(id), nil)
+	r.Host = domain
+	w := httptest.NewRecorder()
+	s.Challenges.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), token(id)+".") {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[id].valid = true
+}
+
+func (s *Server) issue(id int, rawCSR string) error {
+	der, err := base64.RawURLEncoding.DecodeString(rawCSR)
+	if err != nil {
+		return fmt.Errorf("invalid csr: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return fmt.Errorf("invalid csr: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[id]
+	if !o.valid {
+		return fmt.Errorf("order %d is not authorized", id)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 2),
+		Subject:      pkix.Name{CommonName: o.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		// Outside of autocert's renewal window, so nothing is renewed
+		// in the background.
+		NotAfter:    time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	o.leaf, err = x509.CreateCertificate(rand.Reader, template, s.root, csr.PublicKey, s.rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	return nil
+}
+
+func decodePayload(r *http.Request, v any) error {
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return fmt.Errorf("invalid jws: %w", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid jws payload: %w", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("invalid jws payload: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
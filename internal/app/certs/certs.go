@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"shorty/internal/app/config"
+	"shorty/internal/app/domains"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var ErrInvalidConfig = errors.New("invalid tls config")
+
+// Enabled reports whether the server should be served over HTTPS.
+func Enabled(cfg config.Config) bool {
+	return cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.ACME
+}
+
+// Manager hands out the server certificate, either read from the configured
+// files or obtained from an ACME CA for the short link domains.
+type Manager struct {
+	file *fileCertificate
+	acme *autocert.Manager
+}
+
+func NewManager(cfg config.Config, logger *zap.SugaredLogger) (*Manager, error) {
+	switch {
+	case cfg.ACME && (cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""):
+		return nil, fmt.Errorf("%w: certificate files and ACME are mutually exclusive", ErrInvalidConfig)
+	case cfg.ACME:
+		hosts, err := acmeHosts(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Manager{acme: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Email:      cfg.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL},
+		}}, nil
+	case cfg.TLSCertFile == "" || cfg.TLSKeyFile == "":
+		return nil, fmt.Errorf("%w: both the certificate and the key file are required", ErrInvalidConfig)
+	}
+
+	file, err := loadFileCertificate(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	file.watch(cfg.TLSReloadInterval)
+	return &Manager{file: file}, nil
+}
+
+// acmeHosts lists the hosts certificates may be requested for: the hosts of
+// every short link domain, without ports.
+func acmeHosts(cfg config.Config) ([]string, error) {
+	registry, err := domains.NewRegistry(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domains: %w", err)
+	}
+	var hosts []string
+	for _, domain := range registry.Domains() {
+		hosts = append(hosts, (&url.URL{Host: domain.Domain}).Hostname())
+	}
+	return hosts, nil
+}
+
+func (m *Manager) TLSConfig() *tls.Config {
+	if m.acme != nil {
+		// Includes the acme-tls/1 protocol, so certificates can be obtained
+		// without the HTTP listener too.
+		return m.acme.TLSConfig()
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.file.getCertificate,
+	}
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges and passes every other request
+// of the plain HTTP listener to fallback.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	if m.acme != nil {
+		return m.acme.HTTPHandler(fallback)
+	}
+	return fallback
+}
+
+func (m *Manager) Close() error {
+	if m.file != nil {
+		m.file.stop()
+	}
+	return nil
+}
+
+// RedirectHandler sends plain HTTP requests to the same URL on the HTTPS
+// listener at httpsAddress.
+func RedirectHandler(httpsAddress string) http.Handler {
+	_, port, err := net.SplitHostPort(httpsAddress)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: request.URL.Path, RawQuery: request.URL.RawQuery}
+		http.Redirect(writer, request, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// WithHSTS tells browsers to only use HTTPS for the host. The header is only
+// sent on TLS connections, as browsers ignore it on plain HTTP anyway.
+func WithHSTS(h http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	if maxAge <= 0 {
+		return h
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil {
+			writer.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,177 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shorty/internal/app/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// writeKeyPair writes a self-signed certificate for name and its key, with
+// a modification time of modTime.
+func writeKeyPair(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func TestNewManager(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, "short.test", time.Now())
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "files", cfg: config.Config{TLSCertFile: certFile, TLSKeyFile: keyFile}},
+		{name: "acme", cfg: config.Config{BaseAddress: "https://short.test", ACME: true}},
+		{name: "no key", cfg: config.Config{TLSCertFile: certFile}, wantErr: true},
+		{name: "missing file", cfg: config.Config{TLSCertFile: certFile, TLSKeyFile: certFile + ".missing"}, wantErr: true},
+		{name: "not a key", cfg: config.Config{TLSCertFile: certFile, TLSKeyFile: certFile}, wantErr: true},
+		{
+			name:    "files and acme",
+			cfg:     config.Config{BaseAddress: "https://short.test", TLSCertFile: certFile, TLSKeyFile: keyFile, ACME: true},
+			wantErr: true,
+		},
+		{name: "acme bad domain", cfg: config.Config{BaseAddress: "short.test", ACME: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.True(t, Enabled(tt.cfg))
+			manager, err := NewManager(tt.cfg, zaptest.NewLogger(t).Sugar())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, manager.Close())
+		})
+	}
+	assert.False(t, Enabled(config.Config{}))
+}
+
+func TestFileCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeKeyPair(t, certFile, keyFile, "old.test", start)
+
+	manager, err := NewManager(config.Config{
+		TLSCertFile:       certFile,
+		TLSKeyFile:        keyFile,
+		TLSReloadInterval: 10 * time.Millisecond,
+	}, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	defer manager.Close()
+
+	served := func() string {
+		cert, err := manager.TLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "old.test", served())
+
+	// Replacing only the certificate leaves a mismatched pair, the old one
+	// is kept until the key follows.
+	other := filepath.Join(dir, "other.pem")
+	writeKeyPair(t, certFile, other, "new.test", start.Add(time.Second))
+	reloaded, err := manager.file.reload()
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "old.test", served())
+
+	require.NoError(t, os.Rename(other, keyFile))
+	require.NoError(t, os.Chtimes(keyFile, start.Add(time.Second), start.Add(time.Second)))
+	assert.Eventually(t, func() bool { return served() == "new.test" }, time.Second, 10*time.Millisecond)
+
+	reloaded, err = manager.file.reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files aren't read again")
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		target  string
+		want    string
+	}{
+		{name: "default port", address: ":443", target: "http://short.test/abc?x=1", want: "https://short.test/abc?x=1"},
+		{
+			name:    "custom port",
+			address: "0.0.0.0:8443",
+			target:  "http://short.test:8080/abc",
+			want:    "https://short.test:8443/abc",
+		},
+		{name: "no port", address: "localhost", target: "http://short.test/", want: "https://short.test/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			RedirectHandler(tt.address).ServeHTTP(writer, httptest.NewRequest(http.MethodPost, tt.target, nil))
+			assert.Equal(t, http.StatusPermanentRedirect, writer.Code)
+			assert.Equal(t, tt.want, writer.Header().Get("Location"))
+		})
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxAge     time.Duration
+		subdomains bool
+		tls        bool
+		want       string
+	}{
+		{name: "tls", maxAge: time.Hour, tls: true, want: "max-age=3600"},
+		{name: "subdomains", maxAge: time.Hour, subdomains: true, tls: true, want: "max-age=3600; includeSubDomains"},
+		{name: "plain http", maxAge: time.Hour},
+		{name: "disabled", tls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				request.TLS = &tls.ConnectionState{}
+			}
+			writer := httptest.NewRecorder()
+			handler := WithHSTS(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), tt.maxAge, tt.subdomains)
+			handler.ServeHTTP(writer, request)
+			assert.Equal(t, tt.want, writer.Header().Get("Strict-Transport-Security"))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileCertificate is a certificate read from a PEM certificate and key file
+// pair. It is re-read when either file changes, so renewed certificates are
+// picked up without a restart.
+type fileCertificate struct {
+	certFile, keyFile string
+	logger            *zap.SugaredLogger
+
+	mu          *sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	done        chan struct{}
+}
+
+func loadFileCertificate(certFile, keyFile string, logger *zap.SugaredLogger) (*fileCertificate, error) {
+	f := &fileCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		mu:       &sync.RWMutex{},
+		done:     make(chan struct{}),
+	}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert, nil
+}
+
+// reload reads the pair again if either file was modified. A pair that
+// doesn't match, e.g. while only one of them has been replaced, keeps the
+// current certificate and is retried on the next check.
+func (f *fileCertificate) reload() (bool, error) {
+	certInfo, err := os.Stat(f.certFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", f.certFile, err)
+	}
+	keyInfo, err := os.Stat(f.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", f.keyFile, err)
+	}
+
+	f.mu.RLock()
+	unchanged := certInfo.ModTime().Equal(f.certModTime) && keyInfo.ModTime().Equal(f.keyModTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = &cert
+	f.certModTime = certInfo.ModTime()
+	f.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+func (f *fileCertificate) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.done:
+				return
+			case <-ticker.C:
+				reloaded, err := f.reload()
+				if err != nil {
+					f.logger.Errorf("failed to reload tls certificate: %v", err)
+					continue
+				}
+				if reloaded {
+					f.logger.Infof("reloaded tls certificate %s", f.certFile)
+				}
+			}
+		}
+	}()
+}
+
+func (f *fileCertificate) stop() {
+	close(f.done)
+}
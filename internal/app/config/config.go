@@ -2,30 +2,182 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
 type Config struct {
-	ServerAddress        string
-	BaseAddress          string
-	FileStoragePath      string
-	DatabaseDSN          string
-	JWTSecret            string
-	MaxDBConnections     int
-	MaxIdleDBConnections int
+	ServerAddress            string
+	HTTP2                    bool
+	H2C                      bool
+	HTTP3Address             string
+	GRPCAddress              string
+	ReadHeaderTimeout        time.Duration
+	IdleTimeout              time.Duration
+	WriteTimeout             time.Duration
+	TLSCertFile              string
+	TLSKeyFile               string
+	TLSReloadInterval        time.Duration
+	ACME                     bool
+	ACMEDirectoryURL         string
+	ACMEEmail                string
+	ACMECacheDir             string
+	HTTPRedirectAddress      string
+	HSTSMaxAge               time.Duration
+	HSTSIncludeSubdomains    bool
+	BaseAddress              string
+	Domains                  string
+	FileStoragePath          string
+	DatabaseDSN              string
+	JWTSecret                string
+	MaxDBConnections         int
+	MaxIdleDBConnections     int
+	ShortenRateLimit         RateLimit
+	RedirectRateLimit        RateLimit
+	UserAPIRateLimit         RateLimit
+	AuthRateLimit            RateLimit
+	UnlockRateLimit          RateLimit
+	TrustedProxies           string
+	MaxLinksPerUser          int
+	MaxBatchSize             int
+	AllowedSchemes           string
+	DomainDenylistPath       string
+	DomainAllowlistPath      string
+	HashPrefixListPath       string
+	BlockPrivateDestinations bool
+	ResolveDestinationHosts  bool
+	RecheckOnRedirect        bool
+	URLPolicyReloadInterval  time.Duration
+	CanonicalSortQuery       bool
+	CanonicalStripTracking   bool
+	CanonicalTrackingParams  string
+	CanonicalTrailingSlash   string
+	DevMode                  bool
+	JWTKeyFile               string
+	JWTTTL                   time.Duration
+	CookieSecure             bool
+	CookieHTTPOnly           bool
+	CookieSameSite           string
+	CookiePath               string
+	CookieDomain             string
+	StrictAuth               bool
+	OIDCIssuer               string
+	OIDCClientID             string
+	OIDCClientSecret         string
+	OIDCRedirectURL          string
+	OIDCScopes               string
+	OIDCUserClaim            string
+	OIDCPostLoginURL         string
+	WorkspaceInviteTTL       time.Duration
+	FetchMetadata            bool
+	FetchWorkers             int
+	FetchTimeout             time.Duration
+	FetchMaxBytes            int
+	LinkUnlockTTL            time.Duration
+	RedirectCode             int
+	RedirectCacheControl     string
+	RedirectReferrerPolicy   string
+	GeoIPDatabasePath        string
+	VariantCookieTTL         time.Duration
 }
 
+const DefaultJWTSecret = "jwt_secret"
+
 const maxDBConnections = 100
 const maxIdleDBConnections = 100
 
-func GetConfig() Config {
+func GetConfig() (Config, error) {
 	var cfg = Config{MaxDBConnections: maxDBConnections, MaxIdleDBConnections: maxIdleDBConnections}
 
 	flag.StringVar(&cfg.ServerAddress, "a", "localhost:8080", "server address")
+	flag.BoolVar(&cfg.HTTP2, "http2", true, "serve HTTP/2 over TLS")
+	flag.BoolVar(&cfg.H2C, "h2c", false, "serve cleartext HTTP/2 when TLS is off, e.g. behind an internal load balancer")
+	flag.StringVar(&cfg.HTTP3Address, "http3", "", "UDP address of an HTTP/3 listener, requires TLS, empty disables it")
+	flag.StringVar(&cfg.GRPCAddress, "grpc", "", "address of the gRPC API listener, empty disables it")
+	flag.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "time to read request headers, 0 means none")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "time to write a response, 0 means none")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", "", "path to a PEM certificate file, enables HTTPS")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", "", "path to the PEM private key file of -tls-cert")
+	flag.DurationVar(&cfg.TLSReloadInterval, "tls-reload", 10*time.Second, "certificate files reload check interval")
+	flag.BoolVar(&cfg.ACME, "acme", false, "obtain certificates for the short link domains from an ACME CA, enables HTTPS")
+	flag.StringVar(&cfg.ACMEDirectoryURL, "acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL")
+	flag.StringVar(&cfg.ACMEEmail, "acme-email", "", "contact email of the ACME account")
+	flag.StringVar(&cfg.ACMECacheDir, "acme-cache", "/tmp/short-url-acme", "directory the ACME account and certificates are kept in")
+	flag.StringVar(&cfg.HTTPRedirectAddress, "http-redirect", "", "address of a plain HTTP listener redirecting to HTTPS, empty disables it")
+	flag.DurationVar(&cfg.HSTSMaxAge, "hsts-max-age", 365*24*time.Hour, "max-age of the Strict-Transport-Security header, 0 sends none")
+	flag.BoolVar(&cfg.HSTSIncludeSubdomains, "hsts-subdomains", false, "add includeSubDomains to the Strict-Transport-Security header")
 	flag.StringVar(&cfg.BaseAddress, "b", "http://localhost:8080", "base address")
+	flag.StringVar(&cfg.Domains, "domains", "", "comma separated base addresses of extra short link domains")
 	flag.StringVar(&cfg.FileStoragePath, "f", "/tmp/short-url-db.json", "file storage path")
 	flag.StringVar(&cfg.DatabaseDSN, "d", "", "database DSN")
-	flag.StringVar(&cfg.JWTSecret, "s", "jwt_secret", "JWT secret")
+	flag.StringVar(&cfg.JWTSecret, "s", DefaultJWTSecret, "JWT secret")
+	flag.Float64Var(&cfg.ShortenRateLimit.Rate, "rl-shorten-rate", 10, "shorten requests per second, 0 disables the limit")
+	flag.IntVar(&cfg.ShortenRateLimit.Burst, "rl-shorten-burst", 100, "shorten requests burst")
+	flag.Float64Var(&cfg.RedirectRateLimit.Rate, "rl-redirect-rate", 100, "redirects per second, 0 disables the limit")
+	flag.IntVar(&cfg.RedirectRateLimit.Burst, "rl-redirect-burst", 200, "redirects burst")
+	flag.Float64Var(&cfg.UserAPIRateLimit.Rate, "rl-user-rate", 20, "user API requests per second, 0 disables the limit")
+	flag.IntVar(&cfg.UserAPIRateLimit.Burst, "rl-user-burst", 50, "user API requests burst")
+	flag.Float64Var(&cfg.AuthRateLimit.Rate, "rl-auth-rate", 1, "auth requests per second, 0 disables the limit")
+	flag.IntVar(&cfg.AuthRateLimit.Burst, "rl-auth-burst", 10, "auth requests burst")
+	flag.Float64Var(&cfg.UnlockRateLimit.Rate, "rl-unlock-rate", 0.05, "password attempts per second per protected link, 0 disables the limit")
+	flag.IntVar(&cfg.UnlockRateLimit.Burst, "rl-unlock-burst", 5, "password attempts burst per protected link")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "comma separated CIDRs of proxies trusted to set X-Forwarded-For")
+	flag.IntVar(&cfg.MaxLinksPerUser, "max-user-links", 10000, "maximum links per user, 0 means unlimited")
+	flag.IntVar(&cfg.MaxBatchSize, "max-batch-size", 1000, "maximum items in a batch request, 0 means unlimited")
+	flag.StringVar(&cfg.AllowedSchemes, "url-schemes", "http,https", "comma separated allowed destination schemes")
+	flag.StringVar(&cfg.DomainDenylistPath, "url-denylist", "", "path to a file with blocked destination domains")
+	flag.StringVar(&cfg.DomainAllowlistPath, "url-allowlist", "", "path to a file with the only allowed destination domains")
+	flag.StringVar(&cfg.HashPrefixListPath, "url-hash-list", "", "path to a file with sha256 hashes of malicious url expressions")
+	flag.BoolVar(&cfg.BlockPrivateDestinations, "url-block-private", true, "reject destinations on private or loopback addresses")
+	flag.BoolVar(&cfg.ResolveDestinationHosts, "url-resolve-hosts", false, "resolve destination hosts to check for private addresses")
+	flag.BoolVar(&cfg.RecheckOnRedirect, "url-recheck", false, "check destinations against the url policy on every redirect")
+	flag.DurationVar(&cfg.URLPolicyReloadInterval, "url-policy-reload", 10*time.Second, "url policy files reload check interval")
+	flag.BoolVar(&cfg.CanonicalSortQuery, "canon-sort-query", true, "sort query parameters of destinations")
+	flag.BoolVar(&cfg.CanonicalStripTracking, "canon-strip-tracking", false, "strip tracking query parameters from destinations")
+	flag.StringVar(
+		&cfg.CanonicalTrackingParams,
+		"canon-tracking-params",
+		"utm_*,fbclid,gclid,yclid,mc_cid,mc_eid",
+		"comma separated tracking parameters, a trailing * matches a prefix",
+	)
+	flag.StringVar(&cfg.CanonicalTrailingSlash, "canon-trailing-slash", "keep", "trailing slash rule for non-root paths: keep or strip")
+	flag.BoolVar(&cfg.DevMode, "dev", false, "development mode, allows the default JWT secret")
+	flag.StringVar(&cfg.JWTKeyFile, "jwt-keys", "", "path to a JSON file with JWT signing keys, overrides -s")
+	flag.DurationVar(&cfg.JWTTTL, "jwt-ttl", 30*24*time.Hour, "lifetime of issued auth tokens")
+	flag.BoolVar(&cfg.CookieSecure, "cookie-secure", false, "set the Secure attribute on the auth cookie")
+	flag.BoolVar(&cfg.CookieHTTPOnly, "cookie-httponly", true, "set the HttpOnly attribute on the auth cookie")
+	flag.StringVar(&cfg.CookieSameSite, "cookie-samesite", "lax", "SameSite attribute of the auth cookie: lax, strict or none")
+	flag.StringVar(&cfg.CookiePath, "cookie-path", "/", "Path attribute of the auth cookie")
+	flag.StringVar(&cfg.CookieDomain, "cookie-domain", "", "Domain attribute of the auth cookie")
+	flag.BoolVar(&cfg.StrictAuth, "strict-auth", false, "reject /api/user requests without valid credentials instead of creating a new user")
+	flag.StringVar(&cfg.OIDCIssuer, "oidc-issuer", "", "OIDC issuer URL, enables single sign-on")
+	flag.StringVar(&cfg.OIDCClientID, "oidc-client-id", "", "OIDC client ID")
+	flag.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", "", "OIDC client secret, empty for public clients")
+	flag.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", "", "OIDC redirect URL, defaults to <base address>/auth/oidc/callback")
+	flag.StringVar(&cfg.OIDCScopes, "oidc-scopes", "openid email profile", "space separated OIDC scopes")
+	flag.StringVar(&cfg.OIDCUserClaim, "oidc-user-claim", "sub", "ID token claim identifying the user: sub or email")
+	flag.StringVar(&cfg.OIDCPostLoginURL, "oidc-post-login-url", "", "where to redirect after single sign-on, empty returns JSON")
+	flag.DurationVar(&cfg.WorkspaceInviteTTL, "workspace-invite-ttl", 7*24*time.Hour, "lifetime of workspace invites")
+	flag.BoolVar(&cfg.FetchMetadata, "fetch-metadata", false, "fetch title and Open Graph metadata of new destinations")
+	flag.IntVar(&cfg.FetchWorkers, "fetch-workers", 4, "number of concurrent metadata fetches")
+	flag.DurationVar(&cfg.FetchTimeout, "fetch-timeout", 5*time.Second, "timeout of a single metadata fetch")
+	flag.IntVar(&cfg.FetchMaxBytes, "fetch-max-bytes", 512<<10, "maximum bytes of a destination page read for metadata")
+	flag.DurationVar(&cfg.LinkUnlockTTL, "link-unlock-ttl", 15*time.Minute, "how long a correct link password is remembered")
+	flag.IntVar(&cfg.RedirectCode, "redirect-code", 307, "default redirect status: 301, 302, 307 or 308")
+	flag.StringVar(&cfg.RedirectCacheControl, "redirect-cache-control", "", "Cache-Control header of redirects, empty sends none")
+	flag.StringVar(&cfg.RedirectReferrerPolicy, "redirect-referrer-policy", "", "Referrer-Policy header of redirects, empty sends none")
+	flag.DurationVar(&cfg.VariantCookieTTL, "variant-cookie-ttl", 30*24*time.Hour, "how long a sticky split link keeps its variant")
+	flag.StringVar(&cfg.GeoIPDatabasePath, "geoip-db", "", "path to a CSV of start_ip,end_ip,country ranges for country rules")
 	flag.Parse()
 
 	if envServerAddress := os.Getenv("SERVER_ADDRESS"); envServerAddress != "" {
@@ -48,5 +200,209 @@ func GetConfig() Config {
 		cfg.JWTSecret = envJWTSecret
 	}
 
-	return cfg
+	if envTrustedProxies := os.Getenv("TRUSTED_PROXIES"); envTrustedProxies != "" {
+		cfg.TrustedProxies = envTrustedProxies
+	}
+
+	rateLimits := []struct {
+		prefix string
+		limit  *RateLimit
+	}{
+		{prefix: "RATE_LIMIT_SHORTEN", limit: &cfg.ShortenRateLimit},
+		{prefix: "RATE_LIMIT_REDIRECT", limit: &cfg.RedirectRateLimit},
+		{prefix: "RATE_LIMIT_USER", limit: &cfg.UserAPIRateLimit},
+		{prefix: "RATE_LIMIT_AUTH", limit: &cfg.AuthRateLimit},
+		{prefix: "RATE_LIMIT_UNLOCK", limit: &cfg.UnlockRateLimit},
+	}
+	for _, rl := range rateLimits {
+		if err := floatFromEnv(rl.prefix+"_RATE", &rl.limit.Rate); err != nil {
+			return cfg, err
+		}
+		if err := intFromEnv(rl.prefix+"_BURST", &rl.limit.Burst); err != nil {
+			return cfg, err
+		}
+	}
+
+	stringsFromEnv := []struct {
+		name string
+		dst  *string
+	}{
+		{name: "DOMAINS", dst: &cfg.Domains},
+		{name: "HTTP3_ADDRESS", dst: &cfg.HTTP3Address},
+		{name: "GRPC_ADDRESS", dst: &cfg.GRPCAddress},
+		{name: "TLS_CERT_FILE", dst: &cfg.TLSCertFile},
+		{name: "TLS_KEY_FILE", dst: &cfg.TLSKeyFile},
+		{name: "ACME_DIRECTORY", dst: &cfg.ACMEDirectoryURL},
+		{name: "ACME_EMAIL", dst: &cfg.ACMEEmail},
+		{name: "ACME_CACHE_DIR", dst: &cfg.ACMECacheDir},
+		{name: "HTTP_REDIRECT_ADDRESS", dst: &cfg.HTTPRedirectAddress},
+		{name: "URL_SCHEMES", dst: &cfg.AllowedSchemes},
+		{name: "URL_DENYLIST", dst: &cfg.DomainDenylistPath},
+		{name: "URL_ALLOWLIST", dst: &cfg.DomainAllowlistPath},
+		{name: "URL_HASH_LIST", dst: &cfg.HashPrefixListPath},
+		{name: "CANON_TRACKING_PARAMS", dst: &cfg.CanonicalTrackingParams},
+		{name: "CANON_TRAILING_SLASH", dst: &cfg.CanonicalTrailingSlash},
+		{name: "JWT_KEYS", dst: &cfg.JWTKeyFile},
+		{name: "COOKIE_SAMESITE", dst: &cfg.CookieSameSite},
+		{name: "COOKIE_PATH", dst: &cfg.CookiePath},
+		{name: "COOKIE_DOMAIN", dst: &cfg.CookieDomain},
+		{name: "OIDC_ISSUER", dst: &cfg.OIDCIssuer},
+		{name: "OIDC_CLIENT_ID", dst: &cfg.OIDCClientID},
+		{name: "OIDC_CLIENT_SECRET", dst: &cfg.OIDCClientSecret},
+		{name: "OIDC_REDIRECT_URL", dst: &cfg.OIDCRedirectURL},
+		{name: "OIDC_SCOPES", dst: &cfg.OIDCScopes},
+		{name: "OIDC_USER_CLAIM", dst: &cfg.OIDCUserClaim},
+		{name: "OIDC_POST_LOGIN_URL", dst: &cfg.OIDCPostLoginURL},
+		{name: "REDIRECT_CACHE_CONTROL", dst: &cfg.RedirectCacheControl},
+		{name: "REDIRECT_REFERRER_POLICY", dst: &cfg.RedirectReferrerPolicy},
+		{name: "GEOIP_DB", dst: &cfg.GeoIPDatabasePath},
+	}
+	for _, env := range stringsFromEnv {
+		if value := os.Getenv(env.name); value != "" {
+			*env.dst = value
+		}
+	}
+
+	boolsFromEnv := []struct {
+		name string
+		dst  *bool
+	}{
+		{name: "HTTP2", dst: &cfg.HTTP2},
+		{name: "H2C", dst: &cfg.H2C},
+		{name: "ACME", dst: &cfg.ACME},
+		{name: "HSTS_SUBDOMAINS", dst: &cfg.HSTSIncludeSubdomains},
+		{name: "URL_BLOCK_PRIVATE", dst: &cfg.BlockPrivateDestinations},
+		{name: "URL_RESOLVE_HOSTS", dst: &cfg.ResolveDestinationHosts},
+		{name: "URL_RECHECK", dst: &cfg.RecheckOnRedirect},
+		{name: "CANON_SORT_QUERY", dst: &cfg.CanonicalSortQuery},
+		{name: "CANON_STRIP_TRACKING", dst: &cfg.CanonicalStripTracking},
+		{name: "DEV_MODE", dst: &cfg.DevMode},
+		{name: "COOKIE_SECURE", dst: &cfg.CookieSecure},
+		{name: "COOKIE_HTTPONLY", dst: &cfg.CookieHTTPOnly},
+		{name: "STRICT_AUTH", dst: &cfg.StrictAuth},
+		{name: "FETCH_METADATA", dst: &cfg.FetchMetadata},
+	}
+	for _, env := range boolsFromEnv {
+		if err := boolFromEnv(env.name, env.dst); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := durationFromEnv("READ_HEADER_TIMEOUT", &cfg.ReadHeaderTimeout); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("IDLE_TIMEOUT", &cfg.IdleTimeout); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("WRITE_TIMEOUT", &cfg.WriteTimeout); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("TLS_RELOAD", &cfg.TLSReloadInterval); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("HSTS_MAX_AGE", &cfg.HSTSMaxAge); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("URL_POLICY_RELOAD", &cfg.URLPolicyReloadInterval); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("JWT_TTL", &cfg.JWTTTL); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("WORKSPACE_INVITE_TTL", &cfg.WorkspaceInviteTTL); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("FETCH_TIMEOUT", &cfg.FetchTimeout); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("LINK_UNLOCK_TTL", &cfg.LinkUnlockTTL); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("VARIANT_COOKIE_TTL", &cfg.VariantCookieTTL); err != nil {
+		return cfg, err
+	}
+
+	if err := intFromEnv("FETCH_WORKERS", &cfg.FetchWorkers); err != nil {
+		return cfg, err
+	}
+
+	if err := intFromEnv("FETCH_MAX_BYTES", &cfg.FetchMaxBytes); err != nil {
+		return cfg, err
+	}
+
+	if err := intFromEnv("MAX_USER_LINKS", &cfg.MaxLinksPerUser); err != nil {
+		return cfg, err
+	}
+
+	if err := intFromEnv("MAX_BATCH_SIZE", &cfg.MaxBatchSize); err != nil {
+		return cfg, err
+	}
+
+	if err := intFromEnv("REDIRECT_CODE", &cfg.RedirectCode); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+func floatFromEnv(name string, dst *float64) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	*dst = parsed
+	return nil
+}
+
+func intFromEnv(name string, dst *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	*dst = parsed
+	return nil
+}
+
+func boolFromEnv(name string, dst *bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	*dst = parsed
+	return nil
+}
+
+func durationFromEnv(name string, dst *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	*dst = parsed
+	return nil
 }
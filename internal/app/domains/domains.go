@@ -0,0 +1,148 @@
+package domains
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"strings"
+)
+
+var (
+	ErrUnknownDomain = errors.New("unknown domain")
+	ErrInvalidDomain = errors.New("domain must be an absolute http or https base url")
+)
+
+// Registry maps the hosts an instance serves short links on to their base
+// URLs. The primary domain is the base address, links on it store an empty
+// domain so they survive a change of it.
+type Registry struct {
+	primary string
+	bases   map[string]string
+	hosts   []string
+}
+
+// NewRegistry reads the comma separated base URLs of the extra domains.
+func NewRegistry(cfg config.Config) (*Registry, error) {
+	primary, err := host(cfg.BaseAddress)
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{
+		primary: primary,
+		bases:   map[string]string{primary: cfg.BaseAddress},
+		hosts:   []string{primary},
+	}
+
+	for _, base := range strings.Split(cfg.Domains, ",") {
+		base = strings.TrimSpace(base)
+		if base == "" {
+			continue
+		}
+		h, err := host(base)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := r.bases[h]; ok {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidDomain, h)
+		}
+		r.bases[h] = base
+		r.hosts = append(r.hosts, h)
+	}
+	return r, nil
+}
+
+func host(base string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDomain, base)
+	}
+	return strings.ToLower(u.Host), nil
+}
+
+// Key is how storage identifies a link: its code, prefixed with the domain
+// for links that aren't on the primary one. Keys never contain the base
+// address, so it can change without orphaning links.
+func Key(domain, code string) string {
+	if domain == "" {
+		return code
+	}
+	return domain + "/" + code
+}
+
+func SplitKey(key string) (domain, code string) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// LegacyKey turns a full short URL, as links were stored before keys, into
+// the key of a link on domain. It reports false for values that already are
+// keys.
+func LegacyKey(shortURL, domain string) (string, bool) {
+	if !strings.Contains(shortURL, "://") {
+		return shortURL, false
+	}
+	return Key(domain, shortURL[strings.LastIndexByte(shortURL, '/')+1:]), true
+}
+
+// ShortURL renders the public short URL of a key. Links on a domain that
+// was since removed from the configuration are rendered as https.
+func (r *Registry) ShortURL(key string) (string, error) {
+	domain, code := SplitKey(key)
+	base, err := r.Base(domain)
+	if errors.Is(err, ErrUnknownDomain) {
+		base = "https://" + domain
+	}
+	shortURL, err := url.JoinPath(base, code)
+	if err != nil {
+		return "", fmt.Errorf("failed to build short url: %w", err)
+	}
+	return shortURL, nil
+}
+
+// Domain returns the stored form of a host: empty for the primary domain.
+func (r *Registry) Domain(host string) (string, error) {
+	host = strings.ToLower(host)
+	if host == "" || host == r.primary {
+		return "", nil
+	}
+	if _, ok := r.bases[host]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownDomain, host)
+	}
+	return host, nil
+}
+
+// Base returns the base URL of a stored domain.
+func (r *Registry) Base(domain string) (string, error) {
+	if domain == "" {
+		return r.bases[r.primary], nil
+	}
+	base, ok := r.bases[strings.ToLower(domain)]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownDomain, domain)
+	}
+	return base, nil
+}
+
+// ForHost returns the domain a request for host was sent to, falling back
+// to the primary one for hosts that aren't registered, e.g. an internal
+// address of the instance.
+func (r *Registry) ForHost(host string) (domain, base string) {
+	domain, err := r.Domain(host)
+	if err != nil {
+		return "", r.bases[r.primary]
+	}
+	base, _ = r.Base(domain)
+	return domain, base
+}
+
+func (r *Registry) Domains() []models.Domain {
+	domains := make([]models.Domain, len(r.hosts))
+	for i, h := range r.hosts {
+		domains[i] = models.Domain{Domain: h, BaseURL: r.bases[h], Primary: h == r.primary}
+	}
+	return domains
+}
@@ -0,0 +1,113 @@
+package domains
+
+import (
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "primary only", cfg: config.Config{BaseAddress: "http://localhost:8080"}},
+		{name: "extra", cfg: config.Config{BaseAddress: "http://localhost:8080",
+			Domains: "https://go.brand-a.com, https://go.brand-b.com/"}},
+		{name: "relative", cfg: config.Config{BaseAddress: "localhost:8080"}, wantErr: true},
+		{name: "scheme", cfg: config.Config{BaseAddress: "http://localhost:8080", Domains: "ftp://go.brand-a.com"},
+			wantErr: true},
+		{name: "query", cfg: config.Config{BaseAddress: "http://localhost:8080", Domains: "https://a.com/?x=1"},
+			wantErr: true},
+		{name: "duplicate", cfg: config.Config{BaseAddress: "http://localhost:8080", Domains: "https://LOCALHOST:8080"},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRegistry(tt.cfg)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidDomain)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r, err := NewRegistry(config.Config{
+		BaseAddress: "http://localhost:8080",
+		Domains:     "https://go.brand-a.com,https://go.brand-b.com/s",
+	})
+	require.NoError(t, err)
+
+	hosts := []struct {
+		host   string
+		domain string
+		base   string
+	}{
+		{host: "localhost:8080", base: "http://localhost:8080"},
+		{host: "GO.brand-a.com", domain: "go.brand-a.com", base: "https://go.brand-a.com"},
+		{host: "go.brand-b.com", domain: "go.brand-b.com", base: "https://go.brand-b.com/s"},
+		{host: "10.0.0.1:8080", base: "http://localhost:8080"},
+	}
+	for _, tt := range hosts {
+		domain, base := r.ForHost(tt.host)
+		assert.Equal(t, tt.domain, domain, tt.host)
+		assert.Equal(t, tt.base, base, tt.host)
+	}
+
+	domain, err := r.Domain("localhost:8080")
+	require.NoError(t, err)
+	assert.Empty(t, domain, "the primary domain is stored empty")
+	_, err = r.Domain("go.brand-c.com")
+	assert.ErrorIs(t, err, ErrUnknownDomain)
+	_, err = r.Base("go.brand-c.com")
+	assert.ErrorIs(t, err, ErrUnknownDomain)
+
+	assert.Equal(t, []models.Domain{
+		{Domain: "localhost:8080", BaseURL: "http://localhost:8080", Primary: true},
+		{Domain: "go.brand-a.com", BaseURL: "https://go.brand-a.com"},
+		{Domain: "go.brand-b.com", BaseURL: "https://go.brand-b.com/s"},
+	}, r.Domains())
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		shortURL string
+		domain   string
+		key      string
+		legacy   bool
+	}{
+		{shortURL: "http://localhost:8080/abc1234", key: "abc1234", legacy: true},
+		{shortURL: "https://go.brand-a.com/s/abc1234", domain: "go.brand-a.com", key: "go.brand-a.com/abc1234",
+			legacy: true},
+		{shortURL: "abc1234", key: "abc1234"},
+		{shortURL: "go.brand-a.com/abc1234", domain: "go.brand-a.com", key: "go.brand-a.com/abc1234"},
+	}
+	for _, tt := range tests {
+		key, legacy := LegacyKey(tt.shortURL, tt.domain)
+		assert.Equal(t, tt.key, key, tt.shortURL)
+		assert.Equal(t, tt.legacy, legacy, tt.shortURL)
+
+		domain, code := SplitKey(key)
+		assert.Equal(t, tt.domain, domain, tt.shortURL)
+		assert.Equal(t, key, Key(domain, code), tt.shortURL)
+	}
+
+	r, err := NewRegistry(config.Config{BaseAddress: "https://sho.rt/s", Domains: "https://go.brand-a.com"})
+	require.NoError(t, err)
+	for key, want := range map[string]string{
+		"abc1234":                "https://sho.rt/s/abc1234",
+		"go.brand-a.com/abc1234": "https://go.brand-a.com/abc1234",
+		"go.removed.com/abc1234": "https://go.removed.com/abc1234",
+	} {
+		shortURL, err := r.ShortURL(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, shortURL)
+	}
+}
@@ -0,0 +1,115 @@
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Reader resolves an address to an ISO 3166 country code, "" when unknown.
+type Reader interface {
+	Country(ip net.IP) string
+}
+
+type ipRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// Database is a local table of address ranges, sorted by start address.
+type Database struct {
+	ranges []ipRange
+}
+
+func Open(path string) (*Database, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %w", err)
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse reads "start_ip,end_ip,country" lines; "#" starts a comment.
+func Parse(r io.Reader) (*Database, error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		fields, err := csv.NewReader(strings.NewReader(text)).Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse geoip line %d: %w", line, err)
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("failed to parse geoip line %d: want 3 fields, got %d", line, len(fields))
+		}
+		start, end := parseIP(fields[0]), parseIP(fields[1])
+		if start == nil || end == nil || len(start) != len(end) || bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("failed to parse geoip line %d: invalid range", line)
+		}
+		country := strings.ToUpper(strings.TrimSpace(fields[2]))
+		if len(country) != 2 {
+			return nil, fmt.Errorf("failed to parse geoip line %d: invalid country %q", line, fields[2])
+		}
+		ranges = append(ranges, ipRange{start: start, end: end, country: country})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %w", err)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		if len(ranges[i].start) != len(ranges[j].start) {
+			return len(ranges[i].start) < len(ranges[j].start)
+		}
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	return &Database{ranges: ranges}, nil
+}
+
+func (d *Database) Country(ip net.IP) string {
+	ip = normalize(ip)
+	if d == nil || ip == nil {
+		return ""
+	}
+	// First range starting after ip; the one before it is the only candidate.
+	i := sort.Search(len(d.ranges), func(i int) bool {
+		start := d.ranges[i].start
+		if len(start) != len(ip) {
+			return len(start) > len(ip)
+		}
+		return bytes.Compare(start, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	candidate := d.ranges[i-1]
+	if len(candidate.end) != len(ip) || bytes.Compare(ip, candidate.end) > 0 {
+		return ""
+	}
+	return candidate.country
+}
+
+func parseIP(value string) net.IP {
+	return normalize(net.ParseIP(strings.TrimSpace(value)))
+}
+
+// normalize keeps IPv4 addresses in their 4 byte form so ranges of both
+// families sort apart.
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
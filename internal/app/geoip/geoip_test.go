@@ -0,0 +1,61 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseCountry(t *testing.T) {
+	db, err := Parse(strings.NewReader(`# test ranges
+10.0.0.0,10.0.0.255,de
+1.0.0.0,1.0.0.255,AU
+2001:db8::,2001:db8::ffff,FR
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.0.0.0", want: "DE"},
+		{ip: "10.0.0.200", want: "DE"},
+		{ip: "10.0.1.0", want: ""},
+		{ip: "1.0.0.7", want: "AU"},
+		{ip: "0.0.0.1", want: ""},
+		{ip: "::ffff:1.0.0.7", want: "AU"},
+		{ip: "2001:db8::1", want: "FR"},
+		{ip: "2001:db8::1:0", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.want, db.Country(net.ParseIP(tt.ip)))
+		})
+	}
+
+	assert.Equal(t, "", db.Country(nil))
+	var empty *Database
+	assert.Equal(t, "", empty.Country(net.ParseIP("10.0.0.1")))
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "fields", input: "10.0.0.0,10.0.0.255\n"},
+		{name: "address", input: "10.0.0.x,10.0.0.255,DE\n"},
+		{name: "reversed", input: "10.0.0.255,10.0.0.0,DE\n"},
+		{name: "mixed families", input: "10.0.0.0,2001:db8::,DE\n"},
+		{name: "country", input: "10.0.0.0,10.0.0.255,DEU\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			assert.Error(t, err)
+		})
+	}
+}
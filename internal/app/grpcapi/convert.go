@@ -0,0 +1,104 @@
+package grpcapi
+
+import (
+	"errors"
+	"shorty/internal/app/grpcapi/pb"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const internalServerError = "internal server error"
+
+// statusError maps the errors of the link logic to the codes closest to the
+// statuses of the REST API. Unexpected errors are logged and hidden.
+func (s *Server) statusError(err error) error {
+	switch {
+	case errors.Is(err, service.ErrEmptyURL),
+		errors.Is(err, service.ErrNegativeMaxClicks),
+		errors.Is(err, service.ErrPasswordTooLong),
+		errors.Is(err, service.ErrMetadataTooLong),
+		errors.Is(err, service.ErrTooManyTags),
+		errors.Is(err, service.ErrInvalidTag),
+		errors.Is(err, service.ErrInvalidURL),
+		errors.Is(err, service.ErrSchemeNotAllowed),
+		errors.Is(err, service.ErrUnknownDomain):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, service.ErrDomainBlocked), errors.Is(err, service.ErrFlagged):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, service.ErrPrivateDestination):
+		return status.Error(codes.FailedPrecondition, "destination on a private network is not allowed")
+	case errors.Is(err, service.ErrLinkNotFound),
+		errors.Is(err, service.ErrLinkGone),
+		errors.Is(err, service.ErrWorkspaceNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, service.ErrLinkExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, service.ErrLinkProtected), errors.Is(err, service.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, service.ErrBatchTooLarge), errors.Is(err, service.ErrLinksExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		s.logger.Errorf("failed to handle gRPC request: %v", err)
+		return status.Error(codes.Internal, internalServerError)
+	}
+}
+
+func metadataFromProto(meta *pb.LinkMetadata) models.LinkMetadata {
+	result := models.LinkMetadata{
+		Title:        meta.GetTitle(),
+		Description:  meta.GetDescription(),
+		Tags:         meta.GetTags(),
+		Folder:       meta.GetFolder(),
+		Interstitial: meta.GetInterstitial(),
+		RedirectCode: int(meta.GetRedirectCode()),
+		PassQuery:    meta.GetPassQuery(),
+	}
+	if utm := meta.GetUtm(); utm != nil {
+		result.UTM = &models.UTMParams{
+			Source:   utm.GetSource(),
+			Medium:   utm.GetMedium(),
+			Campaign: utm.GetCampaign(),
+			Term:     utm.GetTerm(),
+			Content:  utm.GetContent(),
+		}
+	}
+	return result
+}
+
+func metadataToProto(meta models.LinkMetadata) *pb.LinkMetadata {
+	result := &pb.LinkMetadata{
+		Title:        meta.Title,
+		Description:  meta.Description,
+		Tags:         meta.Tags,
+		Folder:       meta.Folder,
+		Interstitial: meta.Interstitial,
+		RedirectCode: int32(meta.RedirectCode),
+		PassQuery:    meta.PassQuery,
+	}
+	if meta.UTM != nil {
+		result.Utm = &pb.UTMParams{
+			Source:   meta.UTM.Source,
+			Medium:   meta.UTM.Medium,
+			Campaign: meta.UTM.Campaign,
+			Term:     meta.UTM.Term,
+			Content:  meta.UTM.Content,
+		}
+	}
+	return result
+}
+
+func linkToProto(link models.UserURLs) *pb.Link {
+	return &pb.Link{
+		ShortUrl:    link.ShortURL,
+		OriginalUrl: link.OriginalURL,
+		WorkspaceId: link.WorkspaceID,
+		Domain:      link.Domain,
+		Metadata:    metadataToProto(link.LinkMetadata),
+		MaxClicks:   int32(link.MaxClicks),
+		Clicks:      int32(link.Clicks),
+		Deleted:     link.IsDeleted,
+	}
+}
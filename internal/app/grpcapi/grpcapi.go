@@ -0,0 +1,150 @@
+// Package grpcapi serves the link API over gRPC for backend services. It
+// shares the link service with the REST handlers.
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/grpcapi/pb"
+	"shorty/internal/app/models"
+	"shorty/internal/app/ratelimit"
+	"shorty/internal/app/service"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Links are created on the primary domain unless a request names another
+// one, gRPC clients don't address a domain the way browsers do.
+const noHost = ""
+
+type Server struct {
+	pb.UnimplementedShortyServer
+	shortener *service.Shortener
+	logger    *zap.SugaredLogger
+}
+
+// NewServer builds the gRPC server with the logging, auth and rate limit
+// interceptors. Calls that create links are limited by shortenLimit, like the
+// REST routes that do. tlsConfig is nil for plaintext.
+func NewServer(
+	shortener *service.Shortener,
+	tokens *authorization.Tokens,
+	keys authorization.APIKeyStore,
+	limiter *ratelimit.Limiter,
+	shortenLimit ratelimit.Policy,
+	tlsConfig *tls.Config,
+	logger *zap.SugaredLogger,
+) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			withLogging(logger),
+			withAuthorization(tokens, keys, logger),
+			withShortenRateLimit(limiter, shortenLimit, logger),
+		),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	pb.RegisterShortyServer(server, &Server{shortener: shortener, logger: logger})
+	return server
+}
+
+func (s *Server) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	shortURL, existing, err := s.shortener.Shorten(ctx, scope(ctx, req.GetWorkspaceId()), noHost,
+		models.ShortenRequest{
+			URL:          req.GetUrl(),
+			Domain:       req.GetDomain(),
+			Password:     req.GetPassword(),
+			MaxClicks:    int(req.GetMaxClicks()),
+			LinkMetadata: metadataFromProto(req.GetMetadata()),
+		},
+	)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	return &pb.ShortenResponse{ShortUrl: shortURL, Existing: existing}, nil
+}
+
+func (s *Server) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	urls := make(models.ShortenBatchRequest, len(req.GetItems()))
+	for i, item := range req.GetItems() {
+		urls[i].CorrelationID = item.GetCorrelationId()
+		urls[i].OriginalURL = item.GetOriginalUrl()
+		urls[i].Domain = item.GetDomain()
+		urls[i].MaxClicks = int(item.GetMaxClicks())
+		urls[i].LinkMetadata = metadataFromProto(item.GetMetadata())
+	}
+
+	saved, err := s.shortener.ShortenBatch(ctx, scope(ctx, req.GetWorkspaceId()), noHost, urls)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	resp := &pb.ShortenBatchResponse{Items: make([]*pb.ShortenBatchResponse_Item, len(saved))}
+	for i, item := range saved {
+		resp.Items[i] = &pb.ShortenBatchResponse_Item{CorrelationId: item.CorrelationID, ShortUrl: item.ShortURL}
+	}
+	return resp, nil
+}
+
+func (s *Server) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	link, err := s.shortener.Resolve(ctx, service.LinkRef{Code: req.GetCode(), Domain: req.GetDomain()})
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	return &pb.ResolveResponse{Link: linkToProto(link)}, nil
+}
+
+func (s *Server) ListUserURLs(ctx context.Context, req *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	filter := models.URLFilter{Tag: req.GetTag(), Folder: req.GetFolder()}
+	urls, err := s.shortener.List(ctx, scope(ctx, req.GetWorkspaceId()), filter)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	resp := &pb.ListUserURLsResponse{Links: make([]*pb.Link, len(urls))}
+	for i, link := range urls {
+		resp.Links[i] = linkToProto(link)
+	}
+	return resp, nil
+}
+
+// DeleteUserURLs deletes before answering, unlike the REST endpoint, so
+// callers know the links are gone.
+func (s *Server) DeleteUserURLs(
+	ctx context.Context,
+	req *pb.DeleteUserURLsRequest,
+) (*pb.DeleteUserURLsResponse, error) {
+	err := s.shortener.Delete(ctx, scope(ctx, req.GetWorkspaceId()), noHost, req.GetDomain(), req.GetCodes())
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	return &pb.DeleteUserURLsResponse{}, nil
+}
+
+func (s *Server) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	ref := service.LinkRef{Code: req.GetCode(), Domain: req.GetDomain()}
+	stats, err := s.shortener.Stats(ctx, scope(ctx, req.GetWorkspaceId()), ref)
+	if err != nil {
+		return nil, s.statusError(err)
+	}
+	resp := &pb.StatsResponse{ShortUrl: stats.ShortURL, Variants: make([]*pb.VariantStats, len(stats.Variants))}
+	for i, variant := range stats.Variants {
+		resp.Variants[i] = &pb.VariantStats{
+			Id:          variant.ID,
+			Destination: variant.Destination,
+			Weight:      int32(variant.Weight),
+			Clicks:      int32(variant.Clicks),
+		}
+	}
+	return resp, nil
+}
+
+// scope is the caller set by the auth interceptor, which runs for every
+// method but Resolve.
+func scope(ctx context.Context, workspaceID string) service.Scope {
+	userID, _ := ctx.Value(authorization.UserIDContextKey).(string)
+	return service.Scope{UserID: userID, WorkspaceID: workspaceID}
+}
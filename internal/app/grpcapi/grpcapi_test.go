@@ -0,0 +1,237 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/grpcapi/pb"
+	"shorty/internal/app/hash"
+	"shorty/internal/app/ratelimit"
+	"shorty/internal/app/service"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newClient serves the API on an in-memory listener.
+func newClient(t *testing.T) (pb.ShortyClient, *authorization.Tokens) {
+	return newLimitedClient(t, ratelimit.Policy{})
+}
+
+// newLimitedClient limits the calls that create links by shortenLimit.
+func newLimitedClient(t *testing.T, shortenLimit ratelimit.Policy) (pb.ShortyClient, *authorization.Tokens) {
+	cfg := config.Config{
+		BaseAddress: "http://localhost:8080",
+		Domains:     "https://go.test",
+		JWTSecret:   "test-secret",
+		JWTTTL:      time.Hour,
+	}
+	str, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	policy, err := urlpolicy.NewPolicy(cfg)
+	require.NoError(t, err)
+	tokens, err := authorization.NewTokens(cfg)
+	require.NoError(t, err)
+
+	logger := zaptest.NewLogger(t).Sugar()
+	shortener, err := service.New(cfg, str, policy, nil, hash.GenerateCodeAttempt, time.Now, logger)
+	require.NoError(t, err)
+
+	limiter := &ratelimit.Limiter{Store: ratelimit.CreateMemoryStore()}
+	server := NewServer(shortener, tokens, str, limiter, shortenLimit, nil, logger)
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewShortyClient(conn), tokens
+}
+
+func asUser(t *testing.T, tokens *authorization.Tokens, userID string) context.Context {
+	token, err := tokens.Issue(userID)
+	require.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestAuthorization(t *testing.T) {
+	client, tokens := newClient(t)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want codes.Code
+	}{
+		{name: "no token", ctx: context.Background(), want: codes.Unauthenticated},
+		{
+			name: "invalid token",
+			ctx:  metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer nope"),
+			want: codes.Unauthenticated,
+		},
+		{
+			name: "basic auth",
+			ctx:  metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic dXNlcjpwYXNz"),
+			want: codes.Unauthenticated,
+		},
+		{name: "jwt", ctx: asUser(t, tokens, "user"), want: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.ListUserURLs(tt.ctx, &pb.ListUserURLsRequest{})
+			assert.Equal(t, tt.want, status.Code(err))
+		})
+	}
+
+	// Resolving is public, like following a link.
+	_, err := client.Resolve(context.Background(), &pb.ResolveRequest{Code: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestShortenRateLimit(t *testing.T) {
+	client, tokens := newLimitedClient(t, ratelimit.Policy{Rate: 0.001, Burst: 1})
+	ctx := asUser(t, tokens, "user")
+
+	_, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/first"})
+	require.NoError(t, err)
+	var header metadata.MD
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/second"}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.NotEmpty(t, header.Get("retry-after"))
+	_, err = client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.ShortenBatchRequest_Item{
+		{CorrelationId: "1", OriginalUrl: "https://example.com/batch"},
+	}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Other users behind the same IP share its bucket.
+	_, err = client.Shorten(asUser(t, tokens, "other"), &pb.ShortenRequest{Url: "https://example.com/other"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Only calls that create links are limited.
+	_, err = client.ListUserURLs(ctx, &pb.ListUserURLsRequest{})
+	assert.NoError(t, err)
+}
+
+func TestShorten(t *testing.T) {
+	client, tokens := newClient(t)
+	ctx := asUser(t, tokens, "user")
+
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{
+		Url:      "https://example.com/page",
+		Metadata: &pb.LinkMetadata{Title: "Page", Tags: []string{"docs"}},
+	})
+	require.NoError(t, err)
+	assert.Regexp(t, `^http://localhost:8080/\w+$`, resp.GetShortUrl())
+	assert.False(t, resp.GetExisting())
+
+	again, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/page"})
+	require.NoError(t, err)
+	assert.Equal(t, resp.GetShortUrl(), again.GetShortUrl())
+
+	other, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/page", Domain: "go.test"})
+	require.NoError(t, err)
+	assert.Regexp(t, `^https://go.test/\w+$`, other.GetShortUrl())
+
+	tests := []struct {
+		name string
+		req  *pb.ShortenRequest
+		want codes.Code
+	}{
+		{name: "empty url", req: &pb.ShortenRequest{}, want: codes.InvalidArgument},
+		{name: "invalid url", req: &pb.ShortenRequest{Url: "not a url"}, want: codes.InvalidArgument},
+		{
+			name: "unknown domain",
+			req:  &pb.ShortenRequest{Url: "https://example.com", Domain: "other.test"},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "negative max clicks",
+			req:  &pb.ShortenRequest{Url: "https://example.com", MaxClicks: -1},
+			want: codes.InvalidArgument,
+		},
+		{
+			name: "unknown workspace",
+			req:  &pb.ShortenRequest{Url: "https://example.com", WorkspaceId: "missing"},
+			want: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.Shorten(ctx, tt.req)
+			assert.Equal(t, tt.want, status.Code(err), err)
+		})
+	}
+}
+
+func TestLinks(t *testing.T) {
+	client, tokens := newClient(t)
+	ctx := asUser(t, tokens, "user")
+
+	batch, err := client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.ShortenBatchRequest_Item{
+		{CorrelationId: "a", OriginalUrl: "https://example.com/a", Metadata: &pb.LinkMetadata{Tags: []string{"x"}}},
+		{CorrelationId: "b", OriginalUrl: "https://example.com/b", MaxClicks: 5},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.GetItems(), 2)
+	assert.Equal(t, "a", batch.GetItems()[0].GetCorrelationId())
+	code := func(shortURL string) string {
+		return shortURL[len("http://localhost:8080/"):]
+	}
+	a, b := code(batch.GetItems()[0].GetShortUrl()), code(batch.GetItems()[1].GetShortUrl())
+
+	resolved, err := client.Resolve(context.Background(), &pb.ResolveRequest{Code: b})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/b", resolved.GetLink().GetOriginalUrl())
+	assert.Equal(t, int32(5), resolved.GetLink().GetMaxClicks())
+
+	list, err := client.ListUserURLs(ctx, &pb.ListUserURLsRequest{Tag: "X"})
+	require.NoError(t, err)
+	require.Len(t, list.GetLinks(), 1)
+	assert.Equal(t, batch.GetItems()[0].GetShortUrl(), list.GetLinks()[0].GetShortUrl())
+	assert.Equal(t, []string{"x"}, list.GetLinks()[0].GetMetadata().GetTags())
+
+	stats, err := client.Stats(ctx, &pb.StatsRequest{Code: a})
+	require.NoError(t, err)
+	assert.Equal(t, batch.GetItems()[0].GetShortUrl(), stats.GetShortUrl())
+	_, err = client.Stats(asUser(t, tokens, "other"), &pb.StatsRequest{Code: a})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Deleting is done by the time the call returns, others' links are left
+	// alone.
+	_, err = client.DeleteUserURLs(asUser(t, tokens, "other"), &pb.DeleteUserURLsRequest{
+		Codes: []string{b},
+	})
+	require.NoError(t, err)
+	_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Code: b})
+	require.NoError(t, err)
+
+	_, err = client.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{
+		Codes: []string{b},
+	})
+	require.NoError(t, err)
+	_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Code: b})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Protected links can't be resolved, that would skip the password.
+	protected, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://example.com/secret", Password: "secret"})
+	require.NoError(t, err)
+	_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Code: code(protected.GetShortUrl())})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,132 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/grpcapi/pb"
+	"shorty/internal/app/ratelimit"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// publicMethods are served without credentials, like redirects are.
+var publicMethods = map[string]bool{
+	pb.Shorty_Resolve_FullMethodName: true,
+}
+
+// shortenMethods create links, they share the rate limit of the REST
+// routes that do.
+var shortenMethods = map[string]bool{
+	pb.Shorty_Shorten_FullMethodName:      true,
+	pb.Shorty_ShortenBatch_FullMethodName: true,
+}
+
+func withLogging(logger *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logger.Infow("gRPC request",
+			"method", info.FullMethod,
+			"code", status.Code(err).String(),
+			"duration", time.Since(start),
+		)
+		return resp, err
+	}
+}
+
+// withAuthorization accepts the JWTs and API keys of the REST API as bearer
+// tokens in the authorization metadata. A refreshed JWT is sent back in the
+// x-auth-token header. There are no anonymous identities, calls without a
+// valid token are rejected.
+func withAuthorization(
+	tokens *authorization.Tokens,
+	keys authorization.APIKeyStore,
+	logger *zap.SugaredLogger,
+) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if publicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		bearer, ok := bearerToken(ctx)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "bearer token required")
+		}
+		userID, refreshed, err := tokens.BearerIdentity(ctx, bearer, keys)
+		if errors.Is(err, authorization.ErrInvalidCredentials) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		if err != nil {
+			logger.Errorf("failed to check bearer token: %v", err)
+			return nil, status.Error(codes.Internal, internalServerError)
+		}
+		if refreshed != "" {
+			if err := grpc.SetHeader(ctx, metadata.Pairs(authorization.AuthTokenHeader, refreshed)); err != nil {
+				logger.Errorf("failed to send refreshed token: %v", err)
+			}
+		}
+		return handler(context.WithValue(ctx, authorization.UserIDContextKey, userID), req)
+	}
+}
+
+// withShortenRateLimit takes tokens from the buckets of the peer IP and the
+// user in the shorten group, the ones the REST routes that create links
+// take from, so the gRPC listener doesn't bypass their limit. It runs after
+// withAuthorization, which sets the user.
+func withShortenRateLimit(
+	limiter *ratelimit.Limiter,
+	policy ratelimit.Policy,
+	logger *zap.SugaredLogger,
+) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !policy.Enabled() || !shortenMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		userID, _ := ctx.Value(authorization.UserIDContextKey).(string)
+		res := limiter.Take(ctx, "shorten", peerIP(ctx), userID, policy, logger)
+		if res != nil && !res.Allowed {
+			retryAfter := strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds())))
+			if err := grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfter)); err != nil {
+				logger.Errorf("failed to send retry-after: %v", err)
+			}
+			return nil, status.Error(codes.ResourceExhausted, "too many requests")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// peerIP returns the IP address of the client, gRPC is served to backend
+// services directly, without proxies.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func bearerToken(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		scheme, token, ok := strings.Cut(value, " ")
+		token = strings.TrimSpace(token)
+		if ok && strings.EqualFold(scheme, "Bearer") && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
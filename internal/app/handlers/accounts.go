@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"shorty/internal/app/accounts"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func Register(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	tokens *authorization.Tokens,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID, _ := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	var req models.AuthRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	account, err := accounts.Register(ctx, str, userID, req)
+	switch {
+	case errors.Is(err, accounts.ErrInvalidLogin), errors.Is(err, accounts.ErrWeakPassword):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, models.ErrAccountExists):
+		http.Error(writer, "Login is already taken", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to register account: %v", err)
+		return
+	}
+
+	writeAuthResponse(writer, account, http.StatusCreated, tokens, logger)
+}
+
+func Login(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	tokens *authorization.Tokens,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID, _ := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	var req models.AuthRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	account, err := accounts.Login(ctx, str, userID, req)
+	if errors.Is(err, accounts.ErrInvalidCredentials) {
+		http.Error(writer, "Invalid login or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to log in: %v", err)
+		return
+	}
+
+	writeAuthResponse(writer, account, http.StatusOK, tokens, logger)
+}
+
+func Logout(writer http.ResponseWriter, tokens *authorization.Tokens) {
+	tokens.ClearAuthCookie(writer)
+	writer.WriteHeader(http.StatusOK)
+}
+
+func writeAuthResponse(
+	writer http.ResponseWriter,
+	account models.Account,
+	statusCode int,
+	tokens *authorization.Tokens,
+	logger *zap.SugaredLogger,
+) {
+	if err := tokens.SetUserToken(writer, account.ID); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to set auth cookie: %v", err)
+		return
+	}
+
+	writer.Header().Set(contentTypeKey, applicationJSONType)
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(models.AuthResponse{UserID: account.ID, Login: account.Login}); err != nil {
+		logger.Errorf("error encoding auth response: %v", err)
+	}
+}
+
+func GetAPIKeys(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	keys, err := str.UserAPIKeys(ctx, userID)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get api keys: %v", err)
+		return
+	}
+
+	response := make([]models.APIKeyResponse, len(keys))
+	for i, key := range keys {
+		response[i] = models.APIKeyResponse{ID: key.ID, Name: key.Name, CreatedAt: key.CreatedAt, Revoked: key.Revoked}
+	}
+
+	writer.Header().Set(contentTypeKey, applicationJSONType)
+	writer.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		logger.Errorf("error encoding response for api keys: %v", err)
+	}
+}
+
+func CreateAPIKey(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	if !requireAccount(ctx, writer, str, userID, "API keys require a registered account", logger) {
+		return
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, plain, err := accounts.NewAPIKey(userID, req.Name)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to generate api key: %v", err)
+		return
+	}
+	if err := str.CreateAPIKey(ctx, key); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to save api key: %v", err)
+		return
+	}
+
+	writer.Header().Set(contentTypeKey, applicationJSONType)
+	writer.WriteHeader(http.StatusCreated)
+	resp := models.APIKeyResponse{ID: key.ID, Name: key.Name, CreatedAt: key.CreatedAt, Key: plain}
+	if err := json.NewEncoder(writer).Encode(resp); err != nil {
+		logger.Errorf("error encoding response for api key: %v", err)
+	}
+}
+
+func RevokeAPIKey(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	err := str.RevokeAPIKey(ctx, chi.URLParam(request, "id"), userID)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(writer, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to revoke api key: %v", err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
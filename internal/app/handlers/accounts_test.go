@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAccountHandlers(t *testing.T) {
+	configMock := config.Config{
+		BaseAddress: "http://localhost:8080",
+		JWTSecret:   "test-secret",
+		JWTTTL:      time.Hour,
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	tokensMock, err := authorization.NewTokens(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	call := func(
+		handle func(*httptest.ResponseRecorder, *http.Request),
+		method, body, userID string,
+		params ...string,
+	) *httptest.ResponseRecorder {
+		rctx := chi.NewRouteContext()
+		for i := 0; i+1 < len(params); i += 2 {
+			rctx.URLParams.Add(params[i], params[i+1])
+		}
+		request := httptest.NewRequest(method, "/", strings.NewReader(body))
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		request = request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+		writer := httptest.NewRecorder()
+		handle(writer, request)
+		return writer
+	}
+	register := func(w *httptest.ResponseRecorder, r *http.Request) {
+		Register(ctx, w, r, tokensMock, storageMock, loggerMock)
+	}
+	login := func(w *httptest.ResponseRecorder, r *http.Request) {
+		Login(ctx, w, r, tokensMock, storageMock, loggerMock)
+	}
+	shorten := func(w *httptest.ResponseRecorder, r *http.Request) {
+		ShortenLink(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	list := func(w *httptest.ResponseRecorder, r *http.Request) {
+		GetUserURLs(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	createKey := func(w *httptest.ResponseRecorder, r *http.Request) {
+		CreateAPIKey(ctx, w, r, storageMock, loggerMock)
+	}
+	revokeKey := func(w *httptest.ResponseRecorder, r *http.Request) {
+		RevokeAPIKey(ctx, w, r, storageMock, loggerMock)
+	}
+	getKeys := func(w *httptest.ResponseRecorder, r *http.Request) {
+		GetAPIKeys(ctx, w, r, storageMock, loggerMock)
+	}
+	authResponse := func(writer *httptest.ResponseRecorder) models.AuthResponse {
+		var resp models.AuthResponse
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+		return resp
+	}
+
+	credentials := `{"login": "alice", "password": "correct horse"}`
+
+	t.Run("register claims anonymous links", func(t *testing.T) {
+		writer := call(shorten, http.MethodPost, "https://example.com/before-register", "anonymous-1")
+		require.Equal(t, http.StatusCreated, writer.Code)
+
+		writer = call(register, http.MethodPost, `{"login": "alice", "password": "short"}`, "anonymous-1")
+		assert.Equal(t, http.StatusBadRequest, writer.Code)
+		writer = call(register, http.MethodPost, credentials, "anonymous-1")
+		require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+		assert.Equal(t, models.AuthResponse{UserID: "anonymous-1", Login: "alice"}, authResponse(writer))
+		assert.NotEmpty(t, writer.Result().Cookies())
+
+		writer = call(list, http.MethodGet, "", "anonymous-1")
+		require.Equal(t, http.StatusOK, writer.Code)
+		assert.Contains(t, writer.Body.String(), "https://example.com/before-register")
+	})
+
+	t.Run("duplicate login", func(t *testing.T) {
+		writer := call(register, http.MethodPost, `{"login": "Alice", "password": "another one"}`, "anonymous-2")
+		assert.Equal(t, http.StatusConflict, writer.Code)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		writer := call(login, http.MethodPost, `{"login": "alice", "password": "wrong horse"}`, "anonymous-3")
+		assert.Equal(t, http.StatusUnauthorized, writer.Code)
+		assert.Empty(t, writer.Result().Cookies())
+		writer = call(login, http.MethodPost, `{"login": "bob", "password": "correct horse"}`, "anonymous-3")
+		assert.Equal(t, http.StatusUnauthorized, writer.Code)
+	})
+
+	t.Run("login claims anonymous links", func(t *testing.T) {
+		writer := call(shorten, http.MethodPost, "https://example.com/before-login", "anonymous-4")
+		require.Equal(t, http.StatusCreated, writer.Code)
+
+		writer = call(login, http.MethodPost, credentials, "anonymous-4")
+		require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+		assert.Equal(t, "anonymous-1", authResponse(writer).UserID)
+
+		writer = call(list, http.MethodGet, "", "anonymous-1")
+		require.Equal(t, http.StatusOK, writer.Code)
+		assert.Contains(t, writer.Body.String(), "https://example.com/before-login")
+		writer = call(list, http.MethodGet, "", "anonymous-4")
+		assert.Equal(t, http.StatusNoContent, writer.Code)
+	})
+
+	t.Run("revoked api key", func(t *testing.T) {
+		writer := call(createKey, http.MethodPost, `{"name": "ci"}`, "anonymous-5")
+		assert.Equal(t, http.StatusForbidden, writer.Code, "api keys need an account")
+
+		writer = call(createKey, http.MethodPost, `{"name": "ci"}`, "anonymous-1")
+		require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+		var key models.APIKeyResponse
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &key))
+		require.NotEmpty(t, key.Key)
+
+		protected := authorization.WithAuthorization(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			GetUserURLs(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+		}), tokensMock, storageMock, loggerMock)
+		withKey := func() int {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+			request.Header.Set("Authorization", "Bearer "+key.Key)
+			writer := httptest.NewRecorder()
+			protected.ServeHTTP(writer, request)
+			return writer.Code
+		}
+		assert.Equal(t, http.StatusOK, withKey())
+
+		writer = call(revokeKey, http.MethodDelete, "", "anonymous-5", "id", key.ID)
+		assert.Equal(t, http.StatusNotFound, writer.Code, "only the owner can revoke a key")
+		writer = call(revokeKey, http.MethodDelete, "", "anonymous-1", "id", key.ID)
+		require.Equal(t, http.StatusNoContent, writer.Code)
+		assert.Equal(t, http.StatusUnauthorized, withKey())
+
+		writer = call(getKeys, http.MethodGet, "", "anonymous-1")
+		require.Equal(t, http.StatusOK, writer.Code)
+		var keys []models.APIKeyResponse
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &keys))
+		require.Len(t, keys, 1)
+		assert.True(t, keys[0].Revoked)
+		assert.Empty(t, keys[0].Key)
+	})
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"shorty/internal/app/config"
+	"shorty/internal/app/domains"
+	"shorty/internal/app/service"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func GetDomains(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	cfg config.Config,
+	logger *zap.SugaredLogger,
+) {
+	registry, err := domains.NewRegistry(cfg)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to read domains: %v", err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, registry.Domains(), logger)
+}
+
+// linkRef names the link of the {hash} route parameter for the link
+// service, on the domain given by the domain query parameter or the Host
+// header.
+func linkRef(request *http.Request) service.LinkRef {
+	return service.LinkRef{
+		Code:   chi.URLParam(request, "hash"),
+		Domain: request.URL.Query().Get("domain"),
+		Host:   request.Host,
+	}
+}
+
+func writeDomainError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	if errors.Is(err, domains.ErrUnknownDomain) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(writer, internalServerError, http.StatusInternalServerError)
+	logger.Errorf("failed to get domain: %v", err)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDomains(t *testing.T) {
+	configMock := config.Config{
+		BaseAddress: "http://localhost:8080",
+		Domains:     "https://go.brand-a.com,https://go.brand-b.com",
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	shorten := func(target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), authorization.UserIDContextKey, "owner"))
+		writer := httptest.NewRecorder()
+		ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+		return writer
+	}
+	follow := func(target string) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		GetLink(ctx, writer, httptest.NewRequest(http.MethodGet, target, nil), configMock,
+			newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
+		return writer
+	}
+
+	writer := shorten("http://localhost:8080/api/shorten", `{"url": "https://example.com", "domain": "go.brand-a.com"}`)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	var resp models.ShortenResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+	brandA := resp.Result
+	assert.True(t, strings.HasPrefix(brandA, "https://go.brand-a.com/"), brandA)
+
+	// Without a domain the link lives on the one the request was sent to.
+	writer = shorten("http://go.brand-b.com/", "https://example.com")
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	brandB := writer.Body.String()
+	assert.True(t, strings.HasPrefix(brandB, "https://go.brand-b.com/"), brandB)
+
+	hash := path.Base(brandA)
+	assert.Equal(t, hash, path.Base(brandB), "the same code exists on both domains")
+
+	redirects := []struct {
+		target string
+		code   int
+	}{
+		{target: "http://go.brand-a.com/" + hash, code: http.StatusTemporaryRedirect},
+		{target: "http://go.brand-b.com/" + hash, code: http.StatusTemporaryRedirect},
+		{target: "http://localhost:8080/" + hash, code: http.StatusBadRequest},
+	}
+	for _, tt := range redirects {
+		writer = follow(tt.target)
+		assert.Equal(t, tt.code, writer.Code, tt.target)
+	}
+
+	writer = shorten("http://localhost:8080/?domain=go.brand-c.com", "https://example.com")
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	link, err := storageMock.Get(ctx, "go.brand-a.com/"+path.Base(brandA))
+	require.NoError(t, err)
+	assert.Equal(t, "go.brand-a.com", link.Domain)
+
+	writer = httptest.NewRecorder()
+	GetDomains(ctx, writer, httptest.NewRequest(http.MethodGet, "/api/domains", nil), configMock, loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var listed []models.Domain
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &listed))
+	require.Len(t, listed, 3)
+	assert.True(t, listed[0].Primary)
+}
+
+func TestLegacyShortURLs(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "links.json")
+	lines := `{"short_url": "http://localhost:8080/abc1234", "original_url": "https://example.com/a", "user_id": "owner",
+		"variants": [{"id": "v", "destination": "https://example.com/v", "weight": 1}]}` + "\n" +
+		`{"short_url": "https://go.brand-a.com/abc1234", "original_url": "https://example.com/b", "user_id": "owner",
+		"domain": "go.brand-a.com"}` + "\n"
+	lines = strings.ReplaceAll(lines, "\n\t\t", " ")
+	state := `{"edits": [{"short_url": "http://localhost:8080/abc1234", "user_id": "owner",
+		"old_url": "https://example.com/old", "new_url": "https://example.com/a"}],
+		"variant_clicks": {"http://localhost:8080/abc1234#v": 3}}`
+	require.NoError(t, os.WriteFile(filePath, []byte(lines), 0o600))
+	require.NoError(t, os.WriteFile(filePath+".state", []byte(state), 0o600))
+
+	// The base address moved after the links were created.
+	configMock := config.Config{
+		BaseAddress:     "https://sho.rt",
+		Domains:         "https://go.brand-a.com",
+		FileStoragePath: filePath,
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	withHash := func(request *http.Request) *http.Request {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", "abc1234")
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, "owner"))
+	}
+
+	redirects := map[string]string{
+		"https://sho.rt/abc1234":         "https://example.com/v",
+		"https://go.brand-a.com/abc1234": "https://example.com/b",
+	}
+	for target, want := range redirects {
+		writer := httptest.NewRecorder()
+		GetLink(ctx, writer, httptest.NewRequest(http.MethodGet, target, nil), configMock,
+			newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
+		assert.Equal(t, want, writer.Header().Get("Location"), target)
+	}
+
+	writer := httptest.NewRecorder()
+	GetUserURLHistory(ctx, writer, withHash(httptest.NewRequest(http.MethodGet, "https://sho.rt/", nil)),
+		newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var edits []models.LinkEdit
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &edits))
+	require.Len(t, edits, 1)
+	assert.Equal(t, "https://sho.rt/abc1234", edits[0].ShortURL)
+
+	writer = httptest.NewRecorder()
+	GetLinkStats(ctx, writer, withHash(httptest.NewRequest(http.MethodGet, "https://sho.rt/", nil)),
+		newShortener(t, configMock, storageMock, nil), loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var stats models.LinkStats
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &stats))
+	assert.Equal(t, "https://sho.rt/abc1234", stats.ShortURL)
+	require.Len(t, stats.Variants, 1)
+	assert.Equal(t, 4, stats.Variants[0].Clicks, "the old clicks and the new one")
+
+	// The files are migrated in place.
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "://localhost")
+	assert.Contains(t, string(data), `"short_url":"go.brand-a.com/abc1234"`)
+	data, err = os.ReadFile(filePath + ".state")
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "://localhost")
+}
@@ -4,16 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"shorty/internal/app/authorization"
 	"shorty/internal/app/config"
-	"shorty/internal/app/hash"
+	"shorty/internal/app/interstitial"
 	"shorty/internal/app/models"
+	"shorty/internal/app/quota"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/service"
 	"shorty/internal/app/storage"
-	"shorty/internal/app/storage/dbstorage"
+	"shorty/internal/app/urlpolicy"
+	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 )
@@ -27,47 +30,121 @@ func GetLink(
 	writer http.ResponseWriter,
 	request *http.Request,
 	cfg config.Config,
-	str storage.Storage,
+	shortener *service.Shortener,
+	tokens *authorization.Tokens,
+	engine *rules.Engine,
 	logger *zap.SugaredLogger,
 ) {
-	shortURL, err := url.JoinPath(cfg.BaseAddress, request.URL.Path)
-	if err != nil {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("failed to get shortURL: %v", err)
+	link, preview, ok := loadLink(ctx, writer, request, shortener, logger)
+	if !ok {
 		return
 	}
-	link, err := str.Get(ctx, shortURL)
-	if err != nil {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("failed to write response: %v", err)
+
+	if link.PasswordHash != "" && !tokens.Unlocked(request, link.ShortURL) {
+		writeUnlockPrompt(writer, http.StatusOK, shortener, link.ShortURL, "", logger)
 		return
 	}
 
-	if link.OriginalURL == "" {
-		http.Error(writer, "Link not found", http.StatusBadRequest)
+	followLink(ctx, writer, request, link, preview, cfg, shortener, tokens, engine, logger)
+}
+
+// loadLink finds the live link a redirect request points at. A trailing "+"
+// or ?preview=1 asks for the preview page instead of the redirect.
+func loadLink(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) (models.UserURLs, bool, bool) {
+	path, plus := strings.CutSuffix(request.URL.Path, "+")
+	preview, _ := strconv.ParseBool(request.URL.Query().Get("preview"))
+	preview = preview || plus
+
+	link, err := shortener.Lookup(ctx, service.LinkRef{Code: strings.TrimPrefix(path, "/"), Host: request.Host})
+	if err != nil {
+		writeLookupError(writer, err, logger)
+		return models.UserURLs{}, false, false
+	}
+	return link, preview || link.Interstitial, true
+}
+
+// followLink redirects to the destination or renders the preview page, see
+// service.Shortener.Follow.
+func followLink(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	link models.UserURLs,
+	preview bool,
+	cfg config.Config,
+	shortener *service.Shortener,
+	tokens *authorization.Tokens,
+	engine *rules.Engine,
+	logger *zap.SugaredLogger,
+) {
+	visit := service.Visit{Client: engine.Client(request), Query: request.URL.Query(), Preview: preview}
+	if link.StickyVariants {
+		visit.Variant = tokens.Variant(request, link.ShortURL)
+	}
+	result, err := shortener.Follow(ctx, link, visit)
+	if errors.Is(err, service.ErrDestinationBlocked) {
+		logger.Infof("blocked redirect for %s: %v", link.ShortURL, err)
+	}
+	if err != nil {
+		writeLinkError(writer, err, logger)
 		return
 	}
+	if result.Variant != "" {
+		if err := tokens.SetVariantCookie(writer, link.ShortURL, result.Variant, cfg.VariantCookieTTL); err != nil {
+			logger.Errorf("failed to set variant cookie for %s: %v", link.ShortURL, err)
+		}
+	}
 
-	if link.IsDeleted {
-		writer.WriteHeader(http.StatusGone)
+	if preview {
+		link.OriginalURL = result.Destination
+		if link.ShortURL, err = shortener.ShortURL(link.ShortURL); err != nil {
+			http.Error(writer, internalServerError, http.StatusInternalServerError)
+			logger.Errorf("failed to get shortURL for preview: %v", err)
+			return
+		}
+		if err := interstitial.Render(writer, link, result.Flagged); err != nil {
+			http.Error(writer, internalServerError, http.StatusInternalServerError)
+			logger.Errorf("failed to render preview for %s: %v", link.ShortURL, err)
+		}
 		return
 	}
 
-	writer.Header().Set("location", link.OriginalURL)
-	writer.WriteHeader(http.StatusTemporaryRedirect)
+	// A password form is answered with 303 so the browser doesn't post it
+	// to the destination.
+	code := result.Code
+	if request.Method == http.MethodPost {
+		code = http.StatusSeeOther
+	}
+
+	header := writer.Header()
+	switch {
+	case result.Private:
+		header.Set("Cache-Control", "no-store")
+	case cfg.RedirectCacheControl != "":
+		header.Set("Cache-Control", cfg.RedirectCacheControl)
+	}
+	if cfg.RedirectReferrerPolicy != "" {
+		header.Set("Referrer-Policy", cfg.RedirectReferrerPolicy)
+	}
+	header.Set("location", result.Destination)
+	writer.WriteHeader(code)
 }
 
 func ShortenLink(
 	ctx context.Context,
 	writer http.ResponseWriter,
-	request *http.Request, cfg config.Config,
-	str storage.Storage,
+	request *http.Request,
+	shortener *service.Shortener,
 	logger *zap.SugaredLogger,
 ) {
 	var req models.ShortenRequest
-	isJSONRequest := request.RequestURI == "/api/shorten"
-	requestContext := request.Context()
-	userID := requestContext.Value(authorization.UserIDContextKey)
+	isJSONRequest := request.URL.Path == "/api/shorten"
 
 	if isJSONRequest {
 		dec := json.NewDecoder(request.Body)
@@ -86,27 +163,17 @@ func ShortenLink(
 		req.URL = string(body)
 	}
 
-	if req.URL == "" {
-		http.Error(writer, "URL should be provided", http.StatusBadRequest)
-		return
+	if req.Domain == "" {
+		req.Domain = request.URL.Query().Get("domain")
 	}
-
-	shortURL, err := hash.GenerateShortURL(req.URL, cfg.BaseAddress)
+	shortURL, existing, err := shortener.Shorten(ctx, scope(request), request.Host, req)
 	if err != nil {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("failed to generate shortURL: %v", err)
-		return
-	}
-	err = str.Put(ctx, shortURL, req.URL, userID.(string))
-	alreadySaved := errors.Is(err, dbstorage.ErrConflict)
-	if err != nil && !alreadySaved {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("failed to save url: %v", err)
+		writeLinkError(writer, err, logger)
 		return
 	}
 
 	statusCode := http.StatusCreated
-	if alreadySaved {
+	if existing {
 		statusCode = http.StatusConflict
 	}
 
@@ -137,13 +204,9 @@ func ShortenLinkBatch(
 	ctx context.Context,
 	writer http.ResponseWriter,
 	request *http.Request,
-	cfg config.Config,
-	str storage.Storage,
+	shortener *service.Shortener,
 	logger *zap.SugaredLogger,
 ) {
-	requestContext := request.Context()
-	userID := requestContext.Value(authorization.UserIDContextKey)
-
 	var urls models.ShortenBatchRequest
 	dec := json.NewDecoder(request.Body)
 	if err := dec.Decode(&urls); err != nil {
@@ -152,35 +215,17 @@ func ShortenLinkBatch(
 		return
 	}
 
-	userURLs := make([]models.UserURLs, len(urls))
-	for i, u := range urls {
-		shortURL, err := hash.GenerateShortURL(u.OriginalURL, cfg.BaseAddress)
-		if err != nil {
-			http.Error(writer, internalServerError, http.StatusInternalServerError)
-			logger.Errorf("failed to generate shortURL for batch request: %v", err)
-			return
+	for i := range urls {
+		if urls[i].Domain == "" {
+			urls[i].Domain = request.URL.Query().Get("domain")
 		}
-		userURLs[i] = models.UserURLs{OriginalURL: u.OriginalURL, ShortURL: shortURL}
 	}
-
-	err := str.Batch(ctx, userURLs, userID.(string))
+	response, err := shortener.ShortenBatch(ctx, scope(request), request.Host, urls)
 	if err != nil {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("Failed to batch saving: %v", err)
+		writeLinkError(writer, err, logger)
 		return
 	}
 
-	var response models.ShortenBatchResponse
-	for _, u := range urls {
-		shortURL, err := hash.GenerateShortURL(u.OriginalURL, cfg.BaseAddress)
-		if err != nil {
-			http.Error(writer, internalServerError, http.StatusInternalServerError)
-			logger.Errorf("failed to generate shortURL for batch response: %v", err)
-			return
-		}
-		response = append(response, models.ShortenBatchResponseItem{CorrelationID: u.CorrelationID, ShortURL: shortURL})
-	}
-
 	writer.Header().Set(contentTypeKey, applicationJSONType)
 	writer.WriteHeader(http.StatusCreated)
 	enc := json.NewEncoder(writer)
@@ -191,6 +236,112 @@ func ShortenLinkBatch(
 	}
 }
 
+func GetUserQuota(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	usage, err := shortener.Quota(ctx, scope(request).UserID)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get user quota: %v", err)
+		return
+	}
+
+	writer.Header().Set(contentTypeKey, applicationJSONType)
+	writer.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(writer)
+	if err := enc.Encode(usage); err != nil {
+		logger.Errorf("error encoding response for user quota: %v", err)
+		return
+	}
+}
+
+func writePolicyError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	switch {
+	case errors.Is(err, urlpolicy.ErrInvalidURL), errors.Is(err, urlpolicy.ErrSchemeNotAllowed):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, urlpolicy.ErrDomainBlocked), errors.Is(err, urlpolicy.ErrFlagged):
+		http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, urlpolicy.ErrPrivateDestination):
+		http.Error(writer, "Destination on a private network is not allowed", http.StatusUnprocessableEntity)
+	default:
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to validate url: %v", err)
+	}
+}
+
+func writeQuotaError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	switch {
+	case errors.Is(err, quota.ErrBatchTooLarge):
+		http.Error(writer, "Batch size exceeds quota", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, quota.ErrLinksExceeded):
+		http.Error(writer, "Links quota exceeded", http.StatusTooManyRequests)
+	default:
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to check quota: %v", err)
+	}
+}
+
+// writeLookupError answers a request for a link that can't be followed. An
+// unknown link is a bad request, as it always was for the redirect.
+func writeLookupError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	if errors.Is(err, service.ErrLinkNotFound) {
+		http.Error(writer, "Link not found", http.StatusBadRequest)
+		return
+	}
+	writeLinkError(writer, err, logger)
+}
+
+// writeLinkError answers with the status of an error of the link service.
+func writeLinkError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	switch {
+	case errors.Is(err, service.ErrEmptyURL),
+		errors.Is(err, service.ErrNegativeMaxClicks),
+		errors.Is(err, service.ErrPasswordTooLong),
+		errors.Is(err, service.ErrMetadataTooLong),
+		errors.Is(err, service.ErrTooManyTags),
+		errors.Is(err, service.ErrInvalidTag):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrDuplicateRuleID),
+		errors.Is(err, service.ErrInvalidRule),
+		errors.Is(err, service.ErrTooManyRules),
+		errors.Is(err, service.ErrInvalidVariants):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrNothingToUpdate):
+		http.Error(writer, "Nothing to update", http.StatusBadRequest)
+	case errors.Is(err, service.ErrLinkNotFound):
+		http.Error(writer, "Link not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrRuleNotFound):
+		http.Error(writer, "Rule not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrLinkGone):
+		writer.WriteHeader(http.StatusGone)
+	case errors.Is(err, service.ErrLinkExists):
+		http.Error(writer, "Destination already has a short link", http.StatusConflict)
+	case errors.Is(err, service.ErrWorkspaceNotFound):
+		http.Error(writer, "Workspace or member not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrDestinationBlocked):
+		http.Error(writer, "Link destination is blocked", http.StatusForbidden)
+	case errors.Is(err, service.ErrForbidden):
+		http.Error(writer, err.Error(), http.StatusForbidden)
+	case errors.Is(err, service.ErrUnknownDomain):
+		writeDomainError(writer, err, logger)
+	case errors.Is(err, service.ErrBatchTooLarge), errors.Is(err, service.ErrLinksExceeded):
+		writeQuotaError(writer, err, logger)
+	case errors.Is(err, service.ErrInvalidURL),
+		errors.Is(err, service.ErrSchemeNotAllowed),
+		errors.Is(err, service.ErrDomainBlocked),
+		errors.Is(err, service.ErrFlagged),
+		errors.Is(err, service.ErrPrivateDestination):
+		writePolicyError(writer, err, logger)
+	default:
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to handle link request: %v", err)
+	}
+}
+
 func CheckDatabaseConnection(
 	ctx context.Context,
 	writer http.ResponseWriter,
@@ -209,16 +360,14 @@ func GetUserURLs(
 	ctx context.Context,
 	writer http.ResponseWriter,
 	request *http.Request,
-	str storage.Storage,
+	shortener *service.Shortener,
 	logger *zap.SugaredLogger,
 ) {
-	requestContext := request.Context()
-	userID := requestContext.Value(authorization.UserIDContextKey)
-
-	urls, err := str.UserURLs(ctx, userID.(string))
+	query := request.URL.Query()
+	filter := models.URLFilter{Tag: query.Get("tag"), Folder: query.Get("folder")}
+	urls, err := shortener.List(ctx, scope(request), filter)
 	if err != nil {
-		http.Error(writer, internalServerError, http.StatusInternalServerError)
-		logger.Errorf("failed to get user urls from storage: %v", err)
+		writeLinkError(writer, err, logger)
 		return
 	}
 
@@ -241,12 +390,9 @@ func DeleteUserURLs(
 	ctx context.Context,
 	writer http.ResponseWriter,
 	request *http.Request,
-	cfg config.Config,
-	str storage.Storage,
+	shortener *service.Shortener,
 	logger *zap.SugaredLogger,
 ) {
-	requestContext := request.Context()
-	userID := requestContext.Value(authorization.UserIDContextKey)
 	var req models.DeleteUrlsRequest
 
 	dec := json.NewDecoder(request.Body)
@@ -256,37 +402,16 @@ func DeleteUserURLs(
 		return
 	}
 
-	shortURLs := make([]string, len(req))
-	for i, h := range req {
-		shortURL, err := url.JoinPath(cfg.BaseAddress, h)
-		if err != nil {
-			http.Error(writer, internalServerError, http.StatusInternalServerError)
-			logger.Errorf("failed to get shortURL for deleting urls: %v", err)
-			return
-		}
-
-		shortURLs[i] = shortURL
+	err := shortener.DeleteLater(ctx, scope(request), request.Host, request.URL.Query().Get("domain"), req,
+		func(err error) {
+			if err != nil {
+				logger.Errorf("failed to delete URLs: %v", err)
+			}
+		},
+	)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
 	}
-
 	writer.WriteHeader(http.StatusAccepted)
-	go func() {
-		err := deletingUserUrls(ctx, str, shortURLs, userID.(string))
-		if err != nil {
-			http.Error(writer, internalServerError, http.StatusInternalServerError)
-			logger.Errorf("failed to delete URLs: %v", err)
-			return
-		}
-	}()
-}
-
-func deletingUserUrls(ctx context.Context, str storage.Storage, urls []string, userID string) error {
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("deleting was interrupted by context for userID=%s", userID)
-	default:
-		if err := str.DeleteUserURls(ctx, urls, userID); err != nil {
-			return fmt.Errorf("failed to delete user urls with userID=%s: %w", userID, err)
-		}
-		return nil
-	}
 }
@@ -2,15 +2,26 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
 	"shorty/internal/app/authorization"
 	"shorty/internal/app/config"
+	"shorty/internal/app/hash"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
 	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -25,6 +36,10 @@ func TestShortenLink(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to setup storage %v", err)
 	}
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	if err != nil {
+		t.Fatalf("failed to setup url policy: %v", err)
+	}
 	loggerMock := zaptest.NewLogger(t).Sugar()
 
 	tests := []struct {
@@ -46,11 +61,19 @@ func TestShortenLink(t *testing.T) {
 		{
 			name:         "Should handle POST request with correct json body",
 			method:       http.MethodPost,
-			expectedCode: http.StatusCreated,
+			expectedCode: http.StatusBadRequest,
 			contentType:  "application/json",
 			uri:          "/shorten/api",
 			body:         `{"url": "www.google.com"}`,
 		},
+		{
+			name:         "Should reject javascript urls",
+			method:       http.MethodPost,
+			expectedCode: http.StatusBadRequest,
+			contentType:  "text/plain",
+			uri:          "/",
+			body:         "javascript:alert(1)",
+		},
 		{
 			name:         "Should return error for non-POST request",
 			method:       http.MethodGet,
@@ -76,7 +99,10 @@ func TestShortenLink(t *testing.T) {
 			request.Header.Set("Content-Type", tc.contentType)
 			writer := httptest.NewRecorder()
 
-			ShortenLink(context.Background(), writer, request.WithContext(ctx), configMock, storageMock, loggerMock)
+			ShortenLink(
+				context.Background(), writer, request.WithContext(ctx),
+				newShortener(t, configMock, storageMock, policyMock), loggerMock,
+			)
 
 			assert.Equal(t, tc.expectedCode, writer.Code, "Got response code %s; expected %s", writer.Code, tc.expectedCode)
 		})
@@ -94,13 +120,18 @@ func TestGetLink(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to setup storage: %v", err)
 	}
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	if err != nil {
+		t.Fatalf("failed to setup url policy: %v", err)
+	}
 	loggerMock := zaptest.NewLogger(t).Sugar()
 
 	t.Run("Should return error for non-GET request", func(t *testing.T) {
 		request := httptest.NewRequest(http.MethodPost, "/test", nil)
 		writer := httptest.NewRecorder()
 
-		GetLink(context.Background(), writer, request, configMock, storageMock, loggerMock)
+		GetLink(context.Background(), writer, request, configMock,
+			newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
 
 		assert.Equal(
 			t,
@@ -116,7 +147,8 @@ func TestGetLink(t *testing.T) {
 		request := httptest.NewRequest(http.MethodGet, "/not-found", nil)
 		writer := httptest.NewRecorder()
 
-		GetLink(context.Background(), writer, request, configMock, storageMock, loggerMock)
+		GetLink(context.Background(), writer, request, configMock,
+			newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
 
 		assert.Equal(
 			t,
@@ -128,3 +160,342 @@ func TestGetLink(t *testing.T) {
 		)
 	})
 }
+
+func TestGetLinkPreview(t *testing.T) {
+	denylist := filepath.Join(t.TempDir(), "denylist.txt")
+	require.NoError(t, os.WriteFile(denylist, []byte("evil.example\n"), 0o600))
+	configMock := config.Config{BaseAddress: "http://localhost:8080"}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(config.Config{DomainDenylistPath: denylist})
+	require.NoError(t, err)
+	defer policyMock.Close()
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	links := []models.UserURLs{
+		{
+			ShortURL:     "plain",
+			OriginalURL:  "https://example.com/article",
+			LinkMetadata: models.LinkMetadata{Title: "Saved title"},
+			Preview:      &models.LinkPreview{Title: "Fetched <title>"},
+		},
+		{
+			ShortURL:     "always",
+			OriginalURL:  "https://example.com/always",
+			LinkMetadata: models.LinkMetadata{Interstitial: true},
+		},
+		{ShortURL: "flagged", OriginalURL: "https://evil.example/login"},
+	}
+	for _, link := range links {
+		require.NoError(t, storageMock.Put(ctx, link, "owner"))
+	}
+
+	tests := []struct {
+		name         string
+		target       string
+		expectedCode int
+		contains     []string
+		excludes     []string
+	}{
+		{
+			name:         "Should redirect without preview mode",
+			target:       "/plain",
+			expectedCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:         "Should render the preview for a plus suffix",
+			target:       "/plain+",
+			expectedCode: http.StatusOK,
+			contains:     []string{"Fetched &lt;title&gt;", `href="https://example.com/article"`},
+			excludes:     []string{"may be unsafe"},
+		},
+		{
+			name:         "Should render the preview for the query parameter",
+			target:       "/plain?preview=1",
+			expectedCode: http.StatusOK,
+			contains:     []string{"Continue to example.com"},
+		},
+		{
+			name:         "Should always render the preview for interstitial links",
+			target:       "/always",
+			expectedCode: http.StatusOK,
+			contains:     []string{`href="https://example.com/always"`},
+		},
+		{
+			name:         "Should warn about flagged destinations",
+			target:       "/flagged+",
+			expectedCode: http.StatusOK,
+			contains:     []string{"may be unsafe", `href="https://evil.example/login"`},
+		},
+		{
+			name:         "Should not render the preview for missing links",
+			target:       "/missing+",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			writer := httptest.NewRecorder()
+			GetLink(ctx, writer, request, configMock, newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
+
+			require.Equal(t, tt.expectedCode, writer.Code)
+			body := writer.Body.String()
+			for _, want := range tt.contains {
+				assert.Contains(t, body, want)
+			}
+			for _, unwanted := range tt.excludes {
+				assert.NotContains(t, body, unwanted)
+			}
+			if tt.expectedCode == http.StatusOK {
+				assert.Equal(t, "text/html; charset=utf-8", writer.Header().Get("Content-Type"))
+				assert.NotEmpty(t, writer.Header().Get("Content-Security-Policy"))
+			}
+		})
+	}
+}
+
+func TestRedirectOptions(t *testing.T) {
+	configMock := config.Config{
+		BaseAddress:            "http://localhost:8080",
+		RedirectCode:           http.StatusMovedPermanently,
+		RedirectCacheControl:   "public, max-age=60",
+		RedirectReferrerPolicy: "no-referrer",
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	links := []models.UserURLs{
+		{ShortURL: "default", OriginalURL: "https://example.com/default"},
+		{
+			ShortURL:    "campaign",
+			OriginalURL: "https://example.com/landing?lang=en",
+			LinkMetadata: models.LinkMetadata{
+				RedirectCode: http.StatusFound,
+				PassQuery:    true,
+				UTM:          &models.UTMParams{Source: "newsletter"},
+			},
+		},
+		{ShortURL: "limited", OriginalURL: "https://example.com/limited", MaxClicks: 10},
+	}
+	for _, link := range links {
+		require.NoError(t, storageMock.Put(ctx, link, "owner"))
+	}
+
+	tests := []struct {
+		name                 string
+		target               string
+		expectedCode         int
+		expectedLocation     string
+		expectedCacheControl string
+	}{
+		{
+			name:                 "Should use the server defaults",
+			target:               "/default?ref=ignored",
+			expectedCode:         http.StatusMovedPermanently,
+			expectedLocation:     "https://example.com/default",
+			expectedCacheControl: "public, max-age=60",
+		},
+		{
+			name:                 "Should use the link settings",
+			target:               "/campaign?ref=ad",
+			expectedCode:         http.StatusFound,
+			expectedLocation:     "https://example.com/landing?lang=en&ref=ad&utm_source=newsletter",
+			expectedCacheControl: "public, max-age=60",
+		},
+		{
+			name:                 "Should not let limited links be cached",
+			target:               "/limited",
+			expectedCode:         http.StatusMovedPermanently,
+			expectedLocation:     "https://example.com/limited",
+			expectedCacheControl: "no-store",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			GetLink(ctx, writer, request, configMock, newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
+
+			assert.Equal(t, tt.expectedCode, writer.Code)
+			assert.Equal(t, tt.expectedLocation, writer.Header().Get("Location"))
+			assert.Equal(t, tt.expectedCacheControl, writer.Header().Get("Cache-Control"))
+			assert.Equal(t, "no-referrer", writer.Header().Get("Referrer-Policy"))
+		})
+	}
+}
+
+func TestMaxClicks(t *testing.T) {
+	const maxClicks = 5
+	const redirects = 50
+
+	backends := []struct {
+		name string
+		cfg  func(t *testing.T) config.Config
+	}{
+		{
+			name: "map storage",
+			cfg: func(t *testing.T) config.Config {
+				return config.Config{BaseAddress: "http://localhost:8080"}
+			},
+		},
+		{
+			name: "file storage",
+			cfg: func(t *testing.T) config.Config {
+				path := filepath.Join(t.TempDir(), "links.json")
+				return config.Config{BaseAddress: "http://localhost:8080", FileStoragePath: path}
+			},
+		},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			configMock := backend.cfg(t)
+			storageMock, err := storage.NewStorage(configMock)
+			require.NoError(t, err)
+			policyMock, err := urlpolicy.NewPolicy(configMock)
+			require.NoError(t, err)
+			loggerMock := zaptest.NewLogger(t).Sugar()
+			ctx := context.Background()
+
+			shorten := func(body string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+				request = request.WithContext(context.WithValue(request.Context(), authorization.UserIDContextKey, "owner"))
+				writer := httptest.NewRecorder()
+				ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+				return writer
+			}
+			get := func(target string) int {
+				writer := httptest.NewRecorder()
+				GetLink(ctx, writer, httptest.NewRequest(http.MethodGet, target, nil),
+					configMock, newShortener(t, configMock, storageMock, policyMock), nil, nil, loggerMock)
+				return writer.Code
+			}
+
+			writer := shorten(`{"url": "https://example.com/reset", "max_clicks": -1}`)
+			require.Equal(t, http.StatusBadRequest, writer.Code)
+
+			writer = shorten(`{"url": "https://example.com/reset", "max_clicks": 5}`)
+			require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+			var shortened models.ShortenResponse
+			require.NoError(t, json.NewDecoder(writer.Body).Decode(&shortened))
+			target := strings.TrimPrefix(shortened.Result, configMock.BaseAddress)
+
+			codes := map[int]int{}
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for i := 0; i < redirects; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					code := get(target)
+					mu.Lock()
+					codes[code]++
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, map[int]int{
+				http.StatusTemporaryRedirect: maxClicks,
+				http.StatusGone:              redirects - maxClicks,
+			}, codes)
+
+			exhausted := path.Base(shortened.Result)
+			link, err := storageMock.Get(ctx, exhausted)
+			require.NoError(t, err)
+			assert.Equal(t, maxClicks, link.Clicks)
+
+			writer = shorten(`{"url": "https://example.com/reset"}`)
+			require.Equal(t, http.StatusCreated, writer.Code)
+			assert.NotContains(t, writer.Body.String(), target, "an exhausted link must not be handed out again")
+
+			writer = shorten(`{"url": "https://example.com/invite", "max_clicks": 1}`)
+			require.Equal(t, http.StatusCreated, writer.Code)
+			require.NoError(t, json.NewDecoder(writer.Body).Decode(&shortened))
+			target = strings.TrimPrefix(shortened.Result, configMock.BaseAddress)
+			assert.Equal(t, http.StatusOK, get(target+"+"), "the preview reveals the destination and counts")
+			assert.Equal(t, http.StatusGone, get(target))
+
+			if configMock.FileStoragePath != "" {
+				reloaded, err := storage.NewStorage(configMock)
+				require.NoError(t, err)
+				link, err := reloaded.Get(ctx, path.Base(shortened.Result))
+				require.NoError(t, err)
+				assert.Equal(t, 1, link.Clicks, "clicks must survive a restart")
+				link, err = reloaded.Get(ctx, exhausted)
+				require.NoError(t, err)
+				assert.Equal(t, maxClicks, link.Clicks)
+			}
+		})
+	}
+}
+
+func TestShortenLinkQuota(t *testing.T) {
+	configMock := config.Config{
+		BaseAddress:     "http://localhost:8080",
+		MaxLinksPerUser: 2,
+		MaxBatchSize:    2,
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	if err != nil {
+		t.Fatalf("failed to setup storage: %v", err)
+	}
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	if err != nil {
+		t.Fatalf("failed to setup url policy: %v", err)
+	}
+	loggerMock := zaptest.NewLogger(t).Sugar()
+
+	shorten := func(uri, body string) int {
+		request := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(body))
+		ctx := context.WithValue(request.Context(), authorization.UserIDContextKey, "quota-user")
+		writer := httptest.NewRecorder()
+		if uri == "/api/shorten/batch" {
+			ShortenLinkBatch(
+				context.Background(), writer, request.WithContext(ctx),
+				newShortener(t, configMock, storageMock, policyMock), loggerMock,
+			)
+		} else {
+			ShortenLink(
+				context.Background(), writer, request.WithContext(ctx),
+				newShortener(t, configMock, storageMock, policyMock), loggerMock,
+			)
+		}
+		return writer.Code
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, shorten("/api/shorten/batch", `[
+		{"correlation_id": "1", "original_url": "https://a.example.com"},
+		{"correlation_id": "2", "original_url": "https://b.example.com"},
+		{"correlation_id": "3", "original_url": "https://c.example.com"}
+	]`))
+	assert.Equal(t, http.StatusCreated, shorten("/", "https://a.example.com"))
+	assert.Equal(t, http.StatusCreated, shorten("/", "https://b.example.com"))
+	assert.Equal(t, http.StatusTooManyRequests, shorten("/", "https://c.example.com"))
+
+	// Links the user already has don't count again.
+	assert.Equal(t, http.StatusConflict, shorten("/", "https://a.example.com"))
+	assert.Equal(t, http.StatusCreated, shorten("/api/shorten/batch", `[
+		{"correlation_id": "1", "original_url": "https://a.example.com"},
+		{"correlation_id": "2", "original_url": "https://b.example.com"}
+	]`))
+	assert.Equal(t, http.StatusTooManyRequests, shorten("/api/shorten/batch", `[
+		{"correlation_id": "1", "original_url": "https://a.example.com"},
+		{"correlation_id": "2", "original_url": "https://c.example.com"}
+	]`))
+}
+
+func newShortener(
+	t *testing.T,
+	cfg config.Config,
+	str storage.Storage,
+	policy *urlpolicy.Policy,
+) *service.Shortener {
+	shortener, err := service.New(cfg, str, policy, nil, hash.GenerateCodeAttempt, time.Now, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	return shortener
+}
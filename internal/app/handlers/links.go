@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
+
+	"go.uber.org/zap"
+)
+
+func EditUserURL(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	var req models.EditURLRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	link, err := shortener.Edit(ctx, scope(request), linkRef(request), req)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusOK, link, logger)
+}
+
+func GetUserTags(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	tags, err := shortener.Tags(ctx, scope(request))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	if tags == nil {
+		tags = []models.TagCount{}
+	}
+	writeJSON(writer, http.StatusOK, tags, logger)
+}
+
+func GetUserURLHistory(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	edits, err := shortener.History(ctx, scope(request), linkRef(request))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	if edits == nil {
+		edits = []models.LinkEdit{}
+	}
+	writeJSON(writer, http.StatusOK, edits, logger)
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEditUserURL(t *testing.T) {
+	configMock := config.Config{BaseAddress: "http://localhost:8080"}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	withUser := func(request *http.Request, userID, code string) *http.Request {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", code)
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+	}
+	shorten := func(target string) (string, int) {
+		request := withUser(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(target)), "owner", "")
+		writer := httptest.NewRecorder()
+		ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+		return writer.Body.String(), writer.Code
+	}
+	edit := func(userID, code, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+code, strings.NewReader(body))
+		writer := httptest.NewRecorder()
+		shortener := newShortener(t, configMock, storageMock, policyMock)
+		EditUserURL(ctx, writer, withUser(request, userID, code), shortener, loggerMock)
+		return writer
+	}
+
+	shortURL, code := shorten("https://example.com/old")
+	require.Equal(t, http.StatusCreated, code)
+	hash := path.Base(shortURL)
+	_, code = shorten("https://example.com/taken")
+	require.Equal(t, http.StatusCreated, code)
+
+	tests := []struct {
+		name         string
+		userID       string
+		code         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "Should not edit links of other users",
+			userID:       "intruder",
+			code:         hash,
+			body:         `{"original_url": "https://example.com/new"}`,
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "Should require a field to update",
+			userID:       "owner",
+			code:         hash,
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Should validate the new destination",
+			userID:       "owner",
+			code:         hash,
+			body:         `{"original_url": "javascript:alert(1)"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Should reject a destination that already has a link",
+			userID:       "owner",
+			code:         hash,
+			body:         `{"original_url": "https://example.com/taken"}`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "Should repoint the link",
+			userID:       "owner",
+			code:         hash,
+			body:         `{"original_url": "https://example.com/new"}`,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := edit(tt.userID, tt.code, tt.body)
+			assert.Equal(t, tt.expectedCode, writer.Code, writer.Body.String())
+		})
+	}
+
+	link, err := storageMock.Get(ctx, hash)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/new", link.OriginalURL)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+hash+"/history", nil)
+	writer := httptest.NewRecorder()
+	GetUserURLHistory(ctx, writer, withUser(request, "owner", hash),
+		newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var edits []models.LinkEdit
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&edits))
+	require.Len(t, edits, 1)
+	assert.Equal(t, "owner", edits[0].UserID)
+	assert.Equal(t, "https://example.com/old", edits[0].OldURL)
+	assert.Equal(t, "https://example.com/new", edits[0].NewURL)
+
+	writer = httptest.NewRecorder()
+	GetUserURLHistory(ctx, writer, withUser(request, "intruder", hash),
+		newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	reshortened, code := shorten("https://example.com/old")
+	require.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, shortURL, reshortened, "the edited code must not be handed out again")
+	link, err = storageMock.Get(ctx, hash)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/new", link.OriginalURL)
+}
+
+func TestLinkMetadata(t *testing.T) {
+	configMock := config.Config{BaseAddress: "http://localhost:8080"}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	withUser := func(request *http.Request, code string) *http.Request {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", code)
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, "owner"))
+	}
+	list := func(query string) []models.UserURLs {
+		writer := httptest.NewRecorder()
+		request := withUser(httptest.NewRequest(http.MethodGet, "/api/user/urls"+query, nil), "")
+		GetUserURLs(ctx, writer, request, newShortener(t, configMock, storageMock, nil), loggerMock)
+		if writer.Code == http.StatusNoContent {
+			return nil
+		}
+		require.Equal(t, http.StatusOK, writer.Code)
+		var urls []models.UserURLs
+		require.NoError(t, json.NewDecoder(writer.Body).Decode(&urls))
+		return urls
+	}
+
+	body := `{"url": "https://example.com/a", "title": " Launch ", "tags": ["News", "q3"], "folder": "/marketing/"}`
+	request := withUser(httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body)), "")
+	writer := httptest.NewRecorder()
+	ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	var shortened models.ShortenResponse
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&shortened))
+
+	batch := `[{"correlation_id": "1", "original_url": "https://example.com/b", "tags": ["news"]}]`
+	request = withUser(httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(batch)), "")
+	writer = httptest.NewRecorder()
+	ShortenLinkBatch(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+
+	urls := list("?tag=NEWS")
+	assert.Len(t, urls, 2)
+	urls = list("?folder=marketing")
+	require.Len(t, urls, 1)
+	assert.Equal(t, "Launch", urls[0].Title)
+	assert.Equal(t, []string{"news", "q3"}, urls[0].Tags)
+	assert.Empty(t, list("?tag=missing"))
+
+	writer = httptest.NewRecorder()
+	request = withUser(httptest.NewRequest(http.MethodGet, "/api/user/tags", nil), "")
+	GetUserTags(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var tags []models.TagCount
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&tags))
+	assert.Equal(t, []models.TagCount{{Tag: "news", Count: 2}, {Tag: "q3", Count: 1}}, tags)
+
+	hash := path.Base(shortened.Result)
+	patch := `{"tags": ["archive"], "description": "moved"}`
+	request = withUser(httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+hash, strings.NewReader(patch)), hash)
+	writer = httptest.NewRecorder()
+	EditUserURL(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+	var edited models.UserURLs
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&edited))
+	assert.Equal(t, "https://example.com/a", edited.OriginalURL)
+	assert.Equal(t, "Launch", edited.Title, "fields missing from the update must be kept")
+	assert.Equal(t, "moved", edited.Description)
+	assert.Equal(t, []string{"archive"}, edited.Tags)
+	assert.Len(t, list("?tag=archive"), 1)
+}
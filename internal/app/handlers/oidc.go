@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"shorty/internal/app/accounts"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/oidc"
+	"shorty/internal/app/storage"
+
+	"go.uber.org/zap"
+)
+
+func OIDCLogin(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	cfg config.Config,
+	provider *oidc.Provider,
+	logger *zap.SugaredLogger,
+) {
+	flow, err := oidc.NewFlow()
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to start oidc login: %v", err)
+		return
+	}
+
+	target, err := provider.AuthCodeURL(ctx, flow)
+	if err != nil {
+		http.Error(writer, "Identity provider is unavailable", http.StatusBadGateway)
+		logger.Errorf("failed to build oidc authorization url: %v", err)
+		return
+	}
+
+	if err := flow.SetCookie(writer, cfg.CookieSecure); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to set oidc flow cookie: %v", err)
+		return
+	}
+	http.Redirect(writer, request, target, http.StatusFound)
+}
+
+func OIDCCallback(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	cfg config.Config,
+	provider *oidc.Provider,
+	tokens *authorization.Tokens,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID, _ := request.Context().Value(authorization.UserIDContextKey).(string)
+	query := request.URL.Query()
+
+	flow, err := oidc.FlowFromRequest(request)
+	oidc.ClearFlowCookie(writer)
+	if err != nil {
+		http.Error(writer, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		http.Error(writer, "Sign-in was rejected by the identity provider: "+providerError, http.StatusUnauthorized)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		http.Error(writer, "Missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(ctx, code, flow)
+	if err != nil {
+		http.Error(writer, "Failed to redeem authorization code", http.StatusBadGateway)
+		logger.Errorf("failed to exchange oidc code: %v", err)
+		return
+	}
+
+	claims, err := provider.Verify(ctx, rawIDToken, flow.Nonce)
+	if err != nil {
+		http.Error(writer, "Invalid ID token", http.StatusUnauthorized)
+		logger.Warnf("rejected oidc id token: %v", err)
+		return
+	}
+	identity, err := provider.Identity(claims)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	account, err := accounts.LoginExternal(ctx, str, userID, identity.UserID, identity.Login)
+	if errors.Is(err, models.ErrAccountExists) {
+		http.Error(writer, "Login is already taken by another account", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to sign in oidc user: %v", err)
+		return
+	}
+
+	if cfg.OIDCPostLoginURL == "" {
+		writeAuthResponse(writer, account, http.StatusOK, tokens, logger)
+		return
+	}
+	if err := tokens.SetUserToken(writer, account.ID); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to set auth cookie: %v", err)
+		return
+	}
+	http.Redirect(writer, request, cfg.OIDCPostLoginURL, http.StatusFound)
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/oidc"
+	"shorty/internal/app/oidc/oidctest"
+	"shorty/internal/app/storage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	idp := oidctest.NewServer("shorty", "secret")
+	defer idp.Close()
+
+	configMock := config.Config{
+		BaseAddress:      "http://localhost:8080",
+		JWTSecret:        "test-secret",
+		JWTTTL:           time.Hour,
+		OIDCIssuer:       idp.Issuer(),
+		OIDCClientID:     "shorty",
+		OIDCClientSecret: "secret",
+		OIDCScopes:       "openid",
+		OIDCUserClaim:    "sub",
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	tokens, err := authorization.NewTokens(configMock)
+	require.NoError(t, err)
+	provider, err := oidc.NewProvider(configMock, idp.Client())
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+
+	ctx := context.Background()
+	link := models.UserURLs{ShortURL: "abc", OriginalURL: "https://example.com/"}
+	require.NoError(t, storageMock.Put(ctx, link, "anon-1"))
+
+	login := func() (url.Values, []*http.Cookie) {
+		writer := httptest.NewRecorder()
+		OIDCLogin(ctx, writer, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil), configMock, provider, loggerMock)
+		require.Equal(t, http.StatusFound, writer.Code)
+
+		client := idp.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		response, err := client.Get(writer.Header().Get("Location"))
+		require.NoError(t, err)
+		defer response.Body.Close()
+		location, err := url.Parse(response.Header.Get("Location"))
+		require.NoError(t, err)
+		return location.Query(), writer.Result().Cookies()
+	}
+
+	callback := func(query url.Values, cookies []*http.Cookie, userID string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, oidc.CallbackPath+"?"+query.Encode(), nil)
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+		request = request.WithContext(context.WithValue(request.Context(), authorization.UserIDContextKey, userID))
+		writer := httptest.NewRecorder()
+		OIDCCallback(ctx, writer, request, configMock, provider, tokens, storageMock, loggerMock)
+		return writer
+	}
+
+	query, cookies := login()
+	forged := url.Values{"code": {query.Get("code")}, "state": {"forged"}}
+	assert.Equal(t, http.StatusBadRequest, callback(forged, cookies, "anon-1").Code)
+	assert.Equal(t, http.StatusBadRequest, callback(query, nil, "anon-1").Code)
+
+	query, cookies = login()
+	writer := callback(query, cookies, "anon-1")
+	require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+
+	var response models.AuthResponse
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&response))
+	assert.Equal(t, "oidc:user-1", response.Login)
+	assert.NotEqual(t, "anon-1", response.UserID)
+
+	claims, err := tokens.Parse(writer.Header().Get(authorization.AuthTokenHeader))
+	require.NoError(t, err)
+	assert.Equal(t, response.UserID, claims.UserID)
+
+	urls, err := storageMock.UserURLs(ctx, response.UserID, models.URLFilter{})
+	require.NoError(t, err)
+	assert.Len(t, urls, 1, "links of the anonymous session should move to the sso account")
+
+	query, cookies = login()
+	writer = callback(query, cookies, "anon-2")
+	require.Equal(t, http.StatusOK, writer.Code)
+	var second models.AuthResponse
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&second))
+	assert.Equal(t, response.UserID, second.UserID, "the same subject must map to the same user")
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/interstitial"
+	"shorty/internal/app/ratelimit"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/service"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const maxUnlockFormBytes = 4 << 10
+
+// UnlockLink checks the password posted from the prompt of a protected link.
+// Attempts are limited per link, so guessing doesn't get faster by spreading
+// it across clients.
+func UnlockLink(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	cfg config.Config,
+	shortener *service.Shortener,
+	tokens *authorization.Tokens,
+	attempts ratelimit.Store,
+	engine *rules.Engine,
+	logger *zap.SugaredLogger,
+) {
+	link, preview, ok := loadLink(ctx, writer, request, shortener, logger)
+	if !ok {
+		return
+	}
+	if link.PasswordHash == "" {
+		followLink(ctx, writer, request, link, preview, cfg, shortener, tokens, engine, logger)
+		return
+	}
+
+	request.Body = http.MaxBytesReader(writer, request.Body, maxUnlockFormBytes)
+	if err := request.ParseForm(); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	limit := ratelimit.PolicyFromConfig(cfg.UnlockRateLimit)
+	if limit.Enabled() {
+		res, err := attempts.Take(ctx, "unlock:"+link.ShortURL, limit)
+		if err != nil {
+			http.Error(writer, internalServerError, http.StatusInternalServerError)
+			logger.Errorf("failed to count unlock attempts: %v", err)
+			return
+		}
+		if !res.Allowed {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(res.RetryAfter.Seconds())+1))
+			writeUnlockPrompt(writer, http.StatusTooManyRequests, shortener, link.ShortURL,
+				"Too many attempts, try again later.", logger)
+			return
+		}
+	}
+
+	if err := shortener.Unlock(link, request.PostForm.Get("password")); err != nil {
+		writeUnlockPrompt(writer, http.StatusUnauthorized, shortener, link.ShortURL, "Wrong password.", logger)
+		return
+	}
+
+	if err := tokens.SetUnlockCookie(writer, link.ShortURL, cfg.LinkUnlockTTL); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to issue unlock cookie: %v", err)
+		return
+	}
+	followLink(ctx, writer, request, link, preview, cfg, shortener, tokens, engine, logger)
+}
+
+func writeUnlockPrompt(
+	writer http.ResponseWriter,
+	status int,
+	shortener *service.Shortener,
+	key, message string,
+	logger *zap.SugaredLogger,
+) {
+	shortURL, err := shortener.ShortURL(key)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get shortURL for password prompt: %v", err)
+		return
+	}
+	if err := interstitial.RenderUnlock(writer, status, shortURL, message); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to render password prompt for %s: %v", shortURL, err)
+	}
+}
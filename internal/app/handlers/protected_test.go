@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/ratelimit"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestProtectedLink(t *testing.T) {
+	configMock := config.Config{
+		BaseAddress:     "http://localhost:8080",
+		JWTSecret:       "test-secret",
+		JWTTTL:          time.Hour,
+		LinkUnlockTTL:   time.Minute,
+		UnlockRateLimit: config.RateLimit{Rate: 0.001, Burst: 2},
+	}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	tokensMock, err := authorization.NewTokens(configMock)
+	require.NoError(t, err)
+	attemptsMock := ratelimit.CreateMemoryStore()
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	shorten := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		request = request.WithContext(context.WithValue(request.Context(), authorization.UserIDContextKey, "owner"))
+		writer := httptest.NewRecorder()
+		ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+		return writer
+	}
+	get := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+		writer := httptest.NewRecorder()
+		GetLink(ctx, writer, request, configMock,
+			newShortener(t, configMock, storageMock, policyMock), tokensMock, nil, loggerMock)
+		return writer
+	}
+	unlock := func(target, password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}.Encode()
+		request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		writer := httptest.NewRecorder()
+		UnlockLink(ctx, writer, request, configMock,
+			newShortener(t, configMock, storageMock, policyMock), tokensMock, attemptsMock, nil, loggerMock)
+		return writer
+	}
+
+	writer := shorten(`{"url": "https://example.com/secret", "password": "` + strings.Repeat("x", 73) + `"}`)
+	require.Equal(t, http.StatusBadRequest, writer.Code)
+
+	plain := shorten(`{"url": "https://example.com/secret"}`)
+	require.Equal(t, http.StatusCreated, plain.Code)
+	writer = shorten(`{"url": "https://example.com/secret", "password": "open sesame"}`)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	var shortened models.ShortenResponse
+	require.NoError(t, json.NewDecoder(writer.Body).Decode(&shortened))
+	target := strings.TrimPrefix(shortened.Result, configMock.BaseAddress)
+	assert.NotContains(t, plain.Body.String(), target, "an unprotected link must not be reused for a protected one")
+
+	link, err := storageMock.Get(ctx, path.Base(shortened.Result))
+	require.NoError(t, err)
+	assert.NotEmpty(t, link.PasswordHash)
+	assert.NotContains(t, link.PasswordHash, "open sesame")
+
+	writer = shorten(`{"url": "https://example.com/secret"}`)
+	require.Equal(t, http.StatusConflict, writer.Code)
+	assert.Equal(t, plain.Body.String(), writer.Body.String())
+	assert.NotContains(t, writer.Body.String(), target, "re-shortening must not strip the password")
+
+	for _, path := range []string{target, target + "+", target + "?preview=1"} {
+		writer = get(path)
+		assert.Equal(t, http.StatusOK, writer.Code)
+		assert.Contains(t, writer.Body.String(), `name="password"`)
+		assert.NotContains(t, writer.Body.String(), "example.com/secret", "the prompt must not leak the destination")
+	}
+
+	writer = unlock(target, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, writer.Code)
+	assert.Empty(t, writer.Result().Cookies())
+
+	writer = unlock(target, "open sesame")
+	require.Equal(t, http.StatusSeeOther, writer.Code)
+	assert.Equal(t, "https://example.com/secret", writer.Header().Get("Location"))
+	cookies := writer.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	writer = get(target, cookies...)
+	assert.Equal(t, http.StatusTemporaryRedirect, writer.Code)
+	assert.Equal(t, "https://example.com/secret", writer.Header().Get("Location"))
+
+	writer = unlock(target+"+", "open sesame")
+	require.Equal(t, http.StatusTooManyRequests, writer.Code, "attempts are limited per link")
+	assert.NotEmpty(t, writer.Header().Get("Retry-After"))
+	assert.NotContains(t, writer.Body.String(), "example.com/secret")
+}
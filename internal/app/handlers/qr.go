@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"shorty/internal/app/qr"
+	"shorty/internal/app/service"
+
+	"go.uber.org/zap"
+)
+
+// qrMaxAge is how long clients may cache a QR code. The image only depends
+// on the short URL and the options, so it never goes stale while the link
+// lives.
+const qrMaxAge = "86400"
+
+// GetLinkQR renders the QR code of a live short link for anyone. It fails
+// like the redirect for links that can't be followed.
+func GetLinkQR(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	link, err := shortener.Lookup(ctx, linkRef(request))
+	if err != nil {
+		writeLookupError(writer, err, logger)
+		return
+	}
+	shortURL, err := shortener.ShortURL(link.ShortURL)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get shortURL for qr code: %v", err)
+		return
+	}
+
+	writeQR(writer, request, shortURL, "public", logger)
+}
+
+// GetUserURLQR renders the QR code of an owned link, including ones that
+// are deleted or used up, e.g. to reprint a code before re-enabling it.
+func GetUserURLQR(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	link, err := shortener.Owned(ctx, scope(request), linkRef(request))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+
+	writeQR(writer, request, link.ShortURL, "private", logger)
+}
+
+func writeQR(
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortURL, cache string,
+	logger *zap.SugaredLogger,
+) {
+	opts, err := qr.ParseOptions(request.URL.Query())
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	etag := opts.ETag(shortURL)
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Cache-Control", cache+", max-age="+qrMaxAge)
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var image bytes.Buffer
+	if err := qr.Encode(&image, shortURL, opts); err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to render qr code: %v", err)
+		return
+	}
+	writer.Header().Set("Content-Type", opts.ContentType())
+	writer.WriteHeader(http.StatusOK)
+	if _, err := writer.Write(image.Bytes()); err != nil {
+		logger.Errorf("failed to write response: %v", err)
+	}
+}
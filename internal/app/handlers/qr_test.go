@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLinkQR(t *testing.T) {
+	configMock := config.Config{BaseAddress: "http://localhost:8080"}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	shortener := newShortener(t, configMock, storageMock, policyMock)
+
+	withParams := func(request *http.Request, userID, hash string) *http.Request {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("hash", hash)
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+	}
+	request := withParams(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://example.com")), "owner", "")
+	writer := httptest.NewRecorder()
+	ShortenLink(ctx, writer, request, shortener, loggerMock)
+	require.Equal(t, http.StatusCreated, writer.Code)
+	hash := path.Base(writer.Body.String())
+
+	tests := []struct {
+		name        string
+		public      bool
+		userID      string
+		hash        string
+		query       string
+		code        int
+		contentType string
+	}{
+		{name: "public png", public: true, hash: hash, code: http.StatusOK, contentType: "image/png"},
+		{name: "public svg", public: true, hash: hash, query: "?format=svg&level=Q", code: http.StatusOK,
+			contentType: "image/svg+xml"},
+		{name: "public missing", public: true, hash: "missing", code: http.StatusBadRequest},
+		{name: "public invalid", public: true, hash: hash, query: "?size=1", code: http.StatusBadRequest},
+		{name: "owner", userID: "owner", hash: hash, code: http.StatusOK, contentType: "image/png"},
+		{name: "stranger", userID: "stranger", hash: hash, code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := withParams(httptest.NewRequest(http.MethodGet, "/"+tt.query, nil), tt.userID, tt.hash)
+			writer := httptest.NewRecorder()
+			if tt.public {
+				GetLinkQR(ctx, writer, request, shortener, loggerMock)
+			} else {
+				GetUserURLQR(ctx, writer, request, shortener, loggerMock)
+			}
+			require.Equal(t, tt.code, writer.Code, writer.Body.String())
+			if tt.code != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.contentType, writer.Header().Get("Content-Type"))
+			assert.NotEmpty(t, writer.Body.Bytes())
+
+			etag := writer.Header().Get("ETag")
+			require.NotEmpty(t, etag)
+			request.Header.Set("If-None-Match", etag)
+			writer = httptest.NewRecorder()
+			if tt.public {
+				GetLinkQR(ctx, writer, request, shortener, loggerMock)
+			} else {
+				GetUserURLQR(ctx, writer, request, shortener, loggerMock)
+			}
+			assert.Equal(t, http.StatusNotModified, writer.Code)
+			assert.Empty(t, writer.Body.Bytes())
+		})
+	}
+
+	require.NoError(t, storageMock.DeleteUserURls(ctx, []string{hash}, "owner"))
+	request = withParams(httptest.NewRequest(http.MethodGet, "/", nil), "", hash)
+	writer = httptest.NewRecorder()
+	GetLinkQR(ctx, writer, request, shortener, loggerMock)
+	assert.Equal(t, http.StatusGone, writer.Code)
+	request = withParams(httptest.NewRequest(http.MethodGet, "/", nil), "owner", hash)
+	writer = httptest.NewRecorder()
+	GetUserURLQR(ctx, writer, request, shortener, loggerMock)
+	assert.Equal(t, http.StatusOK, writer.Code)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func GetLinkRules(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	linkRules, err := shortener.Rules(ctx, scope(request), linkRef(request))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	if linkRules == nil {
+		linkRules = []models.RedirectRule{}
+	}
+	writeJSON(writer, http.StatusOK, linkRules, logger)
+}
+
+// SetLinkRules replaces all rules of a link, which is also how they are
+// reordered.
+func SetLinkRules(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	var linkRules []models.RedirectRule
+	if err := json.NewDecoder(request.Body).Decode(&linkRules); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	linkRules, err := shortener.SetRules(ctx, scope(request), linkRef(request), linkRules)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	if linkRules == nil {
+		linkRules = []models.RedirectRule{}
+	}
+	writeJSON(writer, http.StatusOK, linkRules, logger)
+}
+
+// AddLinkRule appends a rule, so it is checked after the existing ones.
+func AddLinkRule(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	var rule models.RedirectRule
+	if err := json.NewDecoder(request.Body).Decode(&rule); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := shortener.AddRule(ctx, scope(request), linkRef(request), rule)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, rule, logger)
+}
+
+// UpdateLinkRule replaces a rule in place, keeping its position.
+func UpdateLinkRule(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	var rule models.RedirectRule
+	if err := json.NewDecoder(request.Body).Decode(&rule); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.ID = chi.URLParam(request, "ruleID")
+
+	rule, err := shortener.UpdateRule(ctx, scope(request), linkRef(request), rule)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusOK, rule, logger)
+}
+
+func DeleteLinkRule(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	err := shortener.DeleteRule(ctx, scope(request), linkRef(request), chi.URLParam(request, "ruleID"))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
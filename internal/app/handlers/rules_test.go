@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+type geoMock map[string]string
+
+func (g geoMock) Country(ip net.IP) string {
+	return g[ip.String()]
+}
+
+func TestLinkRules(t *testing.T) {
+	backends := []struct {
+		name     string
+		filePath string
+	}{
+		{name: "map"},
+		{name: "file", filePath: filepath.Join(t.TempDir(), "links.json")},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			configMock := config.Config{
+				BaseAddress:              "http://localhost:8080",
+				FileStoragePath:          backend.filePath,
+				BlockPrivateDestinations: true,
+			}
+			storageMock, err := storage.NewStorage(configMock)
+			require.NoError(t, err)
+			policyMock, err := urlpolicy.NewPolicy(configMock)
+			require.NoError(t, err)
+			engine := rules.NewEngine(geoMock{"192.0.2.1": "DE"}, nil)
+			loggerMock := zaptest.NewLogger(t).Sugar()
+			ctx := context.Background()
+
+			withParams := func(request *http.Request, userID string, params ...string) *http.Request {
+				rctx := chi.NewRouteContext()
+				for i := 0; i+1 < len(params); i += 2 {
+					rctx.URLParams.Add(params[i], params[i+1])
+				}
+				reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+				return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+			}
+			call := func(
+				handle func(*httptest.ResponseRecorder, *http.Request),
+				method, body, userID string,
+				params ...string,
+			) *httptest.ResponseRecorder {
+				request := withParams(httptest.NewRequest(method, "/", strings.NewReader(body)), userID, params...)
+				writer := httptest.NewRecorder()
+				handle(writer, request)
+				return writer
+			}
+			list := func(w *httptest.ResponseRecorder, r *http.Request) {
+				GetLinkRules(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}
+			replace := func(w *httptest.ResponseRecorder, r *http.Request) {
+				SetLinkRules(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}
+			add := func(w *httptest.ResponseRecorder, r *http.Request) {
+				AddLinkRule(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}
+			update := func(w *httptest.ResponseRecorder, r *http.Request) {
+				UpdateLinkRule(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}
+			remove := func(w *httptest.ResponseRecorder, r *http.Request) {
+				DeleteLinkRule(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}
+			follow := func(hash string, headers map[string]string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(http.MethodGet, "/"+hash, nil)
+				request.RemoteAddr = "198.51.100.1:1234"
+				for key, value := range headers {
+					if key == "ip" {
+						request.RemoteAddr = value + ":1234"
+						continue
+					}
+					request.Header.Set(key, value)
+				}
+				writer := httptest.NewRecorder()
+				GetLink(ctx, writer, request, configMock,
+					newShortener(t, configMock, storageMock, policyMock), nil, engine, loggerMock)
+				return writer
+			}
+
+			writer := call(func(w *httptest.ResponseRecorder, r *http.Request) {
+				ShortenLink(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}, http.MethodPost, "https://example.com/default", "owner")
+			require.Equal(t, http.StatusCreated, writer.Code)
+			hash := path.Base(writer.Body.String())
+
+			writer = call(list, http.MethodGet, "", "owner", "hash", hash)
+			require.Equal(t, http.StatusOK, writer.Code)
+			assert.JSONEq(t, `[]`, writer.Body.String())
+
+			writer = call(list, http.MethodGet, "", "stranger", "hash", hash)
+			assert.Equal(t, http.StatusNotFound, writer.Code)
+			writer = call(add, http.MethodPost, `{"destination": "https://example.com/x"}`, "stranger", "hash", hash)
+			assert.Equal(t, http.StatusNotFound, writer.Code)
+
+			invalid := []struct {
+				name string
+				body string
+				code int
+			}{
+				{name: "body", body: `{`, code: http.StatusBadRequest},
+				{name: "os", body: `{"destination": "https://example.com/x", "conditions": {"os": ["beos"]}}`,
+					code: http.StatusBadRequest},
+				{name: "window", body: `{"destination": "https://example.com/x", "conditions": ` +
+					`{"start": "2024-02-01T00:00:00Z", "end": "2024-01-01T00:00:00Z"}}`, code: http.StatusBadRequest},
+				{name: "destination", body: `{"destination": "ftp://example.com/x"}`, code: http.StatusBadRequest},
+				{name: "private destination", body: `{"destination": "http://127.0.0.1/x"}`,
+					code: http.StatusUnprocessableEntity},
+			}
+			for _, tt := range invalid {
+				writer = call(add, http.MethodPost, tt.body, "owner", "hash", hash)
+				assert.Equal(t, tt.code, writer.Code, tt.name)
+			}
+
+			var ios, german, germany, closed models.RedirectRule
+			for _, step := range []struct {
+				dst  *models.RedirectRule
+				body string
+			}{
+				{dst: &ios, body: `{"destination": "https://example.com/ios", "conditions": {"os": ["iOS"]}}`},
+				{dst: &german, body: `{"destination": "https://example.com/de", "conditions": {"languages": ["de"]}}`},
+				{dst: &germany, body: `{"destination": "https://example.com/country", "conditions": {"countries": ["de"]}}`},
+				{dst: &closed, body: `{"destination": "https://example.com/old", "conditions": ` +
+					`{"end": "2000-01-01T00:00:00Z"}}`},
+			} {
+				writer = call(add, http.MethodPost, step.body, "owner", "hash", hash)
+				require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+				require.NoError(t, json.Unmarshal(writer.Body.Bytes(), step.dst))
+				assert.NotEmpty(t, step.dst.ID)
+			}
+			assert.Equal(t, []string{"ios"}, ios.Conditions.OS)
+			assert.Equal(t, []string{"DE"}, germany.Conditions.Countries)
+
+			iPhone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Safari/604.1"
+			redirects := []struct {
+				name    string
+				headers map[string]string
+				want    string
+			}{
+				{name: "no match", want: "https://example.com/default"},
+				{name: "os", headers: map[string]string{"User-Agent": iPhone}, want: "https://example.com/ios"},
+				{name: "language", headers: map[string]string{"Accept-Language": "de-AT,en;q=0.5"},
+					want: "https://example.com/de"},
+				{name: "first match wins", headers: map[string]string{"User-Agent": iPhone, "Accept-Language": "de"},
+					want: "https://example.com/ios"},
+				{name: "country", headers: map[string]string{"ip": "192.0.2.1"}, want: "https://example.com/country"},
+				{name: "secondary language", headers: map[string]string{"Accept-Language": "en,de;q=0.9"},
+					want: "https://example.com/default"},
+			}
+			for _, tt := range redirects {
+				writer = follow(hash, tt.headers)
+				assert.Equal(t, http.StatusTemporaryRedirect, writer.Code, tt.name)
+				assert.Equal(t, tt.want, writer.Header().Get("Location"), tt.name)
+				assert.Equal(t, "no-store", writer.Header().Get("Cache-Control"), tt.name)
+			}
+
+			writer = call(update, http.MethodPut, `{"destination": "https://example.com/apple", "conditions": {"os": ["ios"]}}`,
+				"owner", "hash", hash, "ruleID", ios.ID)
+			require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+			writer = follow(hash, map[string]string{"User-Agent": iPhone})
+			assert.Equal(t, "https://example.com/apple", writer.Header().Get("Location"))
+
+			writer = call(update, http.MethodPut, `{"destination": "https://example.com/x"}`,
+				"owner", "hash", hash, "ruleID", "missing")
+			assert.Equal(t, http.StatusNotFound, writer.Code)
+
+			// Reordering puts the language rule before the OS rule.
+			order := fmt.Sprintf(`[{"id": %q, "destination": "https://example.com/de", "conditions": {"languages": ["de"]}},
+				{"id": %q, "destination": "https://example.com/apple", "conditions": {"os": ["ios"]}}]`, german.ID, ios.ID)
+			writer = call(replace, http.MethodPut, order, "owner", "hash", hash)
+			require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+			writer = follow(hash, map[string]string{"User-Agent": iPhone, "Accept-Language": "de"})
+			assert.Equal(t, "https://example.com/de", writer.Header().Get("Location"))
+			writer = follow(hash, map[string]string{"ip": "192.0.2.1"})
+			assert.Equal(t, "https://example.com/default", writer.Header().Get("Location"))
+
+			duplicate := fmt.Sprintf(`[{"id": %q, "destination": "https://example.com/a"},
+				{"id": %q, "destination": "https://example.com/b"}]`, ios.ID, ios.ID)
+			writer = call(replace, http.MethodPut, duplicate, "owner", "hash", hash)
+			assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+			tooMany := "[" + strings.Repeat(`{"destination": "https://example.com/a"},`, rules.MaxRules) +
+				`{"destination": "https://example.com/a"}]`
+			writer = call(replace, http.MethodPut, tooMany, "owner", "hash", hash)
+			assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+			writer = call(remove, http.MethodDelete, "", "owner", "hash", hash, "ruleID", german.ID)
+			assert.Equal(t, http.StatusNoContent, writer.Code)
+			writer = call(remove, http.MethodDelete, "", "owner", "hash", hash, "ruleID", german.ID)
+			assert.Equal(t, http.StatusNotFound, writer.Code)
+
+			writer = call(list, http.MethodGet, "", "owner", "hash", hash)
+			require.Equal(t, http.StatusOK, writer.Code)
+			var stored []models.RedirectRule
+			require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &stored))
+			require.Len(t, stored, 1)
+			assert.Equal(t, ios.ID, stored[0].ID)
+
+			// The same destination gets a new code instead of sharing the
+			// link and its rules.
+			writer = call(func(w *httptest.ResponseRecorder, r *http.Request) {
+				ShortenLink(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+			}, http.MethodPost, "https://example.com/default", "stranger")
+			require.Equal(t, http.StatusCreated, writer.Code)
+			assert.NotEqual(t, hash, path.Base(writer.Body.String()))
+			// Without its last rule the link would be a second plain link to
+			// the destination.
+			writer = call(remove, http.MethodDelete, "", "owner", "hash", hash, "ruleID", ios.ID)
+			assert.Equal(t, http.StatusConflict, writer.Code)
+
+			if backend.filePath != "" {
+				require.NoError(t, storageMock.Close())
+				reopened, err := storage.NewStorage(configMock)
+				require.NoError(t, err)
+				link, err := reopened.Get(ctx, hash)
+				require.NoError(t, err)
+				require.Len(t, link.Rules, 1)
+				assert.Equal(t, "https://example.com/apple", link.Rules[0].Destination)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
+
+	"go.uber.org/zap"
+)
+
+// SetLinkVariants replaces the weighted destinations of a split link.
+func SetLinkVariants(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	var req models.LinkVariantsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req, err := shortener.SetVariants(ctx, scope(request), linkRef(request), req)
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusOK, req, logger)
+}
+
+func GetLinkStats(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	shortener *service.Shortener,
+	logger *zap.SugaredLogger,
+) {
+	stats, err := shortener.Stats(ctx, scope(request), linkRef(request))
+	if err != nil {
+		writeLinkError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusOK, stats, logger)
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLinkVariants(t *testing.T) {
+	backends := []struct {
+		name     string
+		filePath string
+	}{
+		{name: "map"},
+		{name: "file", filePath: filepath.Join(t.TempDir(), "links.json")},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			configMock := config.Config{
+				BaseAddress:      "http://localhost:8080",
+				FileStoragePath:  backend.filePath,
+				JWTSecret:        "test-secret",
+				JWTTTL:           time.Hour,
+				VariantCookieTTL: time.Hour,
+			}
+			storageMock, err := storage.NewStorage(configMock)
+			require.NoError(t, err)
+			policyMock, err := urlpolicy.NewPolicy(configMock)
+			require.NoError(t, err)
+			tokensMock, err := authorization.NewTokens(configMock)
+			require.NoError(t, err)
+			loggerMock := zaptest.NewLogger(t).Sugar()
+			ctx := context.Background()
+
+			withParams := func(request *http.Request, userID, hash string) *http.Request {
+				rctx := chi.NewRouteContext()
+				rctx.URLParams.Add("hash", hash)
+				reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+				return request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+			}
+			shorten := func(target string) string {
+				request := withParams(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(target)), "owner", "")
+				writer := httptest.NewRecorder()
+				ShortenLink(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+				require.Equal(t, http.StatusCreated, writer.Code)
+				return path.Base(writer.Body.String())
+			}
+			setVariants := func(userID, hash, body string) *httptest.ResponseRecorder {
+				request := withParams(httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body)), userID, hash)
+				writer := httptest.NewRecorder()
+				SetLinkVariants(ctx, writer, request, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+				return writer
+			}
+			stats := func(userID, hash string) (models.LinkStats, int) {
+				request := withParams(httptest.NewRequest(http.MethodGet, "/", nil), userID, hash)
+				writer := httptest.NewRecorder()
+				GetLinkStats(ctx, writer, request, newShortener(t, configMock, storageMock, nil), loggerMock)
+				var result models.LinkStats
+				if writer.Code == http.StatusOK {
+					require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &result))
+				}
+				return result, writer.Code
+			}
+			follow := func(hash string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(http.MethodGet, "/"+hash, nil)
+				for _, cookie := range cookies {
+					request.AddCookie(cookie)
+				}
+				writer := httptest.NewRecorder()
+				GetLink(ctx, writer, request, configMock,
+					newShortener(t, configMock, storageMock, policyMock), tokensMock, nil, loggerMock)
+				return writer
+			}
+			clicks := func(result models.LinkStats) map[string]int {
+				counts := map[string]int{}
+				for _, variant := range result.Variants {
+					counts[variant.ID] = variant.Clicks
+				}
+				return counts
+			}
+
+			hash := shorten("https://example.com/landing")
+
+			invalid := []struct {
+				name string
+				body string
+				code int
+			}{
+				{name: "body", body: `{`, code: http.StatusBadRequest},
+				{name: "all paused", body: `{"variants": [{"destination": "https://example.com/a", "weight": 0}]}`,
+					code: http.StatusBadRequest},
+				{name: "negative weight", body: `{"variants": [{"destination": "https://example.com/a", "weight": -1}]}`,
+					code: http.StatusBadRequest},
+				{name: "destination", body: `{"variants": [{"destination": "ftp://example.com/a", "weight": 1}]}`,
+					code: http.StatusBadRequest},
+			}
+			for _, tt := range invalid {
+				writer := setVariants("owner", hash, tt.body)
+				assert.Equal(t, tt.code, writer.Code, tt.name)
+			}
+			writer := setVariants("stranger", hash, `{"variants": [{"destination": "https://example.com/a", "weight": 1}]}`)
+			assert.Equal(t, http.StatusNotFound, writer.Code)
+			_, code := stats("stranger", hash)
+			assert.Equal(t, http.StatusNotFound, code)
+
+			writer = setVariants("owner", hash, `{"variants": [
+				{"id": "a", "destination": "https://example.com/a", "weight": 1},
+				{"id": "b", "destination": "https://example.com/b", "weight": 1},
+				{"id": "paused", "destination": "https://example.com/paused", "weight": 0}
+			]}`)
+			require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+
+			destinations := map[string]int{}
+			for i := 0; i < 100; i++ {
+				writer = follow(hash)
+				require.Equal(t, http.StatusTemporaryRedirect, writer.Code)
+				assert.Equal(t, "no-store", writer.Header().Get("Cache-Control"))
+				assert.Empty(t, writer.Result().Cookies(), "random splits set no cookie")
+				destinations[writer.Header().Get("Location")]++
+			}
+			assert.Zero(t, destinations["https://example.com/paused"])
+			assert.Zero(t, destinations["https://example.com/landing"])
+			assert.Greater(t, destinations["https://example.com/a"], 0)
+			assert.Greater(t, destinations["https://example.com/b"], 0)
+
+			result, code := stats("owner", hash)
+			require.Equal(t, http.StatusOK, code)
+			counts := clicks(result)
+			assert.Equal(t, destinations["https://example.com/a"], counts["a"])
+			assert.Equal(t, destinations["https://example.com/b"], counts["b"])
+			assert.Zero(t, counts["paused"])
+			require.Len(t, result.Variants, 3)
+			assert.Equal(t, "https://example.com/a", result.Variants[0].Destination)
+
+			// Sticky links remember the first pick, and a paused variant
+			// sends the browser to a new one.
+			writer = setVariants("owner", hash, `{"sticky": true, "variants": [
+				{"id": "a", "destination": "https://example.com/a", "weight": 1},
+				{"id": "b", "destination": "https://example.com/b", "weight": 1}
+			]}`)
+			require.Equal(t, http.StatusOK, writer.Code)
+
+			writer = follow(hash)
+			require.Equal(t, http.StatusTemporaryRedirect, writer.Code)
+			cookies := writer.Result().Cookies()
+			require.Len(t, cookies, 1)
+			first := writer.Header().Get("Location")
+			for i := 0; i < 20; i++ {
+				writer = follow(hash, cookies...)
+				assert.Equal(t, first, writer.Header().Get("Location"))
+			}
+
+			firstID, otherID, other := "a", "b", "https://example.com/b"
+			if first == other {
+				firstID, otherID, other = "b", "a", "https://example.com/a"
+			}
+			writer = setVariants("owner", hash, fmt.Sprintf(`{"sticky": true, "variants": [
+				{"id": %q, "destination": %q, "weight": 0},
+				{"id": %q, "destination": %q, "weight": 1}
+			]}`, firstID, first, otherID, other))
+			require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+			writer = follow(hash, cookies...)
+			assert.Equal(t, other, writer.Header().Get("Location"))
+			assert.Len(t, writer.Result().Cookies(), 1, "the new pick is remembered")
+
+			// Removing a variant drops its clicks.
+			writer = setVariants("owner", hash, `{"variants": [
+				{"id": "b", "destination": "https://example.com/b", "weight": 1}
+			]}`)
+			require.Equal(t, http.StatusOK, writer.Code)
+			result, code = stats("owner", hash)
+			require.Equal(t, http.StatusOK, code)
+			require.Len(t, result.Variants, 1)
+			bClicks := result.Variants[0].Clicks
+			assert.Greater(t, bClicks, 0)
+
+			writer = setVariants("owner", hash, `{"variants": [
+				{"id": "a", "destination": "https://example.com/a", "weight": 1},
+				{"id": "b", "destination": "https://example.com/b", "weight": 1}
+			]}`)
+			require.Equal(t, http.StatusOK, writer.Code)
+			result, _ = stats("owner", hash)
+			assert.Equal(t, map[string]int{"a": 0, "b": bClicks}, clicks(result))
+
+			if backend.filePath != "" {
+				// Clicks are saved in the background and the rest on close.
+				for i := 0; i < 4; i++ {
+					follow(hash)
+				}
+				result, _ = stats("owner", hash)
+				require.NoError(t, storageMock.Close())
+				reopened, err := storage.NewStorage(configMock)
+				require.NoError(t, err)
+				persisted, err := reopened.LinkStats(ctx, hash, "owner", "")
+				require.NoError(t, err)
+				assert.Equal(t, result.Variants, persisted.Variants)
+				storageMock = reopened
+			}
+
+			writer = setVariants("owner", hash, `{"variants": []}`)
+			require.Equal(t, http.StatusOK, writer.Code)
+			writer = follow(hash)
+			assert.Equal(t, "https://example.com/landing", writer.Header().Get("Location"))
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/service"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/workspaces"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func CreateWorkspace(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+	if !requireAccount(ctx, writer, str, userID, "Workspaces require a registered account", logger) {
+		return
+	}
+
+	var req models.CreateWorkspaceRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	workspace, err := workspaces.Create(ctx, str, userID, req.Name)
+	if err != nil {
+		writeWorkspaceError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, workspace, logger)
+}
+
+func GetWorkspaces(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	list, err := str.UserWorkspaces(ctx, userID)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get workspaces: %v", err)
+		return
+	}
+	if list == nil {
+		list = []models.UserWorkspace{}
+	}
+	writeJSON(writer, http.StatusOK, list, logger)
+}
+
+func GetWorkspaceMembers(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+	workspaceID := chi.URLParam(request, "id")
+
+	if _, err := workspaces.Authorize(ctx, str, workspaceID, userID, workspaces.RoleViewer); err != nil {
+		writeWorkspaceError(writer, err, logger)
+		return
+	}
+
+	members, err := str.WorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get workspace members: %v", err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, members, logger)
+}
+
+func SetWorkspaceMemberRole(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	var req models.WorkspaceRoleRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := workspaces.SetRole(ctx, str, chi.URLParam(request, "id"), userID, chi.URLParam(request, "userID"), req.Role)
+	if err != nil {
+		writeWorkspaceError(writer, err, logger)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func RemoveWorkspaceMember(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	err := workspaces.RemoveMember(ctx, str, chi.URLParam(request, "id"), userID, chi.URLParam(request, "userID"))
+	if err != nil {
+		writeWorkspaceError(writer, err, logger)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func CreateWorkspaceInvite(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	cfg config.Config,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+
+	var req models.WorkspaceRoleRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	workspaceID := chi.URLParam(request, "id")
+	invite, token, err := workspaces.Invite(ctx, str, workspaceID, userID, req.Role, cfg.WorkspaceInviteTTL)
+	if err != nil {
+		writeWorkspaceError(writer, err, logger)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, models.WorkspaceInviteResponse{
+		Token:     token,
+		Role:      invite.Role,
+		ExpiresAt: invite.ExpiresAt,
+	}, logger)
+}
+
+func AcceptWorkspaceInvite(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	request *http.Request,
+	str storage.Storage,
+	logger *zap.SugaredLogger,
+) {
+	userID := request.Context().Value(authorization.UserIDContextKey).(string)
+	if !requireAccount(ctx, writer, str, userID, "Workspaces require a registered account", logger) {
+		return
+	}
+
+	var req models.AcceptInviteRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	member, err := workspaces.Accept(ctx, str, req.Token, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(writer, "Invite is invalid, expired or already used", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to accept workspace invite: %v", err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, member, logger)
+}
+
+// workspaceParam returns the workspace a request is scoped to, taken from the
+// /api/workspaces/{id}/... path or the workspace query parameter.
+func workspaceParam(request *http.Request) string {
+	if id := chi.URLParam(request, "id"); id != "" {
+		return id
+	}
+	return request.URL.Query().Get("workspace")
+}
+
+// scope is who a request to the link service is made for.
+func scope(request *http.Request) service.Scope {
+	return service.Scope{
+		UserID:      request.Context().Value(authorization.UserIDContextKey).(string),
+		WorkspaceID: workspaceParam(request),
+	}
+}
+
+func requireAccount(
+	ctx context.Context,
+	writer http.ResponseWriter,
+	str storage.Storage,
+	userID, message string,
+	logger *zap.SugaredLogger,
+) bool {
+	_, err := str.AccountByID(ctx, userID)
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(writer, message, http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to get account: %v", err)
+		return false
+	}
+	return true
+}
+
+func writeWorkspaceError(writer http.ResponseWriter, err error, logger *zap.SugaredLogger) {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		http.Error(writer, "Workspace or member not found", http.StatusNotFound)
+	case errors.Is(err, workspaces.ErrForbidden):
+		http.Error(writer, err.Error(), http.StatusForbidden)
+	case errors.Is(err, workspaces.ErrInvalidRole), errors.Is(err, workspaces.ErrInvalidName):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, workspaces.ErrLastOwner):
+		http.Error(writer, err.Error(), http.StatusConflict)
+	default:
+		http.Error(writer, internalServerError, http.StatusInternalServerError)
+		logger.Errorf("failed to handle workspace request: %v", err)
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, statusCode int, body any, logger *zap.SugaredLogger) {
+	writer.Header().Set(contentTypeKey, applicationJSONType)
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		logger.Errorf("error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"shorty/internal/app/workspaces"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWorkspaceHandlers(t *testing.T) {
+	configMock := config.Config{BaseAddress: "http://localhost:8080", WorkspaceInviteTTL: time.Hour}
+	storageMock, err := storage.NewStorage(configMock)
+	require.NoError(t, err)
+	policyMock, err := urlpolicy.NewPolicy(configMock)
+	require.NoError(t, err)
+	loggerMock := zaptest.NewLogger(t).Sugar()
+	ctx := context.Background()
+
+	for _, id := range []string{"owner", "viewer", "stranger"} {
+		require.NoError(t, storageMock.CreateAccount(ctx, models.Account{ID: id, Login: id, CreatedAt: time.Now()}))
+	}
+
+	call := func(
+		handle func(*httptest.ResponseRecorder, *http.Request),
+		method, body, userID string,
+		params ...string,
+	) *httptest.ResponseRecorder {
+		rctx := chi.NewRouteContext()
+		for i := 0; i+1 < len(params); i += 2 {
+			rctx.URLParams.Add(params[i], params[i+1])
+		}
+		request := httptest.NewRequest(method, "/", strings.NewReader(body))
+		reqCtx := context.WithValue(request.Context(), chi.RouteCtxKey, rctx)
+		request = request.WithContext(context.WithValue(reqCtx, authorization.UserIDContextKey, userID))
+		writer := httptest.NewRecorder()
+		handle(writer, request)
+		return writer
+	}
+	create := func(w *httptest.ResponseRecorder, r *http.Request) {
+		CreateWorkspace(ctx, w, r, storageMock, loggerMock)
+	}
+	members := func(w *httptest.ResponseRecorder, r *http.Request) {
+		GetWorkspaceMembers(ctx, w, r, storageMock, loggerMock)
+	}
+	invite := func(cfg config.Config) func(*httptest.ResponseRecorder, *http.Request) {
+		return func(w *httptest.ResponseRecorder, r *http.Request) {
+			CreateWorkspaceInvite(ctx, w, r, cfg, storageMock, loggerMock)
+		}
+	}
+	accept := func(w *httptest.ResponseRecorder, r *http.Request) {
+		AcceptWorkspaceInvite(ctx, w, r, storageMock, loggerMock)
+	}
+	shorten := func(w *httptest.ResponseRecorder, r *http.Request) {
+		ShortenLink(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	list := func(w *httptest.ResponseRecorder, r *http.Request) {
+		GetUserURLs(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	edit := func(w *httptest.ResponseRecorder, r *http.Request) {
+		EditUserURL(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	remove := func(w *httptest.ResponseRecorder, r *http.Request) {
+		DeleteUserURLs(ctx, w, r, newShortener(t, configMock, storageMock, policyMock), loggerMock)
+	}
+	acceptToken := func(cfg config.Config, workspaceID, userID string) *httptest.ResponseRecorder {
+		writer := call(invite(cfg), http.MethodPost, `{"role": "viewer"}`, "owner", "id", workspaceID)
+		require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+		var created models.WorkspaceInviteResponse
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &created))
+		return call(accept, http.MethodPost, `{"token": "`+created.Token+`"}`, userID)
+	}
+
+	writer := call(create, http.MethodPost, `{"name": "Team"}`, "anonymous")
+	assert.Equal(t, http.StatusForbidden, writer.Code, "workspaces need an account")
+	writer = call(create, http.MethodPost, `{"name": "Team"}`, "owner")
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	var workspace models.UserWorkspace
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &workspace))
+	id := workspace.ID
+
+	t.Run("invites", func(t *testing.T) {
+		writer := call(invite(configMock), http.MethodPost, `{"role": "viewer"}`, "stranger", "id", id)
+		assert.Equal(t, http.StatusNotFound, writer.Code, "only members learn that a workspace exists")
+		writer = call(invite(configMock), http.MethodPost, `{"role": "admin"}`, "owner", "id", id)
+		assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+		expired := configMock
+		expired.WorkspaceInviteTTL = -time.Minute
+		writer = acceptToken(expired, id, "viewer")
+		assert.Equal(t, http.StatusNotFound, writer.Code, "an expired invite can't be accepted")
+		writer = call(members, http.MethodGet, "", "viewer", "id", id)
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+
+		writer = acceptToken(configMock, id, "anonymous")
+		assert.Equal(t, http.StatusForbidden, writer.Code, "accepting needs an account")
+
+		writer = acceptToken(configMock, id, "viewer")
+		require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+		var member models.WorkspaceMember
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &member))
+		assert.Equal(t, workspaces.RoleViewer, member.Role)
+
+		writer = call(members, http.MethodGet, "", "viewer", "id", id)
+		require.Equal(t, http.StatusOK, writer.Code)
+		var list []models.WorkspaceMember
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &list))
+		assert.Len(t, list, 2)
+	})
+
+	writer = call(shorten, http.MethodPost, "https://example.com/team", "owner", "id", id)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	hash := path.Base(writer.Body.String())
+
+	t.Run("viewer", func(t *testing.T) {
+		writer := call(list, http.MethodGet, "", "viewer", "id", id)
+		assert.Equal(t, http.StatusOK, writer.Code)
+		assert.Contains(t, writer.Body.String(), "https://example.com/team")
+
+		writer = call(shorten, http.MethodPost, "https://example.com/viewer", "viewer", "id", id)
+		assert.Equal(t, http.StatusForbidden, writer.Code)
+		writer = call(edit, http.MethodPatch, `{"original_url": "https://example.com/moved"}`, "viewer",
+			"id", id, "hash", hash)
+		assert.Equal(t, http.StatusForbidden, writer.Code)
+		writer = call(remove, http.MethodDelete, `["`+hash+`"]`, "viewer", "id", id)
+		assert.Equal(t, http.StatusForbidden, writer.Code)
+	})
+
+	t.Run("non-member", func(t *testing.T) {
+		writer := call(list, http.MethodGet, "", "stranger", "id", id)
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+		writer = call(edit, http.MethodPatch, `{"original_url": "https://example.com/moved"}`, "stranger",
+			"id", id, "hash", hash)
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+		writer = call(remove, http.MethodDelete, `["`+hash+`"]`, "stranger", "id", id)
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+		writer = call(members, http.MethodGet, "", "stranger", "id", id)
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+	})
+
+	link, err := storageMock.Get(ctx, hash)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/team", link.OriginalURL)
+	assert.False(t, link.IsDeleted)
+}
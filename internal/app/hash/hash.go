@@ -3,18 +3,21 @@ package hash
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"fmt"
-	"net/url"
+	"strconv"
 )
 
-func GenerateShortURL(originalURL string, baseURL string) (string, error) {
+const codeLength = 7
+
+func GenerateCode(originalURL string) string {
 	hash := md5.Sum([]byte(originalURL))
-	hashString := hex.EncodeToString(hash[:])
+	return hex.EncodeToString(hash[:])[:codeLength]
+}
 
-	shortURL, err := url.JoinPath(baseURL, hashString[:7])
-	if err != nil {
-		return "", fmt.Errorf("failed to generate shortURL: %w", err)
+// GenerateCodeAttempt derives an alternative code for retries after the
+// first candidate turned out to be taken. Attempt 0 is GenerateCode.
+func GenerateCodeAttempt(originalURL string, attempt int) string {
+	if attempt == 0 {
+		return GenerateCode(originalURL)
 	}
-
-	return shortURL, nil
+	return GenerateCode(originalURL + "#" + strconv.Itoa(attempt))
 }
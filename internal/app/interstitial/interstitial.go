@@ -0,0 +1,100 @@
+package interstitial
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"shorty/internal/app/models"
+)
+
+//go:embed assets
+var assets embed.FS
+
+var pages = template.Must(template.ParseFS(assets, "assets/*.html"))
+
+var style = func() template.CSS {
+	data, err := assets.ReadFile("assets/preview.css")
+	if err != nil {
+		panic(err)
+	}
+	return template.CSS(data)
+}()
+
+// contentSecurityPolicy only lets the pages load their inline style and the
+// destination's preview image, and post forms back to this server. The pages
+// never run scripts.
+const contentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src http: https:; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+type view struct {
+	Style       template.CSS
+	ShortURL    string
+	Destination string
+	Host        string
+	Title       string
+	Description string
+	Image       string
+	Flagged     bool
+}
+
+type unlockView struct {
+	Style    template.CSS
+	ShortURL string
+	Message  string
+}
+
+// Render writes the preview page for link. Flagged destinations get a
+// warning in place of the usual summary, but the continue button stays.
+func Render(writer http.ResponseWriter, link models.UserURLs, flagged bool) error {
+	v := view{
+		Style:       style,
+		ShortURL:    link.ShortURL,
+		Destination: link.OriginalURL,
+		Title:       link.Title,
+		Description: link.Description,
+		Flagged:     flagged,
+	}
+	if u, err := url.Parse(link.OriginalURL); err == nil {
+		v.Host = u.Hostname()
+	}
+	if link.Preview != nil {
+		if link.Preview.Title != "" {
+			v.Title = link.Preview.Title
+		}
+		if link.Preview.Description != "" {
+			v.Description = link.Preview.Description
+		}
+		v.Image = link.Preview.Image
+	}
+
+	return render(writer, http.StatusOK, "preview.html", v)
+}
+
+// RenderUnlock writes the password prompt of a protected link. It never
+// shows the destination; message explains why a previous attempt failed.
+func RenderUnlock(writer http.ResponseWriter, status int, shortURL, message string) error {
+	return render(writer, status, "unlock.html", unlockView{Style: style, ShortURL: shortURL, Message: message})
+}
+
+func render(writer http.ResponseWriter, status int, name string, data any) error {
+	var body bytes.Buffer
+	if err := pages.ExecuteTemplate(&body, name, data); err != nil {
+		return fmt.Errorf("failed to render %s: %w", name, err)
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Security-Policy", contentSecurityPolicy)
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	if _, err := body.WriteTo(writer); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
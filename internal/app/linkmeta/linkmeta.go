@@ -0,0 +1,118 @@
+package linkmeta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"shorty/internal/app/models"
+	"shorty/internal/app/redirect"
+)
+
+var ErrTooLong = errors.New("metadata field is too long")
+var ErrTooManyTags = errors.New("too many tags")
+var ErrInvalidTag = errors.New("tag must not contain control characters")
+
+const (
+	maxTitleLength       = 255
+	maxDescriptionLength = 1024
+	maxFolderLength      = 255
+	maxTagLength         = 64
+	maxTags              = 20
+	maxUTMLength         = 255
+)
+
+// Normalize trims all fields, lowercases and deduplicates tags and strips
+// surrounding slashes from the folder, so "/Work/" and "work" only differ
+// in case.
+func Normalize(meta models.LinkMetadata) (models.LinkMetadata, error) {
+	meta.Title = strings.TrimSpace(meta.Title)
+	if utf8.RuneCountInString(meta.Title) > maxTitleLength {
+		return meta, fmt.Errorf("title: %w", ErrTooLong)
+	}
+	meta.Description = strings.TrimSpace(meta.Description)
+	if utf8.RuneCountInString(meta.Description) > maxDescriptionLength {
+		return meta, fmt.Errorf("description: %w", ErrTooLong)
+	}
+	meta.Folder = strings.Trim(strings.TrimSpace(meta.Folder), "/")
+	if utf8.RuneCountInString(meta.Folder) > maxFolderLength {
+		return meta, fmt.Errorf("folder: %w", ErrTooLong)
+	}
+
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range meta.Tags {
+		tag = Tag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+			return meta, ErrInvalidTag
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return meta, fmt.Errorf("tag %q: %w", tag, ErrTooLong)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return meta, ErrTooManyTags
+	}
+	meta.Tags = tags
+
+	if meta.RedirectCode != 0 && !redirect.ValidCode(meta.RedirectCode) {
+		return meta, redirect.ErrInvalidCode
+	}
+
+	if meta.UTM != nil {
+		utm := *meta.UTM
+		for _, field := range []*string{&utm.Source, &utm.Medium, &utm.Campaign, &utm.Term, &utm.Content} {
+			*field = strings.TrimSpace(*field)
+			if utf8.RuneCountInString(*field) > maxUTMLength {
+				return meta, fmt.Errorf("utm: %w", ErrTooLong)
+			}
+		}
+		meta.UTM = &utm
+		if utm == (models.UTMParams{}) {
+			meta.UTM = nil
+		}
+	}
+
+	return meta, nil
+}
+
+// Tag returns the stored form of a tag, also used for filtering.
+func Tag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Merge applies the fields set in an update request on top of meta.
+func Merge(meta models.LinkMetadata, req models.EditURLRequest) models.LinkMetadata {
+	if req.Title != nil {
+		meta.Title = *req.Title
+	}
+	if req.Description != nil {
+		meta.Description = *req.Description
+	}
+	if req.Tags != nil {
+		meta.Tags = *req.Tags
+	}
+	if req.Folder != nil {
+		meta.Folder = *req.Folder
+	}
+	if req.Interstitial != nil {
+		meta.Interstitial = *req.Interstitial
+	}
+	if req.RedirectCode != nil {
+		meta.RedirectCode = *req.RedirectCode
+	}
+	if req.PassQuery != nil {
+		meta.PassQuery = *req.PassQuery
+	}
+	if req.UTM != nil {
+		meta.UTM = req.UTM
+	}
+	return meta
+}
@@ -0,0 +1,90 @@
+package linkmeta
+
+import (
+	"strings"
+	"testing"
+
+	"shorty/internal/app/models"
+	"shorty/internal/app/redirect"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	tooManyTags := make([]string, maxTags+1)
+	for i := range tooManyTags {
+		tooManyTags[i] = strings.Repeat("t", i+1)
+	}
+
+	tests := []struct {
+		name    string
+		meta    models.LinkMetadata
+		want    models.LinkMetadata
+		wantErr error
+	}{
+		{
+			name: "Should trim fields and normalise tags and folder",
+			meta: models.LinkMetadata{
+				Title:  "  Launch  ",
+				Tags:   []string{" News", "news", "", "Q3 "},
+				Folder: " /Marketing/Campaigns/ ",
+			},
+			want: models.LinkMetadata{
+				Title:  "Launch",
+				Tags:   []string{"news", "q3"},
+				Folder: "Marketing/Campaigns",
+			},
+		},
+		{
+			name:    "Should reject long titles",
+			meta:    models.LinkMetadata{Title: strings.Repeat("a", maxTitleLength+1)},
+			wantErr: ErrTooLong,
+		},
+		{
+			name:    "Should reject long tags",
+			meta:    models.LinkMetadata{Tags: []string{strings.Repeat("a", maxTagLength+1)}},
+			wantErr: ErrTooLong,
+		},
+		{
+			name:    "Should reject control characters in tags",
+			meta:    models.LinkMetadata{Tags: []string{"new\nline"}},
+			wantErr: ErrInvalidTag,
+		},
+		{
+			name:    "Should limit the number of tags",
+			meta:    models.LinkMetadata{Tags: tooManyTags},
+			wantErr: ErrTooManyTags,
+		},
+		{
+			name:    "Should reject unsupported redirect codes",
+			meta:    models.LinkMetadata{RedirectCode: 303},
+			wantErr: redirect.ErrInvalidCode,
+		},
+		{
+			name: "Should trim UTM parameters and drop empty ones",
+			meta: models.LinkMetadata{RedirectCode: 308, UTM: &models.UTMParams{Source: " mail "}},
+			want: models.LinkMetadata{RedirectCode: 308, UTM: &models.UTMParams{Source: "mail"}},
+		},
+		{
+			name: "Should drop blank UTM parameters",
+			meta: models.LinkMetadata{UTM: &models.UTMParams{Medium: "  "}},
+			want: models.LinkMetadata{},
+		},
+		{
+			name:    "Should reject long UTM parameters",
+			meta:    models.LinkMetadata{UTM: &models.UTMParams{Term: strings.Repeat("a", maxUTMLength+1)}},
+			wantErr: ErrTooLong,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.meta)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
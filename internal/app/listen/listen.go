@@ -0,0 +1,75 @@
+package listen
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"shorty/internal/app/config"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var ErrHTTP3WithoutTLS = errors.New("HTTP/3 requires TLS")
+
+// NewServer configures the TCP server on the server address. tlsConfig is
+// nil for plain HTTP, which speaks HTTP/1.1 and, with h2c on, cleartext
+// HTTP/2. Over TLS HTTP/2 is negotiated unless it is turned off.
+func NewServer(cfg config.Config, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:              cfg.ServerAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+	}
+
+	switch {
+	case tlsConfig != nil && !cfg.HTTP2:
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = without(tlsConfig.NextProtos, http2.NextProtoTLS)
+		// A non-nil empty map turns the built-in HTTP/2 support off.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case tlsConfig == nil && cfg.H2C:
+		server.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	server.TLSConfig = tlsConfig
+	return server
+}
+
+func without(protos []string, proto string) []string {
+	var kept []string
+	for _, p := range protos {
+		if p != proto {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// NewHTTP3Server configures the QUIC listener on the HTTP/3 address. It
+// shares the certificates of the TCP server.
+func NewHTTP3Server(cfg config.Config, handler http.Handler, tlsConfig *tls.Config) (*http3.Server, error) {
+	if tlsConfig == nil {
+		return nil, ErrHTTP3WithoutTLS
+	}
+	return &http3.Server{
+		Addr:       cfg.HTTP3Address,
+		Handler:    handler,
+		TLSConfig:  tlsConfig,
+		QuicConfig: &quic.Config{MaxIdleTimeout: cfg.IdleTimeout},
+	}, nil
+}
+
+// WithAltSvc advertises the HTTP/3 listener on TCP responses, which is how
+// browsers find out they can switch to it.
+func WithAltSvc(h http.Handler, server *http3.Server) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// Fails only until the listener is up, there's nothing to announce
+		// then.
+		_ = server.SetQuicHeaders(writer.Header())
+		h.ServeHTTP(writer, request)
+	})
+}
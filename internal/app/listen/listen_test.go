@@ -0,0 +1,173 @@
+package listen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"shorty/internal/app/config"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// testTLS returns a server config with a self-signed certificate for
+// localhost and a client config trusting it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: roots}
+}
+
+var protoHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	_, _ = io.WriteString(writer, request.Proto)
+})
+
+// serve starts server on a local port and returns its address.
+func serve(t *testing.T, server *http.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		if server.TLSConfig != nil {
+			_ = server.ServeTLS(listener, "", "")
+			return
+		}
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+	return listener.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url string) (string, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return string(body), nil
+}
+
+func TestNewServer(t *testing.T) {
+	cfg := config.Config{
+		ServerAddress:     "localhost:8080",
+		ReadHeaderTimeout: time.Second,
+		IdleTimeout:       time.Minute,
+		WriteTimeout:      2 * time.Second,
+	}
+	server := NewServer(cfg, protoHandler, nil)
+	assert.Equal(t, "localhost:8080", server.Addr)
+	assert.Equal(t, time.Second, server.ReadHeaderTimeout)
+	assert.Equal(t, time.Minute, server.IdleTimeout)
+	assert.Equal(t, 2*time.Second, server.WriteTimeout)
+}
+
+func TestHTTP2(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tests := []struct {
+		name  string
+		http2 bool
+		want  string
+	}{
+		{name: "on", http2: true, want: "HTTP/2.0"},
+		{name: "off", want: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := serve(t, NewServer(config.Config{HTTP2: tt.http2}, protoHandler, serverTLS))
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS, ForceAttemptHTTP2: true}}
+			proto, err := get(t, client, "https://"+address)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, proto)
+		})
+	}
+	assert.Nil(t, serverTLS.NextProtos, "the shared config is left alone")
+}
+
+func TestH2C(t *testing.T) {
+	// A prior knowledge client, like a load balancer configured for h2c.
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	address := serve(t, NewServer(config.Config{H2C: true}, protoHandler, nil))
+	proto, err := get(t, client, "http://"+address)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", proto)
+	proto, err = get(t, http.DefaultClient, "http://"+address)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", proto, "HTTP/1.1 clients are still served")
+
+	address = serve(t, NewServer(config.Config{}, protoHandler, nil))
+	_, err = get(t, client, "http://"+address)
+	assert.Error(t, err)
+}
+
+func TestHTTP3(t *testing.T) {
+	_, err := NewHTTP3Server(config.Config{HTTP3Address: "127.0.0.1:0"}, protoHandler, nil)
+	assert.ErrorIs(t, err, ErrHTTP3WithoutTLS)
+
+	serverTLS, clientTLS := testTLS(t)
+	server, err := NewHTTP3Server(config.Config{IdleTimeout: time.Minute}, protoHandler, serverTLS)
+	require.NoError(t, err)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Logf("http3 server stopped: %v", err)
+		}
+	}()
+	defer server.Close()
+
+	transport := &http3.RoundTripper{TLSClientConfig: clientTLS}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	var proto string
+	require.Eventually(t, func() bool {
+		proto, err = get(t, client, "https://"+conn.LocalAddr().String())
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "HTTP/3.0", proto)
+
+	// The TCP listener announces the QUIC one.
+	serverTLS, clientTLS = testTLS(t)
+	address := serve(t, NewServer(config.Config{HTTP2: true}, WithAltSvc(protoHandler, server), serverTLS))
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	response, err := client.Get("https://" + address)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+	assert.Contains(t, response.Header.Get("Alt-Svc"), `h3=":`+port+`"`)
+}
@@ -0,0 +1,190 @@
+package metafetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/urlpolicy"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+)
+
+var ErrNotHTML = errors.New("destination is not an html page")
+var ErrBadStatus = errors.New("destination returned an error status")
+
+const queueSize = 1024
+const maxRedirects = 3
+const userAgent = "shorty-metafetch/1.0"
+
+type Store interface {
+	SetLinkPreview(ctx context.Context, shortURL, originalURL string, preview models.LinkPreview) error
+}
+
+type job struct {
+	shortURL    string
+	originalURL string
+}
+
+// Fetcher fills in link previews in the background. A nil *Fetcher is valid
+// and ignores all links, which is what handlers get when fetching is off.
+type Fetcher struct {
+	client   *http.Client
+	str      Store
+	logger   *zap.SugaredLogger
+	timeout  time.Duration
+	maxBytes int64
+	jobs     chan job
+	wg       sync.WaitGroup
+	mu       sync.RWMutex
+	closed   bool
+}
+
+func NewFetcher(cfg config.Config, str Store, logger *zap.SugaredLogger) *Fetcher {
+	f := &Fetcher{
+		client:   newClient(cfg.BlockPrivateDestinations),
+		str:      str,
+		logger:   logger,
+		timeout:  cfg.FetchTimeout,
+		maxBytes: int64(cfg.FetchMaxBytes),
+		jobs:     make(chan job, queueSize),
+	}
+
+	workers := cfg.FetchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	f.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go f.work()
+	}
+	return f
+}
+
+// Enqueue schedules a fetch without blocking; links are dropped when the
+// queue is full, they only miss their preview.
+func (f *Fetcher) Enqueue(shortURL, originalURL string) {
+	if f == nil {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return
+	}
+	select {
+	case f.jobs <- job{shortURL: shortURL, originalURL: originalURL}:
+	default:
+		f.logger.Infof("metadata fetch queue is full, skipping %s", shortURL)
+	}
+}
+
+// Close stops accepting links and waits for queued fetches to finish.
+func (f *Fetcher) Close() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.jobs)
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return nil
+}
+
+func (f *Fetcher) work() {
+	defer f.wg.Done()
+	for j := range f.jobs {
+		ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+		preview, err := f.Fetch(ctx, j.originalURL)
+		if err != nil {
+			f.logger.Infof("failed to fetch metadata of %s: %v", j.originalURL, err)
+		} else if err := f.str.SetLinkPreview(ctx, j.shortURL, j.originalURL, preview); err != nil {
+			f.logger.Errorf("failed to save metadata of %s: %v", j.shortURL, err)
+		}
+		cancel()
+	}
+}
+
+// Fetch downloads at most maxBytes of the page and extracts its preview.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (models.LinkPreview, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return models.LinkPreview{}, fmt.Errorf("failed to build request: %w", err)
+	}
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		return models.LinkPreview{}, fmt.Errorf("failed to get page: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return models.LinkPreview{}, fmt.Errorf("%w: %s", ErrBadStatus, response.Status)
+	}
+	contentType := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return models.LinkPreview{}, fmt.Errorf("%w: %q", ErrNotHTML, contentType)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(response.Body, f.maxBytes), contentType)
+	if err != nil {
+		return models.LinkPreview{}, fmt.Errorf("failed to decode page: %w", err)
+	}
+	preview := parse(body, response.Request.URL)
+	preview.FetchedAt = time.Now().UTC()
+	return preview, nil
+}
+
+// newClient refuses to connect to non-public addresses at dial time, after
+// DNS resolution, so neither redirects nor rebinding reach internal hosts.
+func newClient(blockPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if blockPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("failed to parse address: %w", err)
+			}
+			if ip := net.ParseIP(host); ip == nil || !urlpolicy.IsPublicIP(ip) {
+				return fmt.Errorf("%w: %s", urlpolicy.ErrPrivateDestination, host)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s is not allowed", request.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package metafetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage/mapstorage"
+	"shorty/internal/app/urlpolicy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const maxBytes = 4096
+
+func newDestination(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	page := func(contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+	mux.Handle("/og", page("text/html; charset=utf-8", `<!doctype html><html><head>
+		<title>Plain title</title>
+		<meta property="og:title" content="OG title">
+		<meta property="og:description" content="  OG
+			description ">
+		<meta property="og:image" content="https://cdn.example.com/a.png">
+		</head><body><title>ignored</title></body></html>`))
+	mux.Handle("/title", page("text/html", `<html><head><title> Only
+		title </title><meta name="description" content="Meta description">
+		<meta property="og:image" content="/img/b.png"></head></html>`))
+	mux.Handle("/latin1", page("text/html; charset=iso-8859-1", "<title>Caf\xe9</title>"))
+	mux.Handle("/large", page("text/html", "<html><head>"+strings.Repeat(" ", maxBytes)+"<title>late</title>"))
+	mux.Handle("/json", page("application/json", `{"title": "not html"}`))
+	mux.Handle("/redirect", http.RedirectHandler("/og", http.StatusFound))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testConfig(blockPrivate bool) config.Config {
+	return config.Config{
+		BlockPrivateDestinations: blockPrivate,
+		FetchWorkers:             2,
+		FetchTimeout:             time.Second,
+		FetchMaxBytes:            maxBytes,
+	}
+}
+
+func TestFetch(t *testing.T) {
+	server := newDestination(t)
+	fetcher := NewFetcher(testConfig(false), nil, zaptest.NewLogger(t).Sugar())
+	defer fetcher.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		want    models.LinkPreview
+		wantErr error
+	}{
+		{
+			name: "Should prefer Open Graph tags",
+			path: "/og",
+			want: models.LinkPreview{
+				Title:       "OG title",
+				Description: "OG description",
+				Image:       "https://cdn.example.com/a.png",
+			},
+		},
+		{
+			name: "Should fall back to title and description and resolve the image",
+			path: "/title",
+			want: models.LinkPreview{
+				Title:       "Only title",
+				Description: "Meta description",
+				Image:       server.URL + "/img/b.png",
+			},
+		},
+		{
+			name: "Should decode the declared charset",
+			path: "/latin1",
+			want: models.LinkPreview{Title: "Café"},
+		},
+		{
+			name: "Should stop reading at the size limit",
+			path: "/large",
+			want: models.LinkPreview{},
+		},
+		{
+			name: "Should follow redirects",
+			path: "/redirect",
+			want: models.LinkPreview{
+				Title:       "OG title",
+				Description: "OG description",
+				Image:       "https://cdn.example.com/a.png",
+			},
+		},
+		{
+			name:    "Should skip non-html destinations",
+			path:    "/json",
+			wantErr: ErrNotHTML,
+		},
+		{
+			name:    "Should fail on error statuses",
+			path:    "/missing",
+			wantErr: ErrBadStatus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetcher.Fetch(context.Background(), server.URL+tt.path)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.False(t, got.FetchedAt.IsZero())
+			got.FetchedAt = time.Time{}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFetchBlocksPrivateDestinations(t *testing.T) {
+	server := newDestination(t)
+	fetcher := NewFetcher(testConfig(true), nil, zaptest.NewLogger(t).Sugar())
+	defer fetcher.Close()
+
+	_, err := fetcher.Fetch(context.Background(), server.URL+"/og")
+	assert.ErrorIs(t, err, urlpolicy.ErrPrivateDestination)
+}
+
+func TestFetcherStoresPreview(t *testing.T) {
+	ctx := context.Background()
+	server := newDestination(t)
+	str, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+
+	fresh := models.UserURLs{ShortURL: "http://localhost:8080/aaa", OriginalURL: server.URL + "/og"}
+	require.NoError(t, str.Put(ctx, fresh, "user"))
+	stale := models.UserURLs{ShortURL: "http://localhost:8080/bbb", OriginalURL: server.URL + "/other"}
+	require.NoError(t, str.Put(ctx, stale, "user"))
+
+	fetcher := NewFetcher(testConfig(false), str, zaptest.NewLogger(t).Sugar())
+	fetcher.Enqueue(fresh.ShortURL, fresh.OriginalURL)
+	fetcher.Enqueue(stale.ShortURL, server.URL+"/title")
+	require.NoError(t, fetcher.Close())
+	fetcher.Enqueue(fresh.ShortURL, fresh.OriginalURL)
+
+	link, err := str.Get(ctx, fresh.ShortURL)
+	require.NoError(t, err)
+	require.NotNil(t, link.Preview)
+	assert.Equal(t, "OG title", link.Preview.Title)
+
+	link, err = str.Get(ctx, stale.ShortURL)
+	require.NoError(t, err)
+	assert.Nil(t, link.Preview, "a preview of a previous destination must not be stored")
+
+	var nilFetcher *Fetcher
+	nilFetcher.Enqueue(fresh.ShortURL, fresh.OriginalURL)
+	assert.NoError(t, nilFetcher.Close())
+}
@@ -0,0 +1,125 @@
+package metafetch
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"shorty/internal/app/models"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxTitleLength       = 255
+	maxDescriptionLength = 1024
+	maxImageLength       = 1024
+)
+
+// parse reads the document head. Open Graph values win over <title> and the
+// plain description meta tag.
+func parse(body io.Reader, base *url.URL) models.LinkPreview {
+	var title, ogTitle, description, ogDescription, image string
+
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return preview(first(ogTitle, title), first(ogDescription, description), image, base)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = title == ""
+			case atom.Meta:
+				key, content := metaTag(token)
+				switch key {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDescription = content
+				case "og:image", "og:image:url":
+					if image == "" {
+						image = content
+					}
+				case "description":
+					description = content
+				}
+			case atom.Body:
+				return preview(first(ogTitle, title), first(ogDescription, description), image, base)
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom == atom.Title {
+				inTitle = false
+			}
+			if token.DataAtom == atom.Head {
+				return preview(first(ogTitle, title), first(ogDescription, description), image, base)
+			}
+		}
+	}
+}
+
+func metaTag(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(strings.TrimSpace(attr.Val))
+			}
+		case "content":
+			content = attr.Val
+		}
+	}
+	return key, content
+}
+
+func preview(title, description, image string, base *url.URL) models.LinkPreview {
+	return models.LinkPreview{
+		Title:       clean(title, maxTitleLength),
+		Description: clean(description, maxDescriptionLength),
+		Image:       resolveImage(image, base),
+	}
+}
+
+func resolveImage(raw string, base *url.URL) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	u, err := base.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	image := u.String()
+	if len(image) > maxImageLength {
+		return ""
+	}
+	return image
+}
+
+// clean collapses whitespace and cuts the text to max runes.
+func clean(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,11 @@
+package models
+
+import "errors"
+
+var ErrNotFound = errors.New("not found")
+var ErrAccountExists = errors.New("account already exists")
+var ErrURLExists = errors.New("url already has a short link")
+
+// ErrConflict is returned by storages when a link is already saved under
+// the key, or for the destination.
+var ErrConflict = errors.New("url already saved")
@@ -1,7 +1,13 @@
 package models
 
+import "time"
+
 type ShortenRequest struct {
-	URL string `json:"url"`
+	URL       string `json:"url"`
+	Domain    string `json:"domain,omitempty"`
+	Password  string `json:"password,omitempty"`
+	MaxClicks int    `json:"max_clicks,omitempty"`
+	LinkMetadata
 }
 
 type ShortenResponse struct {
@@ -11,6 +17,9 @@ type ShortenResponse struct {
 type ShortenBatchRequest []struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	Domain        string `json:"domain,omitempty"`
+	MaxClicks     int    `json:"max_clicks,omitempty"`
+	LinkMetadata
 }
 
 type ShortenBatchResponseItem struct {
@@ -20,12 +29,235 @@ type ShortenBatchResponseItem struct {
 
 type ShortenBatchResponse []ShortenBatchResponseItem
 
+type LinkMetadata struct {
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Folder      string   `json:"folder,omitempty"`
+	// Interstitial links always show the preview page instead of redirecting.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// RedirectCode overrides the server default status, 0 keeps the default.
+	RedirectCode int        `json:"redirect_code,omitempty"`
+	PassQuery    bool       `json:"pass_query,omitempty"`
+	UTM          *UTMParams `json:"utm,omitempty"`
+}
+
+type UTMParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// LinkPreview is fetched from the destination page after the link is saved.
+type LinkPreview struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
 type UserURLs struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
-	IsDeleted   bool   `json:"is_deleted"`
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	// Domain is the host the link is served on, empty for the primary one.
+	Domain string `json:"domain,omitempty"`
+	LinkMetadata
+	Preview *LinkPreview `json:"preview,omitempty"`
+	// PasswordHash is the bcrypt hash of the password gating the redirect.
+	PasswordHash string `json:"-"`
+	// MaxClicks limits how many times the link can be followed, 0 means
+	// unlimited. Clicks is only counted for limited links.
+	MaxClicks int `json:"max_clicks,omitempty"`
+	Clicks    int `json:"clicks,omitempty"`
+	// Rules are checked in order on every redirect, the first match replaces
+	// the destination.
+	Rules []RedirectRule `json:"rules,omitempty"`
+	// Variants split the traffic that no rule matched by weight. Sticky
+	// variants keep a browser on the variant it got first.
+	Variants       []LinkVariant `json:"variants,omitempty"`
+	StickyVariants bool          `json:"sticky_variants,omitempty"`
+	IsDeleted      bool          `json:"is_deleted"`
+}
+
+// LinkVariant is one destination of a split link. A zero weight pauses the
+// variant without losing its stats.
+type LinkVariant struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+type LinkVariantsRequest struct {
+	Sticky   bool          `json:"sticky"`
+	Variants []LinkVariant `json:"variants"`
+}
+
+type VariantStats struct {
+	LinkVariant
+	Clicks int `json:"clicks"`
+}
+
+type Domain struct {
+	Domain  string `json:"domain"`
+	BaseURL string `json:"base_url"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type LinkStats struct {
+	ShortURL string         `json:"short_url"`
+	Variants []VariantStats `json:"variants"`
+}
+
+type RedirectRule struct {
+	ID          string         `json:"id"`
+	Destination string         `json:"destination"`
+	Conditions  RuleConditions `json:"conditions"`
+}
+
+// RuleConditions match when every set field matches; a list matches when any
+// of its values does.
+type RuleConditions struct {
+	Browsers  []string   `json:"browsers,omitempty"`
+	OS        []string   `json:"os,omitempty"`
+	Languages []string   `json:"languages,omitempty"`
+	Countries []string   `json:"countries,omitempty"`
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+}
+
+type URLFilter struct {
+	Tag    string
+	Folder string
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
 }
 
 type UserURLResponse []UserURLs
 
 type DeleteUrlsRequest []string
+
+type Quota struct {
+	MaxLinks     int `json:"max_links"`
+	MaxBatchSize int `json:"max_batch_size"`
+}
+
+type QuotaResponse struct {
+	MaxLinks       int  `json:"max_links"`
+	UsedLinks      int  `json:"used_links"`
+	RemainingLinks *int `json:"remaining_links,omitempty"`
+	MaxBatchSize   int  `json:"max_batch_size"`
+}
+
+type Account struct {
+	ID           string    `json:"id"`
+	Login        string    `json:"login"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type AuthRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type AuthResponse struct {
+	UserID string `json:"user_id"`
+	Login  string `json:"login"`
+}
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	Revoked   bool      `json:"revoked"`
+}
+
+type APIKeyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Revoked   bool      `json:"revoked"`
+	Key       string    `json:"key,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type Workspace struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type UserWorkspace struct {
+	Workspace
+	Role string `json:"role"`
+}
+
+type WorkspaceMember struct {
+	WorkspaceID string    `json:"workspace_id"`
+	UserID      string    `json:"user_id"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type WorkspaceInvite struct {
+	TokenHash   string    `json:"token_hash"`
+	WorkspaceID string    `json:"workspace_id"`
+	Role        string    `json:"role"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	AcceptedBy  string    `json:"accepted_by"`
+}
+
+type CreateWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type WorkspaceRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type WorkspaceInviteResponse struct {
+	Token     string    `json:"token"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AcceptInviteRequest struct {
+	Token string `json:"token"`
+}
+
+// LinkEdit records a destination change. Metadata carries the link's new
+// metadata to the storage and is not part of the history.
+type LinkEdit struct {
+	ShortURL    string       `json:"short_url"`
+	UserID      string       `json:"user_id"`
+	WorkspaceID string       `json:"workspace_id,omitempty"`
+	OldURL      string       `json:"old_url"`
+	NewURL      string       `json:"new_url"`
+	EditedAt    time.Time    `json:"edited_at"`
+	Metadata    LinkMetadata `json:"-"`
+}
+
+type EditURLRequest struct {
+	OriginalURL  *string    `json:"original_url"`
+	Title        *string    `json:"title"`
+	Description  *string    `json:"description"`
+	Tags         *[]string  `json:"tags"`
+	Folder       *string    `json:"folder"`
+	Interstitial *bool      `json:"interstitial"`
+	RedirectCode *int       `json:"redirect_code"`
+	PassQuery    *bool      `json:"pass_query"`
+	UTM          *UTMParams `json:"utm"`
+}
@@ -0,0 +1,90 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var ErrStateMismatch = errors.New("oidc state mismatch")
+
+const flowCookieName = "OIDCFlow"
+const flowCookiePath = "/auth/oidc"
+const flowCookieMaxAge = 600
+
+// Flow holds the per-login secrets. It lives in a short-lived cookie between
+// the redirect to the provider and the callback.
+type Flow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func NewFlow() (Flow, error) {
+	var values [3]string
+	for i := range values {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return Flow{}, fmt.Errorf("failed to generate oidc flow: %w", err)
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	return Flow{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// challenge is the S256 PKCE code challenge for the verifier.
+func (f Flow) challenge() string {
+	sum := sha256.Sum256([]byte(f.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (f Flow) SetCookie(w http.ResponseWriter, secure bool) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to encode oidc flow: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flowCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     flowCookiePath,
+		MaxAge:   flowCookieMaxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		// Lax is the strictest mode that still sends the cookie on the
+		// top-level redirect back from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func ClearFlowCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: flowCookieName, Path: flowCookiePath, MaxAge: -1})
+}
+
+// FlowFromRequest restores the flow and checks the state returned by the
+// provider against it.
+func FlowFromRequest(r *http.Request) (Flow, error) {
+	cookie, err := r.Cookie(flowCookieName)
+	if err != nil {
+		return Flow{}, ErrStateMismatch
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return Flow{}, ErrStateMismatch
+	}
+	var flow Flow
+	if err := json.Unmarshal(data, &flow); err != nil {
+		return Flow{}, ErrStateMismatch
+	}
+
+	state := r.URL.Query().Get("state")
+	if flow.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(flow.State)) != 1 {
+		return Flow{}, ErrStateMismatch
+	}
+	return flow, nil
+}
@@ -0,0 +1,168 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"shorty/internal/app/config"
+	"shorty/internal/app/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProvider(t *testing.T, idp *oidctest.Server, userClaim string) *Provider {
+	t.Helper()
+	provider, err := NewProvider(config.Config{
+		BaseAddress:      "http://localhost:8080",
+		OIDCIssuer:       idp.Issuer(),
+		OIDCClientID:     idp.ClientID,
+		OIDCClientSecret: idp.ClientSecret,
+		OIDCScopes:       "openid email",
+		OIDCUserClaim:    userClaim,
+	}, idp.Client())
+	require.NoError(t, err)
+	return provider
+}
+
+// authorize follows the provider redirect and returns the callback query.
+func authorize(t *testing.T, idp *oidctest.Server, authURL string) url.Values {
+	t.Helper()
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	response, err := client.Get(authURL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusFound, response.StatusCode)
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/auth/oidc/callback", location.Path)
+	return location.Query()
+}
+
+func TestLoginFlow(t *testing.T) {
+	ctx := context.Background()
+	idp := oidctest.NewServer("shorty", "client-secret")
+	defer idp.Close()
+	provider := newTestProvider(t, idp, "sub")
+
+	flow, err := NewFlow()
+	require.NoError(t, err)
+	authURL, err := provider.AuthCodeURL(ctx, flow)
+	require.NoError(t, err)
+
+	callback := authorize(t, idp, authURL)
+	assert.Equal(t, flow.State, callback.Get("state"))
+
+	wrongVerifier := flow
+	wrongVerifier.Verifier = "guessed"
+	_, err = provider.Exchange(ctx, callback.Get("code"), wrongVerifier)
+	assert.Error(t, err, "the provider must reject a verifier that doesn't match the challenge")
+
+	callback = authorize(t, idp, authURL)
+	rawIDToken, err := provider.Exchange(ctx, callback.Get("code"), flow)
+	require.NoError(t, err)
+
+	_, err = provider.Verify(ctx, rawIDToken, "other-nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	claims, err := provider.Verify(ctx, rawIDToken, flow.Nonce)
+	require.NoError(t, err)
+	identity, err := provider.Identity(claims)
+	require.NoError(t, err)
+	assert.Equal(t, "oidc:user-1", identity.Login)
+
+	again, err := newTestProvider(t, idp, "sub").Identity(claims)
+	require.NoError(t, err)
+	assert.Equal(t, identity.UserID, again.UserID, "user ids must be stable")
+
+	other, err := provider.Identity(&Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "user-2"}})
+	require.NoError(t, err)
+	assert.NotEqual(t, identity.UserID, other.UserID)
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	idp := oidctest.NewServer("shorty", "")
+	defer idp.Close()
+	provider := newTestProvider(t, idp, "sub")
+
+	tests := []struct {
+		name    string
+		modify  func(jwt.MapClaims)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(jwt.MapClaims) {}},
+		{name: "other audience", modify: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, wantErr: true},
+		{name: "several audiences without azp", modify: func(c jwt.MapClaims) { c["aud"] = []string{"shorty", "other"} }, wantErr: true},
+		{
+			name: "several audiences with azp",
+			modify: func(c jwt.MapClaims) {
+				c["aud"] = []string{"shorty", "other"}
+				c["azp"] = "shorty"
+			},
+		},
+		{name: "other issuer", modify: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "expired", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: true},
+		{name: "no expiry", modify: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: true},
+		{name: "no subject", modify: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := idp.Claims("nonce")
+			tc.modify(claims)
+			_, err := provider.Verify(ctx, idp.Sign(claims), "nonce")
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidIDToken)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.Claims("nonce")).SignedString([]byte("shorty"))
+	require.NoError(t, err)
+	_, err = provider.Verify(ctx, hmacToken, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken, "symmetric algorithms must not be accepted")
+}
+
+func TestKeyRollover(t *testing.T) {
+	ctx := context.Background()
+	idp := oidctest.NewServer("shorty", "")
+	defer idp.Close()
+	provider := newTestProvider(t, idp, "sub")
+
+	_, err := provider.Verify(ctx, idp.Sign(idp.Claims("nonce")), "nonce")
+	require.NoError(t, err)
+
+	idp.RotateKey()
+	rotated := idp.Sign(idp.Claims("nonce"))
+	_, err = provider.Verify(ctx, rotated, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken, "jwks refetching is throttled")
+
+	provider.keys.now = func() time.Time { return time.Now().Add(2 * minRefreshInterval) }
+	_, err = provider.Verify(ctx, rotated, "nonce")
+	assert.NoError(t, err)
+}
+
+func TestEmailIdentity(t *testing.T) {
+	idp := oidctest.NewServer("shorty", "")
+	defer idp.Close()
+	provider := newTestProvider(t, idp, "email")
+
+	verified, unverified := true, false
+	identity, err := provider.Identity(&Claims{Email: "Alice@Example.com", EmailVerified: &verified})
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity.Login)
+
+	_, err = provider.Identity(&Claims{Email: "alice@example.com", EmailVerified: &unverified})
+	assert.ErrorIs(t, err, ErrUnverifiedEmail)
+
+	_, err = provider.Identity(&Claims{})
+	assert.Error(t, err)
+}
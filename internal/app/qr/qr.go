@@ -0,0 +1,221 @@
+package qr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var ErrInvalidOptions = errors.New("invalid qr code options")
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+
+	defaultSize   = 256
+	minSize       = 32
+	maxSize       = 2048
+	defaultMargin = 4
+	maxMargin     = 16
+)
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type Options struct {
+	Format string
+	// Size is the width and height of the image in pixels.
+	Size int
+	// Level is the error correction level: L, M, Q or H.
+	Level string
+	// Margin is the quiet zone around the code in modules.
+	Margin     int
+	Foreground color.NRGBA
+	Background color.NRGBA
+}
+
+// ParseOptions reads format, size, level, margin, fg and bg query
+// parameters. Colours are hex RGB or RGBA, with or without "#".
+func ParseOptions(query url.Values) (Options, error) {
+	opts := Options{
+		Format:     FormatPNG,
+		Size:       defaultSize,
+		Level:      "M",
+		Margin:     defaultMargin,
+		Foreground: color.NRGBA{A: 0xff},
+		Background: color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if format != FormatPNG && format != FormatSVG {
+			return opts, fmt.Errorf("%w: format must be png or svg", ErrInvalidOptions)
+		}
+		opts.Format = format
+	}
+	if level := strings.ToUpper(query.Get("level")); level != "" {
+		if _, ok := levels[level]; !ok {
+			return opts, fmt.Errorf("%w: level must be L, M, Q or H", ErrInvalidOptions)
+		}
+		opts.Level = level
+	}
+
+	var err error
+	if opts.Size, err = intParam(query, "size", opts.Size, minSize, maxSize); err != nil {
+		return opts, err
+	}
+	if opts.Margin, err = intParam(query, "margin", opts.Margin, 0, maxMargin); err != nil {
+		return opts, err
+	}
+	if opts.Foreground, err = colorParam(query, "fg", opts.Foreground); err != nil {
+		return opts, err
+	}
+	if opts.Background, err = colorParam(query, "bg", opts.Background); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func intParam(query url.Values, name string, fallback, min, max int) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("%w: %s must be between %d and %d", ErrInvalidOptions, name, min, max)
+	}
+	return value, nil
+}
+
+func colorParam(query url.Values, name string, fallback color.NRGBA) (color.NRGBA, error) {
+	raw := strings.TrimPrefix(query.Get(name), "#")
+	if raw == "" {
+		return fallback, nil
+	}
+	if len(raw) == 6 {
+		raw += "ff"
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil || len(data) != 4 {
+		return fallback, fmt.Errorf("%w: %s must be a hex colour", ErrInvalidOptions, name)
+	}
+	return color.NRGBA{R: data[0], G: data[1], B: data[2], A: data[3]}, nil
+}
+
+func (o Options) ContentType() string {
+	if o.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// ETag identifies the image of content with these options, which never
+// changes since the encoding is deterministic.
+func (o Options) ETag(content string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s|%d|%s|%s",
+		content, o.Format, o.Size, o.Level, o.Margin, hexColor(o.Foreground), hexColor(o.Background))))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func Encode(w io.Writer, content string, opts Options) error {
+	code, err := qrcode.New(content, levels[opts.Level])
+	if err != nil {
+		return fmt.Errorf("failed to encode qr code: %w", err)
+	}
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	if opts.Format == FormatSVG {
+		return writeSVG(w, modules, opts)
+	}
+	return writePNG(w, modules, opts)
+}
+
+// writePNG scales modules by a whole number of pixels so they stay sharp
+// and centres the code, the leftover pixels widen the margin.
+func writePNG(w io.Writer, modules [][]bool, opts Options) error {
+	total := len(modules) + 2*opts.Margin
+	size := opts.Size
+	if size < total {
+		size = total
+	}
+	scale := size / total
+	offset := (size-total*scale)/2 + opts.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{opts.Background, opts.Foreground})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	if err := png.Encode(w, img); err != nil {
+		return fmt.Errorf("failed to write png: %w", err)
+	}
+	return nil
+}
+
+func writeSVG(w io.Writer, modules [][]bool, opts Options) error {
+	total := len(modules) + 2*opts.Margin
+
+	var path bytes.Buffer
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			// Runs of dark modules become a single rectangle.
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", x+opts.Margin, y+opts.Margin, run, run)
+			x += run - 1
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">
+<rect width="%d" height="%d" fill="%s" fill-opacity="%s"/>
+<path d="%s" fill="%s" fill-opacity="%s"/>
+</svg>
+`,
+		opts.Size, opts.Size, total, total,
+		total, total, hexColor(opts.Background), opacity(opts.Background),
+		path.String(), hexColor(opts.Foreground), opacity(opts.Foreground),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write svg: %w", err)
+	}
+	return nil
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func opacity(c color.NRGBA) string {
+	return strconv.FormatFloat(float64(c.A)/0xff, 'f', 3, 64)
+}
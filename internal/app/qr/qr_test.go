@@ -0,0 +1,86 @@
+package qr
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    func(*Options)
+		wantErr bool
+	}{
+		{name: "defaults", want: func(*Options) {}},
+		{name: "svg", query: "format=SVG", want: func(o *Options) { o.Format = FormatSVG }},
+		{name: "size", query: "size=512", want: func(o *Options) { o.Size = 512 }},
+		{name: "level", query: "level=h", want: func(o *Options) { o.Level = "H" }},
+		{name: "no margin", query: "margin=0", want: func(o *Options) { o.Margin = 0 }},
+		{name: "colours", query: "fg=%23ff0000&bg=00000000", want: func(o *Options) {
+			o.Foreground = color.NRGBA{R: 0xff, A: 0xff}
+			o.Background = color.NRGBA{}
+		}},
+		{name: "format", query: "format=gif", wantErr: true},
+		{name: "small", query: "size=8", wantErr: true},
+		{name: "large", query: "size=100000", wantErr: true},
+		{name: "size", query: "size=big", wantErr: true},
+		{name: "level", query: "level=X", wantErr: true},
+		{name: "margin", query: "margin=-1", wantErr: true},
+		{name: "colour", query: "fg=red", wantErr: true},
+		{name: "short colour", query: "bg=fff", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			got, err := ParseOptions(query)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+				return
+			}
+			require.NoError(t, err)
+			want, _ := ParseOptions(url.Values{})
+			tt.want(&want)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	opts, err := ParseOptions(url.Values{"size": {"300"}, "fg": {"112233"}})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, "http://localhost:8080/abc", opts))
+	img, err := png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 300, img.Bounds().Dy())
+
+	background := color.NRGBAModel.Convert(img.At(0, 0))
+	assert.Equal(t, opts.Background, background)
+	// The centre of the top left finder pattern is always dark.
+	found := false
+	for x := 0; x < 150 && !found; x++ {
+		found = color.NRGBAModel.Convert(img.At(x, x)) == opts.Foreground
+	}
+	assert.True(t, found)
+
+	opts.Format = FormatSVG
+	buf.Reset()
+	require.NoError(t, Encode(&buf, "http://localhost:8080/abc", opts))
+	svg := buf.String()
+	assert.True(t, strings.Contains(svg, `width="300"`))
+	assert.True(t, strings.Contains(svg, `fill="#112233"`))
+	assert.True(t, strings.Contains(svg, `<path d="M4 4h7v1h-7z`), "finder pattern starts after the margin")
+
+	assert.NotEqual(t, opts.ETag("http://localhost:8080/abc"), opts.ETag("http://localhost:8080/abd"))
+}
@@ -0,0 +1,94 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+)
+
+var ErrBatchTooLarge = errors.New("batch size exceeds quota")
+var ErrLinksExceeded = errors.New("links quota exceeded")
+
+type Store interface {
+	CountUserURLs(ctx context.Context, userID string) (int, error)
+	UserQuota(ctx context.Context, userID string) (models.Quota, error)
+}
+
+// Effective merges a per-user override into the configured defaults:
+// zero override fields inherit the default, negative ones lift the limit.
+// In the result zero means unlimited.
+func Effective(cfg config.Config, override models.Quota) models.Quota {
+	return models.Quota{
+		MaxLinks:     mergeLimit(cfg.MaxLinksPerUser, override.MaxLinks),
+		MaxBatchSize: mergeLimit(cfg.MaxBatchSize, override.MaxBatchSize),
+	}
+}
+
+func mergeLimit(defaultLimit, override int) int {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	default:
+		return defaultLimit
+	}
+}
+
+func Usage(ctx context.Context, cfg config.Config, str Store, userID string) (models.QuotaResponse, error) {
+	override, err := str.UserQuota(ctx, userID)
+	if err != nil {
+		return models.QuotaResponse{}, fmt.Errorf("failed to get quota override: %w", err)
+	}
+	used, err := str.CountUserURLs(ctx, userID)
+	if err != nil {
+		return models.QuotaResponse{}, fmt.Errorf("failed to count user links: %w", err)
+	}
+
+	q := Effective(cfg, override)
+	resp := models.QuotaResponse{MaxLinks: q.MaxLinks, UsedLinks: used, MaxBatchSize: q.MaxBatchSize}
+	if q.MaxLinks > 0 {
+		remaining := q.MaxLinks - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		resp.RemainingLinks = &remaining
+	}
+
+	return resp, nil
+}
+
+// CheckBatch fails if a batch of size links is larger than the user may
+// send at once, whether they are all saved or not.
+func CheckBatch(ctx context.Context, cfg config.Config, str Store, userID string, size int) error {
+	override, err := str.UserQuota(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get quota override: %w", err)
+	}
+	if q := Effective(cfg, override); q.MaxBatchSize > 0 && size > q.MaxBatchSize {
+		return ErrBatchTooLarge
+	}
+	return nil
+}
+
+// Check fails if saving newLinks more links would exceed the links quota of
+// the user. Callers count only the links they will really save.
+func Check(ctx context.Context, cfg config.Config, str Store, userID string, newLinks int) error {
+	usage, err := Usage(ctx, cfg, str, userID)
+	if err != nil {
+		return err
+	}
+	if !Allows(models.Quota{MaxLinks: usage.MaxLinks}, usage.UsedLinks, newLinks) {
+		return ErrLinksExceeded
+	}
+	return nil
+}
+
+// Allows reports whether a user with used links may save newLinks more
+// under the effective quota q.
+func Allows(q models.Quota, used, newLinks int) bool {
+	return q.MaxLinks <= 0 || newLinks <= 0 || used+newLinks <= q.MaxLinks
+}
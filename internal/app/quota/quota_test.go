@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"context"
+	"testing"
+
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type storeMock struct {
+	used     int
+	override models.Quota
+}
+
+func (s storeMock) CountUserURLs(ctx context.Context, userID string) (int, error) {
+	return s.used, nil
+}
+
+func (s storeMock) UserQuota(ctx context.Context, userID string) (models.Quota, error) {
+	return s.override, nil
+}
+
+func TestEffective(t *testing.T) {
+	cfg := config.Config{MaxLinksPerUser: 10, MaxBatchSize: 5}
+
+	tests := []struct {
+		name     string
+		override models.Quota
+		want     models.Quota
+	}{
+		{
+			name: "Should inherit the defaults without an override",
+			want: models.Quota{MaxLinks: 10, MaxBatchSize: 5},
+		},
+		{
+			name:     "Should prefer positive overrides",
+			override: models.Quota{MaxLinks: 100, MaxBatchSize: 1},
+			want:     models.Quota{MaxLinks: 100, MaxBatchSize: 1},
+		},
+		{
+			name:     "Should lift limits with negative overrides",
+			override: models.Quota{MaxLinks: -1},
+			want:     models.Quota{MaxLinks: 0, MaxBatchSize: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Effective(cfg, tt.override))
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+
+	usage, err := Usage(ctx, config.Config{MaxLinksPerUser: 3}, storeMock{used: 5}, "user")
+	require.NoError(t, err)
+	require.NotNil(t, usage.RemainingLinks)
+	assert.Equal(t, 0, *usage.RemainingLinks, "remaining links never go negative")
+	assert.Equal(t, 5, usage.UsedLinks)
+
+	usage, err = Usage(ctx, config.Config{}, storeMock{used: 5}, "user")
+	require.NoError(t, err)
+	assert.Nil(t, usage.RemainingLinks, "unlimited users have no remaining links")
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Config{MaxLinksPerUser: 3, MaxBatchSize: 2}
+
+	tests := []struct {
+		name     string
+		store    storeMock
+		newLinks int
+		wantErr  error
+	}{
+		{name: "Should allow links up to the limit", store: storeMock{used: 1}, newLinks: 2},
+		{name: "Should reject links over the limit", store: storeMock{used: 2}, newLinks: 2, wantErr: ErrLinksExceeded},
+		{name: "Should allow saving nothing over the limit", store: storeMock{used: 4}},
+		{
+			name:     "Should apply the override",
+			store:    storeMock{used: 3, override: models.Quota{MaxLinks: -1}},
+			newLinks: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, Check(ctx, cfg, tt.store, "user", tt.newLinks), tt.wantErr)
+		})
+	}
+}
+
+func TestCheckBatch(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.Config{MaxLinksPerUser: 1, MaxBatchSize: 2}
+
+	assert.NoError(t, CheckBatch(ctx, cfg, storeMock{used: 1}, "user", 2), "the links quota is checked separately")
+	assert.ErrorIs(t, CheckBatch(ctx, cfg, storeMock{}, "user", 3), ErrBatchTooLarge)
+	assert.NoError(t, CheckBatch(ctx, cfg, storeMock{override: models.Quota{MaxBatchSize: 3}}, "user", 3))
+}
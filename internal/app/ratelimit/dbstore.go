@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const dbSweepInterval = time.Minute
+
+type dbStore struct {
+	db     *sql.DB
+	logger *zap.SugaredLogger
+	done   chan struct{}
+}
+
+// CreateDBStore keeps buckets in db, which stays open when the store is
+// closed as it is shared with the link storage.
+func CreateDBStore(ctx context.Context, db *sql.DB, logger *zap.SugaredLogger) (Store, error) {
+	_, err := db.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			key VARCHAR(255) PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL,
+			full_at TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rate_limits table: %w", err)
+	}
+
+	s := &dbStore{db: db, logger: logger, done: make(chan struct{})}
+	go s.sweep()
+
+	return s, nil
+}
+
+func (s *dbStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	now := time.Now()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to begin rate limit transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			s.logger.Errorf("failed to rollback rate limit transaction: %v", err)
+		}
+	}()
+
+	initial := newBucket(policy, now)
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (key) DO NOTHING`,
+		key,
+		initial.tokens,
+		now,
+	)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to insert rate limit bucket: %w", err)
+	}
+
+	var b bucket
+	row := tx.QueryRowContext(ctx, "SELECT tokens, updated_at FROM rate_limits WHERE key = $1 FOR UPDATE", key)
+	if err := row.Scan(&b.tokens, &b.updatedAt); err != nil {
+		return Result{}, fmt.Errorf("failed to lock rate limit bucket: %w", err)
+	}
+
+	b, res := b.take(policy, now)
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE rate_limits SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1",
+		key,
+		b.tokens,
+		b.updatedAt,
+		b.fullAt,
+	)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to update rate limit bucket: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Result{}, fmt.Errorf("failed to commit rate limit transaction: %w", err)
+	}
+
+	return res, nil
+}
+
+func (s *dbStore) sweep() {
+	ticker := time.NewTicker(dbSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if _, err := s.db.Exec("DELETE FROM rate_limits WHERE full_at < now()"); err != nil {
+				s.logger.Errorf("failed to sweep rate limits: %v", err)
+			}
+		}
+	}
+}
+
+func (s *dbStore) Close() error {
+	close(s.done)
+	return nil
+}
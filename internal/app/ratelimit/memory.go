@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepThreshold = 10000
+
+type MemoryStore struct {
+	mu      *sync.Mutex
+	buckets map[string]bucket
+	now     func() time.Time
+}
+
+func CreateMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:      &sync.Mutex{},
+		buckets: map[string]bucket{},
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if len(s.buckets) >= sweepThreshold {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = newBucket(policy, now)
+	}
+	b, res := b.take(policy, now)
+	s.buckets[key] = b
+
+	return res, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !b.fullAt.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shorty/internal/app/authorization"
+	"shorty/internal/app/config"
+
+	"go.uber.org/zap"
+)
+
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+func (p Policy) Enabled() bool {
+	return p.Rate > 0 && p.Burst > 0
+}
+
+func PolicyFromConfig(rl config.RateLimit) Policy {
+	return Policy{Rate: rl.Rate, Burst: rl.Burst}
+}
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	Take(ctx context.Context, key string, policy Policy) (Result, error)
+	Close() error
+}
+
+// NewStore keeps buckets in db, the pool of the database storage, and in
+// memory when there is none.
+func NewStore(ctx context.Context, db *sql.DB, logger *zap.SugaredLogger) (Store, error) {
+	if db != nil {
+		s, err := CreateDBStore(ctx, db, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init db rate limit store: %w", err)
+		}
+		return s, nil
+	}
+
+	return CreateMemoryStore(), nil
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+func newBucket(policy Policy, now time.Time) bucket {
+	return bucket{tokens: float64(policy.Burst), updatedAt: now, fullAt: now}
+}
+
+func (b bucket) take(policy Policy, now time.Time) (bucket, Result) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens := math.Min(float64(policy.Burst), b.tokens+elapsed*policy.Rate)
+
+	res := Result{Limit: policy.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - tokens) / policy.Rate)
+	}
+	res.Remaining = int(tokens)
+	res.Reset = secondsToDuration((float64(policy.Burst) - tokens) / policy.Rate)
+
+	return bucket{tokens: tokens, updatedAt: now, fullAt: now.Add(res.Reset)}, res
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type Limiter struct {
+	Store          Store
+	TrustedProxies TrustedProxies
+}
+
+// Take takes a token from the bucket of userID, if there is one, and then
+// from the bucket of clientIP in group. The user's bucket goes first, so the
+// rejected requests of a throttled user don't drain the bucket other users
+// behind the same IP share. It returns the strictest result, or nil when no
+// bucket could be checked.
+func (l *Limiter) Take(
+	ctx context.Context,
+	group, clientIP, userID string,
+	policy Policy,
+	logger *zap.SugaredLogger,
+) *Result {
+	var keys []string
+	if userID != "" {
+		keys = append(keys, group+":user:"+userID)
+	}
+	keys = append(keys, group+":ip:"+clientIP)
+
+	var strictest *Result
+	for _, key := range keys {
+		res, err := l.Store.Take(ctx, key, policy)
+		if err != nil {
+			logger.Errorf("Failed to check rate limit for %s: %v", key, err)
+			continue
+		}
+		if strictest == nil || !res.Allowed || (strictest.Allowed && res.Remaining < strictest.Remaining) {
+			res := res
+			strictest = &res
+		}
+		if !res.Allowed {
+			break
+		}
+	}
+	return strictest
+}
+
+func WithRateLimit(h http.Handler, limiter *Limiter, group string, policy Policy, logger *zap.SugaredLogger) http.Handler {
+	if !policy.Enabled() {
+		return h
+	}
+
+	rateLimitMiddleware := func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(authorization.UserIDContextKey).(string)
+		strictest := limiter.Take(r.Context(), group, limiter.TrustedProxies.ClientIP(r), userID, policy, logger)
+		if strictest == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		setRateLimitHeaders(w, *strictest)
+		if !strictest.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(strictest.RetryAfter)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(rateLimitMiddleware)
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, res Result) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
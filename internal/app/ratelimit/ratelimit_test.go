@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shorty/internal/app/authorization"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := CreateMemoryStore()
+	store.now = func() time.Time { return now }
+	policy := Policy{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		res, err := store.Take(context.Background(), "key", policy)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+	}
+
+	res, err := store.Take(context.Background(), "key", policy)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	now = now.Add(time.Second)
+	res, err = store.Take(context.Background(), "key", policy)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	limiter := &Limiter{Store: CreateMemoryStore()}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := WithRateLimit(next, limiter, "test", Policy{Rate: 1, Burst: 1}, zaptest.NewLogger(t).Sugar())
+
+	request := func(userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), authorization.UserIDContextKey, userID))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	first := request("1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "1", first.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", first.Header().Get("RateLimit-Remaining"))
+
+	second := request("2")
+	assert.Equal(t, http.StatusTooManyRequests, second.Code, "IP bucket should be shared between users")
+	assert.Equal(t, "1", second.Header().Get("Retry-After"))
+}
+
+// recordingStore allows every key but rejected, and records the keys
+// tokens were taken from.
+type recordingStore struct {
+	rejected string
+	taken    []string
+}
+
+func (s *recordingStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	s.taken = append(s.taken, key)
+	return Result{Allowed: key != s.rejected, Limit: policy.Burst}, nil
+}
+
+func (s *recordingStore) Close() error {
+	return nil
+}
+
+func TestWithRateLimitThrottledUser(t *testing.T) {
+	store := &recordingStore{rejected: "test:user:1"}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := WithRateLimit(next, &Limiter{Store: store}, "test", Policy{Rate: 1, Burst: 1}, zaptest.NewLogger(t).Sugar())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), authorization.UserIDContextKey, "1"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, []string{"test:user:1"}, store.taken, "a throttled user must not drain the shared IP bucket")
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{
+			name:       "Should use remote address without proxy",
+			remoteAddr: "203.0.113.5:1234",
+			expectedIP: "203.0.113.5",
+		},
+		{
+			name:         "Should ignore X-Forwarded-For from untrusted peer",
+			remoteAddr:   "203.0.113.5:1234",
+			forwardedFor: "198.51.100.1",
+			expectedIP:   "203.0.113.5",
+		},
+		{
+			name:         "Should use first untrusted hop from the right",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "1.1.1.1, 198.51.100.1, 192.168.1.1",
+			expectedIP:   "198.51.100.1",
+		},
+		{
+			name:         "Should stop at malformed hop",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "garbage, 10.0.0.2",
+			expectedIP:   "10.0.0.2",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+
+			assert.Equal(t, tc.expectedIP, proxies.ClientIP(r))
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"shorty/internal/app/models"
+)
+
+var ErrInvalidCode = errors.New("redirect code must be 301, 302, 307 or 308")
+
+const defaultCode = http.StatusTemporaryRedirect
+
+// previewParam asks for the preview page and is never passed through.
+const previewParam = "preview"
+
+func ValidCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Code picks the status of a redirect: the link's own, then the server
+// default, then 307.
+func Code(linkCode, serverCode int) int {
+	if linkCode != 0 {
+		return linkCode
+	}
+	if serverCode != 0 {
+		return serverCode
+	}
+	return defaultCode
+}
+
+// Destination returns where link redirects to for a request with the given
+// query. Incoming parameters are appended when the link passes the query
+// through, and the link's UTM parameters are added unless the stored
+// destination already sets them. The stored query is kept byte for byte.
+func Destination(link models.UserURLs, incoming url.Values) (string, error) {
+	extra := url.Values{}
+	if link.PassQuery {
+		for key, values := range incoming {
+			if key != previewParam {
+				extra[key] = append(extra[key], values...)
+			}
+		}
+	}
+
+	utm := UTMValues(link.UTM)
+	if len(extra) == 0 && len(utm) == 0 {
+		return link.OriginalURL, nil
+	}
+
+	u, err := url.Parse(link.OriginalURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse destination: %w", err)
+	}
+	stored := u.Query()
+	for key, value := range utm {
+		if !stored.Has(key) {
+			extra[key] = value
+		}
+	}
+	if len(extra) == 0 {
+		return link.OriginalURL, nil
+	}
+
+	if u.RawQuery == "" {
+		u.RawQuery = extra.Encode()
+	} else {
+		u.RawQuery += "&" + extra.Encode()
+	}
+	return u.String(), nil
+}
+
+// UTMValues returns the query parameters of the set UTM fields.
+func UTMValues(utm *models.UTMParams) url.Values {
+	values := url.Values{}
+	if utm == nil {
+		return values
+	}
+	for key, value := range map[string]string{
+		"utm_source":   utm.Source,
+		"utm_medium":   utm.Medium,
+		"utm_campaign": utm.Campaign,
+		"utm_term":     utm.Term,
+		"utm_content":  utm.Content,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
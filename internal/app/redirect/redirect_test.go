@@ -0,0 +1,73 @@
+package redirect
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"shorty/internal/app/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestination(t *testing.T) {
+	tests := []struct {
+		name     string
+		link     models.UserURLs
+		incoming url.Values
+		want     string
+	}{
+		{
+			name:     "Should ignore the incoming query by default",
+			link:     models.UserURLs{OriginalURL: "https://example.com/a?b=1"},
+			incoming: url.Values{"ref": {"x"}},
+			want:     "https://example.com/a?b=1",
+		},
+		{
+			name: "Should append the incoming query without touching the stored one",
+			link: models.UserURLs{
+				OriginalURL:  "https://example.com/a?z=1&b=%2F#top",
+				LinkMetadata: models.LinkMetadata{PassQuery: true},
+			},
+			incoming: url.Values{"ref": {"x"}, "z": {"2"}, "preview": {"0"}},
+			want:     "https://example.com/a?z=1&b=%2F&ref=x&z=2#top",
+		},
+		{
+			name: "Should add UTM parameters over incoming ones",
+			link: models.UserURLs{
+				OriginalURL: "https://example.com/a",
+				LinkMetadata: models.LinkMetadata{
+					PassQuery: true,
+					UTM:       &models.UTMParams{Source: "news letter", Campaign: "q3"},
+				},
+			},
+			incoming: url.Values{"utm_source": {"other"}},
+			want:     "https://example.com/a?utm_campaign=q3&utm_source=news+letter",
+		},
+		{
+			name: "Should keep UTM parameters set in the destination",
+			link: models.UserURLs{
+				OriginalURL:  "https://example.com/a?utm_source=site",
+				LinkMetadata: models.LinkMetadata{UTM: &models.UTMParams{Source: "mail"}},
+			},
+			want: "https://example.com/a?utm_source=site",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Destination(tt.link, tt.incoming)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, http.StatusTemporaryRedirect, Code(0, 0))
+	assert.Equal(t, http.StatusMovedPermanently, Code(0, http.StatusMovedPermanently))
+	assert.Equal(t, http.StatusPermanentRedirect, Code(http.StatusPermanentRedirect, http.StatusFound))
+	assert.True(t, ValidCode(http.StatusFound))
+	assert.False(t, ValidCode(http.StatusSeeOther))
+	assert.False(t, ValidCode(0))
+}
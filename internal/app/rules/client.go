@@ -0,0 +1,78 @@
+package rules
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// OS reports the operating system family of a User-Agent. Mobile systems are
+// checked first since their agents also name the desktop system they are
+// based on.
+func OS(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case containsAny(ua, "iphone", "ipad", "ipod"):
+		return "ios"
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "windows"):
+		return "windows"
+	case strings.Contains(ua, "cros"):
+		return "chromeos"
+	case containsAny(ua, "macintosh", "mac os x"):
+		return "macos"
+	case strings.Contains(ua, "linux"):
+		return "linux"
+	}
+	return ""
+}
+
+// Browser reports the browser family of a User-Agent. Chromium based
+// browsers also claim to be Chrome and Safari, so they go first.
+func Browser(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case containsAny(ua, "bot", "crawl", "spider", "slurp", "curl/", "wget/"):
+		return "bot"
+	case containsAny(ua, "edg/", "edge/", "edga/", "edgios/"):
+		return "edge"
+	case containsAny(ua, "opr/", "opera"):
+		return "opera"
+	case strings.Contains(ua, "samsungbrowser"):
+		return "samsung"
+	case containsAny(ua, "firefox/", "fxios/"):
+		return "firefox"
+	case containsAny(ua, "chrome/", "crios/", "chromium/"):
+		return "chrome"
+	case strings.Contains(ua, "safari/"):
+		return "safari"
+	}
+	return ""
+}
+
+// PrimaryLanguage returns the most preferred language of an Accept-Language
+// header, skipping the "*" wildcard.
+func PrimaryLanguage(header string) string {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		if tag != language.Und && tag != wildcard {
+			return tag.String()
+		}
+	}
+	return ""
+}
+
+var wildcard = language.Make("mul")
+
+func containsAny(s string, substrs ...string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"shorty/internal/app/geoip"
+	"shorty/internal/app/models"
+	"shorty/internal/app/ratelimit"
+)
+
+var ErrInvalidRule = errors.New("invalid redirect rule")
+var ErrTooManyRules = errors.New("too many redirect rules")
+
+const MaxRules = 20
+
+var knownOS = map[string]bool{
+	"ios": true, "android": true, "windows": true, "macos": true, "chromeos": true, "linux": true,
+}
+
+var knownBrowsers = map[string]bool{
+	"edge": true, "opera": true, "samsung": true, "firefox": true, "chrome": true, "safari": true, "bot": true,
+}
+
+// Client is what rules are matched against. Empty fields are unknown and
+// never match a condition.
+type Client struct {
+	Browser  string
+	OS       string
+	Language string
+	Country  string
+	Time     time.Time
+}
+
+type Engine struct {
+	geo     geoip.Reader
+	proxies ratelimit.TrustedProxies
+}
+
+// NewEngine returns an engine resolving countries through geo, which may be
+// nil when no database is configured.
+func NewEngine(geo geoip.Reader, proxies ratelimit.TrustedProxies) *Engine {
+	return &Engine{geo: geo, proxies: proxies}
+}
+
+func (e *Engine) Client(r *http.Request) Client {
+	userAgent := r.UserAgent()
+	client := Client{
+		Browser:  Browser(userAgent),
+		OS:       OS(userAgent),
+		Language: PrimaryLanguage(r.Header.Get("Accept-Language")),
+		Time:     time.Now().UTC(),
+	}
+	if e != nil && e.geo != nil {
+		client.Country = e.geo.Country(net.ParseIP(e.proxies.ClientIP(r)))
+	}
+	return client
+}
+
+// Match returns the first rule whose conditions all hold for client.
+func Match(rules []models.RedirectRule, client Client) (models.RedirectRule, bool) {
+	for _, rule := range rules {
+		if matches(rule.Conditions, client) {
+			return rule, true
+		}
+	}
+	return models.RedirectRule{}, false
+}
+
+func matches(c models.RuleConditions, client Client) bool {
+	if len(c.Browsers) > 0 && !contains(c.Browsers, client.Browser) {
+		return false
+	}
+	if len(c.OS) > 0 && !contains(c.OS, client.OS) {
+		return false
+	}
+	if len(c.Countries) > 0 && !contains(c.Countries, client.Country) {
+		return false
+	}
+	if len(c.Languages) > 0 && !matchLanguage(c.Languages, client.Language) {
+		return false
+	}
+	if c.Start != nil && client.Time.Before(*c.Start) {
+		return false
+	}
+	if c.End != nil && !client.Time.Before(*c.End) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLanguage lets a rule for "en" match "en-US", but not the other way
+// round.
+func matchLanguage(languages []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, lang := range languages {
+		if value == lang || strings.HasPrefix(value, lang+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize validates a rule's conditions and brings them to the form Match
+// compares against. The destination is left to the caller's URL policy.
+func Normalize(rule models.RedirectRule) (models.RedirectRule, error) {
+	c := rule.Conditions
+
+	var err error
+	if c.Browsers, err = normalizeList(c.Browsers, "browser", func(v string) (string, bool) {
+		v = strings.ToLower(v)
+		return v, knownBrowsers[v]
+	}); err != nil {
+		return rule, err
+	}
+	if c.OS, err = normalizeList(c.OS, "os", func(v string) (string, bool) {
+		v = strings.ToLower(v)
+		return v, knownOS[v]
+	}); err != nil {
+		return rule, err
+	}
+	if c.Countries, err = normalizeList(c.Countries, "country", func(v string) (string, bool) {
+		v = strings.ToUpper(v)
+		return v, len(v) == 2 && v[0] >= 'A' && v[0] <= 'Z' && v[1] >= 'A' && v[1] <= 'Z'
+	}); err != nil {
+		return rule, err
+	}
+	if c.Languages, err = normalizeList(c.Languages, "language", func(v string) (string, bool) {
+		tag, err := language.Parse(v)
+		if err != nil {
+			return v, false
+		}
+		return tag.String(), true
+	}); err != nil {
+		return rule, err
+	}
+
+	if c.Start != nil && c.End != nil && !c.Start.Before(*c.End) {
+		return rule, fmt.Errorf("%w: start must be before end", ErrInvalidRule)
+	}
+
+	rule.Conditions = c
+	return rule, nil
+}
+
+func normalizeList(values []string, field string, normalize func(string) (string, bool)) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		value, ok := normalize(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown %s %q", ErrInvalidRule, field, value)
+		}
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
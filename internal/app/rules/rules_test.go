@@ -0,0 +1,307 @@
+package rules
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"shorty/internal/app/models"
+	"shorty/internal/app/ratelimit"
+)
+
+const (
+	iPhoneSafari = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 " +
+		"(KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	iPhoneChrome = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 " +
+		"(KHTML, like Gecko) CriOS/118.0.5993.69 Mobile/15E148 Safari/604.1"
+	androidChrome = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 " +
+		"(KHTML, like Gecko) Chrome/118.0.0.0 Mobile Safari/537.36"
+	androidSamsung = "Mozilla/5.0 (Linux; Android 13; SM-S911B) AppleWebKit/537.36 " +
+		"(KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36"
+	windowsEdge = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+		"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46"
+	windowsOpera = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+		"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 OPR/104.0.0.0"
+	macFirefox   = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14.0; rv:118.0) Gecko/20100101 Firefox/118.0"
+	linuxFirefox = "Mozilla/5.0 (X11; Linux x86_64; rv:118.0) Gecko/20100101 Firefox/118.0"
+	chromebook   = "Mozilla/5.0 (X11; CrOS x86_64 15633.69.0) AppleWebKit/537.36 " +
+		"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36"
+	googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+)
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name    string
+		ua      string
+		browser string
+		os      string
+	}{
+		{name: "iphone safari", ua: iPhoneSafari, browser: "safari", os: "ios"},
+		{name: "iphone chrome", ua: iPhoneChrome, browser: "chrome", os: "ios"},
+		{name: "android chrome", ua: androidChrome, browser: "chrome", os: "android"},
+		{name: "android samsung", ua: androidSamsung, browser: "samsung", os: "android"},
+		{name: "windows edge", ua: windowsEdge, browser: "edge", os: "windows"},
+		{name: "windows opera", ua: windowsOpera, browser: "opera", os: "windows"},
+		{name: "mac firefox", ua: macFirefox, browser: "firefox", os: "macos"},
+		{name: "linux firefox", ua: linuxFirefox, browser: "firefox", os: "linux"},
+		{name: "chromebook", ua: chromebook, browser: "chrome", os: "chromeos"},
+		{name: "bot", ua: googlebot, browser: "bot", os: ""},
+		{name: "curl", ua: "curl/8.1.2", browser: "bot", os: ""},
+		{name: "empty", ua: "", browser: "", os: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.browser, Browser(tt.ua))
+			assert.Equal(t, tt.os, OS(tt.ua))
+		})
+	}
+}
+
+func TestPrimaryLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "de-DE,de;q=0.9,en;q=0.8", want: "de-DE"},
+		{header: "en;q=0.5, fr-CA", want: "fr-CA"},
+		{header: "EN-us", want: "en-US"},
+		{header: "*", want: ""},
+		{header: "", want: ""},
+		{header: "not a language!", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			assert.Equal(t, tt.want, PrimaryLanguage(tt.header))
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		conditions models.RuleConditions
+		client     Client
+		want       bool
+	}{
+		{
+			name:   "no conditions",
+			client: Client{Time: now},
+			want:   true,
+		},
+		{
+			name:       "os in list",
+			conditions: models.RuleConditions{OS: []string{"android", "ios"}},
+			client:     Client{OS: "ios", Time: now},
+			want:       true,
+		},
+		{
+			name:       "os not in list",
+			conditions: models.RuleConditions{OS: []string{"android", "ios"}},
+			client:     Client{OS: "windows", Time: now},
+		},
+		{
+			name:       "unknown os",
+			conditions: models.RuleConditions{OS: []string{"android"}},
+			client:     Client{Time: now},
+		},
+		{
+			name:       "browser",
+			conditions: models.RuleConditions{Browsers: []string{"firefox"}},
+			client:     Client{Browser: "firefox", Time: now},
+			want:       true,
+		},
+		{
+			name:       "language prefix",
+			conditions: models.RuleConditions{Languages: []string{"en"}},
+			client:     Client{Language: "en-US", Time: now},
+			want:       true,
+		},
+		{
+			name:       "language region",
+			conditions: models.RuleConditions{Languages: []string{"en-GB"}},
+			client:     Client{Language: "en-US", Time: now},
+		},
+		{
+			name:       "region rule against bare language",
+			conditions: models.RuleConditions{Languages: []string{"en-GB"}},
+			client:     Client{Language: "en", Time: now},
+		},
+		{
+			name:       "language is not a prefix of another",
+			conditions: models.RuleConditions{Languages: []string{"e"}},
+			client:     Client{Language: "en", Time: now},
+		},
+		{
+			name:       "country",
+			conditions: models.RuleConditions{Countries: []string{"DE", "AT"}},
+			client:     Client{Country: "AT", Time: now},
+			want:       true,
+		},
+		{
+			name:       "country unknown",
+			conditions: models.RuleConditions{Countries: []string{"DE"}},
+			client:     Client{Time: now},
+		},
+		{
+			name:       "inside window",
+			conditions: models.RuleConditions{Start: &before, End: &after},
+			client:     Client{Time: now},
+			want:       true,
+		},
+		{
+			name:       "start is inclusive",
+			conditions: models.RuleConditions{Start: &now},
+			client:     Client{Time: now},
+			want:       true,
+		},
+		{
+			name:       "end is exclusive",
+			conditions: models.RuleConditions{End: &now},
+			client:     Client{Time: now},
+		},
+		{
+			name:       "before window",
+			conditions: models.RuleConditions{Start: &after},
+			client:     Client{Time: now},
+		},
+		{
+			name:       "after window",
+			conditions: models.RuleConditions{End: &before},
+			client:     Client{Time: now},
+		},
+		{
+			name: "all conditions",
+			conditions: models.RuleConditions{
+				Browsers: []string{"safari"}, OS: []string{"ios"}, Languages: []string{"de"},
+				Countries: []string{"DE"}, Start: &before, End: &after,
+			},
+			client: Client{Browser: "safari", OS: "ios", Language: "de-AT", Country: "DE", Time: now},
+			want:   true,
+		},
+		{
+			name: "one condition fails",
+			conditions: models.RuleConditions{
+				Browsers: []string{"safari"}, OS: []string{"ios"}, Countries: []string{"DE"},
+			},
+			client: Client{Browser: "safari", OS: "ios", Country: "FR", Time: now},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := models.RedirectRule{ID: "1", Destination: "https://example.com", Conditions: tt.conditions}
+			_, ok := Match([]models.RedirectRule{rule}, tt.client)
+			assert.Equal(t, tt.want, ok)
+		})
+	}
+}
+
+func TestMatchOrder(t *testing.T) {
+	rules := []models.RedirectRule{
+		{ID: "ios", Conditions: models.RuleConditions{OS: []string{"ios"}}},
+		{ID: "german", Conditions: models.RuleConditions{Languages: []string{"de"}}},
+		{ID: "fallback"},
+	}
+
+	rule, ok := Match(rules, Client{OS: "ios", Language: "de"})
+	require.True(t, ok)
+	assert.Equal(t, "ios", rule.ID)
+
+	rule, ok = Match(rules, Client{OS: "android", Language: "de"})
+	require.True(t, ok)
+	assert.Equal(t, "german", rule.ID)
+
+	rule, ok = Match(rules, Client{})
+	require.True(t, ok)
+	assert.Equal(t, "fallback", rule.ID)
+
+	_, ok = Match(rules[:2], Client{})
+	assert.False(t, ok)
+	_, ok = Match(nil, Client{OS: "ios"})
+	assert.False(t, ok)
+}
+
+func TestNormalize(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		conditions models.RuleConditions
+		want       models.RuleConditions
+		wantErr    bool
+	}{
+		{
+			name: "canonical form",
+			conditions: models.RuleConditions{
+				Browsers:  []string{" Chrome ", "chrome", ""},
+				OS:        []string{"iOS", "Android"},
+				Languages: []string{"EN-us", "de"},
+				Countries: []string{"de", "At"},
+				Start:     &start,
+				End:       &end,
+			},
+			want: models.RuleConditions{
+				Browsers:  []string{"chrome"},
+				OS:        []string{"ios", "android"},
+				Languages: []string{"en-US", "de"},
+				Countries: []string{"DE", "AT"},
+				Start:     &start,
+				End:       &end,
+			},
+		},
+		{name: "unknown browser", conditions: models.RuleConditions{Browsers: []string{"netscape"}}, wantErr: true},
+		{name: "unknown os", conditions: models.RuleConditions{OS: []string{"beos"}}, wantErr: true},
+		{name: "bad language", conditions: models.RuleConditions{Languages: []string{"not a tag"}}, wantErr: true},
+		{name: "bad country", conditions: models.RuleConditions{Countries: []string{"DEU"}}, wantErr: true},
+		{name: "numeric country", conditions: models.RuleConditions{Countries: []string{"49"}}, wantErr: true},
+		{name: "empty window", conditions: models.RuleConditions{Start: &end, End: &start}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Normalize(models.RedirectRule{Conditions: tt.conditions})
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidRule)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, rule.Conditions)
+		})
+	}
+}
+
+type staticGeo map[string]string
+
+func (g staticGeo) Country(ip net.IP) string {
+	return g[ip.String()]
+}
+
+func TestEngineClient(t *testing.T) {
+	proxies, err := ratelimit.ParseTrustedProxies("10.0.0.1")
+	require.NoError(t, err)
+	engine := NewEngine(staticGeo{"203.0.113.7": "NL"}, proxies)
+
+	r := httptest.NewRequest("GET", "/abc", nil)
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("User-Agent", androidChrome)
+	r.Header.Set("Accept-Language", "nl-NL,nl;q=0.9")
+
+	client := engine.Client(r)
+	assert.Equal(t, "chrome", client.Browser)
+	assert.Equal(t, "android", client.OS)
+	assert.Equal(t, "nl-NL", client.Language)
+	assert.Equal(t, "NL", client.Country)
+	assert.False(t, client.Time.IsZero())
+
+	var none *Engine
+	client = none.Client(r)
+	assert.Equal(t, "", client.Country)
+	assert.Equal(t, "android", client.OS)
+}
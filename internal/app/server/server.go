@@ -1,18 +1,37 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"shorty/internal/app/authorization"
+	"shorty/internal/app/certs"
 	"shorty/internal/app/compress"
 	"shorty/internal/app/config"
+	"shorty/internal/app/domains"
+	"shorty/internal/app/geoip"
+	"shorty/internal/app/grpcapi"
 	"shorty/internal/app/handlers"
+	"shorty/internal/app/hash"
+	"shorty/internal/app/listen"
 	"shorty/internal/app/logger"
+	"shorty/internal/app/metafetch"
+	"shorty/internal/app/oidc"
+	"shorty/internal/app/ratelimit"
+	"shorty/internal/app/redirect"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/service"
 	"shorty/internal/app/storage"
+	"shorty/internal/app/urlpolicy"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 const userUrlsPath = "/api/user/urls"
@@ -21,18 +40,72 @@ type handler struct {
 	logger  *zap.SugaredLogger
 	storage storage.Storage
 	config  config.Config
+	tokens  *authorization.Tokens
+	oidc    *oidc.Provider
+	fetcher *metafetch.Fetcher
+	// shortener holds the link logic shared with the gRPC API.
+	shortener *service.Shortener
+	// unlockAttempts counts password attempts of protected links.
+	unlockAttempts ratelimit.Store
+	rules          *rules.Engine
 }
 
 func (h *handler) getLink(writer http.ResponseWriter, request *http.Request) {
-	handlers.GetLink(request.Context(), writer, request, h.config, h.storage, h.logger)
+	handlers.GetLink(request.Context(), writer, request, h.config, h.shortener, h.tokens, h.rules, h.logger)
+}
+
+func (h *handler) unlockLink(writer http.ResponseWriter, request *http.Request) {
+	handlers.UnlockLink(
+		request.Context(), writer, request, h.config, h.shortener, h.tokens, h.unlockAttempts, h.rules, h.logger,
+	)
+}
+
+func (h *handler) getLinkRules(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetLinkRules(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) setLinkRules(writer http.ResponseWriter, request *http.Request) {
+	handlers.SetLinkRules(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) addLinkRule(writer http.ResponseWriter, request *http.Request) {
+	handlers.AddLinkRule(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) updateLinkRule(writer http.ResponseWriter, request *http.Request) {
+	handlers.UpdateLinkRule(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) deleteLinkRule(writer http.ResponseWriter, request *http.Request) {
+	handlers.DeleteLinkRule(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) setLinkVariants(writer http.ResponseWriter, request *http.Request) {
+	handlers.SetLinkVariants(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getLinkStats(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetLinkStats(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getLinkQR(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetLinkQR(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getUserURLQR(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetUserURLQR(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getDomains(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetDomains(request.Context(), writer, request, h.config, h.logger)
 }
 
 func (h *handler) shortenLink(writer http.ResponseWriter, request *http.Request) {
-	handlers.ShortenLink(request.Context(), writer, request, h.config, h.storage, h.logger)
+	handlers.ShortenLink(request.Context(), writer, request, h.shortener, h.logger)
 }
 
 func (h *handler) shortenLinkBatch(writer http.ResponseWriter, request *http.Request) {
-	handlers.ShortenLinkBatch(request.Context(), writer, request, h.config, h.storage, h.logger)
+	handlers.ShortenLinkBatch(request.Context(), writer, request, h.shortener, h.logger)
 }
 
 func (h *handler) checkDatabaseConnection(writer http.ResponseWriter, request *http.Request) {
@@ -40,28 +113,131 @@ func (h *handler) checkDatabaseConnection(writer http.ResponseWriter, request *h
 }
 
 func (h *handler) getUserURLs(writer http.ResponseWriter, request *http.Request) {
-	handlers.GetUserURLs(request.Context(), writer, request, h.storage, h.logger)
+	handlers.GetUserURLs(request.Context(), writer, request, h.shortener, h.logger)
 }
 
 func (h *handler) deleteUserURLs(writer http.ResponseWriter, request *http.Request) {
-	handlers.DeleteUserURLs(request.Context(), writer, request, h.config, h.storage, h.logger)
+	handlers.DeleteUserURLs(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) editUserURL(writer http.ResponseWriter, request *http.Request) {
+	handlers.EditUserURL(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getUserURLHistory(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetUserURLHistory(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getUserTags(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetUserTags(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) getUserQuota(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetUserQuota(request.Context(), writer, request, h.shortener, h.logger)
+}
+
+func (h *handler) register(writer http.ResponseWriter, request *http.Request) {
+	handlers.Register(request.Context(), writer, request, h.tokens, h.storage, h.logger)
+}
+
+func (h *handler) login(writer http.ResponseWriter, request *http.Request) {
+	handlers.Login(request.Context(), writer, request, h.tokens, h.storage, h.logger)
+}
+
+func (h *handler) logout(writer http.ResponseWriter, request *http.Request) {
+	handlers.Logout(writer, h.tokens)
+}
+
+func (h *handler) oidcLogin(writer http.ResponseWriter, request *http.Request) {
+	handlers.OIDCLogin(request.Context(), writer, request, h.config, h.oidc, h.logger)
+}
+
+func (h *handler) oidcCallback(writer http.ResponseWriter, request *http.Request) {
+	handlers.OIDCCallback(request.Context(), writer, request, h.config, h.oidc, h.tokens, h.storage, h.logger)
+}
+
+func (h *handler) getAPIKeys(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetAPIKeys(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) createAPIKey(writer http.ResponseWriter, request *http.Request) {
+	handlers.CreateAPIKey(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) revokeAPIKey(writer http.ResponseWriter, request *http.Request) {
+	handlers.RevokeAPIKey(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) createWorkspace(writer http.ResponseWriter, request *http.Request) {
+	handlers.CreateWorkspace(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) getWorkspaces(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetWorkspaces(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) getWorkspaceMembers(writer http.ResponseWriter, request *http.Request) {
+	handlers.GetWorkspaceMembers(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) setWorkspaceMemberRole(writer http.ResponseWriter, request *http.Request) {
+	handlers.SetWorkspaceMemberRole(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) removeWorkspaceMember(writer http.ResponseWriter, request *http.Request) {
+	handlers.RemoveWorkspaceMember(request.Context(), writer, request, h.storage, h.logger)
+}
+
+func (h *handler) createWorkspaceInvite(writer http.ResponseWriter, request *http.Request) {
+	handlers.CreateWorkspaceInvite(request.Context(), writer, request, h.config, h.storage, h.logger)
+}
+
+func (h *handler) acceptWorkspaceInvite(writer http.ResponseWriter, request *http.Request) {
+	handlers.AcceptWorkspaceInvite(request.Context(), writer, request, h.storage, h.logger)
 }
 
 type middleware struct {
-	logger *zap.SugaredLogger
-	cfg    config.Config
+	logger  *zap.SugaredLogger
+	cfg     config.Config
+	limiter *ratelimit.Limiter
+	storage storage.Storage
+	tokens  *authorization.Tokens
 }
 
 func (m *middleware) withLogging(h http.Handler) http.Handler {
 	return logger.WithLogging(h, m.logger)
 }
 
+func (m *middleware) withHSTS(h http.Handler) http.Handler {
+	return certs.WithHSTS(h, m.cfg.HSTSMaxAge, m.cfg.HSTSIncludeSubdomains)
+}
+
 func (m *middleware) withCompressing(h http.Handler) http.Handler {
 	return compress.WithCompressing(h, m.logger)
 }
 
 func (m *middleware) withAuthorization(h http.Handler) http.Handler {
-	return authorization.WithAuthorization(h, m.cfg, m.logger)
+	return authorization.WithAuthorization(h, m.tokens, m.storage, m.logger)
+}
+
+func (m *middleware) withRequiredIdentity(h http.Handler) http.Handler {
+	return authorization.RequireIdentity(h)
+}
+
+func (m *middleware) withShortenRateLimit(h http.Handler) http.Handler {
+	return ratelimit.WithRateLimit(h, m.limiter, "shorten", ratelimit.PolicyFromConfig(m.cfg.ShortenRateLimit), m.logger)
+}
+
+func (m *middleware) withRedirectRateLimit(h http.Handler) http.Handler {
+	return ratelimit.WithRateLimit(h, m.limiter, "redirect", ratelimit.PolicyFromConfig(m.cfg.RedirectRateLimit), m.logger)
+}
+
+func (m *middleware) withUserAPIRateLimit(h http.Handler) http.Handler {
+	return ratelimit.WithRateLimit(h, m.limiter, "user", ratelimit.PolicyFromConfig(m.cfg.UserAPIRateLimit), m.logger)
+}
+
+func (m *middleware) withAuthRateLimit(h http.Handler) http.Handler {
+	return ratelimit.WithRateLimit(h, m.limiter, "auth", ratelimit.PolicyFromConfig(m.cfg.AuthRateLimit), m.logger)
 }
 
 func Start() error {
@@ -69,7 +245,20 @@ func Start() error {
 	if err != nil {
 		return fmt.Errorf("failed to initialize logger: %w", err)
 	}
-	c := config.GetConfig()
+	c, err := config.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if !redirect.ValidCode(c.RedirectCode) {
+		return fmt.Errorf("invalid default redirect code %d: %w", c.RedirectCode, redirect.ErrInvalidCode)
+	}
+	if _, err := domains.NewRegistry(c); err != nil {
+		return fmt.Errorf("failed to read domains: %w", err)
+	}
+	tokens, err := authorization.NewTokens(c)
+	if err != nil {
+		return fmt.Errorf("failed to initialize auth tokens: %w", err)
+	}
 	s, err := storage.NewStorage(c)
 	if err != nil {
 		return fmt.Errorf("failed to initialize storage: %w", err)
@@ -80,25 +269,244 @@ func Start() error {
 		}
 	}()
 
-	h := handler{storage: s, config: c, logger: l}
-	m := middleware{logger: l, cfg: c}
+	trustedProxies, err := ratelimit.ParseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("failed to parse trusted proxies: %w", err)
+	}
+	rateLimitStore, err := ratelimit.NewStore(context.Background(), storage.DB(s), l)
+	if err != nil {
+		return fmt.Errorf("failed to initialize rate limit store: %w", err)
+	}
+	defer func() {
+		if err := rateLimitStore.Close(); err != nil {
+			l.Errorf("failed to close rate limit store: %v", err)
+		}
+	}()
+
+	policy, err := urlpolicy.NewPolicy(c)
+	if err != nil {
+		return fmt.Errorf("failed to initialize url policy: %w", err)
+	}
+	policy.Watch(c.URLPolicyReloadInterval, l)
+	defer func() {
+		if err := policy.Close(); err != nil {
+			l.Errorf("failed to close url policy: %v", err)
+		}
+	}()
+
+	var geo geoip.Reader
+	if c.GeoIPDatabasePath != "" {
+		db, err := geoip.Open(c.GeoIPDatabasePath)
+		if err != nil {
+			return fmt.Errorf("failed to load geoip database: %w", err)
+		}
+		geo = db
+	}
+
+	h := handler{
+		storage:        s,
+		config:         c,
+		logger:         l,
+		tokens:         tokens,
+		unlockAttempts: rateLimitStore,
+		rules:          rules.NewEngine(geo, trustedProxies),
+	}
+	if c.OIDCIssuer != "" {
+		h.oidc, err = oidc.NewProvider(c, nil)
+		if err != nil {
+			return fmt.Errorf("failed to initialize oidc provider: %w", err)
+		}
+	}
+	if c.FetchMetadata {
+		h.fetcher = metafetch.NewFetcher(c, s, l)
+		defer func() {
+			if err := h.fetcher.Close(); err != nil {
+				l.Errorf("failed to close metadata fetcher: %v", err)
+			}
+		}()
+	}
+	h.shortener, err = service.New(c, s, policy, h.fetcher, hash.GenerateCodeAttempt, time.Now, l)
+	if err != nil {
+		return fmt.Errorf("failed to initialize link service: %w", err)
+	}
+	m := middleware{
+		logger:  l,
+		cfg:     c,
+		limiter: &ratelimit.Limiter{Store: rateLimitStore, TrustedProxies: trustedProxies},
+		storage: s,
+		tokens:  tokens,
+	}
 
 	router := chi.NewRouter()
 
 	router.Use(m.withLogging)
+	router.Use(m.withHSTS)
 	router.Use(m.withAuthorization)
 	router.Use(m.withCompressing)
 
-	router.Post("/", h.shortenLink)
-	router.Post("/api/shorten", h.shortenLink)
-	router.Post("/api/shorten/batch", h.shortenLinkBatch)
-	router.Get(userUrlsPath, h.getUserURLs)
-	router.Delete(userUrlsPath, h.deleteUserURLs)
+	router.Group(func(r chi.Router) {
+		r.Use(m.withShortenRateLimit)
+		r.Post("/", h.shortenLink)
+		r.Post("/api/shorten", h.shortenLink)
+		r.Post("/api/shorten/batch", h.shortenLinkBatch)
+	})
+	router.Group(func(r chi.Router) {
+		if c.StrictAuth {
+			r.Use(m.withRequiredIdentity)
+		}
+		r.Use(m.withUserAPIRateLimit)
+		r.Get(userUrlsPath, h.getUserURLs)
+		r.Delete(userUrlsPath, h.deleteUserURLs)
+		r.Patch(userUrlsPath+"/{hash}", h.editUserURL)
+		r.Get(userUrlsPath+"/{hash}/history", h.getUserURLHistory)
+		r.Get(userUrlsPath+"/{hash}/rules", h.getLinkRules)
+		r.Put(userUrlsPath+"/{hash}/rules", h.setLinkRules)
+		r.Post(userUrlsPath+"/{hash}/rules", h.addLinkRule)
+		r.Put(userUrlsPath+"/{hash}/rules/{ruleID}", h.updateLinkRule)
+		r.Delete(userUrlsPath+"/{hash}/rules/{ruleID}", h.deleteLinkRule)
+		r.Put(userUrlsPath+"/{hash}/variants", h.setLinkVariants)
+		r.Get(userUrlsPath+"/{hash}/stats", h.getLinkStats)
+		r.Get(userUrlsPath+"/{hash}/qr", h.getUserURLQR)
+		r.Get("/api/user/tags", h.getUserTags)
+		r.Get("/api/domains", h.getDomains)
+		r.Get("/api/user/quota", h.getUserQuota)
+		r.Get("/api/user/keys", h.getAPIKeys)
+		r.Post("/api/user/keys", h.createAPIKey)
+		r.Delete("/api/user/keys/{id}", h.revokeAPIKey)
+		r.Get("/api/workspaces", h.getWorkspaces)
+		r.Post("/api/workspaces", h.createWorkspace)
+		r.Post("/api/workspaces/join", h.acceptWorkspaceInvite)
+		r.Get("/api/workspaces/{id}/urls", h.getUserURLs)
+		r.Delete("/api/workspaces/{id}/urls", h.deleteUserURLs)
+		r.Patch("/api/workspaces/{id}/urls/{hash}", h.editUserURL)
+		r.Get("/api/workspaces/{id}/urls/{hash}/history", h.getUserURLHistory)
+		r.Get("/api/workspaces/{id}/urls/{hash}/rules", h.getLinkRules)
+		r.Put("/api/workspaces/{id}/urls/{hash}/rules", h.setLinkRules)
+		r.Post("/api/workspaces/{id}/urls/{hash}/rules", h.addLinkRule)
+		r.Put("/api/workspaces/{id}/urls/{hash}/rules/{ruleID}", h.updateLinkRule)
+		r.Delete("/api/workspaces/{id}/urls/{hash}/rules/{ruleID}", h.deleteLinkRule)
+		r.Put("/api/workspaces/{id}/urls/{hash}/variants", h.setLinkVariants)
+		r.Get("/api/workspaces/{id}/urls/{hash}/stats", h.getLinkStats)
+		r.Get("/api/workspaces/{id}/urls/{hash}/qr", h.getUserURLQR)
+		r.Get("/api/workspaces/{id}/tags", h.getUserTags)
+		r.Get("/api/workspaces/{id}/members", h.getWorkspaceMembers)
+		r.Put("/api/workspaces/{id}/members/{userID}", h.setWorkspaceMemberRole)
+		r.Delete("/api/workspaces/{id}/members/{userID}", h.removeWorkspaceMember)
+		r.Post("/api/workspaces/{id}/invites", h.createWorkspaceInvite)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(m.withAuthRateLimit)
+		r.Post("/api/auth/register", h.register)
+		r.Post("/api/auth/login", h.login)
+		r.Post("/api/auth/logout", h.logout)
+		if h.oidc != nil {
+			r.Get("/auth/oidc/login", h.oidcLogin)
+			r.Get(oidc.CallbackPath, h.oidcCallback)
+		}
+	})
 	router.Get("/ping", h.checkDatabaseConnection)
-	router.Get("/{hash}", h.getLink)
+	router.Group(func(r chi.Router) {
+		r.Use(m.withRedirectRateLimit)
+		r.Get("/{hash}", h.getLink)
+		r.Get("/{hash}/qr", h.getLinkQR)
+		r.Post("/{hash}", h.unlockLink)
+	})
+
+	newGRPCServer := func(tlsConfig *tls.Config) *grpc.Server {
+		shortenLimit := ratelimit.PolicyFromConfig(c.ShortenRateLimit)
+		return grpcapi.NewServer(h.shortener, tokens, s, m.limiter, shortenLimit, tlsConfig, l)
+	}
+	return serve(c, router, newGRPCServer, l)
+}
+
+// serve runs the listeners of c until the main one fails. The gRPC API
+// shares the certificates of the main listener.
+func serve(
+	c config.Config,
+	router http.Handler,
+	newGRPCServer func(*tls.Config) *grpc.Server,
+	l *zap.SugaredLogger,
+) error {
+	var tlsConfig *tls.Config
+	if certs.Enabled(c) {
+		certManager, err := certs.NewManager(c, l)
+		if err != nil {
+			return fmt.Errorf("failed to initialize tls certificates: %w", err)
+		}
+		defer func() {
+			if err := certManager.Close(); err != nil {
+				l.Errorf("failed to close tls certificates: %v", err)
+			}
+		}()
+		tlsConfig = certManager.TLSConfig()
 
-	l.Infof("Starting server on address: %s", c.ServerAddress)
-	if err := http.ListenAndServe(c.ServerAddress, router); err != nil {
+		if c.HTTPRedirectAddress != "" {
+			redirectServer := &http.Server{
+				Addr:              c.HTTPRedirectAddress,
+				Handler:           certManager.HTTPHandler(certs.RedirectHandler(c.ServerAddress)),
+				ReadHeaderTimeout: c.ReadHeaderTimeout,
+				IdleTimeout:       c.IdleTimeout,
+				WriteTimeout:      c.WriteTimeout,
+			}
+			go func() {
+				l.Infof("Starting HTTP redirect on address: %s", c.HTTPRedirectAddress)
+				if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					l.Errorf("failed to start HTTP redirect: %v", err)
+				}
+			}()
+			defer func() {
+				if err := redirectServer.Close(); err != nil {
+					l.Errorf("failed to close HTTP redirect: %v", err)
+				}
+			}()
+		}
+	}
+
+	if c.GRPCAddress != "" {
+		grpcServer := newGRPCServer(tlsConfig)
+		listener, err := net.Listen("tcp", c.GRPCAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for gRPC: %w", err)
+		}
+		go func() {
+			l.Infof("Starting gRPC server on address: %s", c.GRPCAddress)
+			if err := grpcServer.Serve(listener); err != nil {
+				l.Errorf("failed to start gRPC server: %v", err)
+			}
+		}()
+		defer grpcServer.Stop()
+	}
+
+	handler := router
+	if c.HTTP3Address != "" {
+		http3Server, err := listen.NewHTTP3Server(c, router, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to initialize HTTP/3: %w", err)
+		}
+		go func() {
+			l.Infof("Starting HTTP/3 server on address: %s", c.HTTP3Address)
+			if err := http3Server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.Errorf("failed to start HTTP/3 server: %v", err)
+			}
+		}()
+		defer func() {
+			if err := http3Server.Close(); err != nil {
+				l.Errorf("failed to close HTTP/3 server: %v", err)
+			}
+		}()
+		handler = listen.WithAltSvc(router, http3Server)
+	}
+
+	server := listen.NewServer(c, handler, tlsConfig)
+	var err error
+	if tlsConfig == nil {
+		l.Infof("Starting server on address: %s", c.ServerAddress)
+		err = server.ListenAndServe()
+	} else {
+		l.Infof("Starting HTTPS server on address: %s", c.ServerAddress)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 	return nil
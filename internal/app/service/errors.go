@@ -0,0 +1,50 @@
+package service
+
+import (
+	"errors"
+	"shorty/internal/app/domains"
+	"shorty/internal/app/linkmeta"
+	"shorty/internal/app/quota"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/urlpolicy"
+	"shorty/internal/app/variants"
+	"shorty/internal/app/workspaces"
+)
+
+var (
+	ErrEmptyURL           = errors.New("URL should be provided")
+	ErrNegativeMaxClicks  = errors.New("max_clicks must not be negative")
+	ErrPasswordTooLong    = errors.New("password must be at most 72 bytes")
+	ErrNothingToUpdate    = errors.New("nothing to update")
+	ErrLinkNotFound       = errors.New("link not found")
+	ErrLinkGone           = errors.New("link is deleted or used up")
+	ErrLinkProtected      = errors.New("link is password protected")
+	ErrLinkExists         = errors.New("destination already has a short link")
+	ErrWorkspaceNotFound  = errors.New("workspace not found")
+	ErrNoFreeCode         = errors.New("no free short url left for the destination")
+	ErrWrongPassword      = errors.New("wrong password")
+	ErrDestinationBlocked = errors.New("link destination is blocked")
+	ErrRuleNotFound       = errors.New("rule not found")
+	ErrDuplicateRuleID    = errors.New("duplicate rule id")
+)
+
+// The errors of the packages the service builds on are returned as they
+// are. They are repeated here so transports only need this package to tell
+// them apart.
+var (
+	ErrUnknownDomain      = domains.ErrUnknownDomain
+	ErrInvalidURL         = urlpolicy.ErrInvalidURL
+	ErrSchemeNotAllowed   = urlpolicy.ErrSchemeNotAllowed
+	ErrDomainBlocked      = urlpolicy.ErrDomainBlocked
+	ErrFlagged            = urlpolicy.ErrFlagged
+	ErrPrivateDestination = urlpolicy.ErrPrivateDestination
+	ErrMetadataTooLong    = linkmeta.ErrTooLong
+	ErrTooManyTags        = linkmeta.ErrTooManyTags
+	ErrInvalidTag         = linkmeta.ErrInvalidTag
+	ErrBatchTooLarge      = quota.ErrBatchTooLarge
+	ErrLinksExceeded      = quota.ErrLinksExceeded
+	ErrForbidden          = workspaces.ErrForbidden
+	ErrInvalidRule        = rules.ErrInvalidRule
+	ErrTooManyRules       = rules.ErrTooManyRules
+	ErrInvalidVariants    = variants.ErrInvalidVariants
+)
@@ -0,0 +1,601 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shorty/internal/app/domains"
+	"shorty/internal/app/linkmeta"
+	"shorty/internal/app/models"
+	"shorty/internal/app/quota"
+	"shorty/internal/app/variants"
+	"shorty/internal/app/workspaces"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const maxPasswordLength = 72
+
+// Shorten saves a link to req.URL and returns its short URL. host is the
+// host the request was sent to, the link is created on its domain unless
+// req names one. existing reports that the destination already had a link,
+// which is returned instead.
+func (s *Shortener) Shorten(
+	ctx context.Context,
+	scope Scope,
+	host string,
+	req models.ShortenRequest,
+) (shortURL string, existing bool, err error) {
+	if req.URL == "" {
+		return "", false, ErrEmptyURL
+	}
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return "", false, err
+	}
+	domain, err := s.domain(host, req.Domain)
+	if err != nil {
+		return "", false, err
+	}
+
+	originalURL, err := s.policy.Validate(ctx, req.URL)
+	if err != nil {
+		return "", false, err
+	}
+	metadata, err := linkmeta.Normalize(req.LinkMetadata)
+	if err != nil {
+		return "", false, err
+	}
+	if req.MaxClicks < 0 {
+		return "", false, ErrNegativeMaxClicks
+	}
+
+	var passwordHash string
+	if req.Password != "" {
+		if passwordHash, err = hashPassword(req.Password); err != nil {
+			return "", false, err
+		}
+	}
+
+	// Protected and limited links never share a code with another link.
+	exclusive := passwordHash != "" || req.MaxClicks > 0
+	link := models.UserURLs{
+		OriginalURL:  originalURL,
+		WorkspaceID:  scope.WorkspaceID,
+		Domain:       domain,
+		LinkMetadata: metadata,
+		PasswordHash: passwordHash,
+		MaxClicks:    req.MaxClicks,
+	}
+	key, existing, err := s.save(ctx, link, scope.UserID, exclusive)
+	if err != nil {
+		return "", false, err
+	}
+
+	if shortURL, err = s.registry.ShortURL(key); err != nil {
+		return "", false, fmt.Errorf("failed to get shortURL: %w", err)
+	}
+	return shortURL, existing, nil
+}
+
+// save puts link under the first free key of its destination, or returns
+// the shared link the destination already has. A conflict means another
+// request took the key or the destination in the meantime, so it looks
+// again.
+func (s *Shortener) save(
+	ctx context.Context,
+	link models.UserURLs,
+	userID string,
+	exclusive bool,
+) (key string, existing bool, err error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		key, existing, err = s.freeKey(ctx, link.OriginalURL, link.Domain, exclusive, nil)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to generate shortURL: %w", err)
+		}
+		if existing {
+			return key, true, nil
+		}
+		// Only links that are really saved count towards the quota.
+		if err := quota.Check(ctx, s.cfg, s.store, userID, 1); err != nil {
+			return "", false, err
+		}
+
+		link.ShortURL = key
+		err = s.store.Put(ctx, link, userID)
+		if err == nil {
+			s.fetcher.Enqueue(key, link.OriginalURL)
+			return key, false, nil
+		}
+		if errors.Is(err, quota.ErrLinksExceeded) {
+			return "", false, err
+		}
+		if !errors.Is(err, models.ErrConflict) {
+			return "", false, fmt.Errorf("failed to save url: %w", err)
+		}
+		if exclusive {
+			// Exclusive links only conflict on the key.
+			continue
+		}
+		// The destination may live under another code after an edit.
+		var saved models.UserURLs
+		saved, err = s.store.GetByOriginalURL(ctx, link.Domain, link.OriginalURL)
+		if err == nil {
+			return saved.ShortURL, true, nil
+		}
+		if !errors.Is(err, models.ErrNotFound) {
+			return "", false, fmt.Errorf("failed to get saved url: %w", err)
+		}
+	}
+	return "", false, ErrNoFreeCode
+}
+
+// ShortenBatch saves the links of a batch all at once. Errors about a
+// single item name its correlation ID.
+func (s *Shortener) ShortenBatch(
+	ctx context.Context,
+	scope Scope,
+	host string,
+	urls models.ShortenBatchRequest,
+) (models.ShortenBatchResponse, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return nil, err
+	}
+	if err := quota.CheckBatch(ctx, s.cfg, s.store, scope.UserID, len(urls)); err != nil {
+		return nil, err
+	}
+
+	items := make([]models.UserURLs, len(urls))
+	for i, u := range urls {
+		originalURL, err := s.policy.Validate(ctx, u.OriginalURL)
+		if err != nil {
+			return nil, fmt.Errorf("correlation_id %s: %w", u.CorrelationID, err)
+		}
+		metadata, err := linkmeta.Normalize(u.LinkMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("correlation_id %s: %w", u.CorrelationID, err)
+		}
+		if u.MaxClicks < 0 {
+			return nil, fmt.Errorf("correlation_id %s: %w", u.CorrelationID, ErrNegativeMaxClicks)
+		}
+		domain, err := s.domain(host, u.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("correlation_id %s: %w", u.CorrelationID, err)
+		}
+		items[i] = models.UserURLs{
+			OriginalURL:  originalURL,
+			WorkspaceID:  scope.WorkspaceID,
+			Domain:       domain,
+			LinkMetadata: metadata,
+			MaxClicks:    u.MaxClicks,
+		}
+	}
+
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		keys, links, err := s.batchKeys(ctx, items)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate shortURL for batch request: %w", err)
+		}
+		if len(links) > 0 {
+			if err := quota.Check(ctx, s.cfg, s.store, scope.UserID, len(links)); err != nil {
+				return nil, err
+			}
+			err := s.store.Batch(ctx, links, scope.UserID)
+			if errors.Is(err, quota.ErrLinksExceeded) {
+				return nil, err
+			}
+			if errors.Is(err, models.ErrConflict) {
+				// Another request took a key or a destination in the
+				// meantime, the keys are picked again.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to save batch: %w", err)
+			}
+		}
+		for _, link := range links {
+			s.fetcher.Enqueue(link.ShortURL, link.OriginalURL)
+		}
+
+		var response models.ShortenBatchResponse
+		for i, u := range urls {
+			shortURL, err := s.registry.ShortURL(keys[i])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get shortURLs for batch response: %w", err)
+			}
+			response = append(response, models.ShortenBatchResponseItem{
+				CorrelationID: u.CorrelationID,
+				ShortURL:      shortURL,
+			})
+		}
+		return response, nil
+	}
+	return nil, ErrNoFreeCode
+}
+
+// batchKeys picks the keys of the items of a batch. Items whose destination
+// already has a shared link, saved or earlier in the batch, get that link,
+// like Shorten. The others get keys no other item takes and are returned as
+// the links to save.
+func (s *Shortener) batchKeys(
+	ctx context.Context,
+	items []models.UserURLs,
+) (keys []string, links []models.UserURLs, err error) {
+	keys = make([]string, len(items))
+	taken := map[string]bool{}
+	sharedKeys := map[[2]string]string{}
+	for i, item := range items {
+		exclusive := item.MaxClicks > 0
+		destination := [2]string{item.Domain, item.OriginalURL}
+		if key, ok := sharedKeys[destination]; ok && !exclusive {
+			keys[i] = key
+			continue
+		}
+
+		key, saved, err := s.freeKey(ctx, item.OriginalURL, item.Domain, exclusive, taken)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = key
+		if !exclusive {
+			sharedKeys[destination] = key
+		}
+		if saved {
+			continue
+		}
+		taken[key] = true
+		item.ShortURL = key
+		links = append(links, item)
+	}
+	return keys, links, nil
+}
+
+// Lookup returns the live link behind ref as it is stored, password hash
+// and rules included, for following it. Its ShortURL is the storage key.
+func (s *Shortener) Lookup(ctx context.Context, ref LinkRef) (models.UserURLs, error) {
+	key, err := s.key(ref)
+	if err != nil {
+		return models.UserURLs{}, err
+	}
+	link, err := s.store.Get(ctx, key)
+	if err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get link: %w", err)
+	}
+	switch {
+	case link.OriginalURL == "":
+		return models.UserURLs{}, ErrLinkNotFound
+	case Gone(link):
+		return models.UserURLs{}, ErrLinkGone
+	}
+	return link, nil
+}
+
+// Resolve returns the live link behind ref without following it. The
+// destination of a password protected link isn't revealed.
+func (s *Shortener) Resolve(ctx context.Context, ref LinkRef) (models.UserURLs, error) {
+	link, err := s.Lookup(ctx, ref)
+	if err != nil {
+		return models.UserURLs{}, err
+	}
+	if link.PasswordHash != "" {
+		return models.UserURLs{}, ErrLinkProtected
+	}
+	if link.ShortURL, err = s.registry.ShortURL(link.ShortURL); err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get shortURL: %w", err)
+	}
+	return link, nil
+}
+
+// Owned returns a link of the user, or of the workspace of the scope, even
+// if it is deleted or used up.
+func (s *Shortener) Owned(ctx context.Context, scope Scope, ref LinkRef) (models.UserURLs, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+		return models.UserURLs{}, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.UserURLs{}, err
+	}
+
+	link, err := s.store.OwnedLink(ctx, key, scope.UserID, scope.WorkspaceID)
+	if errors.Is(err, models.ErrNotFound) {
+		return models.UserURLs{}, ErrLinkNotFound
+	}
+	if err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get owned link: %w", err)
+	}
+	if link.ShortURL, err = s.registry.ShortURL(link.ShortURL); err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get shortURL: %w", err)
+	}
+	return link, nil
+}
+
+// List returns the links of the user, or of the workspace of the scope.
+func (s *Shortener) List(ctx context.Context, scope Scope, filter models.URLFilter) ([]models.UserURLs, error) {
+	filter.Tag = linkmeta.Tag(filter.Tag)
+	filter.Folder = strings.Trim(strings.TrimSpace(filter.Folder), "/")
+
+	var urls []models.UserURLs
+	var err error
+	if scope.WorkspaceID != "" {
+		if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+			return nil, err
+		}
+		urls, err = s.store.WorkspaceURLs(ctx, scope.WorkspaceID, filter)
+	} else {
+		urls, err = s.store.UserURLs(ctx, scope.UserID, filter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user urls from storage: %w", err)
+	}
+	if err := s.shortURLs(urls); err != nil {
+		return nil, fmt.Errorf("failed to get shortURLs for user urls: %w", err)
+	}
+	return urls, nil
+}
+
+// Edit changes the destination or the metadata of a link. Fields missing
+// from req are kept, the storage records the old destination in the
+// history of the link.
+func (s *Shortener) Edit(
+	ctx context.Context,
+	scope Scope,
+	ref LinkRef,
+	req models.EditURLRequest,
+) (models.UserURLs, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return models.UserURLs{}, err
+	}
+	if req == (models.EditURLRequest{}) {
+		return models.UserURLs{}, ErrNothingToUpdate
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.UserURLs{}, err
+	}
+
+	// Unchanged fields are taken from the current link; EditURL checks the
+	// ownership before anything is written.
+	current, err := s.store.Get(ctx, key)
+	if err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get url for editing: %w", err)
+	}
+	if current.OriginalURL == "" {
+		return models.UserURLs{}, ErrLinkNotFound
+	}
+
+	originalURL := current.OriginalURL
+	if req.OriginalURL != nil {
+		if originalURL, err = s.policy.Validate(ctx, *req.OriginalURL); err != nil {
+			return models.UserURLs{}, err
+		}
+	}
+	metadata, err := linkmeta.Normalize(linkmeta.Merge(current.LinkMetadata, req))
+	if err != nil {
+		return models.UserURLs{}, err
+	}
+
+	edit, err := s.store.EditURL(ctx, models.LinkEdit{
+		ShortURL:    key,
+		UserID:      scope.UserID,
+		WorkspaceID: scope.WorkspaceID,
+		NewURL:      originalURL,
+		EditedAt:    s.now().UTC(),
+		Metadata:    metadata,
+	})
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return models.UserURLs{}, ErrLinkNotFound
+	case errors.Is(err, models.ErrURLExists):
+		return models.UserURLs{}, ErrLinkExists
+	case err != nil:
+		return models.UserURLs{}, fmt.Errorf("failed to edit url: %w", err)
+	}
+
+	if edit.OldURL != edit.NewURL {
+		s.fetcher.Enqueue(edit.ShortURL, edit.NewURL)
+	}
+	shortURL, err := s.registry.ShortURL(edit.ShortURL)
+	if err != nil {
+		return models.UserURLs{}, fmt.Errorf("failed to get shortURL for editing: %w", err)
+	}
+	return models.UserURLs{
+		ShortURL:     shortURL,
+		OriginalURL:  edit.NewURL,
+		WorkspaceID:  scope.WorkspaceID,
+		Domain:       current.Domain,
+		LinkMetadata: edit.Metadata,
+	}, nil
+}
+
+// Delete marks the links with the given codes on domain deleted. Links owned
+// by someone else, or outside the workspace, are left alone.
+func (s *Shortener) Delete(ctx context.Context, scope Scope, host, domain string, codes []string) error {
+	keys, err := s.deletionKeys(ctx, scope, host, domain, codes)
+	if err != nil {
+		return err
+	}
+	return s.delete(ctx, scope, keys)
+}
+
+// DeleteLater checks a deletion like Delete but deletes in the background,
+// so callers can answer before the links are gone. done is called with the
+// outcome; the deletion isn't canceled with ctx.
+func (s *Shortener) DeleteLater(
+	ctx context.Context,
+	scope Scope,
+	host, domain string,
+	codes []string,
+	done func(error),
+) error {
+	keys, err := s.deletionKeys(ctx, scope, host, domain, codes)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		done(s.delete(ctx, scope, keys))
+	}()
+	return nil
+}
+
+func (s *Shortener) deletionKeys(
+	ctx context.Context,
+	scope Scope,
+	host, domain string,
+	codes []string,
+) ([]string, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return nil, err
+	}
+	domain, err := s.domain(host, domain)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(codes))
+	for i, code := range codes {
+		keys[i] = domains.Key(domain, code)
+	}
+	return keys, nil
+}
+
+func (s *Shortener) delete(ctx context.Context, scope Scope, keys []string) error {
+	if scope.WorkspaceID != "" {
+		if err := s.store.DeleteWorkspaceURLs(ctx, keys, scope.WorkspaceID); err != nil {
+			return fmt.Errorf("failed to delete urls of workspace=%s: %w", scope.WorkspaceID, err)
+		}
+		return nil
+	}
+	if err := s.store.DeleteUserURls(ctx, keys, scope.UserID); err != nil {
+		return fmt.Errorf("failed to delete user urls with userID=%s: %w", scope.UserID, err)
+	}
+	return nil
+}
+
+// Stats returns the clicks of the variants of a link.
+func (s *Shortener) Stats(ctx context.Context, scope Scope, ref LinkRef) (models.LinkStats, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+		return models.LinkStats{}, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.LinkStats{}, err
+	}
+
+	stats, err := s.store.LinkStats(ctx, key, scope.UserID, scope.WorkspaceID)
+	if errors.Is(err, models.ErrNotFound) {
+		return models.LinkStats{}, ErrLinkNotFound
+	}
+	if err != nil {
+		return models.LinkStats{}, fmt.Errorf("failed to get link stats: %w", err)
+	}
+	if stats.ShortURL, err = s.registry.ShortURL(stats.ShortURL); err != nil {
+		return models.LinkStats{}, fmt.Errorf("failed to get shortURL for link stats: %w", err)
+	}
+	return stats, nil
+}
+
+// SetVariants replaces the weighted destinations of a split link. Kept
+// variant IDs keep their clicks, an empty list turns the split off.
+// Variants without an ID get a new one.
+func (s *Shortener) SetVariants(
+	ctx context.Context,
+	scope Scope,
+	ref LinkRef,
+	req models.LinkVariantsRequest,
+) (models.LinkVariantsRequest, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return models.LinkVariantsRequest{}, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.LinkVariantsRequest{}, err
+	}
+
+	for i := range req.Variants {
+		if req.Variants[i].ID == "" {
+			req.Variants[i].ID = uuid.NewString()
+		}
+	}
+	linkVariants, err := variants.Normalize(req.Variants)
+	if err != nil {
+		return models.LinkVariantsRequest{}, err
+	}
+	for i, variant := range linkVariants {
+		if linkVariants[i].Destination, err = s.policy.Validate(ctx, variant.Destination); err != nil {
+			return models.LinkVariantsRequest{}, err
+		}
+	}
+	if linkVariants == nil {
+		linkVariants = []models.LinkVariant{}
+	}
+	req.Variants = linkVariants
+
+	err = s.store.SetLinkVariants(ctx, key, scope.UserID, scope.WorkspaceID, req)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return models.LinkVariantsRequest{}, ErrLinkNotFound
+	case errors.Is(err, models.ErrURLExists):
+		// Without rules and variants the link would be a second plain link
+		// to a destination that already has one.
+		return models.LinkVariantsRequest{}, ErrLinkExists
+	case err != nil:
+		return models.LinkVariantsRequest{}, fmt.Errorf("failed to set link variants: %w", err)
+	}
+	return req, nil
+}
+
+// History returns the earlier destinations of a link, oldest first.
+func (s *Shortener) History(ctx context.Context, scope Scope, ref LinkRef) ([]models.LinkEdit, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+		return nil, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	edits, err := s.store.URLHistory(ctx, key, scope.UserID, scope.WorkspaceID)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, ErrLinkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get url history: %w", err)
+	}
+	for i := range edits {
+		if edits[i].ShortURL, err = s.registry.ShortURL(edits[i].ShortURL); err != nil {
+			return nil, fmt.Errorf("failed to get shortURL for history: %w", err)
+		}
+	}
+	return edits, nil
+}
+
+// Tags counts the links of the user, or of the workspace of the scope, per
+// tag.
+func (s *Shortener) Tags(ctx context.Context, scope Scope) ([]models.TagCount, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+		return nil, err
+	}
+	tags, err := s.store.TagCounts(ctx, scope.UserID, scope.WorkspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tags: %w", err)
+	}
+	return tags, nil
+}
+
+// Quota returns the limits of the user and how much of them is used.
+func (s *Shortener) Quota(ctx context.Context, userID string) (models.QuotaResponse, error) {
+	return quota.Usage(ctx, s.cfg, s.store, userID)
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash link password: %w", err)
+	}
+	return string(hash), nil
+}
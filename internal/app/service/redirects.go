@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"shorty/internal/app/models"
+	"shorty/internal/app/redirect"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/variants"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Visit is a request to follow a link.
+type Visit struct {
+	// Client is what the redirect rules of the link are matched against.
+	Client rules.Client
+	// Query is the query of the short URL, passed on if the link asks for it.
+	Query url.Values
+	// Variant is the variant the client got before, sticky links keep
+	// sending it there.
+	Variant string
+	// Preview asks for the destination without redirecting to it.
+	Preview bool
+}
+
+// Redirect is where a visit of a link goes.
+type Redirect struct {
+	Destination string
+	Code        int
+	// Variant is a new pick of a sticky link the client has to remember.
+	Variant string
+	// Private redirects must not be cached, the next visit may have to
+	// check the password, count a click or go elsewhere.
+	Private bool
+	// Flagged reports that the destination of a preview fails the URL
+	// policy by now.
+	Flagged bool
+}
+
+// Follow counts a visit of a link returned by Lookup and tells where it goes.
+// The first matching redirect rule replaces the link's destination, without
+// one a split link picks one of its variants. A preview always rechecks the
+// destination so it can warn about domains flagged after the link was
+// created. Both count as a click of a limited link, since the preview
+// reveals the destination too. Checking the password is up to the caller.
+func (s *Shortener) Follow(ctx context.Context, link models.UserURLs, visit Visit) (Redirect, error) {
+	var result Redirect
+	var variant models.LinkVariant
+	if rule, ok := rules.Match(link.Rules, visit.Client); ok {
+		link.OriginalURL = rule.Destination
+	} else if variant, ok = pickVariant(link, visit.Variant); ok {
+		link.OriginalURL = variant.Destination
+		if link.StickyVariants && variant.ID != visit.Variant {
+			result.Variant = variant.ID
+		}
+	}
+
+	if s.cfg.RecheckOnRedirect || visit.Preview {
+		if err := s.policy.CheckString(ctx, link.OriginalURL); err != nil {
+			if s.cfg.RecheckOnRedirect {
+				return Redirect{}, fmt.Errorf("%w: %w", ErrDestinationBlocked, err)
+			}
+			result.Flagged = true
+		}
+	}
+
+	destination, err := redirect.Destination(link, visit.Query)
+	if err != nil {
+		return Redirect{}, fmt.Errorf("failed to build destination: %w", err)
+	}
+
+	if link.MaxClicks > 0 {
+		ok, err := s.store.ConsumeClick(ctx, link.ShortURL)
+		if err != nil {
+			return Redirect{}, fmt.Errorf("failed to count click: %w", err)
+		}
+		if !ok {
+			return Redirect{}, ErrLinkGone
+		}
+	}
+	if variant.ID != "" {
+		// Losing a click in the stats is better than failing the redirect.
+		if err := s.store.CountVariantClick(ctx, link.ShortURL, variant.ID); err != nil {
+			s.logger.Errorf("failed to count click of variant %s for %s: %v", variant.ID, link.ShortURL, err)
+		}
+	}
+
+	result.Destination = destination
+	result.Code = redirect.Code(link.RedirectCode, s.cfg.RedirectCode)
+	// A cached redirect would skip the password, the click count, the rules
+	// or the split.
+	result.Private = link.PasswordHash != "" || link.MaxClicks > 0 || len(link.Rules) > 0 || len(link.Variants) > 0
+	return result, nil
+}
+
+// pickVariant chooses the variant of a split link by weight. Sticky links
+// first try the variant the client got before.
+func pickVariant(link models.UserURLs, previous string) (models.LinkVariant, bool) {
+	if link.StickyVariants {
+		if variant, ok := variants.Find(link.Variants, previous); ok {
+			return variant, true
+		}
+	}
+	return variants.Pick(link.Variants)
+}
+
+// Unlock checks the password of a protected link.
+func (s *Shortener) Unlock(link models.UserURLs, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password))
+	if err != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shorty/internal/app/models"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/workspaces"
+
+	"github.com/google/uuid"
+)
+
+// Rules returns the redirect rules of a link in the order they are checked.
+func (s *Shortener) Rules(ctx context.Context, scope Scope, ref LinkRef) ([]models.RedirectRule, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleViewer); err != nil {
+		return nil, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadRules(ctx, scope, key)
+}
+
+// SetRules replaces all rules of a link, which is also how they are
+// reordered. Rules without an ID get a new one.
+func (s *Shortener) SetRules(
+	ctx context.Context,
+	scope Scope,
+	ref LinkRef,
+	linkRules []models.RedirectRule,
+) ([]models.RedirectRule, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return nil, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(linkRules) > rules.MaxRules {
+		return nil, ErrTooManyRules
+	}
+
+	seen := map[string]bool{}
+	for i, rule := range linkRules {
+		if rule.ID == "" {
+			rule.ID = uuid.NewString()
+		}
+		if seen[rule.ID] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateRuleID, rule.ID)
+		}
+		seen[rule.ID] = true
+
+		if linkRules[i], err = s.validateRule(ctx, rule); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.saveRules(ctx, scope, key, linkRules); err != nil {
+		return nil, err
+	}
+	return linkRules, nil
+}
+
+// AddRule appends a rule, so it is checked after the existing ones.
+func (s *Shortener) AddRule(
+	ctx context.Context,
+	scope Scope,
+	ref LinkRef,
+	rule models.RedirectRule,
+) (models.RedirectRule, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return models.RedirectRule{}, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.RedirectRule{}, err
+	}
+	rule.ID = uuid.NewString()
+	if rule, err = s.validateRule(ctx, rule); err != nil {
+		return models.RedirectRule{}, err
+	}
+
+	linkRules, err := s.loadRules(ctx, scope, key)
+	if err != nil {
+		return models.RedirectRule{}, err
+	}
+	if len(linkRules) >= rules.MaxRules {
+		return models.RedirectRule{}, ErrTooManyRules
+	}
+	if err := s.saveRules(ctx, scope, key, append(linkRules, rule)); err != nil {
+		return models.RedirectRule{}, err
+	}
+	return rule, nil
+}
+
+// UpdateRule replaces the rule with the ID of rule in place, keeping its
+// position.
+func (s *Shortener) UpdateRule(
+	ctx context.Context,
+	scope Scope,
+	ref LinkRef,
+	rule models.RedirectRule,
+) (models.RedirectRule, error) {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return models.RedirectRule{}, err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return models.RedirectRule{}, err
+	}
+	if rule, err = s.validateRule(ctx, rule); err != nil {
+		return models.RedirectRule{}, err
+	}
+
+	linkRules, err := s.loadRules(ctx, scope, key)
+	if err != nil {
+		return models.RedirectRule{}, err
+	}
+	i := ruleIndex(linkRules, rule.ID)
+	if i < 0 {
+		return models.RedirectRule{}, ErrRuleNotFound
+	}
+	linkRules[i] = rule
+	if err := s.saveRules(ctx, scope, key, linkRules); err != nil {
+		return models.RedirectRule{}, err
+	}
+	return rule, nil
+}
+
+func (s *Shortener) DeleteRule(ctx context.Context, scope Scope, ref LinkRef, id string) error {
+	if err := s.checkWorkspace(ctx, scope, workspaces.RoleEditor); err != nil {
+		return err
+	}
+	key, err := s.key(ref)
+	if err != nil {
+		return err
+	}
+
+	linkRules, err := s.loadRules(ctx, scope, key)
+	if err != nil {
+		return err
+	}
+	i := ruleIndex(linkRules, id)
+	if i < 0 {
+		return ErrRuleNotFound
+	}
+	return s.saveRules(ctx, scope, key, append(linkRules[:i], linkRules[i+1:]...))
+}
+
+func (s *Shortener) validateRule(ctx context.Context, rule models.RedirectRule) (models.RedirectRule, error) {
+	rule, err := rules.Normalize(rule)
+	if err != nil {
+		return rule, err
+	}
+	rule.Destination, err = s.policy.Validate(ctx, rule.Destination)
+	return rule, err
+}
+
+func (s *Shortener) loadRules(ctx context.Context, scope Scope, key string) ([]models.RedirectRule, error) {
+	linkRules, err := s.store.LinkRules(ctx, key, scope.UserID, scope.WorkspaceID)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, ErrLinkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link rules: %w", err)
+	}
+	return linkRules, nil
+}
+
+func (s *Shortener) saveRules(ctx context.Context, scope Scope, key string, linkRules []models.RedirectRule) error {
+	err := s.store.SetLinkRules(ctx, key, scope.UserID, scope.WorkspaceID, linkRules)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return ErrLinkNotFound
+	case errors.Is(err, models.ErrURLExists):
+		// Without rules and variants the link would be a second plain link
+		// to a destination that already has one.
+		return ErrLinkExists
+	case err != nil:
+		return fmt.Errorf("failed to set link rules: %w", err)
+	}
+	return nil
+}
+
+func ruleIndex(linkRules []models.RedirectRule, id string) int {
+	for i, rule := range linkRules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
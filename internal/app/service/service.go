@@ -0,0 +1,193 @@
+// Package service holds the link logic shared by the REST handlers and the
+// gRPC API. It knows nothing about either transport: callers pass typed
+// requests and map the errors of this package to their own statuses.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shorty/internal/app/config"
+	"shorty/internal/app/domains"
+	"shorty/internal/app/metafetch"
+	"shorty/internal/app/models"
+	"shorty/internal/app/quota"
+	"shorty/internal/app/urlpolicy"
+	"shorty/internal/app/workspaces"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxCodeAttempts = 8
+
+// Store is the part of the storage the service works with.
+type Store interface {
+	quota.Store
+	workspaces.Store
+	Put(ctx context.Context, link models.UserURLs, userID string) error
+	Get(ctx context.Context, key string) (models.UserURLs, error)
+	GetByOriginalURL(ctx context.Context, domain, originalURL string) (models.UserURLs, error)
+	OwnedLink(ctx context.Context, shortURL, userID, workspaceID string) (models.UserURLs, error)
+	EditURL(ctx context.Context, edit models.LinkEdit) (models.LinkEdit, error)
+	URLHistory(ctx context.Context, shortURL, userID, workspaceID string) ([]models.LinkEdit, error)
+	ConsumeClick(ctx context.Context, shortURL string) (bool, error)
+	LinkRules(ctx context.Context, shortURL, userID, workspaceID string) ([]models.RedirectRule, error)
+	SetLinkRules(ctx context.Context, shortURL, userID, workspaceID string, rules []models.RedirectRule) error
+	SetLinkVariants(ctx context.Context, shortURL, userID, workspaceID string, req models.LinkVariantsRequest) error
+	CountVariantClick(ctx context.Context, shortURL, variantID string) error
+	LinkStats(ctx context.Context, shortURL, userID, workspaceID string) (models.LinkStats, error)
+	Batch(ctx context.Context, urls []models.UserURLs, userID string) error
+	UserURLs(ctx context.Context, userID string, filter models.URLFilter) ([]models.UserURLs, error)
+	WorkspaceURLs(ctx context.Context, workspaceID string, filter models.URLFilter) ([]models.UserURLs, error)
+	DeleteUserURls(ctx context.Context, urls []string, userID string) error
+	DeleteWorkspaceURLs(ctx context.Context, urls []string, workspaceID string) error
+	TagCounts(ctx context.Context, userID, workspaceID string) ([]models.TagCount, error)
+}
+
+// Generator derives the candidate codes of a destination. Attempt 0 is
+// tried first, the following ones after collisions.
+type Generator func(originalURL string, attempt int) string
+
+type Clock func() time.Time
+
+// Scope is who a call is made for. Calls with a workspace are about the
+// links of the workspace instead of the user's own.
+type Scope struct {
+	UserID      string
+	WorkspaceID string
+}
+
+// LinkRef names a link by its code. Without a requested domain the link is
+// looked up on the domain Host belongs to, or the primary one.
+type LinkRef struct {
+	Code   string
+	Domain string
+	Host   string
+}
+
+type Shortener struct {
+	cfg      config.Config
+	registry *domains.Registry
+	store    Store
+	policy   *urlpolicy.Policy
+	fetcher  *metafetch.Fetcher
+	generate Generator
+	now      Clock
+	logger   *zap.SugaredLogger
+}
+
+// New creates the service. fetcher may be nil when link previews are off.
+func New(
+	cfg config.Config,
+	store Store,
+	policy *urlpolicy.Policy,
+	fetcher *metafetch.Fetcher,
+	generate Generator,
+	now Clock,
+	logger *zap.SugaredLogger,
+) (*Shortener, error) {
+	registry, err := domains.NewRegistry(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domains: %w", err)
+	}
+	return &Shortener{
+		cfg:      cfg,
+		registry: registry,
+		store:    store,
+		policy:   policy,
+		fetcher:  fetcher,
+		generate: generate,
+		now:      now,
+		logger:   logger,
+	}, nil
+}
+
+// Gone reports whether a link can no longer be followed.
+func Gone(link models.UserURLs) bool {
+	return link.IsDeleted || link.MaxClicks > 0 && link.Clicks >= link.MaxClicks
+}
+
+// domain returns the stored form of the requested domain, or of the one
+// host belongs to.
+func (s *Shortener) domain(host, requested string) (string, error) {
+	if requested == "" {
+		domain, _ := s.registry.ForHost(host)
+		return domain, nil
+	}
+	return s.registry.Domain(requested)
+}
+
+func (s *Shortener) key(ref LinkRef) (string, error) {
+	domain, err := s.domain(ref.Host, ref.Domain)
+	if err != nil {
+		return "", err
+	}
+	return domains.Key(domain, ref.Code), nil
+}
+
+// checkWorkspace checks the role of the user in the workspace of the scope,
+// if there is one.
+func (s *Shortener) checkWorkspace(ctx context.Context, scope Scope, required string) error {
+	if scope.WorkspaceID == "" {
+		return nil
+	}
+	_, err := workspaces.Authorize(ctx, s.store, scope.WorkspaceID, scope.UserID, required)
+	if errors.Is(err, models.ErrNotFound) {
+		return ErrWorkspaceNotFound
+	}
+	if err != nil && !errors.Is(err, workspaces.ErrForbidden) {
+		return fmt.Errorf("failed to check workspace role: %w", err)
+	}
+	return err
+}
+
+// freeKey returns the key of a link to originalURL on domain, skipping
+// candidates that already point elsewhere because their link has been
+// edited. A link to the same destination is only reused when neither it nor
+// the new one is exclusive, i.e. password protected or click limited, and
+// the existing one has no redirect rules or variants, so re-shortening can't
+// strip or skip a password, a limit, the rules or the split. saved reports
+// that the key is such a link, which must be handed out instead of saved
+// again. Keys in taken are about to be saved by the caller and are skipped.
+func (s *Shortener) freeKey(
+	ctx context.Context,
+	originalURL, domain string,
+	exclusive bool,
+	taken map[string]bool,
+) (key string, saved bool, err error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		key := domains.Key(domain, s.generate(originalURL, attempt))
+		if taken[key] {
+			continue
+		}
+		link, err := s.store.Get(ctx, key)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to check shortURL: %w", err)
+		}
+		if link.OriginalURL == "" {
+			return key, false, nil
+		}
+		if link.OriginalURL == originalURL && link.PasswordHash == "" && link.MaxClicks == 0 &&
+			len(link.Rules) == 0 && len(link.Variants) == 0 && !exclusive {
+			return key, true, nil
+		}
+	}
+	return "", false, ErrNoFreeCode
+}
+
+// ShortURL renders the short URL of a link key.
+func (s *Shortener) ShortURL(key string) (string, error) {
+	return s.registry.ShortURL(key)
+}
+
+func (s *Shortener) shortURLs(links []models.UserURLs) error {
+	for i := range links {
+		shortURL, err := s.registry.ShortURL(links[i].ShortURL)
+		if err != nil {
+			return err
+		}
+		links[i].ShortURL = shortURL
+	}
+	return nil
+}
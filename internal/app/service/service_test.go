@@ -0,0 +1,472 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"shorty/internal/app/config"
+	"shorty/internal/app/models"
+	"shorty/internal/app/rules"
+	"shorty/internal/app/storage"
+	"shorty/internal/app/storage/dbstorage"
+	"shorty/internal/app/storage/mapstorage"
+	"shorty/internal/app/urlpolicy"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+var editedAt = time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+
+// collide generates the same first code for every destination, so the
+// second one has to move on to its next attempt.
+func collide(originalURL string, attempt int) string {
+	if attempt == 0 {
+		return "same"
+	}
+	return fmt.Sprintf("alt%d", attempt)
+}
+
+// byPath uses the last path segment of a destination as its code.
+func byPath(originalURL string, attempt int) string {
+	return path.Base(originalURL) + strings.Repeat("x", attempt)
+}
+
+func newShortener(t *testing.T, generate Generator) (*Shortener, *mapstorage.MapStorage) {
+	cfg := config.Config{BaseAddress: "http://localhost:8080", Domains: "https://go.test"}
+	str, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+	policy, err := urlpolicy.NewPolicy(cfg)
+	require.NoError(t, err)
+	s, err := New(cfg, str, policy, nil, generate, func() time.Time { return editedAt }, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	return s, str
+}
+
+// racingStore tries to save a shared link to destination under the key of
+// every Put first, as a request that found the key free at the same time
+// would.
+type racingStore struct {
+	*mapstorage.MapStorage
+	destination string
+}
+
+func (s racingStore) Put(ctx context.Context, link models.UserURLs, userID string) error {
+	racer := models.UserURLs{ShortURL: link.ShortURL, OriginalURL: s.destination, Domain: link.Domain}
+	// Only the first key is still free, later ones already fail for the
+	// destination.
+	_ = s.MapStorage.Put(ctx, racer, "racer")
+	return s.MapStorage.Put(ctx, link, userID)
+}
+
+func (s racingStore) Batch(ctx context.Context, urls []models.UserURLs, userID string) error {
+	racer := models.UserURLs{ShortURL: urls[0].ShortURL, OriginalURL: s.destination, Domain: urls[0].Domain}
+	_ = s.MapStorage.Put(ctx, racer, "racer")
+	return s.MapStorage.Batch(ctx, urls, userID)
+}
+
+func TestShorten(t *testing.T) {
+	ctx := context.Background()
+	user := Scope{UserID: "user"}
+
+	t.Run("collisions", func(t *testing.T) {
+		s, _ := newShortener(t, collide)
+
+		first, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/same", first)
+		again, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.Equal(t, first, again)
+
+		second, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/b"})
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/alt1", second)
+
+		// A protected link never shares the code of another one.
+		protected, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{
+			URL:      "https://example.com/a",
+			Password: "secret",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/alt2", protected)
+	})
+
+	t.Run("same destination of two users", func(t *testing.T) {
+		s, _ := newShortener(t, collide)
+		other := Scope{UserID: "other"}
+
+		first, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.False(t, existing)
+		again, existing, err := s.Shorten(ctx, other, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.True(t, existing)
+		assert.Equal(t, first, again)
+		batch, err := s.ShortenBatch(ctx, other, "", models.ShortenBatchRequest{
+			{CorrelationID: "a", OriginalURL: "https://example.com/a"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, models.ShortenBatchResponse{{CorrelationID: "a", ShortURL: first}}, batch)
+
+		// The link stays with the user who shortened it first.
+		links, err := s.List(ctx, user, models.URLFilter{})
+		require.NoError(t, err)
+		require.Len(t, links, 1)
+		assert.Equal(t, first, links[0].ShortURL)
+		links, err = s.List(ctx, other, models.URLFilter{})
+		require.NoError(t, err)
+		assert.Empty(t, links)
+	})
+
+	t.Run("no free code", func(t *testing.T) {
+		s, _ := newShortener(t, func(string, int) string { return "same" })
+
+		_, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		_, _, err = s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/b"})
+		assert.ErrorIs(t, err, ErrNoFreeCode)
+	})
+
+	t.Run("taken in the meantime", func(t *testing.T) {
+		for name, req := range map[string]models.ShortenRequest{
+			"shared":    {URL: "https://example.com/a"},
+			"protected": {URL: "https://example.com/a", Password: "secret"},
+			"limited":   {URL: "https://example.com/a", MaxClicks: 1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, str := newShortener(t, collide)
+				s.store = racingStore{str, "https://example.com/other"}
+
+				shortURL, existing, err := s.Shorten(ctx, user, "", req)
+				require.NoError(t, err)
+				assert.False(t, existing)
+				assert.Equal(t, "http://localhost:8080/alt1", shortURL)
+				link, err := str.Get(ctx, "same")
+				require.NoError(t, err)
+				assert.Equal(t, "https://example.com/other", link.OriginalURL)
+			})
+		}
+
+		s, str := newShortener(t, collide)
+		s.store = racingStore{str, "https://example.com/a"}
+		shortURL, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.True(t, existing, "a shared link saved in the meantime is handed out")
+		assert.Equal(t, "http://localhost:8080/same", shortURL)
+
+		s, str = newShortener(t, collide)
+		s.store = racingStore{str, "https://example.com/other"}
+		batch, err := s.ShortenBatch(ctx, user, "", models.ShortenBatchRequest{
+			{CorrelationID: "a", OriginalURL: "https://example.com/a"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, models.ShortenBatchResponse{{CorrelationID: "a", ShortURL: "http://localhost:8080/alt1"}}, batch)
+	})
+
+	t.Run("batch with repeated destinations", func(t *testing.T) {
+		s, _ := newShortener(t, collide)
+
+		batch, err := s.ShortenBatch(ctx, user, "", models.ShortenBatchRequest{
+			{CorrelationID: "limited", OriginalURL: "https://example.com/a", MaxClicks: 1},
+			{CorrelationID: "a", OriginalURL: "https://example.com/a"},
+			{CorrelationID: "again", OriginalURL: "https://example.com/a"},
+			{CorrelationID: "b", OriginalURL: "https://example.com/b"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, models.ShortenBatchResponse{
+			{CorrelationID: "limited", ShortURL: "http://localhost:8080/same"},
+			{CorrelationID: "a", ShortURL: "http://localhost:8080/alt1"},
+			{CorrelationID: "again", ShortURL: "http://localhost:8080/alt1"},
+			{CorrelationID: "b", ShortURL: "http://localhost:8080/alt2"},
+		}, batch)
+		links, err := s.List(ctx, user, models.URLFilter{})
+		require.NoError(t, err)
+		assert.Len(t, links, 3)
+	})
+
+	t.Run("domains", func(t *testing.T) {
+		s, _ := newShortener(t, collide)
+
+		onHost, _, err := s.Shorten(ctx, user, "go.test", models.ShortenRequest{URL: "https://example.com/a"})
+		require.NoError(t, err)
+		assert.Equal(t, "https://go.test/same", onHost)
+		requested, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{
+			URL:    "https://example.com/b",
+			Domain: "go.test",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "https://go.test/alt1", requested)
+	})
+
+	tests := []struct {
+		name  string
+		scope Scope
+		req   models.ShortenRequest
+		want  error
+	}{
+		{name: "empty url", scope: user, req: models.ShortenRequest{}, want: ErrEmptyURL},
+		{name: "invalid url", scope: user, req: models.ShortenRequest{URL: "not a url"}, want: ErrInvalidURL},
+		{
+			name:  "unknown domain",
+			scope: user,
+			req:   models.ShortenRequest{URL: "https://example.com", Domain: "other.test"},
+			want:  ErrUnknownDomain,
+		},
+		{
+			name:  "negative max clicks",
+			scope: user,
+			req:   models.ShortenRequest{URL: "https://example.com", MaxClicks: -1},
+			want:  ErrNegativeMaxClicks,
+		},
+		{
+			name:  "long password",
+			scope: user,
+			req:   models.ShortenRequest{URL: "https://example.com", Password: string(make([]byte, 73))},
+			want:  ErrPasswordTooLong,
+		},
+		{
+			name:  "unknown workspace",
+			scope: Scope{UserID: "user", WorkspaceID: "missing"},
+			req:   models.ShortenRequest{URL: "https://example.com"},
+			want:  ErrWorkspaceNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newShortener(t, collide)
+			_, _, err := s.Shorten(ctx, tt.scope, "", tt.req)
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+// TestExclusiveLinks runs on the database too when TEST_DATABASE_DSN is set,
+// as both storages have to agree on which links share a destination.
+func TestExclusiveLinks(t *testing.T) {
+	ctx := context.Background()
+	user := Scope{UserID: "user"}
+	backends := map[string]func(t *testing.T) storage.Storage{
+		"map": func(t *testing.T) storage.Storage {
+			str, err := mapstorage.CreateMapStorage()
+			require.NoError(t, err)
+			return str
+		},
+		"database": func(t *testing.T) storage.Storage {
+			dsn := os.Getenv("TEST_DATABASE_DSN")
+			if dsn == "" {
+				t.Skip("TEST_DATABASE_DSN is not set")
+			}
+			str, err := dbstorage.CreateDBStorage(ctx, config.Config{DatabaseDSN: dsn})
+			require.NoError(t, err)
+			t.Cleanup(func() { assert.NoError(t, str.Close()) })
+			return str
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			str := open(t)
+			cfg := config.Config{BaseAddress: "http://localhost:8080"}
+			policy, err := urlpolicy.NewPolicy(cfg)
+			require.NoError(t, err)
+			// Runs share the database, so codes and destinations are unique
+			// per run.
+			run := fmt.Sprintf("%x", time.Now().UnixNano())
+			generate := func(originalURL string, attempt int) string {
+				return run + collide(originalURL, attempt)
+			}
+			s, err := New(cfg, str, policy, nil, generate, time.Now, zaptest.NewLogger(t).Sugar())
+			require.NoError(t, err)
+			destination := "https://example.com/" + run
+
+			plain, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: destination})
+			require.NoError(t, err)
+			assert.False(t, existing)
+			protected, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{
+				URL:      destination,
+				Password: "secret",
+			})
+			require.NoError(t, err)
+			assert.False(t, existing)
+			assert.NotEqual(t, plain, protected)
+			limited, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: destination, MaxClicks: 3})
+			require.NoError(t, err)
+			assert.False(t, existing)
+			assert.NotContains(t, []string{plain, protected}, limited)
+
+			again, existing, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: destination})
+			require.NoError(t, err)
+			assert.True(t, existing)
+			assert.Equal(t, plain, again)
+			batch, err := s.ShortenBatch(ctx, user, "", models.ShortenBatchRequest{
+				{CorrelationID: "plain", OriginalURL: destination},
+				{CorrelationID: "limited", OriginalURL: destination, MaxClicks: 1},
+			})
+			require.NoError(t, err)
+			require.Len(t, batch, 2)
+			assert.Equal(t, plain, batch[0].ShortURL)
+			assert.NotContains(t, []string{plain, protected, limited}, batch[1].ShortURL)
+
+			link, err := str.GetByOriginalURL(ctx, "", destination)
+			require.NoError(t, err)
+			assert.Equal(t, path.Base(plain), link.ShortURL)
+		})
+	}
+}
+
+func TestLinks(t *testing.T) {
+	ctx := context.Background()
+	user := Scope{UserID: "user"}
+	other := Scope{UserID: "other"}
+	s, str := newShortener(t, byPath)
+
+	batch, err := s.ShortenBatch(ctx, user, "", models.ShortenBatchRequest{
+		{CorrelationID: "a", OriginalURL: "https://example.com/a"},
+		{CorrelationID: "b", OriginalURL: "https://example.com/b", MaxClicks: 1},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, models.ShortenBatchResponse{
+		{CorrelationID: "a", ShortURL: "http://localhost:8080/a"},
+		{CorrelationID: "b", ShortURL: "http://localhost:8080/b"},
+	}, batch)
+
+	link, err := s.Resolve(ctx, LinkRef{Code: "b"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/b", link.OriginalURL)
+	assert.Equal(t, "http://localhost:8080/b", link.ShortURL)
+	_, err = s.Resolve(ctx, LinkRef{Code: "b", Domain: "go.test"})
+	assert.ErrorIs(t, err, ErrLinkNotFound)
+
+	t.Run("edit", func(t *testing.T) {
+		_, err := s.Edit(ctx, user, LinkRef{Code: "a"}, models.EditURLRequest{})
+		assert.ErrorIs(t, err, ErrNothingToUpdate)
+
+		moved := "https://example.com/moved"
+		_, err = s.Edit(ctx, other, LinkRef{Code: "a"}, models.EditURLRequest{OriginalURL: &moved})
+		assert.ErrorIs(t, err, ErrLinkNotFound)
+
+		edited, err := s.Edit(ctx, user, LinkRef{Code: "a"}, models.EditURLRequest{OriginalURL: &moved})
+		require.NoError(t, err)
+		assert.Equal(t, models.UserURLs{ShortURL: "http://localhost:8080/a", OriginalURL: moved}, edited)
+
+		key, err := s.key(LinkRef{Code: "a"})
+		require.NoError(t, err)
+		history, err := str.URLHistory(ctx, key, "user", "")
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		assert.Equal(t, editedAt.UTC(), history[0].EditedAt)
+	})
+
+	t.Run("list and stats", func(t *testing.T) {
+		links, err := s.List(ctx, user, models.URLFilter{})
+		require.NoError(t, err)
+		assert.Len(t, links, 2)
+		links, err = s.List(ctx, other, models.URLFilter{})
+		require.NoError(t, err)
+		assert.Empty(t, links)
+
+		stats, err := s.Stats(ctx, user, LinkRef{Code: "b"})
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/b", stats.ShortURL)
+		_, err = s.Stats(ctx, other, LinkRef{Code: "b"})
+		assert.ErrorIs(t, err, ErrLinkNotFound)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Delete(ctx, other, "", "", []string{"b"}))
+		_, err := s.Resolve(ctx, LinkRef{Code: "b"})
+		require.NoError(t, err)
+
+		done := make(chan error, 1)
+		require.NoError(t, s.DeleteLater(ctx, user, "", "", []string{"b"}, func(err error) { done <- err }))
+		require.NoError(t, <-done)
+		_, err = s.Resolve(ctx, LinkRef{Code: "b"})
+		assert.ErrorIs(t, err, ErrLinkGone)
+
+		owned, err := s.Owned(ctx, user, LinkRef{Code: "b"})
+		require.NoError(t, err)
+		assert.True(t, owned.IsDeleted)
+		assert.Equal(t, "http://localhost:8080/b", owned.ShortURL)
+		_, err = s.Owned(ctx, other, LinkRef{Code: "b"})
+		assert.ErrorIs(t, err, ErrLinkNotFound)
+
+		err = s.Delete(ctx, Scope{UserID: "user", WorkspaceID: "missing"}, "", "", []string{"a"})
+		assert.ErrorIs(t, err, ErrWorkspaceNotFound)
+	})
+}
+
+func TestRedirects(t *testing.T) {
+	ctx := context.Background()
+	user := Scope{UserID: "user"}
+	other := Scope{UserID: "other"}
+	s, _ := newShortener(t, byPath)
+
+	_, _, err := s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/ruled"})
+	require.NoError(t, err)
+	_, _, err = s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/once", MaxClicks: 1})
+	require.NoError(t, err)
+	_, _, err = s.Shorten(ctx, user, "", models.ShortenRequest{URL: "https://example.com/secret", Password: "pw"})
+	require.NoError(t, err)
+	ruled := LinkRef{Code: "ruled"}
+
+	t.Run("rules", func(t *testing.T) {
+		_, err := s.AddRule(ctx, other, ruled, models.RedirectRule{Destination: "https://example.com/x"})
+		assert.ErrorIs(t, err, ErrLinkNotFound)
+		_, err = s.AddRule(ctx, user, ruled, models.RedirectRule{
+			Destination: "https://example.com/x",
+			Conditions:  models.RuleConditions{OS: []string{"beos"}},
+		})
+		assert.ErrorIs(t, err, ErrInvalidRule)
+		_, err = s.SetRules(ctx, user, ruled, []models.RedirectRule{
+			{ID: "a", Destination: "https://example.com/a"},
+			{ID: "a", Destination: "https://example.com/b"},
+		})
+		assert.ErrorIs(t, err, ErrDuplicateRuleID)
+		_, err = s.UpdateRule(ctx, user, ruled, models.RedirectRule{ID: "missing", Destination: "https://example.com/x"})
+		assert.ErrorIs(t, err, ErrRuleNotFound)
+
+		rule, err := s.AddRule(ctx, user, ruled, models.RedirectRule{
+			Destination: "https://example.com/ios",
+			Conditions:  models.RuleConditions{OS: []string{"iOS"}},
+		})
+		require.NoError(t, err)
+		linkRules, err := s.Rules(ctx, user, ruled)
+		require.NoError(t, err)
+		assert.Equal(t, []models.RedirectRule{rule}, linkRules)
+
+		link, err := s.Lookup(ctx, ruled)
+		require.NoError(t, err)
+		redirect, err := s.Follow(ctx, link, Visit{Client: rules.Client{OS: "ios"}})
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/ios", redirect.Destination)
+		assert.True(t, redirect.Private)
+		redirect, err = s.Follow(ctx, link, Visit{})
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/ruled", redirect.Destination)
+	})
+
+	t.Run("click limit", func(t *testing.T) {
+		link, err := s.Lookup(ctx, LinkRef{Code: "once"})
+		require.NoError(t, err)
+		redirect, err := s.Follow(ctx, link, Visit{})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusTemporaryRedirect, redirect.Code)
+		_, err = s.Follow(ctx, link, Visit{})
+		assert.ErrorIs(t, err, ErrLinkGone)
+		_, err = s.Lookup(ctx, LinkRef{Code: "once"})
+		assert.ErrorIs(t, err, ErrLinkGone)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		link, err := s.Lookup(ctx, LinkRef{Code: "secret"})
+		require.NoError(t, err)
+		assert.ErrorIs(t, s.Unlock(link, "wrong"), ErrWrongPassword)
+		assert.NoError(t, s.Unlock(link, "pw"))
+	})
+}
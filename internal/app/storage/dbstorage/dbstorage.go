@@ -3,20 +3,39 @@ package dbstorage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"shorty/internal/app/config"
 	"shorty/internal/app/models"
+	"shorty/internal/app/quota"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
-var ErrConflict = errors.New("url already saved")
+// uniqueViolation is the SQLSTATE of a duplicate key.
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+const linkColumns = "short_url, original_url, workspace_id, domain, " +
+	"title, description, tags, folder, interstitial, redirect_code, pass_query, utm, password_hash, max_clicks"
+const selectColumns = linkColumns +
+	", preview_title, preview_description, preview_image, preview_fetched_at, clicks, rules, variants, sticky_variants"
 
 type dbstorage struct {
 	db *sql.DB
+	// cfg holds the default quotas, which inserts enforce along with the
+	// overrides of user_quotas.
+	cfg config.Config
 }
 
 func CreateDBStorage(ctx context.Context, cfg config.Config) (*dbstorage, error) {
@@ -31,7 +50,7 @@ func CreateDBStorage(ctx context.Context, cfg config.Config) (*dbstorage, error)
 		return nil, err
 	}
 
-	s := &dbstorage{db: db}
+	s := &dbstorage{db: db, cfg: cfg}
 
 	return s, nil
 }
@@ -48,33 +67,254 @@ func (s *dbstorage) Get(ctx context.Context, shortURL string) (models.UserURLs,
 	}()
 	row := conn.QueryRowContext(
 		ctx,
-		"SELECT short_url, original_url, is_deleted FROM links WHERE short_url = $1",
+		"SELECT "+selectColumns+", is_deleted FROM links WHERE short_url = $1",
 		shortURL,
 	)
 
-	if err := row.Scan(&urls.ShortURL, &urls.OriginalURL, &urls.IsDeleted); err != nil {
+	var isDeleted bool
+	urls, err = scanLink(row, pgtype.NewMap(), &isDeleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserURLs{}, nil
+	}
+	if err != nil {
 		return urls, fmt.Errorf("failed to scan row: %w", err)
 	}
+	urls.IsDeleted = isDeleted
 	return urls, nil
 }
 
-func (s *dbstorage) Put(ctx context.Context, shortURL, originalURL, userID string) error {
-	conn, err := s.db.Conn(ctx)
+func (s *dbstorage) GetByOriginalURL(ctx context.Context, domain, originalURL string) (models.UserURLs, error) {
+	var isDeleted bool
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT "+selectColumns+", is_deleted FROM links WHERE domain = $1 AND original_url = $2 AND "+sharedLink,
+		domain,
+		originalURL,
+	)
+	link, err := scanLink(row, pgtype.NewMap(), &isDeleted)
+	link.IsDeleted = isDeleted
+	if errors.Is(err, sql.ErrNoRows) {
+		return link, models.ErrNotFound
+	}
+	if err != nil {
+		return link, fmt.Errorf("failed to get link by original url: %w", err)
+	}
+	return link, nil
+}
+
+// sharedLink matches links that re-shortening their destination may hand
+// out: neither password protected nor click limited, without redirect rules
+// or variants. Only those are unique per destination, see
+// id_domain_shared_url.
+const sharedLink = "password_hash = '' AND max_clicks = 0 AND rules = '[]' AND variants = '[]'"
+
+// ownedLink matches personal links of $2 when $3 is empty and links of
+// workspace $3 otherwise.
+const ownedLink = "CASE WHEN $3 = '' THEN user_id = $2 AND workspace_id = '' ELSE workspace_id = $3 END"
+
+// OwnedLink returns the link even if it is deleted or used up.
+func (s *dbstorage) OwnedLink(ctx context.Context, shortURL, userID, workspaceID string) (models.UserURLs, error) {
+	var isDeleted bool
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT "+selectColumns+", is_deleted FROM links WHERE short_url = $1 AND "+ownedLink,
+		shortURL,
+		userID,
+		workspaceID,
+	)
+	link, err := scanLink(row, pgtype.NewMap(), &isDeleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserURLs{}, models.ErrNotFound
+	}
+	if err != nil {
+		return link, fmt.Errorf("failed to get owned link: %w", err)
+	}
+	link.IsDeleted = isDeleted
+	return link, nil
+}
+
+func (s *dbstorage) EditURL(ctx context.Context, edit models.LinkEdit) (models.LinkEdit, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to open connection to db: %w", err)
+		return edit, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer func() {
-		err := conn.Close()
-		log.Printf("failed to close db connection for saving: %v", err)
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
 	}()
 
-	result, err := conn.ExecContext(
+	row := tx.QueryRowContext(
+		ctx,
+		"SELECT original_url, domain, "+sharedLink+" FROM links "+
+			"WHERE short_url = $1 AND NOT is_deleted AND "+ownedLink+" FOR UPDATE",
+		edit.ShortURL,
+		edit.UserID,
+		edit.WorkspaceID,
+	)
+	var domain string
+	var shared bool
+	err = row.Scan(&edit.OldURL, &domain, &shared)
+	if errors.Is(err, sql.ErrNoRows) {
+		return edit, models.ErrNotFound
+	}
+	if err != nil {
+		return edit, fmt.Errorf("failed to get link for editing: %w", err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE links SET title = $2, description = $3, tags = $4, folder = $5, interstitial = $6,
+		redirect_code = $7, pass_query = $8, utm = $9
+		WHERE short_url = $1`,
+		edit.ShortURL,
+		edit.Metadata.Title,
+		edit.Metadata.Description,
+		tagsParam(edit.Metadata.Tags),
+		edit.Metadata.Folder,
+		edit.Metadata.Interstitial,
+		edit.Metadata.RedirectCode,
+		edit.Metadata.PassQuery,
+		utmParam(edit.Metadata.UTM),
+	)
+	if err != nil {
+		return edit, fmt.Errorf("failed to update link metadata: %w", err)
+	}
+	if edit.OldURL == edit.NewURL {
+		if err := tx.Commit(); err != nil {
+			return edit, fmt.Errorf("failed to commit %w", err)
+		}
+		return edit, nil
+	}
+
+	if shared {
+		var taken bool
+		row = tx.QueryRowContext(
+			ctx,
+			"SELECT EXISTS (SELECT 1 FROM links WHERE domain = $1 AND original_url = $2 AND "+sharedLink+")",
+			domain,
+			edit.NewURL,
+		)
+		if err := row.Scan(&taken); err != nil {
+			return edit, fmt.Errorf("failed to check new url: %w", err)
+		}
+		if taken {
+			return edit, models.ErrURLExists
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE links SET original_url = $2, preview_fetched_at = NULL WHERE short_url = $1",
+		edit.ShortURL,
+		edit.NewURL,
+	)
+	if err != nil {
+		return edit, fmt.Errorf("failed to update link: %w", err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO link_edits (short_url, user_id, workspace_id, old_url, new_url, edited_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		edit.ShortURL,
+		edit.UserID,
+		edit.WorkspaceID,
+		edit.OldURL,
+		edit.NewURL,
+		edit.EditedAt,
+	)
+	if err != nil {
+		return edit, fmt.Errorf("failed to insert link edit: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return edit, fmt.Errorf("failed to commit %w", err)
+	}
+	return edit, nil
+}
+
+func (s *dbstorage) URLHistory(ctx context.Context, shortURL, userID, workspaceID string) ([]models.LinkEdit, error) {
+	var owned bool
+	row := s.db.QueryRowContext(
 		ctx,
-		`INSERT INTO links (short_url, original_url, user_id) 
-		VALUES ($1, $2, $3) ON CONFLICT (original_url) DO NOTHING`,
+		"SELECT EXISTS (SELECT 1 FROM links WHERE short_url = $1 AND "+ownedLink+")",
 		shortURL,
-		originalURL,
 		userID,
+		workspaceID,
+	)
+	if err := row.Scan(&owned); err != nil {
+		return nil, fmt.Errorf("failed to check link owner: %w", err)
+	}
+	if !owned {
+		return nil, models.ErrNotFound
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT short_url, user_id, workspace_id, old_url, new_url, edited_at
+		FROM link_edits WHERE short_url = $1 ORDER BY edited_at, id`,
+		shortURL,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edits of link=%s: %w", shortURL, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	var edits []models.LinkEdit
+	for rows.Next() {
+		var e models.LinkEdit
+		if err := rows.Scan(&e.ShortURL, &e.UserID, &e.WorkspaceID, &e.OldURL, &e.NewURL, &e.EditedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan link edit: %w", err)
+		}
+		edits = append(edits, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during selecting link edits: %w", err)
+	}
+
+	return edits, nil
+}
+
+func (s *dbstorage) Put(ctx context.Context, link models.UserURLs, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
+	}()
+
+	if err := s.checkQuota(ctx, tx, userID, 1); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO links (short_url, original_url, user_id, workspace_id, domain, `+
+			`title, description, tags, folder, interstitial, redirect_code, pass_query, utm, password_hash, max_clicks)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT DO NOTHING`,
+		link.ShortURL,
+		link.OriginalURL,
+		userID,
+		link.WorkspaceID,
+		link.Domain,
+		link.Title,
+		link.Description,
+		tagsParam(link.Tags),
+		link.Folder,
+		link.Interstitial,
+		link.RedirectCode,
+		link.PassQuery,
+		utmParam(link.UTM),
+		link.PasswordHash,
+		link.MaxClicks,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert row: %w", err)
@@ -86,12 +326,273 @@ func (s *dbstorage) Put(ctx context.Context, shortURL, originalURL, userID strin
 	}
 
 	if count == 0 {
-		return ErrConflict
+		return models.ErrConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %w", err)
+	}
+	return nil
+}
+
+// checkQuota fails with quota.ErrLinksExceeded if newLinks more links of
+// userID would exceed the links quota. A limited user is locked until tx
+// ends, so parallel inserts can't both take the last free links.
+func (s *dbstorage) checkQuota(ctx context.Context, tx *sql.Tx, userID string, newLinks int) error {
+	var override models.Quota
+	err := tx.QueryRowContext(
+		ctx,
+		"SELECT max_links, max_batch_size FROM user_quotas WHERE user_id = $1",
+		userID,
+	).Scan(&override.MaxLinks, &override.MaxBatchSize)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get quota for userID=%s: %w", userID, err)
+	}
+	q := quota.Effective(s.cfg, override)
+	if q.MaxLinks <= 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", userID); err != nil {
+		return fmt.Errorf("failed to lock links of userID=%s: %w", userID, err)
+	}
+	var used int
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT count(*) FROM links WHERE user_id = $1 AND NOT is_deleted",
+		userID,
+	).Scan(&used)
+	if err != nil {
+		return fmt.Errorf("failed to count urls for userID=%s: %w", userID, err)
+	}
+	if !quota.Allows(q, used, newLinks) {
+		return quota.ErrLinksExceeded
+	}
+	return nil
+}
+
+// SetLinkPreview is a no-op when the link was repointed in the meantime.
+func (s *dbstorage) SetLinkPreview(
+	ctx context.Context,
+	shortURL, originalURL string,
+	preview models.LinkPreview,
+) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE links SET preview_title = $3, preview_description = $4, preview_image = $5, preview_fetched_at = $6
+		WHERE short_url = $1 AND original_url = $2`,
+		shortURL,
+		originalURL,
+		preview.Title,
+		preview.Description,
+		preview.Image,
+		preview.FetchedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set link preview: %w", err)
+	}
+	return nil
+}
+
+func (s *dbstorage) LinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+) ([]models.RedirectRule, error) {
+	var rules []models.RedirectRule
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT rules FROM links WHERE short_url = $1 AND NOT is_deleted AND "+ownedLink,
+		shortURL,
+		userID,
+		workspaceID,
+	)
+	err := row.Scan(jsonListScanner[models.RedirectRule]{"rules", &rules})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (s *dbstorage) SetLinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	rules []models.RedirectRule,
+) error {
+	data, err := jsonListParam(rules)
+	if err != nil {
+		return fmt.Errorf("failed to encode link rules: %w", err)
+	}
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE links SET rules = $4 WHERE short_url = $1 AND NOT is_deleted AND "+ownedLink,
+		shortURL,
+		userID,
+		workspaceID,
+		data,
+	)
+	if isUniqueViolation(err) {
+		return models.ErrURLExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set link rules: %w", err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// SetLinkVariants also drops the clicks of variants that were removed.
+func (s *dbstorage) SetLinkVariants(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	req models.LinkVariantsRequest,
+) error {
+	data, err := jsonListParam(req.Variants)
+	if err != nil {
+		return fmt.Errorf("failed to encode link variants: %w", err)
+	}
+	ids := make([]string, 0, len(req.Variants))
+	for _, variant := range req.Variants {
+		ids = append(ids, variant.ID)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
+	}()
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE links SET variants = $4, sticky_variants = $5 WHERE short_url = $1 AND NOT is_deleted AND "+ownedLink,
+		shortURL,
+		userID,
+		workspaceID,
+		data,
+		req.Sticky,
+	)
+	if isUniqueViolation(err) {
+		return models.ErrURLExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set link variants: %w", err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count == 0 {
+		return models.ErrNotFound
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM variant_clicks WHERE short_url = $1 AND variant_id <> ALL($2)",
+		shortURL,
+		ids,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete clicks of removed variants: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %w", err)
 	}
+	return nil
+}
 
+func (s *dbstorage) CountVariantClick(ctx context.Context, shortURL, variantID string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO variant_clicks (short_url, variant_id, clicks) VALUES ($1, $2, 1)
+		ON CONFLICT (short_url, variant_id) DO UPDATE SET clicks = variant_clicks.clicks + 1`,
+		shortURL,
+		variantID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to count variant click: %w", err)
+	}
 	return nil
 }
 
+func (s *dbstorage) LinkStats(ctx context.Context, shortURL, userID, workspaceID string) (models.LinkStats, error) {
+	stats := models.LinkStats{ShortURL: shortURL, Variants: []models.VariantStats{}}
+
+	var variants []models.LinkVariant
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT variants FROM links WHERE short_url = $1 AND "+ownedLink,
+		shortURL,
+		userID,
+		workspaceID,
+	)
+	err := row.Scan(jsonListScanner[models.LinkVariant]{"variants", &variants})
+	if errors.Is(err, sql.ErrNoRows) {
+		return stats, models.ErrNotFound
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to get link variants: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT variant_id, clicks FROM variant_clicks WHERE short_url = $1", shortURL)
+	if err != nil {
+		return stats, fmt.Errorf("failed to get variant clicks: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+	clicks := map[string]int{}
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return stats, fmt.Errorf("failed to scan variant clicks: %w", err)
+		}
+		clicks[id] = count
+	}
+	if err := rows.Err(); err != nil {
+		return stats, fmt.Errorf("failed to read variant clicks: %w", err)
+	}
+
+	for _, variant := range variants {
+		stats.Variants = append(stats.Variants, models.VariantStats{LinkVariant: variant, Clicks: clicks[variant.ID]})
+	}
+	return stats, nil
+}
+
+// ConsumeClick counts the click in a single conditional UPDATE, so
+// concurrent redirects can't follow a limited link more than max_clicks times.
+func (s *dbstorage) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	result, err := s.db.ExecContext(
+		ctx,
+		`UPDATE links SET clicks = clicks + 1
+		WHERE short_url = $1 AND NOT is_deleted AND (max_clicks = 0 OR clicks < max_clicks)`,
+		shortURL,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to count click: %w", err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to count affected rows %w", err)
+	}
+	return count == 1, nil
+}
+
 func (s *dbstorage) Ping(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
@@ -107,22 +608,34 @@ func (s *dbstorage) Batch(ctx context.Context, urls []models.UserURLs, userID st
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	if err := s.checkQuota(ctx, tx, userID, len(urls)); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return fmt.Errorf("failed to rollback %w", err)
+		}
+		return err
+	}
 
 	values := make([]string, len(urls))
 
 	for index := range urls {
-		values[index] = "( $" + strconv.Itoa(2*index+1) +
-			", $" + strconv.Itoa(2*index+2) +
-			", $" + strconv.Itoa(2*len(urls)+1) + ")"
+		placeholders := make([]string, batchColumns, batchColumns+1)
+		for column := range placeholders {
+			placeholders[column] = "$" + strconv.Itoa(batchColumns*index+column+1)
+		}
+		placeholders = append(placeholders, "$"+strconv.Itoa(batchColumns*len(urls)+1))
+		values[index] = "(" + strings.Join(placeholders, ", ") + ")"
 	}
 
-	query := "INSERT INTO links (short_url, original_url, user_id) VALUES " + strings.Join(values, ", ")
+	query := "INSERT INTO links (" + linkColumns + ", user_id) VALUES " + strings.Join(values, ", ")
 
 	_, err = tx.ExecContext(ctx, query, generateQueryValues(urls, userID)...)
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
 			return fmt.Errorf("failed to rollback %w", err)
 		}
+		if isUniqueViolation(err) {
+			return models.ErrConflict
+		}
 		return fmt.Errorf("failed to insert line in table with %w", err)
 	}
 
@@ -133,46 +646,20 @@ func (s *dbstorage) Batch(ctx context.Context, urls []models.UserURLs, userID st
 	return nil
 }
 
-func (s *dbstorage) UserURLs(ctx context.Context, userID string) ([]models.UserURLs, error) {
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open connection to db %w", err)
-	}
-	defer func() {
-		err := conn.Close()
-		log.Printf("failed to close db connection for getting user urls: %v", err)
-	}()
+// linkFilter applies a models.URLFilter passed as $2 (tag) and $3 (folder).
+const linkFilter = "($2 = '' OR $2 = ANY (tags)) AND ($3 = '' OR folder = $3)"
 
-	rows, err := conn.QueryContext(
+func (s *dbstorage) UserURLs(ctx context.Context, userID string, filter models.URLFilter) ([]models.UserURLs, error) {
+	urls, err := s.queryLinks(
 		ctx,
-		"SELECT short_url, original_url FROM links WHERE user_id = $1",
+		"SELECT "+selectColumns+" FROM links WHERE user_id = $1 AND workspace_id = '' AND "+linkFilter,
 		userID,
+		filter.Tag,
+		filter.Folder,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get users rows with userID=%s: %w", userID, err)
 	}
-	defer func() {
-		err := rows.Close()
-		log.Printf("failed to close row: %v", err)
-	}()
-
-	var urls []models.UserURLs
-	for rows.Next() {
-		var row models.UserURLs
-
-		err = rows.Scan(&row.ShortURL, &row.OriginalURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan urls %w", err)
-		}
-
-		urls = append(urls, row)
-	}
-
-	err = rows.Err()
-	if err != nil {
-		return nil, fmt.Errorf("failed during selecting urls %w", err)
-	}
-
 	return urls, nil
 }
 
@@ -187,7 +674,7 @@ func (s *dbstorage) DeleteUserURls(ctx context.Context, urls []string, userID st
 	}()
 
 	_, err = conn.ExecContext(ctx,
-		"UPDATE links SET is_deleted = true WHERE user_id = $1 AND short_url = any($2)",
+		"UPDATE links SET is_deleted = true WHERE user_id = $1 AND workspace_id = '' AND short_url = any($2)",
 		userID,
 		urls,
 	)
@@ -198,12 +685,472 @@ func (s *dbstorage) DeleteUserURls(ctx context.Context, urls []string, userID st
 	return nil
 }
 
-func (s *dbstorage) Close() error {
-	err := s.db.Close()
+func (s *dbstorage) WorkspaceURLs(
+	ctx context.Context,
+	workspaceID string,
+	filter models.URLFilter,
+) ([]models.UserURLs, error) {
+	urls, err := s.queryLinks(
+		ctx,
+		"SELECT "+selectColumns+" FROM links WHERE workspace_id = $1 AND "+linkFilter,
+		workspaceID,
+		filter.Tag,
+		filter.Folder,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to close db: %w", err)
+		return nil, fmt.Errorf("failed to get links of workspace=%s: %w", workspaceID, err)
 	}
-	return nil
+	return urls, nil
+}
+
+func (s *dbstorage) TagCounts(ctx context.Context, userID, workspaceID string) ([]models.TagCount, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT tag, count(*) FROM links, unnest(tags) AS tag
+		WHERE NOT is_deleted
+		AND CASE WHEN $2 = '' THEN user_id = $1 AND workspace_id = '' ELSE workspace_id = $2 END
+		GROUP BY tag ORDER BY count(*) DESC, tag`,
+		userID,
+		workspaceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tags: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	tags := []models.TagCount{}
+	for rows.Next() {
+		var tag models.TagCount
+		if err := rows.Scan(&tag.Tag, &tag.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan tag count: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during counting tags: %w", err)
+	}
+
+	return tags, nil
+}
+
+func (s *dbstorage) DeleteWorkspaceURLs(ctx context.Context, urls []string, workspaceID string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE links SET is_deleted = true WHERE workspace_id = $1 AND short_url = any($2)",
+		workspaceID,
+		urls,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete links of workspace=%s: %w", workspaceID, err)
+	}
+	return nil
+}
+
+func (s *dbstorage) CountUserURLs(ctx context.Context, userID string) (int, error) {
+	var count int
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT count(*) FROM links WHERE user_id = $1 AND NOT is_deleted",
+		userID,
+	)
+	if err := row.Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count urls for userID=%s: %w", userID, err)
+	}
+	return count, nil
+}
+
+func (s *dbstorage) UserQuota(ctx context.Context, userID string) (models.Quota, error) {
+	var quota models.Quota
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT max_links, max_batch_size FROM user_quotas WHERE user_id = $1",
+		userID,
+	)
+	err := row.Scan(&quota.MaxLinks, &quota.MaxBatchSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return quota, nil
+	}
+	if err != nil {
+		return quota, fmt.Errorf("failed to get quota for userID=%s: %w", userID, err)
+	}
+	return quota, nil
+}
+
+func (s *dbstorage) CreateAccount(ctx context.Context, account models.Account) error {
+	result, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO accounts (id, login, password_hash, created_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		account.ID,
+		account.Login,
+		account.PasswordHash,
+		account.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert account: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count == 0 {
+		return models.ErrAccountExists
+	}
+
+	return nil
+}
+
+func (s *dbstorage) AccountByLogin(ctx context.Context, login string) (models.Account, error) {
+	return s.account(ctx, "SELECT id, login, password_hash, created_at FROM accounts WHERE login = $1", login)
+}
+
+func (s *dbstorage) AccountByID(ctx context.Context, id string) (models.Account, error) {
+	return s.account(ctx, "SELECT id, login, password_hash, created_at FROM accounts WHERE id = $1", id)
+}
+
+func (s *dbstorage) account(ctx context.Context, query string, arg string) (models.Account, error) {
+	var account models.Account
+	row := s.db.QueryRowContext(ctx, query, arg)
+	err := row.Scan(&account.ID, &account.Login, &account.PasswordHash, &account.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return account, models.ErrNotFound
+	}
+	if err != nil {
+		return account, fmt.Errorf("failed to scan account: %w", err)
+	}
+	return account, nil
+}
+
+func (s *dbstorage) ClaimUserURLs(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE links SET user_id = $2 WHERE user_id = $1", fromUserID, toUserID)
+	if err != nil {
+		return fmt.Errorf("failed to claim links of userID=%s: %w", fromUserID, err)
+	}
+	return nil
+}
+
+func (s *dbstorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO api_keys (id, user_id, name, key_hash, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		key.ID,
+		key.UserID,
+		key.Name,
+		key.KeyHash,
+		key.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert api key: %w", err)
+	}
+	return nil
+}
+
+func (s *dbstorage) UserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT id, user_id, name, key_hash, created_at, revoked
+		FROM api_keys WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys of userID=%s: %w", userID, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		var key models.APIKey
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, &key.CreatedAt, &key.Revoked); err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during selecting api keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (s *dbstorage) RevokeAPIKey(ctx context.Context, id, userID string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked = true WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *dbstorage) UserIDByAPIKey(ctx context.Context, keyHash string) (string, error) {
+	var userID string
+	row := s.db.QueryRowContext(ctx, "SELECT user_id FROM api_keys WHERE key_hash = $1 AND NOT revoked", keyHash)
+	err := row.Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", models.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get api key: %w", err)
+	}
+	return userID, nil
+}
+
+func (s *dbstorage) CreateWorkspace(ctx context.Context, workspace models.Workspace, ownerID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
+	}()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO workspaces (id, name, created_at) VALUES ($1, $2, $3)",
+		workspace.ID,
+		workspace.Name,
+		workspace.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert workspace: %w", err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES ($1, $2, 'owner', $3)",
+		workspace.ID,
+		ownerID,
+		workspace.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert workspace owner: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %w", err)
+	}
+	return nil
+}
+
+func (s *dbstorage) UserWorkspaces(ctx context.Context, userID string) ([]models.UserWorkspace, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT w.id, w.name, w.created_at, m.role
+		FROM workspace_members m JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = $1 ORDER BY w.created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces of userID=%s: %w", userID, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	var workspaces []models.UserWorkspace
+	for rows.Next() {
+		var w models.UserWorkspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.CreatedAt, &w.Role); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %w", err)
+		}
+		workspaces = append(workspaces, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during selecting workspaces: %w", err)
+	}
+
+	return workspaces, nil
+}
+
+func (s *dbstorage) WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	var role string
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspaceID,
+		userID,
+	)
+	err := row.Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", models.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get workspace role: %w", err)
+	}
+	return role, nil
+}
+
+func (s *dbstorage) WorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT workspace_id, user_id, role, created_at
+		FROM workspace_members WHERE workspace_id = $1 ORDER BY created_at`,
+		workspaceID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members of workspace=%s: %w", workspaceID, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	var members []models.WorkspaceMember
+	for rows.Next() {
+		var m models.WorkspaceMember
+		if err := rows.Scan(&m.WorkspaceID, &m.UserID, &m.Role, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace member: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during selecting workspace members: %w", err)
+	}
+
+	return members, nil
+}
+
+func (s *dbstorage) SetWorkspaceMember(ctx context.Context, member models.WorkspaceMember) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		member.WorkspaceID,
+		member.UserID,
+		member.Role,
+		member.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set workspace member: %w", err)
+	}
+	return nil
+}
+
+func (s *dbstorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	result, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspaceID,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove workspace member: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func (s *dbstorage) CreateWorkspaceInvite(ctx context.Context, invite models.WorkspaceInvite) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO workspace_invites (token_hash, workspace_id, role, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		invite.TokenHash,
+		invite.WorkspaceID,
+		invite.Role,
+		invite.CreatedBy,
+		invite.CreatedAt,
+		invite.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert workspace invite: %w", err)
+	}
+	return nil
+}
+
+func (s *dbstorage) AcceptWorkspaceInvite(
+	ctx context.Context,
+	tokenHash, userID string,
+	now time.Time,
+) (models.WorkspaceMember, error) {
+	member := models.WorkspaceMember{UserID: userID, CreatedAt: now}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return member, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
+	}()
+
+	row := tx.QueryRowContext(
+		ctx,
+		`UPDATE workspace_invites SET accepted_by = $2
+		WHERE token_hash = $1 AND accepted_by = '' AND expires_at > $3
+		RETURNING workspace_id, role`,
+		tokenHash,
+		userID,
+		now,
+	)
+	err = row.Scan(&member.WorkspaceID, &member.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return member, models.ErrNotFound
+	}
+	if err != nil {
+		return member, fmt.Errorf("failed to consume workspace invite: %w", err)
+	}
+
+	row = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = workspace_members.role
+		RETURNING role, created_at`,
+		member.WorkspaceID,
+		userID,
+		member.Role,
+		now,
+	)
+	if err := row.Scan(&member.Role, &member.CreatedAt); err != nil {
+		return member, fmt.Errorf("failed to add workspace member: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return member, fmt.Errorf("failed to commit %w", err)
+	}
+	return member, nil
+}
+
+// DB returns the connection pool, so others keeping their own tables don't
+// open another one.
+func (s *dbstorage) DB() *sql.DB {
+	return s.db
+}
+
+func (s *dbstorage) Close() error {
+	err := s.db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close db: %w", err)
+	}
+	return nil
 }
 
 func setUpDatabase(ctx context.Context, db *sql.DB) error {
@@ -229,18 +1176,522 @@ func setUpDatabase(ctx context.Context, db *sql.DB) error {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
 
-	_, err = conn.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS id_url ON links (original_url)`)
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS user_quotas (
+			user_id VARCHAR(36) PRIMARY KEY,
+			max_links INTEGER NOT NULL DEFAULT 0,
+			max_batch_size INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create user_quotas table: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS accounts (
+			id VARCHAR(36) PRIMARY KEY,
+			login VARCHAR(255) NOT NULL UNIQUE,
+			password_hash VARCHAR(255) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create accounts table: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id VARCHAR(36) NOT NULL,
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			key_hash VARCHAR(64) NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			revoked BOOLEAN NOT NULL DEFAULT false
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to set api_keys index: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links ADD COLUMN IF NOT EXISTS workspace_id VARCHAR(36) NOT NULL DEFAULT ''`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add workspace_id column: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS links_workspace_id ON links (workspace_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to set links workspace index: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS workspaces (
+			id VARCHAR(36) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create workspaces table: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS workspace_members (
+			workspace_id VARCHAR(36) NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			user_id VARCHAR(36) NOT NULL,
+			role VARCHAR(16) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (workspace_id, user_id)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create workspace_members table: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS workspace_members_user_id ON workspace_members (user_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to set workspace_members index: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS workspace_invites (
+			token_hash VARCHAR(64) PRIMARY KEY,
+			workspace_id VARCHAR(36) NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+			role VARCHAR(16) NOT NULL,
+			created_by VARCHAR(36) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			accepted_by VARCHAR(36) NOT NULL DEFAULT ''
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create workspace_invites table: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS link_edits (
+			id SERIAL PRIMARY KEY,
+			short_url VARCHAR(128) NOT NULL,
+			user_id VARCHAR(36) NOT NULL,
+			workspace_id VARCHAR(36) NOT NULL DEFAULT '',
+			old_url VARCHAR(1024) NOT NULL,
+			new_url VARCHAR(1024) NOT NULL,
+			edited_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create link_edits table: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS link_edits_short_url ON link_edits (short_url)`)
+	if err != nil {
+		return fmt.Errorf("failed to set link_edits index: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links
+			ADD COLUMN IF NOT EXISTS title VARCHAR(255) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS description VARCHAR(1024) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}',
+			ADD COLUMN IF NOT EXISTS folder VARCHAR(255) NOT NULL DEFAULT ''`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link metadata columns: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS links_tags ON links USING GIN (tags)`)
+	if err != nil {
+		return fmt.Errorf("failed to set links tags index: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links
+			ADD COLUMN IF NOT EXISTS preview_title VARCHAR(255) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS preview_description VARCHAR(1024) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS preview_image VARCHAR(1024) NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS preview_fetched_at TIMESTAMPTZ`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link preview columns: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT false`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link interstitial column: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links ADD COLUMN IF NOT EXISTS password_hash VARCHAR(255) NOT NULL DEFAULT ''`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link password column: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links
+			ADD COLUMN IF NOT EXISTS max_clicks INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS clicks INTEGER NOT NULL DEFAULT 0`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link click columns: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links
+			ADD COLUMN IF NOT EXISTS redirect_code SMALLINT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS pass_query BOOLEAN NOT NULL DEFAULT false,
+			ADD COLUMN IF NOT EXISTS utm JSONB NOT NULL DEFAULT '{}'`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link redirect columns: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links ADD COLUMN IF NOT EXISTS rules JSONB NOT NULL DEFAULT '[]'`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link rules column: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`ALTER TABLE links
+			ADD COLUMN IF NOT EXISTS variants JSONB NOT NULL DEFAULT '[]',
+			ADD COLUMN IF NOT EXISTS sticky_variants BOOLEAN NOT NULL DEFAULT false`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add link variant columns: %w", err)
+	}
+
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS variant_clicks (
+			short_url VARCHAR(128) NOT NULL,
+			variant_id VARCHAR(64) NOT NULL,
+			clicks BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (short_url, variant_id)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create variant_clicks table: %w", err)
+	}
+
+	// A destination gets one link per domain, which replaces the old
+	// id_url index on original_url alone.
+	_, err = conn.ExecContext(ctx, `ALTER TABLE links ADD COLUMN IF NOT EXISTS domain VARCHAR(255) NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("failed to add link domain column: %w", err)
+	}
+	// Other links never share their code, so a destination may have any
+	// number of them next to its shared link. That replaces the
+	// id_domain_url index on all links.
+	_, err = conn.ExecContext(
+		ctx,
+		`CREATE UNIQUE INDEX IF NOT EXISTS id_domain_shared_url ON links (domain, original_url) WHERE `+sharedLink,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set domain index: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, `DROP INDEX IF EXISTS id_domain_url`)
 	if err != nil {
-		return fmt.Errorf("failed to set index: %w", err)
+		return fmt.Errorf("failed to drop domain index: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, `DROP INDEX IF EXISTS id_url`)
+	if err != nil {
+		return fmt.Errorf("failed to drop url index: %w", err)
+	}
+
+	if err := migrateLegacyKeys(ctx, conn); err != nil {
+		return fmt.Errorf("failed to migrate links to keys: %w", err)
+	}
+
+	// Put relies on the index to never save two links under one code,
+	// whether they are shared or not.
+	if err := separateDuplicateKeys(ctx, conn); err != nil {
+		return fmt.Errorf("failed to separate duplicate keys: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS id_short_url ON links (short_url)`)
+	if err != nil {
+		return fmt.Errorf("failed to set short url index: %w", err)
+	}
+	return nil
+}
+
+// separateDuplicateKeys moves all but the oldest of the links saved under
+// the same key to the key with their id appended. Such links could be
+// saved while only shared links had a unique index.
+func separateDuplicateKeys(ctx context.Context, conn *sql.Conn) error {
+	result, err := conn.ExecContext(
+		ctx,
+		`UPDATE links l SET short_url = l.short_url || '-' || l.id
+		WHERE EXISTS (SELECT 1 FROM links f WHERE f.short_url = l.short_url AND f.id < l.id)`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rekey links: %w", err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if count > 0 {
+		log.Printf("moved %d links sharing their key with an older link to the key with their id appended", count)
 	}
 	return nil
 }
 
+// legacyKey is the key of link l stored under its full short URL, see
+// domains.LegacyKey.
+const legacyKey = "CASE WHEN l.domain = '' THEN '' ELSE l.domain || '/' END || regexp_replace(l.short_url, '^.*/', '')"
+
+// migrateLegacyKeys rekeys links stored under their full short URL, as they
+// were before links were keyed by code, along with their edits and variant
+// clicks. A link whose key is taken, by a link of another base URL with the
+// same code or one saved under its key already, gets the key with its id
+// appended. Migrated rows no longer match, so it runs on every start.
+func migrateLegacyKeys(ctx context.Context, conn *sql.Conn) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("failed to rollback: %v", err)
+		}
+	}()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`CREATE TEMPORARY TABLE legacy_keys ON COMMIT DROP AS
+		SELECT l.id, l.short_url, `+legacyKey+` AS key FROM links l WHERE l.short_url LIKE '%://%'`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to collect legacy keys: %w", err)
+	}
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE legacy_keys t SET key = t.key || '-' || t.id
+		WHERE EXISTS (SELECT 1 FROM links o WHERE o.short_url = t.key)
+			OR EXISTS (SELECT 1 FROM legacy_keys o WHERE o.key = t.key AND o.id < t.id)`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to move taken keys: %w", err)
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to count affected rows %w", err)
+	}
+	if moved > 0 {
+		log.Printf("the keys of %d legacy links are taken, they are moved to the key with their id appended", moved)
+	}
+
+	statements := []string{
+		`UPDATE link_edits e SET short_url = t.key FROM legacy_keys t WHERE e.short_url = t.short_url`,
+		`UPDATE variant_clicks v SET short_url = t.key FROM legacy_keys t WHERE v.short_url = t.short_url`,
+		`UPDATE links l SET short_url = t.key FROM legacy_keys t WHERE l.id = t.id`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to rekey links: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %w", err)
+	}
+	return nil
+}
+
+// batchColumns is the number of linkColumns, which generateQueryValues
+// emits per link.
+const batchColumns = 14
+
 func generateQueryValues(urls []models.UserURLs, userID string) []any {
 	keys := []any{}
 	for _, row := range urls {
-		keys = append(keys, row.ShortURL, row.OriginalURL)
+		keys = append(keys,
+			row.ShortURL,
+			row.OriginalURL,
+			row.WorkspaceID,
+			row.Domain,
+			row.Title,
+			row.Description,
+			tagsParam(row.Tags),
+			row.Folder,
+			row.Interstitial,
+			row.RedirectCode,
+			row.PassQuery,
+			utmParam(row.UTM),
+			row.PasswordHash,
+			row.MaxClicks,
+		)
 	}
 	keys = append(keys, userID)
 	return keys
 }
+
+// tagsParam keeps nil tags from turning into a NULL array.
+func tagsParam(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// utmParam stores missing UTM parameters as an empty object.
+func utmParam(utm *models.UTMParams) string {
+	if utm == nil {
+		return "{}"
+	}
+	data, err := json.Marshal(utm)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// utmScanner reads the utm JSONB column, leaving an empty object as nil.
+type utmScanner struct {
+	dst **models.UTMParams
+}
+
+func (s utmScanner) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected utm column type %T", src)
+	}
+	var utm models.UTMParams
+	if err := json.Unmarshal(data, &utm); err != nil {
+		return fmt.Errorf("failed to decode utm: %w", err)
+	}
+	if utm != (models.UTMParams{}) {
+		*s.dst = &utm
+	}
+	return nil
+}
+
+// jsonListScanner reads a JSONB array column, leaving an empty array as nil.
+type jsonListScanner[T any] struct {
+	column string
+	dst    *[]T
+}
+
+func (s jsonListScanner[T]) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected %s column type %T", s.column, src)
+	}
+	var list []T
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", s.column, err)
+	}
+	if len(list) > 0 {
+		*s.dst = list
+	}
+	return nil
+}
+
+// jsonListParam stores a missing list as an empty array.
+func jsonListParam[T any](list []T) (string, error) {
+	if list == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode list: %w", err)
+	}
+	return string(data), nil
+}
+
+// scanLink reads the selectColumns followed by extra destinations. Tags need
+// the pgtype map because database/sql can't scan arrays on its own.
+func scanLink(row interface{ Scan(dest ...any) error }, m *pgtype.Map, extra ...any) (models.UserURLs, error) {
+	var link models.UserURLs
+	var preview models.LinkPreview
+	var fetchedAt sql.NullTime
+	dest := []any{
+		&link.ShortURL,
+		&link.OriginalURL,
+		&link.WorkspaceID,
+		&link.Domain,
+		&link.Title,
+		&link.Description,
+		m.SQLScanner(&link.Tags),
+		&link.Folder,
+		&link.Interstitial,
+		&link.RedirectCode,
+		&link.PassQuery,
+		utmScanner{&link.UTM},
+		&link.PasswordHash,
+		&link.MaxClicks,
+		&preview.Title,
+		&preview.Description,
+		&preview.Image,
+		&fetchedAt,
+		&link.Clicks,
+		jsonListScanner[models.RedirectRule]{"rules", &link.Rules},
+		jsonListScanner[models.LinkVariant]{"variants", &link.Variants},
+		&link.StickyVariants,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if fetchedAt.Valid {
+		preview.FetchedAt = fetchedAt.Time
+		link.Preview = &preview
+	}
+	return link, err
+}
+
+func (s *dbstorage) queryLinks(ctx context.Context, query string, args ...any) ([]models.UserURLs, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query links: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %v", err)
+		}
+	}()
+
+	m := pgtype.NewMap()
+	var urls []models.UserURLs
+	for rows.Next() {
+		row, err := scanLink(rows, m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan urls %w", err)
+		}
+		urls = append(urls, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during selecting urls %w", err)
+	}
+
+	return urls, nil
+}
@@ -4,28 +4,94 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"shorty/internal/app/models"
 	"shorty/internal/app/storage/mapstorage"
+	"sync"
+	"time"
 )
 
 type fileStorage struct {
 	mapStorage *mapstorage.MapStorage
 	filePath   string
+	stateMu    *sync.Mutex
+	// clicksCounted reports variant clicks that are not saved yet, it is
+	// guarded by stateMu.
+	clicksCounted bool
+	// fileMu keeps appends and rewrites of the links file from interleaving.
+	fileMu *sync.Mutex
+	done   chan struct{}
 }
 
 const filePerm = 0666
+const stateFileSuffix = ".state"
+
+// clicksFlushInterval is how often counted variant clicks are saved, so a
+// split redirect doesn't rewrite the state file.
+const clicksFlushInterval = time.Second
 
 type fileLine struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
 	UserID      string `json:"user_id"`
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	Domain      string `json:"domain,omitempty"`
 	IsDeleted   bool   `json:"is_deleted"`
+	models.LinkMetadata
+	Preview        *models.LinkPreview   `json:"preview,omitempty"`
+	PasswordHash   string                `json:"password_hash,omitempty"`
+	MaxClicks      int                   `json:"max_clicks,omitempty"`
+	Clicks         int                   `json:"clicks,omitempty"`
+	Rules          []models.RedirectRule `json:"rules,omitempty"`
+	Variants       []models.LinkVariant  `json:"variants,omitempty"`
+	StickyVariants bool                  `json:"sticky_variants,omitempty"`
+	// Click marks a line that only counts a click of the link saved under
+	// ShortURL, so limited redirects append to the file instead of
+	// rewriting it. A rewrite folds them into Clicks.
+	Click bool `json:"click,omitempty"`
+	// PreviewUpdate marks a line that only sets the Preview of the link
+	// saved under ShortURL, if it still points to OriginalURL, so fetched
+	// previews are appended like clicks.
+	PreviewUpdate bool `json:"preview_update,omitempty"`
 }
 
-func (s *fileStorage) Put(ctx context.Context, shortURL, originalURL, userID string) error {
+func (s *fileStorage) Put(ctx context.Context, link models.UserURLs, userID string) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.mapStorage.Put(ctx, link, userID); err != nil {
+		return fmt.Errorf("failed to save line in map storage %w", err)
+	}
+	return s.appendLinks([]models.UserURLs{link}, userID)
+}
+
+// appendLinks writes new links to the end of the file, the caller holds
+// fileMu.
+func (s *fileStorage) appendLinks(links []models.UserURLs, userID string) error {
+	lines := make([]fileLine, 0, len(links))
+	for _, link := range links {
+		lines = append(lines, fileLine{
+			ShortURL:       link.ShortURL,
+			OriginalURL:    link.OriginalURL,
+			UserID:         userID,
+			WorkspaceID:    link.WorkspaceID,
+			Domain:         link.Domain,
+			LinkMetadata:   link.LinkMetadata,
+			PasswordHash:   link.PasswordHash,
+			MaxClicks:      link.MaxClicks,
+			Clicks:         link.Clicks,
+			Rules:          link.Rules,
+			Variants:       link.Variants,
+			StickyVariants: link.StickyVariants,
+		})
+	}
+	return s.appendLines(lines)
+}
+
+// appendLines writes lines to the end of the file, the caller holds fileMu.
+func (s *fileStorage) appendLines(lines []fileLine) error {
 	file, err := os.OpenFile(s.filePath, os.O_WRONLY|os.O_APPEND, filePerm)
 	if err != nil {
 		return fmt.Errorf("failed to open the file fo saving \"%s\": %w", s.filePath, err)
@@ -35,32 +101,159 @@ func (s *fileStorage) Put(ctx context.Context, shortURL, originalURL, userID str
 		log.Printf("failed to close file for saving: %v", err)
 	}()
 
-	line := fileLine{ShortURL: shortURL, OriginalURL: originalURL, UserID: userID}
-	data, err := json.Marshal(&line)
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		data, err := json.Marshal(&line)
+		if err != nil {
+			return fmt.Errorf("failed to encode json for saving: %w", err)
+		}
+		data = append(data, '\n')
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("failed to save data to file %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to save data to file %w", err)
+	}
+	return nil
+}
+
+func (s *fileStorage) Get(ctx context.Context, shortURL string) (models.UserURLs, error) {
+	urls, err := s.mapStorage.Get(ctx, shortURL)
 	if err != nil {
-		return fmt.Errorf("failed to encode json for saving: %w", err)
+		return urls, fmt.Errorf("failed to get links from map storage: %w", err)
 	}
-	data = append(data, '\n')
 
-	_, err = file.Write(data)
+	return urls, nil
+}
+
+func (s *fileStorage) GetByOriginalURL(ctx context.Context, domain, originalURL string) (models.UserURLs, error) {
+	link, err := s.mapStorage.GetByOriginalURL(ctx, domain, originalURL)
 	if err != nil {
-		return fmt.Errorf("failed to save data to file %w", err)
+		return link, fmt.Errorf("failed to get link by original url from map storage: %w", err)
 	}
+	return link, nil
+}
 
-	if err := s.mapStorage.Put(ctx, shortURL, originalURL, userID); err != nil {
-		return fmt.Errorf("failed to save line in map storage %w", err)
+func (s *fileStorage) OwnedLink(ctx context.Context, shortURL, userID, workspaceID string) (models.UserURLs, error) {
+	link, err := s.mapStorage.OwnedLink(ctx, shortURL, userID, workspaceID)
+	if err != nil {
+		return link, fmt.Errorf("failed to get owned link from map storage: %w", err)
+	}
+	return link, nil
+}
+
+// EditURL appends the edited link, whose line replaces the earlier ones of
+// its key when the file is loaded.
+func (s *fileStorage) EditURL(ctx context.Context, edit models.LinkEdit) (models.LinkEdit, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	edit, err := s.mapStorage.EditURL(ctx, edit)
+	if err != nil {
+		return edit, fmt.Errorf("failed to edit link in map storage: %w", err)
+	}
+	item, _ := s.mapStorage.Item(edit.ShortURL)
+	if err := s.appendLines([]fileLine{itemLine(edit.ShortURL, item)}); err != nil {
+		return edit, err
+	}
+	return edit, s.saveState()
+}
+
+func (s *fileStorage) URLHistory(ctx context.Context, shortURL, userID, workspaceID string) ([]models.LinkEdit, error) {
+	edits, err := s.mapStorage.URLHistory(ctx, shortURL, userID, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link history from map storage: %w", err)
+	}
+	return edits, nil
+}
+
+func (s *fileStorage) LinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+) ([]models.RedirectRule, error) {
+	rules, err := s.mapStorage.LinkRules(ctx, shortURL, userID, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link rules from map storage: %w", err)
+	}
+	return rules, nil
+}
+
+func (s *fileStorage) SetLinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	rules []models.RedirectRule,
+) error {
+	if err := s.mapStorage.SetLinkRules(ctx, shortURL, userID, workspaceID, rules); err != nil {
+		return fmt.Errorf("failed to set link rules in map storage: %w", err)
 	}
+	return s.rewrite()
+}
 
+func (s *fileStorage) SetLinkVariants(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	req models.LinkVariantsRequest,
+) error {
+	if err := s.mapStorage.SetLinkVariants(ctx, shortURL, userID, workspaceID, req); err != nil {
+		return fmt.Errorf("failed to set link variants in map storage: %w", err)
+	}
+	if err := s.rewrite(); err != nil {
+		return err
+	}
+	return s.saveState()
+}
+
+// CountVariantClick leaves saving the click to flushClicks.
+func (s *fileStorage) CountVariantClick(ctx context.Context, shortURL, variantID string) error {
+	if err := s.mapStorage.CountVariantClick(ctx, shortURL, variantID); err != nil {
+		return fmt.Errorf("failed to count variant click in map storage: %w", err)
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.clicksCounted = true
 	return nil
 }
 
-func (s *fileStorage) Get(ctx context.Context, shortURL string) (models.UserURLs, error) {
-	urls, err := s.mapStorage.Get(ctx, shortURL)
+func (s *fileStorage) LinkStats(ctx context.Context, shortURL, userID, workspaceID string) (models.LinkStats, error) {
+	stats, err := s.mapStorage.LinkStats(ctx, shortURL, userID, workspaceID)
 	if err != nil {
-		return urls, fmt.Errorf("failed to get links from map storage: %w", err)
+		return stats, fmt.Errorf("failed to get link stats from map storage: %w", err)
+	}
+	return stats, nil
+}
+
+// SetLinkPreview appends a preview line, see ConsumeClick.
+func (s *fileStorage) SetLinkPreview(
+	ctx context.Context,
+	shortURL, originalURL string,
+	preview models.LinkPreview,
+) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.mapStorage.SetLinkPreview(ctx, shortURL, originalURL, preview); err != nil {
+		return fmt.Errorf("failed to set link preview in map storage: %w", err)
 	}
+	return s.appendLines([]fileLine{{
+		ShortURL:      shortURL,
+		OriginalURL:   originalURL,
+		Preview:       &preview,
+		PreviewUpdate: true,
+	}})
+}
 
-	return urls, nil
+// ConsumeClick appends a click line. It holds fileMu throughout, so a
+// concurrent rewrite either includes the click or keeps its line.
+func (s *fileStorage) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	ok, err := s.mapStorage.ConsumeClick(ctx, shortURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to count click in map storage: %w", err)
+	}
+	if !ok {
+		return false, nil
+	}
+	return true, s.appendLines([]fileLine{{ShortURL: shortURL, Click: true}})
 }
 
 func (s *fileStorage) Ping(ctx context.Context) error {
@@ -68,16 +261,16 @@ func (s *fileStorage) Ping(ctx context.Context) error {
 }
 
 func (s *fileStorage) Batch(ctx context.Context, urls []models.UserURLs, userID string) error {
-	for _, url := range urls {
-		if err := s.Put(ctx, url.ShortURL, url.OriginalURL, userID); err != nil {
-			return err
-		}
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.mapStorage.Batch(ctx, urls, userID); err != nil {
+		return fmt.Errorf("failed to save batch in map storage %w", err)
 	}
-	return nil
+	return s.appendLinks(urls, userID)
 }
 
-func (s *fileStorage) UserURLs(ctx context.Context, userID string) ([]models.UserURLs, error) {
-	urls, err := s.mapStorage.UserURLs(ctx, userID)
+func (s *fileStorage) UserURLs(ctx context.Context, userID string, filter models.URLFilter) ([]models.UserURLs, error) {
+	urls, err := s.mapStorage.UserURLs(ctx, userID, filter)
 	if err != nil {
 		return urls, fmt.Errorf("failed to get user links from map storage: %w", err)
 	}
@@ -90,34 +283,277 @@ func (s *fileStorage) DeleteUserURls(ctx context.Context, shortURLs []string, us
 		return fmt.Errorf("failed to delete links from map storage: %w", err)
 	}
 
-	file, err := os.OpenFile(s.filePath, os.O_WRONLY|os.O_CREATE, filePerm)
+	return s.rewrite()
+}
+
+func (s *fileStorage) WorkspaceURLs(
+	ctx context.Context,
+	workspaceID string,
+	filter models.URLFilter,
+) ([]models.UserURLs, error) {
+	urls, err := s.mapStorage.WorkspaceURLs(ctx, workspaceID, filter)
+	if err != nil {
+		return urls, fmt.Errorf("failed to get workspace links from map storage: %w", err)
+	}
+	return urls, nil
+}
+
+func (s *fileStorage) TagCounts(ctx context.Context, userID, workspaceID string) ([]models.TagCount, error) {
+	tags, err := s.mapStorage.TagCounts(ctx, userID, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tags in map storage: %w", err)
+	}
+	return tags, nil
+}
+
+func (s *fileStorage) DeleteWorkspaceURLs(ctx context.Context, shortURLs []string, workspaceID string) error {
+	if err := s.mapStorage.DeleteWorkspaceURLs(ctx, shortURLs, workspaceID); err != nil {
+		return fmt.Errorf("failed to delete workspace links from map storage: %w", err)
+	}
+	return s.rewrite()
+}
+
+// rewrite replaces the file with the current links. It writes them to a
+// temporary file first, so a failed rewrite leaves the old file in place.
+func (s *fileStorage) rewrite() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	tmpPath := s.filePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
 	if err != nil {
-		return fmt.Errorf("failed to open the file for deleting \"%s\": %w", s.filePath, err)
+		return fmt.Errorf("failed to open the file for rewriting \"%s\": %w", tmpPath, err)
 	}
 	defer func() {
-		err := file.Close()
-		log.Printf("failed to close file for deleting: %v", err)
+		if err := file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Printf("failed to close file for rewriting: %v", err)
+		}
 	}()
 
-	for shortURL, item := range s.mapStorage.Links {
-		line := fileLine{ShortURL: shortURL, OriginalURL: item.OriginalURL, UserID: item.UserID, IsDeleted: item.IsDeleted}
+	writer := bufio.NewWriter(file)
+	var encodeErr error
+	s.mapStorage.Range(func(shortURL string, item mapstorage.Item) {
+		if encodeErr != nil {
+			return
+		}
+		line := itemLine(shortURL, item)
 		data, err := json.Marshal(&line)
 		if err != nil {
-			return fmt.Errorf("failed to encode json: %w", err)
+			encodeErr = fmt.Errorf("failed to encode json: %w", err)
+			return
 		}
 		data = append(data, '\n')
-
-		_, err = file.Write(data)
-		if err != nil {
-			return fmt.Errorf("failed to save data to file: %w", err)
+		if _, err := writer.Write(data); err != nil {
+			encodeErr = fmt.Errorf("failed to save data to file: %w", err)
 		}
+	})
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.filePath); err != nil {
+		return fmt.Errorf("failed to replace the file \"%s\": %w", s.filePath, err)
 	}
 
 	return nil
 }
 
+func itemLine(shortURL string, item mapstorage.Item) fileLine {
+	return fileLine{
+		ShortURL:       shortURL,
+		OriginalURL:    item.OriginalURL,
+		UserID:         item.UserID,
+		WorkspaceID:    item.WorkspaceID,
+		Domain:         item.Domain,
+		IsDeleted:      item.IsDeleted,
+		LinkMetadata:   item.LinkMetadata,
+		Preview:        item.Preview,
+		PasswordHash:   item.PasswordHash,
+		MaxClicks:      item.MaxClicks,
+		Clicks:         item.Clicks,
+		Rules:          item.Rules,
+		Variants:       item.Variants,
+		StickyVariants: item.StickyVariants,
+	}
+}
+
+func (s *fileStorage) CountUserURLs(ctx context.Context, userID string) (int, error) {
+	count, err := s.mapStorage.CountUserURLs(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count user links in map storage: %w", err)
+	}
+	return count, nil
+}
+
+func (s *fileStorage) UserQuota(ctx context.Context, userID string) (models.Quota, error) {
+	quota, err := s.mapStorage.UserQuota(ctx, userID)
+	if err != nil {
+		return quota, fmt.Errorf("failed to get user quota from map storage: %w", err)
+	}
+	return quota, nil
+}
+
+func (s *fileStorage) CreateAccount(ctx context.Context, account models.Account) error {
+	if err := s.mapStorage.CreateAccount(ctx, account); err != nil {
+		return fmt.Errorf("failed to create account in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) AccountByLogin(ctx context.Context, login string) (models.Account, error) {
+	account, err := s.mapStorage.AccountByLogin(ctx, login)
+	if err != nil {
+		return account, fmt.Errorf("failed to get account from map storage: %w", err)
+	}
+	return account, nil
+}
+
+func (s *fileStorage) AccountByID(ctx context.Context, id string) (models.Account, error) {
+	account, err := s.mapStorage.AccountByID(ctx, id)
+	if err != nil {
+		return account, fmt.Errorf("failed to get account from map storage: %w", err)
+	}
+	return account, nil
+}
+
+func (s *fileStorage) ClaimUserURLs(ctx context.Context, fromUserID, toUserID string) error {
+	if err := s.mapStorage.ClaimUserURLs(ctx, fromUserID, toUserID); err != nil {
+		return fmt.Errorf("failed to claim links in map storage: %w", err)
+	}
+	return s.rewrite()
+}
+
+func (s *fileStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	if err := s.mapStorage.CreateAPIKey(ctx, key); err != nil {
+		return fmt.Errorf("failed to create api key in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) UserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	keys, err := s.mapStorage.UserAPIKeys(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys from map storage: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *fileStorage) RevokeAPIKey(ctx context.Context, id, userID string) error {
+	if err := s.mapStorage.RevokeAPIKey(ctx, id, userID); err != nil {
+		return fmt.Errorf("failed to revoke api key in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) UserIDByAPIKey(ctx context.Context, keyHash string) (string, error) {
+	userID, err := s.mapStorage.UserIDByAPIKey(ctx, keyHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to get api key from map storage: %w", err)
+	}
+	return userID, nil
+}
+
+func (s *fileStorage) CreateWorkspace(ctx context.Context, workspace models.Workspace, ownerID string) error {
+	if err := s.mapStorage.CreateWorkspace(ctx, workspace, ownerID); err != nil {
+		return fmt.Errorf("failed to create workspace in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) UserWorkspaces(ctx context.Context, userID string) ([]models.UserWorkspace, error) {
+	workspaces, err := s.mapStorage.UserWorkspaces(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspaces from map storage: %w", err)
+	}
+	return workspaces, nil
+}
+
+func (s *fileStorage) WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	role, err := s.mapStorage.WorkspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get workspace role from map storage: %w", err)
+	}
+	return role, nil
+}
+
+func (s *fileStorage) WorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	members, err := s.mapStorage.WorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace members from map storage: %w", err)
+	}
+	return members, nil
+}
+
+func (s *fileStorage) SetWorkspaceMember(ctx context.Context, member models.WorkspaceMember) error {
+	if err := s.mapStorage.SetWorkspaceMember(ctx, member); err != nil {
+		return fmt.Errorf("failed to set workspace member in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	if err := s.mapStorage.RemoveWorkspaceMember(ctx, workspaceID, userID); err != nil {
+		return fmt.Errorf("failed to remove workspace member in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) CreateWorkspaceInvite(ctx context.Context, invite models.WorkspaceInvite) error {
+	if err := s.mapStorage.CreateWorkspaceInvite(ctx, invite); err != nil {
+		return fmt.Errorf("failed to create workspace invite in map storage: %w", err)
+	}
+	return s.saveState()
+}
+
+func (s *fileStorage) AcceptWorkspaceInvite(
+	ctx context.Context,
+	tokenHash, userID string,
+	now time.Time,
+) (models.WorkspaceMember, error) {
+	member, err := s.mapStorage.AcceptWorkspaceInvite(ctx, tokenHash, userID, now)
+	if err != nil {
+		return member, fmt.Errorf("failed to accept workspace invite in map storage: %w", err)
+	}
+	return member, s.saveState()
+}
+
+func (s *fileStorage) flushClicks() {
+	ticker := time.NewTicker(clicksFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.saveClicks(); err != nil {
+				log.Printf("failed to save variant clicks: %v", err)
+			}
+		}
+	}
+}
+
+// saveClicks saves the state if variant clicks were counted since it was
+// last saved.
+func (s *fileStorage) saveClicks() error {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if !s.clicksCounted {
+		return nil
+	}
+	return s.writeState()
+}
+
 func (s *fileStorage) Close() error {
-	return nil
+	close(s.done)
+	return s.saveClicks()
 }
 
 func CreateFileStorage(filePath string, mapStorage *mapstorage.MapStorage) (*fileStorage, error) {
@@ -130,7 +566,13 @@ func CreateFileStorage(filePath string, mapStorage *mapstorage.MapStorage) (*fil
 		log.Printf("failed to close file for initing storage: %v", err)
 	}()
 
-	s := &fileStorage{filePath: filePath, mapStorage: mapStorage}
+	s := &fileStorage{
+		filePath:   filePath,
+		mapStorage: mapStorage,
+		stateMu:    &sync.Mutex{},
+		fileMu:     &sync.Mutex{},
+		done:       make(chan struct{}),
+	}
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -138,11 +580,95 @@ func CreateFileStorage(filePath string, mapStorage *mapstorage.MapStorage) (*fil
 		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
 			return nil, fmt.Errorf("failed to decode json: %w", err)
 		}
-		err := s.mapStorage.Put(context.Background(), line.ShortURL, line.OriginalURL, line.UserID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to save line in map storage: %w", err)
+		if line.Click {
+			if _, err := s.mapStorage.ConsumeClick(context.Background(), line.ShortURL); err != nil {
+				return nil, fmt.Errorf("failed to count click: %w", err)
+			}
+			continue
+		}
+		if line.PreviewUpdate && line.Preview != nil {
+			err := s.mapStorage.SetLinkPreview(context.Background(), line.ShortURL, line.OriginalURL, *line.Preview)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set link preview: %w", err)
+			}
+			continue
+		}
+		link := models.UserURLs{
+			ShortURL:       line.ShortURL,
+			OriginalURL:    line.OriginalURL,
+			WorkspaceID:    line.WorkspaceID,
+			Domain:         line.Domain,
+			IsDeleted:      line.IsDeleted,
+			LinkMetadata:   line.LinkMetadata,
+			Preview:        line.Preview,
+			PasswordHash:   line.PasswordHash,
+			MaxClicks:      line.MaxClicks,
+			Clicks:         line.Clicks,
+			Rules:          line.Rules,
+			Variants:       line.Variants,
+			StickyVariants: line.StickyVariants,
+		}
+		// A later line of a key replaces the earlier ones.
+		s.mapStorage.Load(link, line.UserID)
+	}
+
+	if err := s.loadState(); err != nil {
+		return nil, err
+	}
+
+	if s.mapStorage.MigrateLegacyKeys() {
+		if err := s.rewrite(); err != nil {
+			return nil, fmt.Errorf("failed to migrate links to keys: %w", err)
+		}
+		if err := s.saveState(); err != nil {
+			return nil, fmt.Errorf("failed to migrate state to keys: %w", err)
 		}
 	}
 
+	go s.flushClicks()
 	return s, nil
 }
+
+func (s *fileStorage) loadState() error {
+	data, err := os.ReadFile(s.filePath + stateFileSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var state mapstorage.State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to decode state file: %w", err)
+	}
+	s.mapStorage.Restore(state)
+
+	return nil
+}
+
+func (s *fileStorage) saveState() error {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.writeState()
+}
+
+// writeState saves the whole state, counted variant clicks included. The
+// caller holds stateMu.
+func (s *fileStorage) writeState() error {
+	data, err := json.MarshalIndent(s.mapStorage.Snapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmpPath := s.filePath + stateFileSuffix + ".tmp"
+	if err := os.WriteFile(tmpPath, data, filePerm); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.filePath+stateFileSuffix); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	s.clicksCounted = false
+
+	return nil
+}
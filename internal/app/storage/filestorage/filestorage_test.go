@@ -0,0 +1,98 @@
+package filestorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage/mapstorage"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openFileStorage(t *testing.T, filePath string) *fileStorage {
+	mapStorage, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+	s, err := CreateFileStorage(filePath, mapStorage)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, s.Close()) })
+	return s
+}
+
+func countLines(t *testing.T, filePath string) int {
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestFileStorage(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "links.json")
+	s := openFileStorage(t, filePath)
+
+	require.NoError(t, s.Put(ctx, models.UserURLs{ShortURL: "a", OriginalURL: "https://example.com/a"}, "user"))
+	require.NoError(t, s.Put(ctx, models.UserURLs{ShortURL: "b", OriginalURL: "https://example.com/b"}, "user"))
+
+	t.Run("preview", func(t *testing.T) {
+		preview := models.LinkPreview{Title: "A", FetchedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+		require.NoError(t, s.SetLinkPreview(ctx, "a", "https://example.com/a", preview))
+		assert.Equal(t, 3, countLines(t, filePath), "a preview is appended, not rewritten")
+		stale := models.LinkPreview{Title: "Stale"}
+		require.NoError(t, s.SetLinkPreview(ctx, "b", "https://example.com/moved", stale))
+
+		link, err := openFileStorage(t, filePath).Get(ctx, "a")
+		require.NoError(t, err)
+		require.NotNil(t, link.Preview)
+		assert.Equal(t, preview.Title, link.Preview.Title)
+		assert.True(t, preview.FetchedAt.Equal(link.Preview.FetchedAt))
+		link, err = openFileStorage(t, filePath).Get(ctx, "b")
+		require.NoError(t, err)
+		assert.Nil(t, link.Preview, "a preview of an old destination is skipped")
+	})
+
+	t.Run("edit", func(t *testing.T) {
+		ok, err := s.ConsumeClick(ctx, "a")
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, err = s.EditURL(ctx, models.LinkEdit{
+			ShortURL: "a",
+			UserID:   "user",
+			NewURL:   "https://example.com/moved",
+			Metadata: models.LinkMetadata{Title: "Moved", Tags: []string{"docs"}},
+			EditedAt: time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 6, countLines(t, filePath), "an edit is appended, not rewritten")
+
+		reopened := openFileStorage(t, filePath)
+		link, err := reopened.Get(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/moved", link.OriginalURL)
+		assert.Equal(t, models.LinkMetadata{Title: "Moved", Tags: []string{"docs"}}, link.LinkMetadata)
+		assert.Nil(t, link.Preview, "the preview of the old destination is dropped")
+		assert.Equal(t, 1, link.Clicks)
+		edits, err := reopened.URLHistory(ctx, "a", "user", "")
+		require.NoError(t, err)
+		require.Len(t, edits, 1)
+		assert.Equal(t, "https://example.com/a", edits[0].OldURL)
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		require.NoError(t, s.DeleteUserURls(ctx, []string{"b"}, "user"))
+		assert.Equal(t, 2, countLines(t, filePath))
+		_, err := os.Stat(filePath + ".tmp")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		reopened := openFileStorage(t, filePath)
+		link, err := reopened.Get(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/moved", link.OriginalURL)
+		link, err = reopened.Get(ctx, "b")
+		require.NoError(t, err)
+		assert.True(t, link.IsDeleted)
+	})
+}
@@ -2,36 +2,324 @@ package mapstorage
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"shorty/internal/app/domains"
 	"shorty/internal/app/models"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-type storageItem struct {
+type Item struct {
 	OriginalURL string
 	UserID      string
+	WorkspaceID string
+	Domain      string
 	IsDeleted   bool
+	models.LinkMetadata
+	Preview        *models.LinkPreview
+	PasswordHash   string
+	MaxClicks      int
+	Clicks         int
+	Rules          []models.RedirectRule
+	Variants       []models.LinkVariant
+	StickyVariants bool
+}
+
+type State struct {
+	Quotas     map[string]models.Quota           `json:"quotas"`
+	Accounts   map[string]models.Account         `json:"accounts"`
+	APIKeys    map[string]models.APIKey          `json:"api_keys"`
+	Workspaces map[string]models.Workspace       `json:"workspaces"`
+	Members    map[string]models.WorkspaceMember `json:"members"`
+	Invites    map[string]models.WorkspaceInvite `json:"invites"`
+	Edits      []models.LinkEdit                 `json:"edits"`
+	// VariantClicks is keyed by variantKey.
+	VariantClicks map[string]int `json:"variant_clicks"`
 }
 
 type MapStorage struct {
 	mu    *sync.Mutex
-	Links map[string]storageItem
+	Links map[string]Item
+	state State
 }
 
 func (s *MapStorage) Get(ctx context.Context, key string) (models.UserURLs, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	val := s.Links[key]
+	return userURLs(key, s.Links[key]), nil
+}
+
+func (s *MapStorage) GetByOriginalURL(ctx context.Context, domain, originalURL string) (models.UserURLs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for shortURL, item := range s.Links {
+		if item.Domain == domain && item.OriginalURL == originalURL && shared(item) {
+			return userURLs(shortURL, item), nil
+		}
+	}
+	return models.UserURLs{}, models.ErrNotFound
+}
+
+// OwnedLink returns the link even if it is deleted or used up.
+func (s *MapStorage) OwnedLink(ctx context.Context, shortURL, userID, workspaceID string) (models.UserURLs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || !owns(item, userID, workspaceID) {
+		return models.UserURLs{}, models.ErrNotFound
+	}
+	return userURLs(shortURL, item), nil
+}
+
+func (s *MapStorage) EditURL(ctx context.Context, edit models.LinkEdit) (models.LinkEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[edit.ShortURL]
+	if !ok || item.IsDeleted || !owns(item, edit.UserID, edit.WorkspaceID) {
+		return edit, models.ErrNotFound
+	}
+	edit.OldURL = item.OriginalURL
+	if edit.OldURL != edit.NewURL {
+		if shared(item) && s.sharedURL(edit.ShortURL, item.Domain, edit.NewURL) {
+			return edit, models.ErrURLExists
+		}
+		s.state.Edits = append(s.state.Edits, edit)
+	}
+
+	if item.OriginalURL != edit.NewURL {
+		item.Preview = nil
+	}
+	item.OriginalURL = edit.NewURL
+	item.LinkMetadata = edit.Metadata
+	s.Links[edit.ShortURL] = item
+	return edit, nil
+}
+
+func (s *MapStorage) URLHistory(ctx context.Context, shortURL, userID, workspaceID string) ([]models.LinkEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || !owns(item, userID, workspaceID) {
+		return nil, models.ErrNotFound
+	}
+	var edits []models.LinkEdit
+	for _, edit := range s.state.Edits {
+		if edit.ShortURL == shortURL {
+			edits = append(edits, edit)
+		}
+	}
+	return edits, nil
+}
+
+func (s *MapStorage) LinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+) ([]models.RedirectRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || item.IsDeleted || !owns(item, userID, workspaceID) {
+		return nil, models.ErrNotFound
+	}
+	return item.Rules, nil
+}
+
+func (s *MapStorage) SetLinkRules(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	rules []models.RedirectRule,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || item.IsDeleted || !owns(item, userID, workspaceID) {
+		return models.ErrNotFound
+	}
+	item.Rules = rules
+	if shared(item) && s.sharedURL(shortURL, item.Domain, item.OriginalURL) {
+		return models.ErrURLExists
+	}
+	s.Links[shortURL] = item
+	return nil
+}
+
+// SetLinkVariants also drops the clicks of variants that were removed.
+func (s *MapStorage) SetLinkVariants(
+	ctx context.Context,
+	shortURL, userID, workspaceID string,
+	req models.LinkVariantsRequest,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || item.IsDeleted || !owns(item, userID, workspaceID) {
+		return models.ErrNotFound
+	}
+	updated := item
+	updated.Variants = req.Variants
+	updated.StickyVariants = req.Sticky
+	if shared(updated) && s.sharedURL(shortURL, item.Domain, item.OriginalURL) {
+		return models.ErrURLExists
+	}
+	kept := map[string]bool{}
+	for _, variant := range req.Variants {
+		kept[variantKey(shortURL, variant.ID)] = true
+	}
+	for _, variant := range item.Variants {
+		if key := variantKey(shortURL, variant.ID); !kept[key] {
+			delete(s.state.VariantClicks, key)
+		}
+	}
+	s.Links[shortURL] = updated
+	return nil
+}
+
+func (s *MapStorage) CountVariantClick(ctx context.Context, shortURL, variantID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.VariantClicks[variantKey(shortURL, variantID)]++
+	return nil
+}
+
+func (s *MapStorage) LinkStats(ctx context.Context, shortURL, userID, workspaceID string) (models.LinkStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || !owns(item, userID, workspaceID) {
+		return models.LinkStats{}, models.ErrNotFound
+	}
+	stats := models.LinkStats{ShortURL: shortURL, Variants: []models.VariantStats{}}
+	for _, variant := range item.Variants {
+		stats.Variants = append(stats.Variants, models.VariantStats{
+			LinkVariant: variant,
+			Clicks:      s.state.VariantClicks[variantKey(shortURL, variant.ID)],
+		})
+	}
+	return stats, nil
+}
+
+// variantKey can't collide since short URLs have no fragment.
+func variantKey(shortURL, variantID string) string {
+	return shortURL + "#" + variantID
+}
+
+func userURLs(key string, item Item) models.UserURLs {
 	return models.UserURLs{
-		OriginalURL: val.OriginalURL,
-		ShortURL:    key,
-		IsDeleted:   val.IsDeleted,
-	}, nil
+		OriginalURL:    item.OriginalURL,
+		ShortURL:       key,
+		WorkspaceID:    item.WorkspaceID,
+		Domain:         item.Domain,
+		LinkMetadata:   item.LinkMetadata,
+		Preview:        item.Preview,
+		PasswordHash:   item.PasswordHash,
+		MaxClicks:      item.MaxClicks,
+		Rules:          item.Rules,
+		Variants:       item.Variants,
+		StickyVariants: item.StickyVariants,
+		Clicks:         item.Clicks,
+		IsDeleted:      item.IsDeleted,
+	}
 }
 
-func (s *MapStorage) Put(ctx context.Context, key, value, userID string) error {
+// owns reports whether the link is a personal link of userID or, when
+// workspaceID is set, belongs to that workspace.
+func owns(item Item, userID, workspaceID string) bool {
+	if workspaceID != "" {
+		return item.WorkspaceID == workspaceID
+	}
+	return item.UserID == userID && item.WorkspaceID == ""
+}
+
+// shared reports whether re-shortening the destination may hand out the
+// link: it is neither password protected nor click limited and has no
+// redirect rules or variants. A destination has one such link per domain,
+// like the unique index of the database storage.
+func shared(item Item) bool {
+	return item.PasswordHash == "" && item.MaxClicks == 0 && len(item.Rules) == 0 && len(item.Variants) == 0
+}
+
+// sharedURL reports whether a shared link to originalURL other than the one
+// under key is saved on domain. The caller holds mu.
+func (s *MapStorage) sharedURL(key, domain, originalURL string) bool {
+	for other, item := range s.Links {
+		if other != key && item.Domain == domain && item.OriginalURL == originalURL && shared(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Put saves a new link. It never replaces the link saved under the key or
+// the shared link to the destination, like the insert of the database
+// storage.
+func (s *MapStorage) Put(ctx context.Context, link models.UserURLs, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := newItem(link, userID)
+	if _, ok := s.Links[link.ShortURL]; ok || shared(item) && s.sharedURL(link.ShortURL, item.Domain, item.OriginalURL) {
+		return models.ErrConflict
+	}
+	s.Links[link.ShortURL] = item
+	return nil
+}
+
+// Load saves a link read from a file, replacing the one under its key.
+func (s *MapStorage) Load(link models.UserURLs, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Links[link.ShortURL] = newItem(link, userID)
+}
+
+func newItem(link models.UserURLs, userID string) Item {
+	return Item{
+		OriginalURL:    link.OriginalURL,
+		UserID:         userID,
+		WorkspaceID:    link.WorkspaceID,
+		Domain:         link.Domain,
+		IsDeleted:      link.IsDeleted,
+		LinkMetadata:   link.LinkMetadata,
+		Preview:        link.Preview,
+		PasswordHash:   link.PasswordHash,
+		MaxClicks:      link.MaxClicks,
+		Clicks:         link.Clicks,
+		Rules:          link.Rules,
+		Variants:       link.Variants,
+		StickyVariants: link.StickyVariants,
+	}
+}
+
+// ConsumeClick counts a click and reports false once the link is gone or
+// its clicks are used up.
+func (s *MapStorage) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	if !ok || item.IsDeleted || item.MaxClicks > 0 && item.Clicks >= item.MaxClicks {
+		return false, nil
+	}
+	item.Clicks++
+	s.Links[shortURL] = item
+	return true, nil
+}
+
+// SetLinkPreview is a no-op when the link was repointed in the meantime.
+func (s *MapStorage) SetLinkPreview(
+	ctx context.Context,
+	shortURL, originalURL string,
+	preview models.LinkPreview,
+) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.Links[key] = storageItem{OriginalURL: value, UserID: userID, IsDeleted: false}
+	item, ok := s.Links[shortURL]
+	if !ok || item.OriginalURL != originalURL {
+		return nil
+	}
+	item.Preview = &preview
+	s.Links[shortURL] = item
 	return nil
 }
 
@@ -39,37 +327,514 @@ func (s *MapStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
+// Batch saves all links or, if one of them conflicts, none.
 func (s *MapStorage) Batch(ctx context.Context, urls []models.UserURLs, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make(map[string]bool, len(urls))
+	destinations := make(map[[2]string]bool, len(urls))
 	for _, url := range urls {
-		if err := s.Put(ctx, url.ShortURL, url.OriginalURL, userID); err != nil {
-			return err
+		if _, ok := s.Links[url.ShortURL]; ok || keys[url.ShortURL] {
+			return models.ErrConflict
+		}
+		keys[url.ShortURL] = true
+		if item := newItem(url, userID); shared(item) {
+			destination := [2]string{item.Domain, item.OriginalURL}
+			if destinations[destination] || s.sharedURL(url.ShortURL, item.Domain, item.OriginalURL) {
+				return models.ErrConflict
+			}
+			destinations[destination] = true
 		}
 	}
+	for _, url := range urls {
+		s.Links[url.ShortURL] = newItem(url, userID)
+	}
 	return nil
 }
 
-func (s *MapStorage) UserURLs(ctx context.Context, userID string) ([]models.UserURLs, error) {
+func (s *MapStorage) UserURLs(ctx context.Context, userID string, filter models.URLFilter) ([]models.UserURLs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var userUrls []models.UserURLs
-	for shortURL, storageItem := range s.Links {
-		if storageItem.UserID == userID {
-			userUrls = append(userUrls, models.UserURLs{OriginalURL: storageItem.OriginalURL, ShortURL: shortURL})
+	for shortURL, item := range s.Links {
+		if item.UserID == userID && item.WorkspaceID == "" && matches(item, filter) {
+			userUrls = append(userUrls, models.UserURLs{
+				OriginalURL:    item.OriginalURL,
+				ShortURL:       shortURL,
+				Domain:         item.Domain,
+				LinkMetadata:   item.LinkMetadata,
+				Preview:        item.Preview,
+				MaxClicks:      item.MaxClicks,
+				Rules:          item.Rules,
+				Variants:       item.Variants,
+				StickyVariants: item.StickyVariants,
+				Clicks:         item.Clicks,
+			})
 		}
 	}
 	return userUrls, nil
 }
 
+func matches(item Item, filter models.URLFilter) bool {
+	if filter.Folder != "" && item.Folder != filter.Folder {
+		return false
+	}
+	if filter.Tag == "" {
+		return true
+	}
+	for _, tag := range item.Tags {
+		if tag == filter.Tag {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *MapStorage) DeleteUserURls(ctx context.Context, shortURLs []string, userID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, shortURL := range shortURLs {
 		item, ok := s.Links[shortURL]
-		if ok && item.UserID == userID {
-			s.Links[shortURL] = storageItem{OriginalURL: item.OriginalURL, UserID: userID, IsDeleted: true}
+		if ok && item.UserID == userID && item.WorkspaceID == "" {
+			item.IsDeleted = true
+			s.Links[shortURL] = item
+		}
+	}
+	return nil
+}
+
+func (s *MapStorage) WorkspaceURLs(
+	ctx context.Context,
+	workspaceID string,
+	filter models.URLFilter,
+) ([]models.UserURLs, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var urls []models.UserURLs
+	for shortURL, item := range s.Links {
+		if item.WorkspaceID == workspaceID && matches(item, filter) {
+			urls = append(urls, models.UserURLs{
+				OriginalURL:    item.OriginalURL,
+				ShortURL:       shortURL,
+				WorkspaceID:    workspaceID,
+				Domain:         item.Domain,
+				LinkMetadata:   item.LinkMetadata,
+				Preview:        item.Preview,
+				MaxClicks:      item.MaxClicks,
+				Rules:          item.Rules,
+				Variants:       item.Variants,
+				StickyVariants: item.StickyVariants,
+				Clicks:         item.Clicks,
+			})
+		}
+	}
+	return urls, nil
+}
+
+func (s *MapStorage) TagCounts(ctx context.Context, userID, workspaceID string) ([]models.TagCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int{}
+	for _, item := range s.Links {
+		if item.IsDeleted || !owns(item, userID, workspaceID) {
+			continue
+		}
+		for _, tag := range item.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := make([]models.TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, models.TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+func (s *MapStorage) DeleteWorkspaceURLs(ctx context.Context, shortURLs []string, workspaceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, shortURL := range shortURLs {
+		item, ok := s.Links[shortURL]
+		if ok && item.WorkspaceID == workspaceID {
+			item.IsDeleted = true
+			s.Links[shortURL] = item
+		}
+	}
+	return nil
+}
+
+func (s *MapStorage) CountUserURLs(ctx context.Context, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, item := range s.Links {
+		if item.UserID == userID && !item.IsDeleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MapStorage) UserQuota(ctx context.Context, userID string) (models.Quota, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Quotas[userID], nil
+}
+
+func (s *MapStorage) CreateAccount(ctx context.Context, account models.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.state.Accounts {
+		if existing.Login == account.Login {
+			return models.ErrAccountExists
 		}
 	}
+	if _, ok := s.state.Accounts[account.ID]; ok {
+		return models.ErrAccountExists
+	}
+	s.state.Accounts[account.ID] = account
 	return nil
 }
 
+func (s *MapStorage) AccountByLogin(ctx context.Context, login string) (models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, account := range s.state.Accounts {
+		if account.Login == login {
+			return account, nil
+		}
+	}
+	return models.Account{}, models.ErrNotFound
+}
+
+func (s *MapStorage) AccountByID(ctx context.Context, id string) (models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.state.Accounts[id]
+	if !ok {
+		return account, models.ErrNotFound
+	}
+	return account, nil
+}
+
+func (s *MapStorage) ClaimUserURLs(ctx context.Context, fromUserID, toUserID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for shortURL, item := range s.Links {
+		if item.UserID == fromUserID {
+			item.UserID = toUserID
+			s.Links[shortURL] = item
+		}
+	}
+	return nil
+}
+
+func (s *MapStorage) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.APIKeys[key.ID] = key
+	return nil
+}
+
+func (s *MapStorage) UserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []models.APIKey
+	for _, key := range s.state.APIKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *MapStorage) RevokeAPIKey(ctx context.Context, id, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.state.APIKeys[id]
+	if !ok || key.UserID != userID {
+		return models.ErrNotFound
+	}
+	key.Revoked = true
+	s.state.APIKeys[id] = key
+	return nil
+}
+
+func (s *MapStorage) UserIDByAPIKey(ctx context.Context, keyHash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.state.APIKeys {
+		if key.KeyHash == keyHash && !key.Revoked {
+			return key.UserID, nil
+		}
+	}
+	return "", models.ErrNotFound
+}
+
+func (s *MapStorage) CreateWorkspace(ctx context.Context, workspace models.Workspace, ownerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Workspaces[workspace.ID] = workspace
+	s.state.Members[memberKey(workspace.ID, ownerID)] = models.WorkspaceMember{
+		WorkspaceID: workspace.ID,
+		UserID:      ownerID,
+		Role:        "owner",
+		CreatedAt:   workspace.CreatedAt,
+	}
+	return nil
+}
+
+func (s *MapStorage) UserWorkspaces(ctx context.Context, userID string) ([]models.UserWorkspace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var workspaces []models.UserWorkspace
+	for _, member := range s.state.Members {
+		if member.UserID == userID {
+			workspaces = append(workspaces, models.UserWorkspace{
+				Workspace: s.state.Workspaces[member.WorkspaceID],
+				Role:      member.Role,
+			})
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].CreatedAt.Before(workspaces[j].CreatedAt) })
+	return workspaces, nil
+}
+
+func (s *MapStorage) WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.state.Members[memberKey(workspaceID, userID)]
+	if !ok {
+		return "", models.ErrNotFound
+	}
+	return member.Role, nil
+}
+
+func (s *MapStorage) WorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var members []models.WorkspaceMember
+	for _, member := range s.state.Members {
+		if member.WorkspaceID == workspaceID {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].CreatedAt.Before(members[j].CreatedAt) })
+	return members, nil
+}
+
+func (s *MapStorage) SetWorkspaceMember(ctx context.Context, member models.WorkspaceMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memberKey(member.WorkspaceID, member.UserID)
+	if existing, ok := s.state.Members[key]; ok {
+		member.CreatedAt = existing.CreatedAt
+	}
+	s.state.Members[key] = member
+	return nil
+}
+
+func (s *MapStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memberKey(workspaceID, userID)
+	if _, ok := s.state.Members[key]; !ok {
+		return models.ErrNotFound
+	}
+	delete(s.state.Members, key)
+	return nil
+}
+
+func (s *MapStorage) CreateWorkspaceInvite(ctx context.Context, invite models.WorkspaceInvite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Invites[invite.TokenHash] = invite
+	return nil
+}
+
+func (s *MapStorage) AcceptWorkspaceInvite(
+	ctx context.Context,
+	tokenHash, userID string,
+	now time.Time,
+) (models.WorkspaceMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.state.Invites[tokenHash]
+	if !ok || invite.AcceptedBy != "" || !now.Before(invite.ExpiresAt) {
+		return models.WorkspaceMember{}, models.ErrNotFound
+	}
+	invite.AcceptedBy = userID
+	s.state.Invites[tokenHash] = invite
+
+	key := memberKey(invite.WorkspaceID, userID)
+	if member, ok := s.state.Members[key]; ok {
+		return member, nil
+	}
+	member := models.WorkspaceMember{WorkspaceID: invite.WorkspaceID, UserID: userID, Role: invite.Role, CreatedAt: now}
+	s.state.Members[key] = member
+	return member, nil
+}
+
+func memberKey(workspaceID, userID string) string {
+	return workspaceID + "/" + userID
+}
+
+// Item returns the link saved under shortURL as it is stored.
+func (s *MapStorage) Item(shortURL string) (Item, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.Links[shortURL]
+	return item, ok
+}
+
+func (s *MapStorage) Range(f func(shortURL string, item Item)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for shortURL, item := range s.Links {
+		f(shortURL, item)
+	}
+}
+
+func (s *MapStorage) Snapshot() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return State{
+		Quotas:     copyMap(s.state.Quotas),
+		Accounts:   copyMap(s.state.Accounts),
+		APIKeys:    copyMap(s.state.APIKeys),
+		Workspaces: copyMap(s.state.Workspaces),
+		Members:    copyMap(s.state.Members),
+		Invites:    copyMap(s.state.Invites),
+		Edits:      append([]models.LinkEdit(nil), s.state.Edits...),
+
+		VariantClicks: copyMap(s.state.VariantClicks),
+	}
+}
+
+func (s *MapStorage) Restore(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = State{
+		Quotas:     copyMap(state.Quotas),
+		Accounts:   copyMap(state.Accounts),
+		APIKeys:    copyMap(state.APIKeys),
+		Workspaces: copyMap(state.Workspaces),
+		Members:    copyMap(state.Members),
+		Invites:    copyMap(state.Invites),
+		Edits:      append([]models.LinkEdit(nil), state.Edits...),
+
+		VariantClicks: copyMap(state.VariantClicks),
+	}
+}
+
+// MigrateLegacyKeys rekeys links stored under their full short URL, as
+// they were before links were keyed by code, along with their edits and
+// variant clicks. A link whose key is taken, by a link of another base URL
+// with the same code or one saved under its key already, gets the key with a
+// counter appended. It reports whether anything changed.
+func (s *MapStorage) MigrateLegacyKeys() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var legacy []string
+	for shortURL := range s.Links {
+		if strings.Contains(shortURL, "://") {
+			legacy = append(legacy, shortURL)
+		}
+	}
+	sort.Strings(legacy)
+
+	rekeyed := make(map[string]string, len(legacy))
+	for _, shortURL := range legacy {
+		item := s.Links[shortURL]
+		key, _ := domains.LegacyKey(shortURL, item.Domain)
+		if _, ok := s.Links[key]; ok {
+			free := key
+			for n := 2; ; n++ {
+				free = fmt.Sprintf("%s-%d", key, n)
+				if _, ok := s.Links[free]; !ok {
+					break
+				}
+			}
+			log.Printf("key %s of link %s is taken, it is moved to %s", key, shortURL, free)
+			key = free
+		}
+		delete(s.Links, shortURL)
+		s.Links[key] = item
+		rekeyed[shortURL] = key
+	}
+	migrated := len(legacy) > 0
+
+	for i, edit := range s.state.Edits {
+		if strings.Contains(edit.ShortURL, "://") {
+			s.state.Edits[i].ShortURL = s.migratedKey(rekeyed, edit.ShortURL)
+			migrated = true
+		}
+	}
+	for key, clicks := range s.state.VariantClicks {
+		shortURL, variantID, _ := strings.Cut(key, "#")
+		if strings.Contains(shortURL, "://") {
+			delete(s.state.VariantClicks, key)
+			s.state.VariantClicks[variantKey(s.migratedKey(rekeyed, shortURL), variantID)] = clicks
+			migrated = true
+		}
+	}
+	return migrated
+}
+
+// migratedKey returns the key the link of a full short URL was moved to, or
+// the one it would have been moved to if it is gone.
+func (s *MapStorage) migratedKey(rekeyed map[string]string, shortURL string) string {
+	if key, ok := rekeyed[shortURL]; ok {
+		return key
+	}
+	return s.legacyKey(shortURL)
+}
+
+// legacyKey finds the key of a full short URL once its link is migrated.
+// The link's domain is gone with the URL, so a host with a link of that
+// code wins over the primary domain.
+func (s *MapStorage) legacyKey(shortURL string) string {
+	u, err := url.Parse(shortURL)
+	if err != nil {
+		key, _ := domains.LegacyKey(shortURL, "")
+		return key
+	}
+	code := u.Path[strings.LastIndexByte(u.Path, '/')+1:]
+	if key := domains.Key(strings.ToLower(u.Host), code); s.Links[key].OriginalURL != "" {
+		return key
+	}
+	return code
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func newState() State {
+	return State{
+		Quotas:     map[string]models.Quota{},
+		Accounts:   map[string]models.Account{},
+		APIKeys:    map[string]models.APIKey{},
+		Workspaces: map[string]models.Workspace{},
+		Members:    map[string]models.WorkspaceMember{},
+		Invites:    map[string]models.WorkspaceInvite{},
+
+		VariantClicks: map[string]int{},
+	}
+}
+
 func (s *MapStorage) Close() error {
 	return nil
 }
@@ -77,7 +842,8 @@ func (s *MapStorage) Close() error {
 func CreateMapStorage() (*MapStorage, error) {
 	s := &MapStorage{
 		mu:    &sync.Mutex{},
-		Links: map[string]storageItem{},
+		Links: map[string]Item{},
+		state: newState(),
 	}
 
 	return s, nil
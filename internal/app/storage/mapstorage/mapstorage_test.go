@@ -0,0 +1,45 @@
+package mapstorage
+
+import (
+	"context"
+	"shorty/internal/app/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	s, err := CreateMapStorage()
+	require.NoError(t, err)
+
+	// Two base URLs used the same code, and a link was already saved under
+	// the key of a third one.
+	s.Load(models.UserURLs{ShortURL: "http://localhost:8080/abc", OriginalURL: "https://example.com/old"}, "user")
+	s.Load(models.UserURLs{ShortURL: "https://sho.rt/abc", OriginalURL: "https://example.com/new"}, "user")
+	s.Load(models.UserURLs{ShortURL: "xyz", OriginalURL: "https://example.com/keyed"}, "user")
+	s.Load(models.UserURLs{ShortURL: "https://sho.rt/xyz", OriginalURL: "https://example.com/legacy"}, "user")
+	s.Restore(State{Edits: []models.LinkEdit{
+		{ShortURL: "https://sho.rt/abc", OldURL: "https://example.com/before", NewURL: "https://example.com/new"},
+	}})
+
+	require.True(t, s.MigrateLegacyKeys())
+	assert.False(t, s.MigrateLegacyKeys(), "migrated links no longer match")
+
+	links := map[string]string{}
+	s.Range(func(shortURL string, item Item) {
+		links[shortURL] = item.OriginalURL
+	})
+	assert.Equal(t, map[string]string{
+		"abc":   "https://example.com/old",
+		"abc-2": "https://example.com/new",
+		"xyz":   "https://example.com/keyed",
+		"xyz-2": "https://example.com/legacy",
+	}, links, "no link is lost to a taken key")
+
+	edits, err := s.URLHistory(ctx, "abc-2", "user", "")
+	require.NoError(t, err)
+	require.Len(t, edits, 1, "edits follow their link to its new key")
+	assert.Equal(t, "https://example.com/before", edits[0].OldURL)
+}
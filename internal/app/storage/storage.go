@@ -2,28 +2,81 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"shorty/internal/app/config"
 	"shorty/internal/app/models"
 	"shorty/internal/app/storage/dbstorage"
 	"shorty/internal/app/storage/filestorage"
 	"shorty/internal/app/storage/mapstorage"
+	"time"
 )
 
+// Storage keeps links under their key, see domains.Key, so short URLs are
+// only built for responses.
 type Storage interface {
-	Put(ctx context.Context, key, value, userID string) error
+	Put(ctx context.Context, link models.UserURLs, userID string) error
 	Get(ctx context.Context, key string) (models.UserURLs, error)
+	GetByOriginalURL(ctx context.Context, domain, originalURL string) (models.UserURLs, error)
+	OwnedLink(ctx context.Context, shortURL, userID, workspaceID string) (models.UserURLs, error)
+	EditURL(ctx context.Context, edit models.LinkEdit) (models.LinkEdit, error)
+	URLHistory(ctx context.Context, shortURL, userID, workspaceID string) ([]models.LinkEdit, error)
+	SetLinkPreview(ctx context.Context, shortURL, originalURL string, preview models.LinkPreview) error
+	ConsumeClick(ctx context.Context, shortURL string) (bool, error)
+	LinkRules(ctx context.Context, shortURL, userID, workspaceID string) ([]models.RedirectRule, error)
+	SetLinkRules(ctx context.Context, shortURL, userID, workspaceID string, rules []models.RedirectRule) error
+	SetLinkVariants(ctx context.Context, shortURL, userID, workspaceID string, req models.LinkVariantsRequest) error
+	CountVariantClick(ctx context.Context, shortURL, variantID string) error
+	LinkStats(ctx context.Context, shortURL, userID, workspaceID string) (models.LinkStats, error)
 	Ping(ctx context.Context) error
 	Batch(ctx context.Context, urls []models.UserURLs, userID string) error
-	UserURLs(ctx context.Context, userID string) ([]models.UserURLs, error)
+	UserURLs(ctx context.Context, userID string, filter models.URLFilter) ([]models.UserURLs, error)
 	DeleteUserURls(ctx context.Context, urls []string, userID string) error
+	CountUserURLs(ctx context.Context, userID string) (int, error)
+	UserQuota(ctx context.Context, userID string) (models.Quota, error)
+	CreateAccount(ctx context.Context, account models.Account) error
+	AccountByLogin(ctx context.Context, login string) (models.Account, error)
+	AccountByID(ctx context.Context, id string) (models.Account, error)
+	ClaimUserURLs(ctx context.Context, fromUserID, toUserID string) error
+	CreateAPIKey(ctx context.Context, key models.APIKey) error
+	UserAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id, userID string) error
+	UserIDByAPIKey(ctx context.Context, keyHash string) (string, error)
+	WorkspaceURLs(ctx context.Context, workspaceID string, filter models.URLFilter) ([]models.UserURLs, error)
+	TagCounts(ctx context.Context, userID, workspaceID string) ([]models.TagCount, error)
+	DeleteWorkspaceURLs(ctx context.Context, urls []string, workspaceID string) error
+	CreateWorkspace(ctx context.Context, workspace models.Workspace, ownerID string) error
+	UserWorkspaces(ctx context.Context, userID string) ([]models.UserWorkspace, error)
+	WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error)
+	WorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error)
+	SetWorkspaceMember(ctx context.Context, member models.WorkspaceMember) error
+	RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error
+	CreateWorkspaceInvite(ctx context.Context, invite models.WorkspaceInvite) error
+	AcceptWorkspaceInvite(ctx context.Context, tokenHash, userID string, now time.Time) (models.WorkspaceMember, error)
 	Close() error
 }
 
+// pooled is a storage backed by a database connection pool.
+type pooled interface {
+	DB() *sql.DB
+}
+
+// DB returns the connection pool of a database storage and nil for the
+// others.
+func DB(s Storage) *sql.DB {
+	if p, ok := s.(pooled); ok {
+		return p.DB()
+	}
+	return nil
+}
+
 func NewStorage(config config.Config) (Storage, error) {
 	if config.DatabaseDSN != "" {
 		s, err := dbstorage.CreateDBStorage(context.Background(), config)
-		return s, fmt.Errorf("failed to init db storage: %w", err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init db storage: %w", err)
+		}
+		return s, nil
 	}
 
 	if config.FileStoragePath != "" {
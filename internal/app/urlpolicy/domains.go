@@ -0,0 +1,65 @@
+package urlpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+)
+
+type DomainList struct {
+	mu      *sync.RWMutex
+	domains map[string]bool
+	file    *watchedFile
+}
+
+// LoadDomainList reads one domain per line; "#" starts a comment. A listed
+// domain also matches all of its subdomains.
+func LoadDomainList(path string) (*DomainList, error) {
+	l := &DomainList{mu: &sync.RWMutex{}, domains: map[string]bool{}}
+	file, err := newWatchedFile(path, l.parse)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+func (l *DomainList) parse(data []byte) error {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.Trim(strings.ToLower(strings.TrimSpace(line)), ".")
+		if line != "" {
+			domains[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.domains = domains
+	return nil
+}
+
+func (l *DomainList) Contains(host string) bool {
+	host = strings.Trim(strings.ToLower(host), ".")
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for {
+		if l.domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
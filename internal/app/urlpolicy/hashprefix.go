@@ -0,0 +1,134 @@
+package urlpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const hashPrefixLen = 4
+const maxHostSuffixes = 4
+const maxPathPrefixes = 4
+
+// HashPrefixChecker mimics the Safe Browsing lookup scheme against a local
+// list: the file holds hex SHA-256 hashes of "host/path" expressions, which
+// are indexed by a short prefix and confirmed by the full hash.
+type HashPrefixChecker struct {
+	mu       *sync.RWMutex
+	prefixes map[[hashPrefixLen]byte][][sha256.Size]byte
+	file     *watchedFile
+}
+
+func LoadHashPrefixChecker(path string) (*HashPrefixChecker, error) {
+	c := &HashPrefixChecker{mu: &sync.RWMutex{}}
+	file, err := newWatchedFile(path, c.parse)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+	return c, nil
+}
+
+func (c *HashPrefixChecker) parse(data []byte) error {
+	prefixes := map[[hashPrefixLen]byte][][sha256.Size]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		decoded, err := hex.DecodeString(line)
+		if err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("invalid sha256 hash %q", line)
+		}
+		var full [sha256.Size]byte
+		copy(full[:], decoded)
+		var prefix [hashPrefixLen]byte
+		copy(prefix[:], decoded)
+		prefixes[prefix] = append(prefixes[prefix], full)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefixes = prefixes
+	return nil
+}
+
+func (c *HashPrefixChecker) Check(ctx context.Context, u *url.URL) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, expr := range Expressions(u) {
+		full := sha256.Sum256([]byte(expr))
+		var prefix [hashPrefixLen]byte
+		copy(prefix[:], full[:])
+		for _, candidate := range c.prefixes[prefix] {
+			if candidate == full {
+				return fmt.Errorf("%w: matched %s", ErrFlagged, expr)
+			}
+		}
+	}
+	return nil
+}
+
+func HashExpression(expr string) string {
+	sum := sha256.Sum256([]byte(expr))
+	return hex.EncodeToString(sum[:])
+}
+
+// Expressions returns the host suffix / path prefix combinations a url is
+// looked up under, e.g. a.b.c/1/2 yields a.b.c/1/2, a.b.c/1/, b.c/ and so on.
+func Expressions(u *url.URL) []string {
+	host := strings.Trim(strings.ToLower(u.Hostname()), ".")
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		parts := strings.Split(host, ".")
+		start := len(parts) - maxHostSuffixes - 1
+		if start < 1 {
+			start = 1
+		}
+		for i := start; i < len(parts)-1; i++ {
+			hosts = append(hosts, strings.Join(parts[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	prefix := "/"
+	for i := 0; i < len(segments) && i < maxPathPrefixes; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+		prefix += segments[i] + "/"
+	}
+
+	seen := map[string]bool{}
+	var expressions []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			expr := h + p
+			if !seen[expr] {
+				seen[expr] = true
+				expressions = append(expressions, expr)
+			}
+		}
+	}
+	return expressions
+}
@@ -0,0 +1,335 @@
+package urlpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"shorty/internal/app/canonical"
+	"shorty/internal/app/config"
+
+	"go.uber.org/zap"
+)
+
+var ErrInvalidURL = errors.New("invalid url")
+var ErrSchemeNotAllowed = errors.New("url scheme is not allowed")
+var ErrDomainBlocked = errors.New("destination domain is blocked")
+var ErrPrivateDestination = errors.New("destination resolves to a private address")
+var ErrFlagged = errors.New("destination is flagged as malicious")
+
+const resolveTimeout = 2 * time.Second
+const defaultAllowedSchemes = "http,https"
+
+type URLChecker interface {
+	Check(ctx context.Context, u *url.URL) error
+}
+
+type Policy struct {
+	schemes      map[string]bool
+	denylist     *DomainList
+	allowlist    *DomainList
+	blockPrivate bool
+	resolveHosts bool
+	resolver     *net.Resolver
+	checkers     []URLChecker
+	watchers     []*watchedFile
+	canonical    canonical.Options
+}
+
+func NewPolicy(cfg config.Config, checkers ...URLChecker) (*Policy, error) {
+	p := &Policy{
+		schemes:      map[string]bool{},
+		blockPrivate: cfg.BlockPrivateDestinations,
+		resolveHosts: cfg.ResolveDestinationHosts,
+		resolver:     net.DefaultResolver,
+		checkers:     checkers,
+		canonical:    canonical.OptionsFromConfig(cfg),
+	}
+
+	allowedSchemes := cfg.AllowedSchemes
+	if allowedSchemes == "" {
+		allowedSchemes = defaultAllowedSchemes
+	}
+	for _, scheme := range strings.Split(allowedSchemes, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			p.schemes[scheme] = true
+		}
+	}
+
+	if cfg.DomainDenylistPath != "" {
+		list, err := LoadDomainList(cfg.DomainDenylistPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain denylist: %w", err)
+		}
+		p.denylist = list
+		p.watchers = append(p.watchers, list.file)
+	}
+
+	if cfg.DomainAllowlistPath != "" {
+		list, err := LoadDomainList(cfg.DomainAllowlistPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain allowlist: %w", err)
+		}
+		p.allowlist = list
+		p.watchers = append(p.watchers, list.file)
+	}
+
+	if cfg.HashPrefixListPath != "" {
+		checker, err := LoadHashPrefixChecker(cfg.HashPrefixListPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hash prefix list: %w", err)
+		}
+		p.checkers = append(p.checkers, checker)
+		p.watchers = append(p.watchers, checker.file)
+	}
+
+	return p, nil
+}
+
+// Watch reloads the list files when they change, checking every interval
+// until the policy is closed.
+func (p *Policy) Watch(interval time.Duration, logger *zap.SugaredLogger) {
+	for _, w := range p.watchers {
+		w.watch(interval, logger)
+	}
+}
+
+// Validate parses a user supplied destination, canonicalises it and runs it
+// through every rule. The canonical form is what should be hashed and stored.
+func (p *Policy) Validate(ctx context.Context, raw string) (string, error) {
+	u, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	u, err = canonical.Canonicalize(u, p.canonical)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	if err := p.Check(ctx, u); err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+func (p *Policy) Check(ctx context.Context, u *url.URL) error {
+	if !p.schemes[u.Scheme] {
+		return fmt.Errorf("%w: %s", ErrSchemeNotAllowed, u.Scheme)
+	}
+
+	host := u.Hostname()
+	if p.allowlist != nil && !p.allowlist.Contains(host) {
+		return fmt.Errorf("%w: %s is not in the allowlist", ErrDomainBlocked, host)
+	}
+	if p.denylist != nil && p.denylist.Contains(host) {
+		return fmt.Errorf("%w: %s", ErrDomainBlocked, host)
+	}
+
+	if p.blockPrivate {
+		if err := p.checkPublic(ctx, host); err != nil {
+			return err
+		}
+	}
+
+	for _, checker := range p.checkers {
+		if err := checker.Check(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) CheckString(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	return p.Check(ctx, u)
+}
+
+func (p *Policy) checkPublic(ctx context.Context, host string) error {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrPrivateDestination, host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !IsPublicIP(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateDestination, host)
+		}
+		return nil
+	}
+
+	if !p.resolveHosts {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		// A host that doesn't resolve right now can't be proven private.
+		return nil
+	}
+	for _, addr := range addrs {
+		if !IsPublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrPrivateDestination, host, addr.IP)
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) Close() error {
+	for _, w := range p.watchers {
+		w.stop()
+	}
+	return nil
+}
+
+func Parse(raw string) (*url.URL, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidURL)
+	}
+
+	u, err := url.Parse(raw)
+	if err == nil && !strings.Contains(raw, "://") && looksSchemeless(u) {
+		u, err = url.Parse("http://" + raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Opaque != "" {
+		return nil, fmt.Errorf("%w: %s urls are not supported", ErrSchemeNotAllowed, u.Scheme)
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: host is required", ErrInvalidURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%w: credentials in url are not allowed", ErrInvalidURL)
+	}
+	if strings.ContainsAny(u.Hostname(), " \t\"<>\\^`{|}") {
+		return nil, fmt.Errorf("%w: malformed host", ErrInvalidURL)
+	}
+	u.Host = strings.ToLower(u.Host)
+
+	ip, ok := parseIPv4Host(u.Hostname())
+	if ok && ip == nil {
+		return nil, fmt.Errorf("%w: malformed ip address", ErrInvalidURL)
+	}
+	if ok {
+		port := u.Port()
+		u.Host = ip.String()
+		if port != "" {
+			u.Host = net.JoinHostPort(u.Host, port)
+		}
+	}
+
+	return u, nil
+}
+
+// looksSchemeless tells "example.com" and "example.com:8080/x" (which parses
+// as scheme "example.com") apart from real opaque urls like "mailto:a@b".
+func looksSchemeless(u *url.URL) bool {
+	if u.Scheme == "" {
+		return !strings.HasPrefix(u.Path, "/")
+	}
+	return strings.Contains(u.Scheme, ".") || (u.Opaque != "" && u.Opaque[0] >= '0' && u.Opaque[0] <= '9')
+}
+
+// parseIPv4Host reads hosts that browsers take for IPv4 addresses, like
+// "2130706433", "127.1" or "0x7f.0.0.1", so they are stored dotted and
+// can't pass the private address check. ok reports a numeric host, ip is
+// nil when it is out of range.
+func parseIPv4Host(host string) (ip net.IP, ok bool) {
+	if strings.Contains(host, ":") {
+		return nil, false
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if _, err := parseIPv4Number(labels[len(labels)-1]); err != nil {
+		return nil, false
+	}
+	if len(labels) > net.IPv4len {
+		return nil, true
+	}
+
+	var addr uint64
+	for i, label := range labels {
+		n, err := parseIPv4Number(label)
+		if err != nil {
+			return nil, true
+		}
+		if i < len(labels)-1 {
+			if n > 0xff {
+				return nil, true
+			}
+			addr |= n << (8 * (net.IPv4len - 1 - i))
+			continue
+		}
+		// The last number fills all bytes left.
+		if n >= 1<<(8*(net.IPv4len-i)) {
+			return nil, true
+		}
+		addr |= n
+	}
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr)), true
+}
+
+// parseIPv4Number reads a decimal, "0x" hexadecimal or "0" octal number.
+func parseIPv4Number(s string) (uint64, error) {
+	base := 10
+	switch {
+	case len(s) > 2 && s[:2] == "0x":
+		s, base = s[2:], 16
+	case len(s) > 1 && s[0] == '0':
+		s, base = s[1:], 8
+	}
+	n, err := strconv.ParseUint(s, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ip number: %w", err)
+	}
+	return n, nil
+}
+
+// reservedNetworks are not covered by the net.IP checks but can't be
+// reached on the internet either.
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func IsPublicIP(ip net.IP) bool {
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast())
+}
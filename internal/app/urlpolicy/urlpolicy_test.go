@@ -0,0 +1,125 @@
+package urlpolicy
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shorty/internal/app/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	denylist := filepath.Join(dir, "deny.txt")
+	require.NoError(t, os.WriteFile(denylist, []byte("# blocked\nevil.example\n"), 0600))
+	hashList := filepath.Join(dir, "hashes.txt")
+	require.NoError(t, os.WriteFile(hashList, []byte(HashExpression("phish.example/login/")+"\n"), 0600))
+
+	policy, err := NewPolicy(config.Config{
+		DomainDenylistPath:       denylist,
+		HashPrefixListPath:       hashList,
+		BlockPrivateDestinations: true,
+	})
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, policy.Close()) }()
+
+	tests := []struct {
+		name        string
+		raw         string
+		expected    string
+		expectedErr error
+	}{
+		{name: "Should add missing scheme", raw: " www.Google.com ", expected: "http://www.google.com/"},
+		{name: "Should add scheme to host with port", raw: "example.com:8080/x", expected: "http://example.com:8080/x"},
+		{name: "Should keep https urls", raw: "HTTPS://example.com/a?b=c", expected: "https://example.com/a?b=c"},
+		{name: "Should reject javascript scheme", raw: "javascript:alert(1)", expectedErr: ErrSchemeNotAllowed},
+		{name: "Should reject ftp scheme", raw: "ftp://example.com/file", expectedErr: ErrSchemeNotAllowed},
+		{name: "Should reject garbage", raw: `{"url": "x"}`, expectedErr: ErrInvalidURL},
+		{name: "Should reject credentials", raw: "http://google.com@evil.example", expectedErr: ErrInvalidURL},
+		{name: "Should reject denylisted subdomain", raw: "https://www.evil.example/", expectedErr: ErrDomainBlocked},
+		{name: "Should reject loopback", raw: "http://127.0.0.1:8080/admin", expectedErr: ErrPrivateDestination},
+		{name: "Should reject private network", raw: "http://[fd00::1]/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject shared address space", raw: "http://100.64.0.1/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject this network", raw: "http://0.1.2.3/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject decimal loopback", raw: "http://2130706433/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject short loopback", raw: "http://127.1/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject hex loopback", raw: "http://0x7f.0.0.1:8080/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject octal private", raw: "http://012.0.0.1/", expectedErr: ErrPrivateDestination},
+		{name: "Should reject out of range address", raw: "http://256.0.0.1/", expectedErr: ErrInvalidURL},
+		{name: "Should store numeric host dotted", raw: "http://134744072/", expected: "http://8.8.8.8/"},
+		{name: "Should keep port of numeric host", raw: "http://8.8.2056:8080/x", expected: "http://8.8.8.8:8080/x"},
+		{name: "Should keep mapped ipv6", raw: "http://[::ffff:8.8.8.8]/", expected: "http://[::ffff:8.8.8.8]/"},
+		{name: "Should reject localhost", raw: "localhost:8080", expectedErr: ErrPrivateDestination},
+		{name: "Should reject flagged url", raw: "https://phish.example/login/form?x=1", expectedErr: ErrFlagged},
+		{name: "Should allow unflagged path on flagged host", raw: "https://phish.example/about", expected: "https://phish.example/about"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			normalized, err := policy.Validate(context.Background(), tc.raw)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, normalized)
+		})
+	}
+}
+
+func TestDomainListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	require.NoError(t, os.WriteFile(path, []byte("good.example\n"), 0600))
+
+	policy, err := NewPolicy(config.Config{DomainAllowlistPath: path})
+	require.NoError(t, err)
+	policy.Watch(10*time.Millisecond, zaptest.NewLogger(t).Sugar())
+	defer func() { assert.NoError(t, policy.Close()) }()
+
+	_, err = policy.Validate(context.Background(), "https://other.example")
+	assert.ErrorIs(t, err, ErrDomainBlocked)
+
+	require.NoError(t, os.WriteFile(path, []byte("good.example\nother.example\n"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	assert.Eventually(t, func() bool {
+		_, err := policy.Validate(context.Background(), "https://other.example")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestExpressions(t *testing.T) {
+	u, err := url.Parse("http://a.b.c.d.e.f.g/1/2.html?param=1")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"a.b.c.d.e.f.g/1/2.html?param=1",
+		"a.b.c.d.e.f.g/1/2.html",
+		"a.b.c.d.e.f.g/",
+		"a.b.c.d.e.f.g/1/",
+		"c.d.e.f.g/1/2.html?param=1",
+		"c.d.e.f.g/1/2.html",
+		"c.d.e.f.g/",
+		"c.d.e.f.g/1/",
+		"d.e.f.g/1/2.html?param=1",
+		"d.e.f.g/1/2.html",
+		"d.e.f.g/",
+		"d.e.f.g/1/",
+		"e.f.g/1/2.html?param=1",
+		"e.f.g/1/2.html",
+		"e.f.g/",
+		"e.f.g/1/",
+		"f.g/1/2.html?param=1",
+		"f.g/1/2.html",
+		"f.g/",
+		"f.g/1/",
+	}, Expressions(u))
+}
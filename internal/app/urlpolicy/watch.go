@@ -0,0 +1,79 @@
+package urlpolicy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type watchedFile struct {
+	path    string
+	load    func(data []byte) error
+	mu      *sync.Mutex
+	modTime time.Time
+	done    chan struct{}
+}
+
+func newWatchedFile(path string, load func(data []byte) error) (*watchedFile, error) {
+	w := &watchedFile{path: path, load: load, mu: &sync.Mutex{}, done: make(chan struct{})}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *watchedFile) reload() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", w.path, err)
+	}
+	if info.ModTime().Equal(w.modTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", w.path, err)
+	}
+	if err := w.load(data); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", w.path, err)
+	}
+	w.modTime = info.ModTime()
+
+	return true, nil
+}
+
+func (w *watchedFile) watch(interval time.Duration, logger *zap.SugaredLogger) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				reloaded, err := w.reload()
+				if err != nil {
+					logger.Errorf("failed to reload url policy file: %v", err)
+					continue
+				}
+				if reloaded {
+					logger.Infof("reloaded url policy file %s", w.path)
+				}
+			}
+		}
+	}()
+}
+
+func (w *watchedFile) stop() {
+	close(w.done)
+}
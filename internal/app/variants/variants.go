@@ -0,0 +1,82 @@
+package variants
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"shorty/internal/app/models"
+)
+
+var ErrInvalidVariants = errors.New("invalid link variants")
+
+const (
+	MaxVariants = 10
+	maxWeight   = 1000
+	maxIDLength = 64
+)
+
+// Normalize checks the variants of a split link. An empty list removes the
+// split, otherwise at least one variant has to get traffic.
+func Normalize(variants []models.LinkVariant) ([]models.LinkVariant, error) {
+	if len(variants) > MaxVariants {
+		return nil, fmt.Errorf("%w: at most %d variants", ErrInvalidVariants, MaxVariants)
+	}
+
+	total := 0
+	seen := map[string]bool{}
+	for i, variant := range variants {
+		variant.ID = strings.TrimSpace(variant.ID)
+		if variant.ID == "" || len(variant.ID) > maxIDLength {
+			return nil, fmt.Errorf("%w: id must be 1 to %d bytes", ErrInvalidVariants, maxIDLength)
+		}
+		if seen[variant.ID] {
+			return nil, fmt.Errorf("%w: duplicate id %q", ErrInvalidVariants, variant.ID)
+		}
+		seen[variant.ID] = true
+		if variant.Weight < 0 || variant.Weight > maxWeight {
+			return nil, fmt.Errorf("%w: weight must be between 0 and %d", ErrInvalidVariants, maxWeight)
+		}
+		total += variant.Weight
+		variants[i] = variant
+	}
+	if len(variants) > 0 && total == 0 {
+		return nil, fmt.Errorf("%w: at least one variant needs a positive weight", ErrInvalidVariants)
+	}
+	return variants, nil
+}
+
+// Pick chooses a variant with a chance proportional to its weight.
+func Pick(variants []models.LinkVariant) (models.LinkVariant, bool) {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	if total == 0 {
+		return models.LinkVariant{}, false
+	}
+	return pick(variants, rand.Intn(total)), true
+}
+
+// pick returns the variant whose share of the total weight contains n.
+func pick(variants []models.LinkVariant, n int) models.LinkVariant {
+	for _, variant := range variants {
+		if n < variant.Weight {
+			return variant
+		}
+		n -= variant.Weight
+	}
+	return variants[len(variants)-1]
+}
+
+// Find returns the variant with id if it still gets traffic, so a sticky
+// browser is moved away from a paused or removed variant.
+func Find(variants []models.LinkVariant, id string) (models.LinkVariant, bool) {
+	for _, variant := range variants {
+		if variant.ID == id && variant.Weight > 0 {
+			return variant, true
+		}
+	}
+	return models.LinkVariant{}, false
+}
@@ -0,0 +1,97 @@
+package variants
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"shorty/internal/app/models"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		variants []models.LinkVariant
+		wantErr  bool
+	}{
+		{name: "empty"},
+		{
+			name: "valid",
+			variants: []models.LinkVariant{
+				{ID: "a", Destination: "https://example.com/a", Weight: 3},
+				{ID: "b", Destination: "https://example.com/b", Weight: 0},
+			},
+		},
+		{name: "missing id", variants: []models.LinkVariant{{Weight: 1}}, wantErr: true},
+		{name: "duplicate id", variants: []models.LinkVariant{{ID: "a", Weight: 1}, {ID: " a ", Weight: 1}}, wantErr: true},
+		{name: "negative weight", variants: []models.LinkVariant{{ID: "a", Weight: -1}}, wantErr: true},
+		{name: "too heavy", variants: []models.LinkVariant{{ID: "a", Weight: maxWeight + 1}}, wantErr: true},
+		{name: "all paused", variants: []models.LinkVariant{{ID: "a"}, {ID: "b"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Normalize(tt.variants)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidVariants)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	tooMany := make([]models.LinkVariant, MaxVariants+1)
+	for i := range tooMany {
+		tooMany[i] = models.LinkVariant{ID: string(rune('a' + i)), Weight: 1}
+	}
+	_, err := Normalize(tooMany)
+	assert.ErrorIs(t, err, ErrInvalidVariants)
+}
+
+func TestPick(t *testing.T) {
+	variants := []models.LinkVariant{
+		{ID: "a", Weight: 1},
+		{ID: "paused", Weight: 0},
+		{ID: "b", Weight: 3},
+	}
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{n: 0, want: "a"},
+		{n: 1, want: "b"},
+		{n: 3, want: "b"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, pick(variants, tt.n).ID)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		variant, ok := Pick(variants)
+		require.True(t, ok)
+		counts[variant.ID]++
+	}
+	assert.Zero(t, counts["paused"])
+	assert.InDelta(t, 1000, counts["a"], 200)
+	assert.InDelta(t, 3000, counts["b"], 200)
+
+	_, ok := Pick([]models.LinkVariant{{ID: "a"}})
+	assert.False(t, ok)
+	_, ok = Pick(nil)
+	assert.False(t, ok)
+}
+
+func TestFind(t *testing.T) {
+	variants := []models.LinkVariant{{ID: "a", Weight: 1}, {ID: "paused"}}
+
+	variant, ok := Find(variants, "a")
+	assert.True(t, ok)
+	assert.Equal(t, "a", variant.ID)
+
+	_, ok = Find(variants, "paused")
+	assert.False(t, ok)
+	_, ok = Find(variants, "gone")
+	assert.False(t, ok)
+}
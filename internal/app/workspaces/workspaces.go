@@ -0,0 +1,188 @@
+package workspaces
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"shorty/internal/app/models"
+
+	"github.com/google/uuid"
+)
+
+var ErrForbidden = errors.New("not enough permissions in the workspace")
+var ErrInvalidRole = errors.New("role must be owner, editor or viewer")
+var ErrInvalidName = errors.New("workspace name must be 1 to 255 characters")
+var ErrLastOwner = errors.New("workspace must keep at least one owner")
+
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+const maxNameLength = 255
+const inviteTokenBytes = 32
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+type Store interface {
+	CreateWorkspace(ctx context.Context, workspace models.Workspace, ownerID string) error
+	WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error)
+	WorkspaceMembers(ctx context.Context, workspaceID string) ([]models.WorkspaceMember, error)
+	SetWorkspaceMember(ctx context.Context, member models.WorkspaceMember) error
+	RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) error
+	CreateWorkspaceInvite(ctx context.Context, invite models.WorkspaceInvite) error
+	AcceptWorkspaceInvite(ctx context.Context, tokenHash, userID string, now time.Time) (models.WorkspaceMember, error)
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Allows reports whether role grants at least the permissions of required.
+func Allows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+func Create(ctx context.Context, str Store, userID, name string) (models.UserWorkspace, error) {
+	name = strings.TrimSpace(name)
+	if n := utf8.RuneCountInString(name); n == 0 || n > maxNameLength {
+		return models.UserWorkspace{}, ErrInvalidName
+	}
+
+	workspace := models.Workspace{ID: uuid.NewString(), Name: name, CreatedAt: time.Now().UTC()}
+	if err := str.CreateWorkspace(ctx, workspace, userID); err != nil {
+		return models.UserWorkspace{}, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	return models.UserWorkspace{Workspace: workspace, Role: RoleOwner}, nil
+}
+
+// Authorize checks that the user has at least the required role. Users who
+// are not members get models.ErrNotFound, so workspace IDs can't be probed.
+func Authorize(ctx context.Context, str Store, workspaceID, userID, required string) (string, error) {
+	role, err := str.WorkspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		return "", err
+	}
+	if !Allows(role, required) {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
+
+func SetRole(ctx context.Context, str Store, workspaceID, actorID, userID, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+	if _, err := Authorize(ctx, str, workspaceID, actorID, RoleOwner); err != nil {
+		return err
+	}
+	if _, err := str.WorkspaceRole(ctx, workspaceID, userID); err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		if err := keepOwner(ctx, str, workspaceID, userID); err != nil {
+			return err
+		}
+	}
+	return str.SetWorkspaceMember(ctx, models.WorkspaceMember{
+		WorkspaceID: workspaceID,
+		UserID:      userID,
+		Role:        role,
+		CreatedAt:   time.Now().UTC(),
+	})
+}
+
+// RemoveMember lets owners remove anyone and every member leave on their own.
+func RemoveMember(ctx context.Context, str Store, workspaceID, actorID, userID string) error {
+	required := RoleOwner
+	if actorID == userID {
+		required = RoleViewer
+	}
+	if _, err := Authorize(ctx, str, workspaceID, actorID, required); err != nil {
+		return err
+	}
+	if err := keepOwner(ctx, str, workspaceID, userID); err != nil {
+		return err
+	}
+	return str.RemoveWorkspaceMember(ctx, workspaceID, userID)
+}
+
+// keepOwner fails when userID is the only owner left.
+func keepOwner(ctx context.Context, str Store, workspaceID, userID string) error {
+	members, err := str.WorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to get workspace members: %w", err)
+	}
+	for _, member := range members {
+		if member.Role == RoleOwner && member.UserID != userID {
+			return nil
+		}
+	}
+	for _, member := range members {
+		if member.UserID == userID && member.Role == RoleOwner {
+			return ErrLastOwner
+		}
+	}
+	return nil
+}
+
+// Invite returns the stored invite and the plain token, which is handed to the
+// invitee once and never persisted.
+func Invite(
+	ctx context.Context,
+	str Store,
+	workspaceID, actorID, role string,
+	ttl time.Duration,
+) (models.WorkspaceInvite, string, error) {
+	if !ValidRole(role) {
+		return models.WorkspaceInvite{}, "", ErrInvalidRole
+	}
+	if _, err := Authorize(ctx, str, workspaceID, actorID, RoleOwner); err != nil {
+		return models.WorkspaceInvite{}, "", err
+	}
+
+	buf := make([]byte, inviteTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return models.WorkspaceInvite{}, "", fmt.Errorf("failed to generate invite token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now().UTC()
+	invite := models.WorkspaceInvite{
+		TokenHash:   hashToken(token),
+		WorkspaceID: workspaceID,
+		Role:        role,
+		CreatedBy:   actorID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if err := str.CreateWorkspaceInvite(ctx, invite); err != nil {
+		return models.WorkspaceInvite{}, "", fmt.Errorf("failed to save invite: %w", err)
+	}
+	return invite, token, nil
+}
+
+// Accept consumes an invite. Members who already belong to the workspace
+// keep their current role.
+func Accept(ctx context.Context, str Store, token, userID string) (models.WorkspaceMember, error) {
+	member, err := str.AcceptWorkspaceInvite(ctx, hashToken(token), userID, time.Now().UTC())
+	if err != nil {
+		return models.WorkspaceMember{}, err
+	}
+	return member, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
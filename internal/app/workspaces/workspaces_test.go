@@ -0,0 +1,84 @@
+package workspaces
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"shorty/internal/app/models"
+	"shorty/internal/app/storage/mapstorage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembership(t *testing.T) {
+	ctx := context.Background()
+	str, err := mapstorage.CreateMapStorage()
+	require.NoError(t, err)
+
+	_, err = Create(ctx, str, "owner", "  ")
+	assert.ErrorIs(t, err, ErrInvalidName)
+
+	workspace, err := Create(ctx, str, "owner", " Marketing ")
+	require.NoError(t, err)
+	assert.Equal(t, "Marketing", workspace.Name)
+	assert.Equal(t, RoleOwner, workspace.Role)
+
+	_, err = Authorize(ctx, str, workspace.ID, "stranger", RoleViewer)
+	assert.ErrorIs(t, err, models.ErrNotFound, "non-members must not learn that the workspace exists")
+
+	_, _, err = Invite(ctx, str, workspace.ID, "owner", "admin", time.Hour)
+	assert.ErrorIs(t, err, ErrInvalidRole)
+
+	_, token, err := Invite(ctx, str, workspace.ID, "owner", RoleViewer, time.Hour)
+	require.NoError(t, err)
+
+	member, err := Accept(ctx, str, token, "viewer")
+	require.NoError(t, err)
+	assert.Equal(t, RoleViewer, member.Role)
+
+	_, err = Accept(ctx, str, token, "someone-else")
+	assert.ErrorIs(t, err, models.ErrNotFound, "invites are single use")
+
+	_, err = Authorize(ctx, str, workspace.ID, "viewer", RoleEditor)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, _, err = Invite(ctx, str, workspace.ID, "viewer", RoleViewer, time.Hour)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	require.NoError(t, SetRole(ctx, str, workspace.ID, "owner", "viewer", RoleEditor))
+	role, err := Authorize(ctx, str, workspace.ID, "viewer", RoleEditor)
+	require.NoError(t, err)
+	assert.Equal(t, RoleEditor, role)
+
+	assert.ErrorIs(t, SetRole(ctx, str, workspace.ID, "owner", "owner", RoleEditor), ErrLastOwner)
+	assert.ErrorIs(t, RemoveMember(ctx, str, workspace.ID, "owner", "owner"), ErrLastOwner)
+	assert.ErrorIs(t, RemoveMember(ctx, str, workspace.ID, "viewer", "owner"), ErrForbidden)
+
+	require.NoError(t, RemoveMember(ctx, str, workspace.ID, "viewer", "viewer"))
+	_, err = Authorize(ctx, str, workspace.ID, "viewer", RoleViewer)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	_, token, err = Invite(ctx, str, workspace.ID, "owner", RoleEditor, -time.Minute)
+	require.NoError(t, err)
+	_, err = Accept(ctx, str, token, "late")
+	assert.ErrorIs(t, err, models.ErrNotFound, "expired invites must be rejected")
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		role     string
+		required string
+		want     bool
+	}{
+		{role: RoleOwner, required: RoleEditor, want: true},
+		{role: RoleEditor, required: RoleEditor, want: true},
+		{role: RoleViewer, required: RoleEditor, want: false},
+		{role: "", required: RoleViewer, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+"/"+tt.required, func(t *testing.T) {
+			assert.Equal(t, tt.want, Allows(tt.role, tt.required))
+		})
+	}
+}